@@ -0,0 +1,145 @@
+package fsnotify
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+// accumulated wraps a backend to collect events until they're read with
+// Watcher.Changes(), instead of sending them on the Events channel.
+type accumulated struct {
+	backend
+
+	Events chan Event
+	Errors chan error
+
+	in       chan Event         // Events from the backend
+	inErrs   chan error         // Errors from the backend
+	syncReq  chan chan struct{} // Closed by the accumulate goroutine once everything before it is applied
+	mu       sync.Mutex         // Protects pending
+	pending  map[string]Event   // Latest event for every path since the last Changes() (key: path)
+	doneResp chan struct{}      // Closed when the accumulate goroutine exits
+}
+
+func newAccumulated(ev chan Event, errs chan error, pipe *pipeline) (*accumulated, error) {
+	in, inErrs := make(chan Event), make(chan error)
+	b, err := newBackend(in, inErrs, pipe)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &accumulated{
+		backend:  b,
+		Events:   ev,
+		Errors:   errs,
+		in:       in,
+		inErrs:   inErrs,
+		syncReq:  make(chan chan struct{}),
+		pending:  make(map[string]Event),
+		doneResp: make(chan struct{}),
+	}
+	go w.accumulate()
+	return w, nil
+}
+
+func (w *accumulated) Close() error {
+	err := w.backend.Close()
+	<-w.doneResp
+	return err
+}
+
+func (w *accumulated) CloseWait(ctx context.Context) error {
+	err := w.backend.CloseWait(ctx)
+	<-w.doneResp
+	return err
+}
+
+// Sync waits until all events the backend sent are applied, so that they're
+// returned by the next Changes().
+func (w *accumulated) Sync(ctx context.Context) error {
+	if err := w.backend.Sync(ctx); err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	select {
+	case w.syncReq <- done:
+	case <-w.doneResp:
+		return ErrClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// changes gets all pending events ordered by Event.Seq, and clears them.
+func (w *accumulated) changes() []Event {
+	w.mu.Lock()
+	pending := w.pending
+	w.pending = make(map[string]Event)
+	w.mu.Unlock()
+
+	events := make([]Event, 0, len(pending))
+	for _, e := range pending {
+		events = append(events, e)
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].Seq < events[j].Seq })
+	return events
+}
+
+// apply an event to the pending events.
+func (w *accumulated) apply(e Event) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	p, ok := w.pending[e.Name]
+	switch {
+	case !ok || !p.Has(Create):
+		w.pending[e.Name] = e
+	// A path that didn't exist at the last Changes() and is gone again.
+	case e.Has(Remove) || e.Has(Rename):
+		delete(w.pending, e.Name)
+	// Still new to the caller, no matter what else happened to it.
+	default:
+		e.Op = Create
+		w.pending[e.Name] = e
+	}
+}
+
+// accumulate reads events from the backend until its channels are closed.
+func (w *accumulated) accumulate() {
+	defer func() {
+		close(w.Errors)
+		close(w.Events)
+		close(w.doneResp)
+	}()
+
+	errs := w.inErrs
+	for {
+		select {
+		case done := <-w.syncReq:
+			close(done)
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			// Don't block on errors, as nothing may be reading them; a
+			// caller that polls Changes() has no reason to.
+			select {
+			case w.Errors <- err:
+			default:
+			}
+		case e, ok := <-w.in:
+			if !ok {
+				return
+			}
+			w.apply(e)
+		}
+	}
+}
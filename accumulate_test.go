@@ -0,0 +1,161 @@
+package fsnotify
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func newAccumulatingWatcher(t *testing.T, add ...string) *Watcher {
+	t.Helper()
+	w, err := NewAccumulatingWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { w.Close() })
+	for _, a := range add {
+		if err := w.Add(a); err != nil {
+			t.Fatalf("add %q: %s", a, err)
+		}
+	}
+	return w
+}
+
+func syncChanges(t *testing.T, w *Watcher) Events {
+	t.Helper()
+	// Some filesystems send events with a delay, which Sync can't see.
+	time.Sleep(100 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := w.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	return Events(w.Changes())
+}
+
+func TestAccumulate(t *testing.T) {
+	tests := []struct {
+		name   string
+		before func(t *testing.T, tmp string)
+		ops    func(t *testing.T, tmp string)
+		want   string
+	}{
+		{"create write", func(t *testing.T, tmp string) {}, func(t *testing.T, tmp string) {
+			touch(t, tmp, "file")
+			cat(t, "data", tmp, "file")
+			cat(t, "data", tmp, "file")
+		}, `
+			create  /file
+		`},
+
+		{"create remove", func(t *testing.T, tmp string) {}, func(t *testing.T, tmp string) {
+			touch(t, tmp, "file")
+			cat(t, "data", tmp, "file")
+			rm(t, tmp, "file")
+			touch(t, tmp, "other")
+		}, `
+			create  /other
+		`},
+
+		{"write remove", func(t *testing.T, tmp string) {
+			touch(t, tmp, "file")
+		}, func(t *testing.T, tmp string) {
+			cat(t, "data", tmp, "file")
+			rm(t, tmp, "file")
+		}, `
+			remove  /file
+		`},
+
+		{"remove create", func(t *testing.T, tmp string) {
+			touch(t, tmp, "file")
+		}, func(t *testing.T, tmp string) {
+			rm(t, tmp, "file")
+			touch(t, tmp, "file")
+		}, `
+			create  /file
+		`},
+
+		{"rename", func(t *testing.T, tmp string) {
+			touch(t, tmp, "file")
+		}, func(t *testing.T, tmp string) {
+			mv(t, join(tmp, "file"), tmp, "renamed")
+		}, `
+			rename  /file
+			create  /renamed
+		`},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			tmp := t.TempDir()
+			tt.before(t, tmp)
+			w := newAccumulatingWatcher(t, tmp)
+			tt.ops(t, tmp)
+			cmpEvents(t, tmp, syncChanges(t, w), newEvents(t, tt.want))
+		})
+	}
+}
+
+func TestAccumulatingWatcher(t *testing.T) {
+	t.Run("clears", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		w := newAccumulatingWatcher(t, tmp)
+		touch(t, tmp, "one")
+		cmpEvents(t, tmp, syncChanges(t, w), newEvents(t, `create /one`))
+
+		if c := w.Changes(); len(c) != 0 {
+			t.Errorf("not cleared: %s", Events(c))
+		}
+
+		touch(t, tmp, "two")
+		cmpEvents(t, tmp, syncChanges(t, w), newEvents(t, `create /two`))
+	})
+
+	t.Run("order", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		touch(t, tmp, "one")
+		touch(t, tmp, "two")
+		w := newAccumulatingWatcher(t, tmp)
+		cat(t, "data", tmp, "one")
+		cat(t, "data", tmp, "two")
+		cat(t, "data", tmp, "one")
+
+		have := syncChanges(t, w)
+		if len(have) != 2 || have[0].Name != join(tmp, "two") || have[1].Name != join(tmp, "one") {
+			t.Errorf("wrong order:\n%s", indent(have))
+		}
+	})
+
+	t.Run("after close", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		w := newAccumulatingWatcher(t, tmp)
+		touch(t, tmp, "file")
+		time.Sleep(100 * time.Millisecond)
+		if err := w.CloseWait(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := <-w.Events; ok {
+			t.Error("Events not closed")
+		}
+		cmpEvents(t, tmp, Events(w.Changes()), newEvents(t, `create /file`))
+	})
+
+	t.Run("not accumulating", func(t *testing.T) {
+		t.Parallel()
+
+		w := newWatcher(t)
+		defer w.Close()
+		if c := w.Changes(); c != nil {
+			t.Errorf("Changes() = %s; want nil", Events(c))
+		}
+	})
+}
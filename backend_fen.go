@@ -4,136 +4,57 @@
 package fsnotify
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
+	"time"
 
 	"golang.org/x/sys/unix"
 )
 
-// Watcher watches a set of paths, delivering events on a channel.
-//
-// A watcher should not be copied (e.g. pass it by pointer, rather than by
-// value).
-//
-// # Linux notes
-//
-// When a file is removed a Remove event won't be emitted until all file
-// descriptors are closed, and deletes will always emit a Chmod. For example:
-//
-//     fp := os.Open("file")
-//     os.Remove("file")        // Triggers Chmod
-//     fp.Close()               // Triggers Remove
-//
-// This is the event that inotify sends, so not much can be changed about this.
-//
-// The fs.inotify.max_user_watches sysctl variable specifies the upper limit
-// for the number of watches per user, and fs.inotify.max_user_instances
-// specifies the maximum number of inotify instances per user. Every Watcher you
-// create is an "instance", and every path you add is a "watch".
-//
-// These are also exposed in /proc as /proc/sys/fs/inotify/max_user_watches and
-// /proc/sys/fs/inotify/max_user_instances
-//
-// To increase them you can use sysctl or write the value to the /proc file:
-//
-//     # Default values on Linux 5.18
-//     sysctl fs.inotify.max_user_watches=124983
-//     sysctl fs.inotify.max_user_instances=128
-//
-// To make the changes persist on reboot edit /etc/sysctl.conf or
-// /usr/lib/sysctl.d/50-default.conf (details differ per Linux distro; check
-// your distro's documentation):
-//
-//     fs.inotify.max_user_watches=124983
-//     fs.inotify.max_user_instances=128
-//
-// Reaching the limit will result in a "no space left on device" or "too many open
-// files" error.
-//
-// # kqueue notes (macOS, BSD)
-//
-// kqueue requires opening a file descriptor for every file that's being watched;
-// so if you're watching a directory with five files then that's six file
-// descriptors. You will run in to your system's "max open files" limit faster on
-// these platforms.
-//
-// The sysctl variables kern.maxfiles and kern.maxfilesperproc can be used to
-// control the maximum number of open files, as well as /etc/login.conf on BSD
-// systems.
-//
-// # macOS notes
-//
-// Spotlight indexing on macOS can result in multiple events (see [#15]). A
-// temporary workaround is to add your folder(s) to the "Spotlight Privacy
-// Settings" until we have a native FSEvents implementation (see [#11]).
-//
-// [#11]: https://github.com/fsnotify/fsnotify/issues/11
-// [#15]: https://github.com/fsnotify/fsnotify/issues/15
-type Watcher struct {
-	// Events sends the filesystem change events.
-	//
-	// fsnotify can send the following events; a "path" here can refer to a
-	// file, directory, symbolic link, or special file like a FIFO.
-	//
-	//   fsnotify.Create    A new path was created; this may be followed by one
-	//                      or more Write events if data also gets written to a
-	//                      file.
-	//
-	//   fsnotify.Remove    A path was removed.
-	//
-	//   fsnotify.Rename    A path was renamed. A rename is always sent with the
-	//                      old path as Event.Name, and a Create event will be
-	//                      sent with the new name. Renames are only sent for
-	//                      paths that are currently watched; e.g. moving an
-	//                      unmonitored file into a monitored directory will
-	//                      show up as just a Create. Similarly, renaming a file
-	//                      to outside a monitored directory will show up as
-	//                      only a Rename.
-	//
-	//   fsnotify.Write     A file or named pipe was written to. A Truncate will
-	//                      also trigger a Write. A single "write action"
-	//                      initiated by the user may show up as one or multiple
-	//                      writes, depending on when the system syncs things to
-	//                      disk. For example when compiling a large Go program
-	//                      you may get hundreds of Write events, so you
-	//                      probably want to wait until you've stopped receiving
-	//                      them (see the dedup example in cmd/fsnotify).
-	//
-	//   fsnotify.Chmod     Attributes were changed. On Linux this is also sent
-	//                      when a file is removed (or more accurately, when a
-	//                      link to an inode is removed). On kqueue it's sent
-	//                      and on kqueue when a file is truncated. On Windows
-	//                      it's never sent.
-	Events chan Event
+type fen struct {
+	stats // Counters for Watcher.Stats()
 
-	// Errors sends any errors.
-	//
-	// [ErrEventOverflow] is used to indicate ther are too many events:
-	//
-	//  - inotify: there are too many queued events (fs.inotify.max_queued_events sysctl)
-	//  - windows: The buffer size is too small.
-	//  - kqueue, fen: not used.
+	Events chan Event
 	Errors chan error
-
-	mu      sync.Mutex
-	port    *unix.EventPort
-	done    chan struct{}       // Channel for sending a "quit message" to the reader goroutine
-	dirs    map[string]struct{} // Explicitly watched directories
-	watches map[string]struct{} // Explicitly watched non-directories
+	pipe   *pipeline   // Filters, changes, and sends events; shared with the Watcher.
+	auto   rewatcher   // Removed files to watch again once they're recreated, for WithAutoRewatch()
+	scans  initialScan // Existing paths to send a Create for, for WithInitialScan()
+	reads  reader      // If the reader goroutine is busy, for Watcher.Sync()
+
+	mu       sync.Mutex
+	port     *unix.EventPort
+	done     chan struct{}       // Channel for sending a "quit message" to the reader goroutine
+	doneResp chan struct{}       // Closed when the reader goroutine exits
+	abort    chan struct{}       // Stop sending events; closed by Close, or by CloseWait if ctx is done
+	dirs     map[string]withOpts // Explicitly watched directories
+	watches  map[string]withOpts // Explicitly watched non-directories
+	recurse  map[string]bool     // Directories in dirs that were added recursively
+	internal map[string]string   // Subdirectories of recursive watches (key: path, value: root of the recursive watch)
+
+	// Time the last batch of events was read, for Event.Time. Only accessed
+	// from the readEvents() goroutine.
+	readTime time.Time
 }
 
-// NewWatcher creates a new Watcher.
-func NewWatcher() (*Watcher, error) {
-	w := &Watcher{
-		Events:  make(chan Event),
-		Errors:  make(chan error),
-		dirs:    make(map[string]struct{}),
-		watches: make(map[string]struct{}),
-		done:    make(chan struct{}),
-	}
+func newBackend(ev chan Event, errs chan error, pipe *pipeline) (backend, error) {
+	w := &fen{
+		Events:   ev,
+		Errors:   errs,
+		pipe:     pipe,
+		dirs:     make(map[string]withOpts),
+		watches:  make(map[string]withOpts),
+		recurse:  make(map[string]bool),
+		internal: make(map[string]string),
+		done:     make(chan struct{}),
+		doneResp: make(chan struct{}),
+		abort:    make(chan struct{}),
+	}
+	w.auto.b = w
 
 	var err error
 	w.port, err = unix.NewEventPort()
@@ -147,27 +68,106 @@ func NewWatcher() (*Watcher, error) {
 
 // sendEvent attempts to send an event to the user, returning true if the event
 // was put in the channel successfully and false if the watcher has been closed.
-func (w *Watcher) sendEvent(name string, op Op) (sent bool) {
-	select {
-	case w.Events <- Event{Name: name, Op: op}:
+func (w *fen) sendEvent(name string, op Op, isDir bool) (sent bool) {
+	return w.send(Event{Name: name, Op: op, Time: w.readTime, isDir: isDir})
+}
+
+// sendPortEvent is like sendEvent, for the path of a port event; Event.Raw is
+// set if WithRawEvents() was used.
+func (w *fen) sendPortEvent(pe *unix.PortEvent, op Op, isDir bool) (sent bool) {
+	e := Event{Name: pe.Path, Op: op, Time: w.readTime, isDir: isDir}
+	if w.rawFor(pe.Path) {
+		e.Raw = RawFENEvent{Events: pe.Events}
+	}
+	return w.send(e)
+}
+
+// send is like sendEvent, but for an event that already has the Time set.
+func (w *fen) send(e Event) (sent bool) {
+	e.Seq = w.pipe.nextSeq()
+	if w.auto.route(e.Name, w.IsWatched) {
+		return true
+	}
+	if w.pipe.match(e.Name) {
+		return true
+	}
+
+	// Drop operations that weren't asked for with WithOps().
+	e.Op &= w.opsFor(e.Name)
+	if e.Op == 0 {
 		return true
-	case <-w.done:
-		return false
 	}
+
+	if w.pipe.dropExt(e) || w.pipe.dropPaused() {
+		return true
+	}
+	w.scans.wait()
+	return w.pipe.send(w.Events, e, w.abort, &w.stats)
 }
 
 // sendError attempts to send an error to the user, returning true if the error
 // was put in the channel successfully and false if the watcher has been closed.
-func (w *Watcher) sendError(err error) (sent bool) {
+// opsFor gets the operations to send for a path: the ops for the path itself if
+// it was added with Add(), and the ops of the parent directory if that was
+// added. All ops are sent if neither was added.
+func (w *fen) opsFor(name string) Op {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var (
+		ops     Op
+		watched bool
+	)
+	if with, ok := w.watches[name]; ok {
+		ops, watched = ops|with.ops, true
+	}
+	if with, ok := w.dirOpts(name); ok {
+		ops, watched = ops|with.ops, true
+	}
+	if with, ok := w.dirOpts(filepath.Dir(name)); ok {
+		ops, watched = ops|with.ops, true
+	}
+	if !watched {
+		return AllOps
+	}
+	return ops
+}
+
+// rawFor reports if WithRawEvents() was used for the path, or the directory
+// it's in.
+func (w *fen) rawFor(name string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	dir, _ := w.dirOpts(name)
+	parent, _ := w.dirOpts(filepath.Dir(name))
+	return w.watches[name].raw || dir.raw || parent.raw
+}
+
+// dirOpts gets the options for a watched directory, which can be a
+// subdirectory of a recursive watch.
+//
+// Unlocked!
+func (w *fen) dirOpts(path string) (withOpts, bool) {
+	if with, ok := w.dirs[path]; ok {
+		return with, true
+	}
+	if root, ok := w.internal[path]; ok {
+		with, ok := w.dirs[root]
+		return with, ok
+	}
+	return withOpts{}, false
+}
+
+func (w *fen) sendError(err error) (sent bool) {
 	select {
 	case w.Errors <- err:
+		w.sentError(err)
 		return true
-	case <-w.done:
+	case <-w.abort:
 		return false
 	}
 }
 
-func (w *Watcher) isClosed() bool {
+func (w *fen) isClosed() bool {
 	select {
 	case <-w.done:
 		return true
@@ -176,8 +176,7 @@ func (w *Watcher) isClosed() bool {
 	}
 }
 
-// Close removes all watches and closes the events channel.
-func (w *Watcher) Close() error {
+func (w *fen) Close() error {
 	// Take the lock used by associateFile to prevent lingering events from
 	// being processed after the close
 	w.mu.Lock()
@@ -186,91 +185,298 @@ func (w *Watcher) Close() error {
 		return nil
 	}
 	close(w.done)
+	close(w.abort)
 	return w.port.Close()
 }
 
-// Add starts monitoring the path for changes.
-//
-// A path can only be watched once; attempting to watch it more than once will
-// return an error. Paths that do not yet exist on the filesystem cannot be
-// added.
-//
-// A watch will be automatically removed if the watched path is deleted or
-// renamed. The exception is the Windows backend, which doesn't remove the
-// watcher on renames.
-//
-// Notifications on network filesystems (NFS, SMB, FUSE, etc.) or special
-// filesystems (/proc, /sys, etc.) generally don't work.
-//
-// Returns [ErrClosed] if [Watcher.Close] was called.
-//
-// # Watching directories
-//
-// All files in a directory are monitored, including new files that are created
-// after the watcher is started. Subdirectories are not watched (i.e. it's
-// non-recursive).
-//
-// # Watching files
-//
-// Watching individual files (rather than directories) is generally not
-// recommended as many tools update files atomically. Instead of "just" writing
-// to the file a temporary file will be written to first, and if successful the
-// temporary file is moved to to destination removing the original, or some
-// variant thereof. The watcher on the original file is now lost, as it no
-// longer exists.
-//
-// Instead, watch the parent directory and use Event.Name to filter out files
-// you're not interested in. There is an example of this in [cmd/fsnotify/file.go].
-func (w *Watcher) Add(name string) error {
+func (w *fen) CloseWait(ctx context.Context) error {
+	w.mu.Lock()
+	if w.isClosed() {
+		w.mu.Unlock()
+		return nil
+	}
+	close(w.done)
+	err := w.port.Close()
+	w.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	select {
+	case <-w.doneResp:
+		return nil
+	case <-ctx.Done():
+		close(w.abort)
+		<-w.doneResp
+		return ctx.Err()
+	}
+}
+
+func (w *fen) AddWith(name string, opts ...addOpt) error {
 	if w.isClosed() {
 		return ErrClosed
 	}
-	if w.port.PathIsWatched(name) {
+	with, err := getOptions(opts...)
+	if err != nil {
+		return err
+	}
+	if with.trackInode {
+		return ErrInodeUnsupported
+	}
+	if with.createWatch {
+		if waiting, err := w.auto.create(filepath.Clean(name), with, w.send, w.sendError); waiting || err != nil {
+			return err
+		}
+	}
+	if with.initialScan {
+		w.scans.begin()
+		defer w.scans.end()
+	}
+
+	name, recurse := recursivePath(name)
+	w.mu.Lock()
+	alreadyRecurse := w.recurse[name]
+	dirWith, isDir := w.dirs[name]
+	_, internal := w.internal[name]
+	w.mu.Unlock()
+	if with.internal {
+		// Directory that's waited in by the rewatcher; see rewatcher.hold().
+		// It's added as a directory even if it's already associated for the
+		// directory it's in, to find out what's created in it.
+		if (isDir && !dirWith.internal) || internal {
+			return errAlreadyWatched
+		}
+	} else {
+		w.auto.claim(name)
+	}
+	if recurse && !alreadyRecurse {
+		return w.addRecursive(name, with)
+	}
+
+	if w.port.PathIsWatched(name) && !with.internal {
+		w.mu.Lock()
+		if _, ok := w.dirs[name]; ok {
+			w.dirs[name] = with
+		}
+		if _, ok := w.watches[name]; ok {
+			w.watches[name] = with
+		}
+		recurse := w.recurse[name]
+		w.mu.Unlock()
+		w.scans.run(name, recurse, with, w.pipe, w.Events, w.abort, &w.stats)
 		return nil
 	}
 
 	// Currently we resolve symlinks that were explicitly requested to be
-	// watched. Otherwise we would use LStat here.
+	// watched, unless WithNoFollow() is used.
 	stat, err := os.Stat(name)
+	if with.noFollow {
+		stat, err = os.Lstat(name)
+	}
 	if err != nil {
 		return err
 	}
 
 	// Associate all files in the directory.
 	if stat.IsDir() {
-		err := w.handleDirectory(name, stat, true, w.associateFile)
+		err := w.handleDirectory(name, stat, !with.noFollow, w.associateFile)
 		if err != nil {
 			return err
 		}
 
 		w.mu.Lock()
-		w.dirs[name] = struct{}{}
+		w.dirs[name] = with
 		w.mu.Unlock()
+		w.scans.run(name, false, with, w.pipe, w.Events, w.abort, &w.stats)
 		return nil
 	}
 
-	err = w.associateFile(name, stat, true)
+	err = w.associateFile(name, stat, !with.noFollow)
 	if err != nil {
 		return err
 	}
 
 	w.mu.Lock()
-	w.watches[name] = struct{}{}
+	w.watches[name] = with
 	w.mu.Unlock()
 	return nil
 }
 
-// Remove stops monitoring the path for changes.
-//
-// Directories are always removed non-recursively. For example, if you added
-// /tmp/dir and /tmp/dir/subdir then you will need to remove both.
+// addRecursive adds a recursive watch for name, and all directories below it.
+// Symlinks to directories are never followed.
+func (w *fen) addRecursive(name string, with withOpts) error {
+	skipped := newSkippedError(with)
+	dirs, err := findDirs(name, w.pipe, false, with.maxDepth, skipped)
+	if err != nil {
+		return err
+	}
+	added := dirs[:0]
+	for i, dir := range dirs {
+		// Only the root of the watch follows a symlink.
+		follow := i == 0 && !with.noFollow
+		stat, err := os.Lstat(dir)
+		if err == nil && follow {
+			stat, err = os.Stat(dir)
+		}
+		if err == nil {
+			err = w.handleDirectory(dir, stat, follow, w.associateFile)
+		}
+		if err != nil && i > 0 && skipped.skip(&WatchError{Path: dir, Op: "add", Err: err}) {
+			continue
+		}
+		if err != nil {
+			for _, d := range added {
+				w.dissociateDir(d)
+			}
+			return err
+		}
+		added = append(added, dir)
+	}
+
+	w.mu.Lock()
+	w.dirs[name], w.recurse[name] = with, true
+	for _, dir := range added[1:] {
+		if _, ok := w.internal[dir]; !ok {
+			w.internal[dir] = name
+			w.rewatch()
+		}
+	}
+	w.mu.Unlock()
+	w.scans.run(name, true, with, w.pipe, w.Events, w.abort, &w.stats)
+	return skipped.err()
+}
+
+// addSubdir watches the directory name that was created inside the directory
+// parent, if parent is part of a recursive watch.
 //
-// Removing a path that has not yet been added returns [ErrNonExistentWatch].
-func (w *Watcher) Remove(name string) error {
+// Everything in it is handled as new, so that a Create is sent for files and
+// directories that were created before the directory was watched (e.g. "mkdir
+// -p a/b/c").
+func (w *fen) addSubdir(parent, name string) error {
+	if w.pipe.match(name) {
+		return nil
+	}
+
+	w.mu.Lock()
+	root := parent
+	if !w.recurse[parent] {
+		root = w.internal[parent]
+	}
+	with, ok := w.dirs[root]
+	if !ok || (with.maxDepth >= 0 && depth(root, name) > with.maxDepth) {
+		w.mu.Unlock()
+		return nil
+	}
+	if _, ok := w.internal[name]; !ok {
+		w.internal[name] = root
+		w.rewatch()
+	}
+	w.mu.Unlock()
+
+	err := w.updateDirectory(name)
+	// Already removed again; nothing to watch.
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if skipped := newSkippedError(with); err != nil && skipped.skip(&WatchError{Path: name, Op: "add", Err: err}) {
+		return skipped
+	}
+	return err
+}
+
+// removeSubdirs stops watching the subdirectories of a recursive watch that
+// are below path (and path itself). If root isn't empty only the directories
+// of the recursive watch for root are removed, for Remove(); otherwise the
+// directory was removed or renamed and everything below it is removed.
+func (w *fen) removeSubdirs(path, root string) {
+	var (
+		prefix = path + string(filepath.Separator)
+		remove []string
+	)
+	w.mu.Lock()
+	for dir, r := range w.internal {
+		if (dir == path || strings.HasPrefix(dir, prefix)) && (root == "" || r == root) {
+			delete(w.internal, dir)
+			// Also added with Add(), so still needed.
+			if _, ok := w.dirs[dir]; !ok {
+				remove = append(remove, dir)
+			}
+		}
+	}
+	w.mu.Unlock()
+
+	for _, dir := range remove {
+		w.dissociateDir(dir)
+	}
+}
+
+// dissociateDir removes the associations for a directory and all files in it.
+// The directory may already be gone, in which case only the association for
+// the directory itself is removed; the associations for the files are removed
+// once an event is sent for them.
+func (w *fen) dissociateDir(dir string) {
+	if stat, err := os.Lstat(dir); err == nil && stat.IsDir() {
+		_ = w.handleDirectory(dir, stat, false, w.dissociateFile)
+		return
+	}
+	_ = w.dissociateFile(dir, nil, false)
+}
+
+// orphans stops watching the paths below the directory name that were added
+// with Add(), as they're gone once it's removed or renamed. Nothing is sent for
+// these if only an ancestor is renamed, as the associations are for the file
+// objects.
+func (w *fen) orphans(name string) []orphan {
+	var (
+		prefix = name + string(filepath.Separator)
+		found  []orphan
+	)
+	w.mu.Lock()
+	for path, with := range w.watches {
+		if strings.HasPrefix(path, prefix) {
+			found = append(found, orphan{name: path, with: with})
+			delete(w.watches, path)
+		}
+	}
+	for path, with := range w.dirs {
+		if strings.HasPrefix(path, prefix) {
+			found = append(found, orphan{name: path, isDir: true, with: with})
+			delete(w.dirs, path)
+			delete(w.recurse, path)
+		}
+	}
+	w.mu.Unlock()
+
+	for _, o := range found {
+		if o.isDir {
+			w.dissociateDir(o.name)
+		} else {
+			_ = w.dissociateFile(o.name, nil, false)
+		}
+	}
+	return found
+}
+
+func (w *fen) Remove(name string) error {
 	if w.isClosed() {
+		return ErrClosed
+	}
+	name, recurse := recursivePath(name)
+	if w.auto.stop(filepath.Clean(name)) {
 		return nil
 	}
-	if !w.port.PathIsWatched(name) {
+	if w.auto.owns(filepath.Clean(name)) {
+		return fmt.Errorf("%w: %s", ErrNonExistentWatch, name)
+	}
+	// This also dissociates the directories in it.
+	defer w.auto.rehold(filepath.Clean(name), true)
+
+	w.mu.Lock()
+	_, isDir := w.dirs[name]
+	_, internal := w.internal[name]
+	wasRecurse := w.recurse[name]
+	w.mu.Unlock()
+	if !w.port.PathIsWatched(name) || (internal && !isDir) || (recurse && !wasRecurse) {
 		return fmt.Errorf("%w: %s", ErrNonExistentWatch, name)
 	}
 
@@ -280,8 +486,17 @@ func (w *Watcher) Remove(name string) error {
 	w.mu.Lock()
 	delete(w.watches, name)
 	delete(w.dirs, name)
+	delete(w.recurse, name)
 	w.mu.Unlock()
 
+	if wasRecurse {
+		w.removeSubdirs(name, name)
+	}
+	// Still needed for the recursive watch it's in.
+	if internal {
+		return nil
+	}
+
 	stat, err := os.Stat(name)
 	if err != nil {
 		return err
@@ -305,17 +520,24 @@ func (w *Watcher) Remove(name string) error {
 }
 
 // readEvents contains the main loop that runs in a goroutine watching for events.
-func (w *Watcher) readEvents() {
+func (w *fen) readEvents() {
 	// If this function returns, the watcher has been closed and we can close
 	// these channels
 	defer func() {
+		w.auto.close()
+		w.scans.close()
+		w.pipe.closeHeld()
 		close(w.Errors)
 		close(w.Events)
+		close(w.doneResp)
 	}()
 
 	pevents := make([]unix.PortEvent, 8)
 	for {
+		w.reads.idle()
 		count, err := w.port.Get(pevents, 1, nil)
+		w.reads.start()
+		w.readTime = time.Now()
 		if err != nil && err != unix.ETIME {
 			// Interrupted system call (count should be 0) ignore and continue
 			if errors.Is(err, unix.EINTR) && count == 0 {
@@ -325,6 +547,11 @@ func (w *Watcher) readEvents() {
 			if errors.Is(err, unix.EBADF) && w.isClosed() {
 				return
 			}
+			// The port was closed by something else.
+			if errors.Is(err, unix.EBADF) {
+				w.sendError(&DiedError{Err: err})
+				return
+			}
 			// There was an error not caused by calling w.Close()
 			if !w.sendError(err) {
 				return
@@ -341,8 +568,10 @@ func (w *Watcher) readEvents() {
 				continue
 			}
 
+			// Errors after Close or CloseWait are expected, as the files
+			// can't be associated again.
 			err = w.handleEvent(&pevent)
-			if err != nil {
+			if err != nil && !w.isClosed() {
 				if !w.sendError(err) {
 					return
 				}
@@ -351,7 +580,7 @@ func (w *Watcher) readEvents() {
 	}
 }
 
-func (w *Watcher) handleDirectory(path string, stat os.FileInfo, follow bool, handler func(string, os.FileInfo, bool) error) error {
+func (w *fen) handleDirectory(path string, stat os.FileInfo, follow bool, handler func(string, os.FileInfo, bool) error) error {
 	files, err := os.ReadDir(path)
 	if err != nil {
 		return err
@@ -377,7 +606,7 @@ func (w *Watcher) handleDirectory(path string, stat os.FileInfo, follow bool, ha
 // bitmap matches more than one event type (e.g. the file was both modified and
 // had the attributes changed between when the association was created and the
 // when event was returned)
-func (w *Watcher) handleEvent(event *unix.PortEvent) error {
+func (w *fen) handleEvent(event *unix.PortEvent) error {
 	var (
 		events     = event.Events
 		path       = event.Path
@@ -386,19 +615,32 @@ func (w *Watcher) handleEvent(event *unix.PortEvent) error {
 	)
 
 	w.mu.Lock()
-	_, watchedDir := w.dirs[path]
-	_, watchedPath := w.watches[path]
+	dirOpts, watchedDir := w.dirOpts(path)
+	userWith, userDir := w.dirs[path]
+	pathOpts, watchedPath := w.watches[path]
+	_, watchedParent := w.dirOpts(filepath.Dir(path))
 	w.mu.Unlock()
-	isWatched := watchedDir || watchedPath
+	// Subdirectories of a recursive watch don't follow symlinks.
+	isWatched := (userDir && !userWith.internal) || watchedPath
+	follow := isWatched && !dirOpts.noFollow && !pathOpts.noFollow
 
-	if events&unix.FILE_DELETE != 0 {
-		if !w.sendEvent(path, Remove) {
+	if events&(unix.FILE_DELETE|unix.UNMOUNTED) != 0 {
+		if !w.sendPortEvent(event, Remove, fmode.IsDir()) {
+			return nil
+		}
+		if events&unix.UNMOUNTED != 0 && isWatched && !w.sendError(&WatchError{Path: path, Op: "read", Err: ErrUnmounted}) {
 			return nil
 		}
 		reRegister = false
 	}
 	if events&unix.FILE_RENAME_FROM != 0 {
-		if !w.sendEvent(path, Rename) {
+		// A file added with Add() that's renamed is gone, as on the other
+		// platforms.
+		op := Rename
+		if watchedPath && !watchedParent {
+			op = Remove
+		}
+		if !w.sendPortEvent(event, op, fmode.IsDir()) {
 			return nil
 		}
 		// Don't keep watching the new file name
@@ -412,7 +654,7 @@ func (w *Watcher) handleEvent(event *unix.PortEvent) error {
 
 		// inotify reports a Remove event in this case, so we simulate this
 		// here.
-		if !w.sendEvent(path, Remove) {
+		if !w.sendPortEvent(event, Remove, fmode.IsDir()) {
 			return nil
 		}
 		// Don't keep watching the file that was removed
@@ -421,15 +663,27 @@ func (w *Watcher) handleEvent(event *unix.PortEvent) error {
 
 	// The file is gone, nothing left to do.
 	if !reRegister {
+		if fmode.IsDir() && !sendOrphans(w.orphans(path), w.readTime, &w.auto, &w.stats, w.send, w.sendError) {
+			return nil
+		}
 		if watchedDir {
 			w.mu.Lock()
 			delete(w.dirs, path)
+			delete(w.recurse, path)
 			w.mu.Unlock()
+			// Everything below it is gone too; the associations of the files
+			// in it are gone once the kernel sends an event for them, but the
+			// directories that are still associated (after a rename) need to
+			// be removed.
+			w.removeSubdirs(path, "")
 		}
 		if watchedPath {
 			w.mu.Lock()
 			delete(w.watches, path)
 			w.mu.Unlock()
+			if pathOpts.autoRewatch && !fmode.IsDir() {
+				w.auto.start(path, pathOpts, &w.stats, w.send, w.sendError)
+			}
 		}
 		return nil
 	}
@@ -446,9 +700,15 @@ func (w *Watcher) handleEvent(event *unix.PortEvent) error {
 		// get here, the sudirectory is already gone. Clearly we were watching
 		// this path but now it is gone. Let's tell the user that it was
 		// removed.
-		if !w.sendEvent(path, Remove) {
+		if !w.sendPortEvent(event, Remove, fmode.IsDir()) {
 			return nil
 		}
+		if fmode.IsDir() && !sendOrphans(w.orphans(path), w.readTime, &w.auto, &w.stats, w.send, w.sendError) {
+			return nil
+		}
+		if watchedDir {
+			w.removeSubdirs(path, "")
+		}
 		// Suppress extra write events on removed directories; they are not
 		// informative and can be confusing.
 		return nil
@@ -456,12 +716,12 @@ func (w *Watcher) handleEvent(event *unix.PortEvent) error {
 
 	// resolve symlinks that were explicitly watched as we would have at Add()
 	// time. this helps suppress spurious Chmod events on watched symlinks
-	if isWatched {
+	if follow {
 		stat, err = os.Stat(path)
 		if err != nil {
 			// The symlink still exists, but the target is gone. Report the
 			// Remove similar to above.
-			if !w.sendEvent(path, Remove) {
+			if !w.sendPortEvent(event, Remove, fmode.IsDir()) {
 				return nil
 			}
 			// Don't return the error
@@ -474,13 +734,16 @@ func (w *Watcher) handleEvent(event *unix.PortEvent) error {
 				if err := w.updateDirectory(path); err != nil {
 					return err
 				}
-			} else {
-				if !w.sendEvent(path, Write) {
+			}
+			// Directories that are only watched for the rewatcher still send
+			// the Write for the directory they're in.
+			if !watchedDir || dirOpts.internal {
+				if !w.sendPortEvent(event, Write, fmode.IsDir()) {
 					return nil
 				}
 			}
 		} else {
-			if !w.sendEvent(path, Write) {
+			if !w.sendPortEvent(event, Write, fmode.IsDir()) {
 				return nil
 			}
 		}
@@ -488,7 +751,7 @@ func (w *Watcher) handleEvent(event *unix.PortEvent) error {
 	if events&unix.FILE_ATTRIB != 0 && stat != nil {
 		// Only send Chmod if perms changed
 		if stat.Mode().Perm() != fmode.Perm() {
-			if !w.sendEvent(path, Chmod) {
+			if !w.sendPortEvent(event, Chmod, fmode.IsDir()) {
 				return nil
 			}
 		}
@@ -497,22 +760,22 @@ func (w *Watcher) handleEvent(event *unix.PortEvent) error {
 	if stat != nil {
 		// If we get here, it means we've hit an event above that requires us to
 		// continue watching the file or directory
-		return w.associateFile(path, stat, isWatched)
+		return w.associateFile(path, stat, follow)
 	}
 	return nil
 }
 
-func (w *Watcher) updateDirectory(path string) error {
+func (w *fen) updateDirectory(dir string) error {
 	// The directory was modified, so we must find unwatched entities and watch
 	// them. If something was removed from the directory, nothing will happen,
 	// as everything else should still be watched.
-	files, err := os.ReadDir(path)
+	files, err := os.ReadDir(dir)
 	if err != nil {
-		return err
+		return &WatchError{Path: dir, Op: "read", Err: err}
 	}
 
 	for _, entry := range files {
-		path := filepath.Join(path, entry.Name())
+		path := filepath.Join(dir, entry.Name())
 		if w.port.PathIsWatched(path) {
 			continue
 		}
@@ -523,18 +786,25 @@ func (w *Watcher) updateDirectory(path string) error {
 		}
 		err = w.associateFile(path, finfo, false)
 		if err != nil {
-			if !w.sendError(err) {
+			if !w.sendError(&WatchError{Path: path, Op: "add", Err: err}) {
 				return nil
 			}
 		}
-		if !w.sendEvent(path, Create) {
+		if finfo.IsDir() {
+			if err := w.addSubdir(dir, path); err != nil {
+				if !w.sendError(err) {
+					return nil
+				}
+			}
+		}
+		if !w.sendEvent(path, Create, finfo.IsDir()) {
 			return nil
 		}
 	}
 	return nil
 }
 
-func (w *Watcher) associateFile(path string, stat os.FileInfo, follow bool) error {
+func (w *fen) associateFile(path string, stat os.FileInfo, follow bool) error {
 	if w.isClosed() {
 		return ErrClosed
 	}
@@ -568,19 +838,16 @@ func (w *Watcher) associateFile(path string, stat os.FileInfo, follow bool) erro
 		stat.Mode())
 }
 
-func (w *Watcher) dissociateFile(path string, stat os.FileInfo, unused bool) error {
+func (w *fen) dissociateFile(path string, stat os.FileInfo, unused bool) error {
 	if !w.port.PathIsWatched(path) {
 		return nil
 	}
 	return w.port.DissociatePath(path)
 }
 
-// WatchList returns all paths added with [Add] (and are not yet removed).
-//
-// Returns nil if [Watcher.Close] was called.
-func (w *Watcher) WatchList() []string {
+func (w *fen) WatchList() []string {
 	if w.isClosed() {
-		return nil
+		return []string{}
 	}
 
 	w.mu.Lock()
@@ -588,11 +855,75 @@ func (w *Watcher) WatchList() []string {
 
 	entries := make([]string, 0, len(w.watches)+len(w.dirs))
 	for pathname := range w.dirs {
+		if w.recurse[pathname] {
+			pathname = filepath.Join(pathname, "...")
+		}
 		entries = append(entries, pathname)
 	}
 	for pathname := range w.watches {
 		entries = append(entries, pathname)
 	}
 
-	return entries
+	return w.auto.hide(entries)
+}
+
+func (w *fen) IsWatched(name string) bool {
+	if w.isClosed() {
+		return false
+	}
+
+	name, recurse := recursivePath(filepath.Clean(name))
+	if w.auto.owns(name) {
+		return false
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if recurse {
+		return w.recurse[name]
+	}
+	_, isDir := w.dirs[name]
+	_, isFile := w.watches[name]
+	return isDir || isFile
+}
+
+func (w *fen) Sync(ctx context.Context) error {
+	return w.reads.sync(ctx, w.doneResp, func() bool {
+		n, err := w.port.Pending()
+		return n > 0 || err == unix.EINTR
+	})
+}
+
+func (w *fen) Fd() (uintptr, bool) { return 0, false }
+
+func (w *fen) Heartbeat(d time.Duration) <-chan time.Time {
+	return w.reads.heartbeat(d, w.doneResp)
+}
+
+func (w *fen) rescan(events []Event) {
+	w.scans.send(events, w.pipe, w.Events, w.abort, &w.stats)
+}
+
+func (w *fen) reset() error { return ErrResetUnsupported }
+
+// DryRunAdd counts the associations for every directory and every file in it.
+func (w *fen) DryRunAdd(name string, opts ...addOpt) (int, error) {
+	with, err := getOptions(opts...)
+	if err != nil {
+		return 0, err
+	}
+	// Symlinks are never followed below a recursive watch.
+	with.follow = false
+	dirs, err := dryRunDirs(filepath.Clean(name), with, w.pipe)
+	n := 0
+	for _, d := range dirs {
+		n++
+		if ls, err := os.ReadDir(d); err == nil {
+			n += len(ls)
+		}
+	}
+	return n, err
 }
+
+func (w *fen) SupportsRecursion() bool { return true }
+
+func (w *fen) setMaxWatches(int) {}
@@ -19,26 +19,27 @@ func TestRemoveState(t *testing.T) {
 	touch(t, file)
 
 	w := newWatcher(t, tmp)
+	b := w.b.(*fen)
 	addWatch(t, w, tmp)
 	addWatch(t, w, file)
 
 	check := func(wantDirs, wantFiles int) {
 		t.Helper()
-		if len(w.watches) != wantFiles {
+		if len(b.watches) != wantFiles {
 			var d []string
-			for k, v := range w.watches {
+			for k, v := range b.watches {
 				d = append(d, fmt.Sprintf("%#v = %#v", k, v))
 			}
 			t.Errorf("unexpected number of entries in w.watches (have %d, want %d):\n%v",
-				len(w.watches), wantFiles, strings.Join(d, "\n"))
+				len(b.watches), wantFiles, strings.Join(d, "\n"))
 		}
-		if len(w.dirs) != wantDirs {
+		if len(b.dirs) != wantDirs {
 			var d []string
-			for k, v := range w.dirs {
+			for k, v := range b.dirs {
 				d = append(d, fmt.Sprintf("%#v = %#v", k, v))
 			}
 			t.Errorf("unexpected number of entries in w.dirs (have %d, want %d):\n%v",
-				len(w.dirs), wantDirs, strings.Join(d, "\n"))
+				len(b.dirs), wantDirs, strings.Join(d, "\n"))
 		}
 	}
 
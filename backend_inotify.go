@@ -4,136 +4,70 @@
 package fsnotify
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
+	"time"
 	"unsafe"
 
 	"golang.org/x/sys/unix"
 )
 
-// Watcher watches a set of paths, delivering events on a channel.
-//
-// A watcher should not be copied (e.g. pass it by pointer, rather than by
-// value).
-//
-// # Linux notes
-//
-// When a file is removed a Remove event won't be emitted until all file
-// descriptors are closed, and deletes will always emit a Chmod. For example:
-//
-//     fp := os.Open("file")
-//     os.Remove("file")        // Triggers Chmod
-//     fp.Close()               // Triggers Remove
-//
-// This is the event that inotify sends, so not much can be changed about this.
-//
-// The fs.inotify.max_user_watches sysctl variable specifies the upper limit
-// for the number of watches per user, and fs.inotify.max_user_instances
-// specifies the maximum number of inotify instances per user. Every Watcher you
-// create is an "instance", and every path you add is a "watch".
-//
-// These are also exposed in /proc as /proc/sys/fs/inotify/max_user_watches and
-// /proc/sys/fs/inotify/max_user_instances
-//
-// To increase them you can use sysctl or write the value to the /proc file:
-//
-//     # Default values on Linux 5.18
-//     sysctl fs.inotify.max_user_watches=124983
-//     sysctl fs.inotify.max_user_instances=128
-//
-// To make the changes persist on reboot edit /etc/sysctl.conf or
-// /usr/lib/sysctl.d/50-default.conf (details differ per Linux distro; check
-// your distro's documentation):
-//
-//     fs.inotify.max_user_watches=124983
-//     fs.inotify.max_user_instances=128
-//
-// Reaching the limit will result in a "no space left on device" or "too many open
-// files" error.
-//
-// # kqueue notes (macOS, BSD)
-//
-// kqueue requires opening a file descriptor for every file that's being watched;
-// so if you're watching a directory with five files then that's six file
-// descriptors. You will run in to your system's "max open files" limit faster on
-// these platforms.
-//
-// The sysctl variables kern.maxfiles and kern.maxfilesperproc can be used to
-// control the maximum number of open files, as well as /etc/login.conf on BSD
-// systems.
-//
-// # macOS notes
-//
-// Spotlight indexing on macOS can result in multiple events (see [#15]). A
-// temporary workaround is to add your folder(s) to the "Spotlight Privacy
-// Settings" until we have a native FSEvents implementation (see [#11]).
-//
-// [#11]: https://github.com/fsnotify/fsnotify/issues/11
-// [#15]: https://github.com/fsnotify/fsnotify/issues/15
-type Watcher struct {
-	// Events sends the filesystem change events.
-	//
-	// fsnotify can send the following events; a "path" here can refer to a
-	// file, directory, symbolic link, or special file like a FIFO.
-	//
-	//   fsnotify.Create    A new path was created; this may be followed by one
-	//                      or more Write events if data also gets written to a
-	//                      file.
-	//
-	//   fsnotify.Remove    A path was removed.
-	//
-	//   fsnotify.Rename    A path was renamed. A rename is always sent with the
-	//                      old path as Event.Name, and a Create event will be
-	//                      sent with the new name. Renames are only sent for
-	//                      paths that are currently watched; e.g. moving an
-	//                      unmonitored file into a monitored directory will
-	//                      show up as just a Create. Similarly, renaming a file
-	//                      to outside a monitored directory will show up as
-	//                      only a Rename.
-	//
-	//   fsnotify.Write     A file or named pipe was written to. A Truncate will
-	//                      also trigger a Write. A single "write action"
-	//                      initiated by the user may show up as one or multiple
-	//                      writes, depending on when the system syncs things to
-	//                      disk. For example when compiling a large Go program
-	//                      you may get hundreds of Write events, so you
-	//                      probably want to wait until you've stopped receiving
-	//                      them (see the dedup example in cmd/fsnotify).
-	//
-	//   fsnotify.Chmod     Attributes were changed. On Linux this is also sent
-	//                      when a file is removed (or more accurately, when a
-	//                      link to an inode is removed). On kqueue it's sent
-	//                      and on kqueue when a file is truncated. On Windows
-	//                      it's never sent.
-	Events chan Event
+type inotify struct {
+	stats // Counters for Watcher.Stats()
 
-	// Errors sends any errors.
-	//
-	// [ErrEventOverflow] is used to indicate ther are too many events:
-	//
-	//  - inotify: there are too many queued events (fs.inotify.max_queued_events sysctl)
-	//  - windows: The buffer size is too small.
-	//  - kqueue, fen: not used.
+	Events chan Event
 	Errors chan error
+	pipe   *pipeline   // Filters, changes, and sends events; shared with the Watcher.
+	auto   rewatcher   // Removed files to watch again once they're recreated, for WithAutoRewatch()
+	scans  initialScan // Existing paths to send a Create for, for WithInitialScan()
+	reads  reader      // If the reader goroutine is busy, for Watcher.Sync()
 
 	// Store fd here as os.File.Read() will no longer return on close after
 	// calling Fd(). See: https://github.com/golang/go/issues/26439
 	fd          int
-	mu          sync.Mutex // Map access
+	mu          sync.Mutex // Map access, and fd and inotifyFile (which are replaced by reset())
 	inotifyFile *os.File
-	watches     map[string]*watch // Map of inotify watches (path → watch)
-	paths       map[int]string    // Map of watched paths (watch descriptor → path)
-	done        chan struct{}     // Channel for sending a "quit message" to the reader goroutine
-	doneResp    chan struct{}     // Channel to respond to Close
+	watches     map[string]*watch      // Map of inotify watches (path → watch)
+	paths       map[int]string         // Map of watched paths (watch descriptor → path)
+	links       map[int][]string       // Files added with Add() that have hard links (watch descriptor → paths)
+	targets     map[int]*target        // Targets of symlinks in directories added with WithResolveTargets() (watch descriptor → target)
+	tracked     map[string]os.FileInfo // Files added with WithTrackInode(), to find them again once they're renamed (path → file)
+	done        chan struct{}          // Channel for sending a "quit message" to the reader goroutine
+	doneResp    chan struct{}          // Channel to respond to Close
+	abort       chan struct{}          // Stop sending events; closed by Close, or by CloseWait if ctx is done
+	resetC      chan struct{}          // Tells the reader goroutine the fd was replaced by reset()
+
+	// Store the last few IN_MOVED_FROM events, so that the IN_MOVED_TO can be
+	// paired with it. Only accessed from the readEvents() goroutine.
+	cookies     [10]moveCookie
+	cookieIndex int
+
+	// Cookie of the last IN_MOVED_FROM for a file that's followed with
+	// WithTrackInode(); the IN_MOVED_TO for it isn't sent. Only accessed from
+	// the readEvents() goroutine.
+	trackCookie uint32
+}
+
+// target is a file that symlinks point to, for WithResolveTargets().
+type target struct {
+	dev, ino uint64   // To see if a symlink still points to this file.
+	links    []string // Symlinks to the file.
 }
 
-// NewWatcher creates a new Watcher.
-func NewWatcher() (*Watcher, error) {
+type moveCookie struct {
+	cookie uint32
+	path   string
+}
+
+func newBackend(ev chan Event, errs chan error, pipe *pipeline) (backend, error) {
 	// Create inotify fd
 	// Need to set the FD to nonblocking mode in order for SetDeadline methods to work
 	// Otherwise, blocking i/o operations won't terminate on close
@@ -142,42 +76,54 @@ func NewWatcher() (*Watcher, error) {
 		return nil, errno
 	}
 
-	w := &Watcher{
+	w := &inotify{
 		fd:          fd,
 		inotifyFile: os.NewFile(uintptr(fd), ""),
 		watches:     make(map[string]*watch),
 		paths:       make(map[int]string),
-		Events:      make(chan Event),
-		Errors:      make(chan error),
+		links:       make(map[int][]string),
+		targets:     make(map[int]*target),
+		tracked:     make(map[string]os.FileInfo),
+		Events:      ev,
+		Errors:      errs,
+		pipe:        pipe,
 		done:        make(chan struct{}),
 		doneResp:    make(chan struct{}),
+		abort:       make(chan struct{}),
+		resetC:      make(chan struct{}, 1),
 	}
+	w.auto.b = w
 
 	go w.readEvents()
 	return w, nil
 }
 
 // Returns true if the event was sent, or false if watcher is closed.
-func (w *Watcher) sendEvent(e Event) bool {
-	select {
-	case w.Events <- e:
+func (w *inotify) sendEvent(e Event) bool {
+	e.Seq = w.pipe.nextSeq()
+	if w.pipe.match(e.Name) {
 		return true
-	case <-w.done:
 	}
-	return false
+
+	if w.pipe.dropExt(e) || w.pipe.dropPaused() {
+		return true
+	}
+	w.scans.wait()
+	return w.pipe.send(w.Events, e, w.abort, &w.stats)
 }
 
 // Returns true if the error was sent, or false if watcher is closed.
-func (w *Watcher) sendError(err error) bool {
+func (w *inotify) sendError(err error) bool {
 	select {
 	case w.Errors <- err:
+		w.sentError(err)
 		return true
-	case <-w.done:
+	case <-w.abort:
 		return false
 	}
 }
 
-func (w *Watcher) isClosed() bool {
+func (w *inotify) isClosed() bool {
 	select {
 	case <-w.done:
 		return true
@@ -186,8 +132,7 @@ func (w *Watcher) isClosed() bool {
 	}
 }
 
-// Close removes all watches and closes the events channel.
-func (w *Watcher) Close() error {
+func (w *inotify) Close() error {
 	w.mu.Lock()
 	if w.isClosed() {
 		w.mu.Unlock()
@@ -196,6 +141,7 @@ func (w *Watcher) Close() error {
 
 	// Send 'close' signal to goroutine, and set the Watcher to closed.
 	close(w.done)
+	close(w.abort)
 	w.mu.Unlock()
 
 	// Causes any blocking reads to return with an error, provided the file
@@ -211,99 +157,778 @@ func (w *Watcher) Close() error {
 	return nil
 }
 
-// Add starts monitoring the path for changes.
+func (w *inotify) CloseWait(ctx context.Context) error {
+	w.mu.Lock()
+	if w.isClosed() {
+		w.mu.Unlock()
+		return nil
+	}
+	close(w.done)
+	w.mu.Unlock()
+
+	// The reader goroutine will send whatever is still in its buffer, and stop
+	// once the next read returns an error.
+	err := w.inotifyFile.Close()
+	if err != nil {
+		return err
+	}
+
+	select {
+	case <-w.doneResp:
+		return nil
+	case <-ctx.Done():
+		close(w.abort)
+		<-w.doneResp
+		return ctx.Err()
+	}
+}
+
+// reset replaces the inotify fd with a new one, and forgets all watches. The
+// reader goroutine keeps running, and reads from the new fd once the old one
+// is closed (or once it's told to, if it stopped because the old one died).
+func (w *inotify) reset() error {
+	fd, errno := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if fd == -1 {
+		return errno
+	}
+
+	w.mu.Lock()
+	if w.isClosed() {
+		w.mu.Unlock()
+		unix.Close(fd)
+		return ErrClosed
+	}
+	old := w.inotifyFile
+	w.fd, w.inotifyFile = fd, os.NewFile(uintptr(fd), "")
+	w.watches = make(map[string]*watch)
+	w.paths = make(map[int]string)
+	w.links = make(map[int][]string)
+	w.targets = make(map[int]*target)
+	w.tracked = make(map[string]os.FileInfo)
+	w.mu.Unlock()
+
+	select {
+	case w.resetC <- struct{}{}:
+	default:
+	}
+	// Fails if it was replaced with something else, which is fine.
+	_ = old.Close()
+	w.auto.reset()
+	return nil
+}
+
+func (w *inotify) setMaxWatches(int) {}
+
+func (w *inotify) AddWith(name string, opts ...addOpt) error {
+	name = filepath.Clean(name)
+	if w.isClosed() {
+		return ErrClosed
+	}
+	with, err := getOptions(opts...)
+	if err != nil {
+		return err
+	}
+	if with.createWatch {
+		if waiting, err := w.auto.create(name, with, w.sendEvent, w.sendError); waiting || err != nil {
+			return err
+		}
+	}
+
+	if with.initialScan {
+		w.scans.begin()
+		defer w.scans.end()
+	}
+
+	name, recurse := recursivePath(name)
+	if !with.internal {
+		w.auto.claim(name)
+	}
+	if !recurse {
+		// Files are watched through their parent directory, so that a Remove
+		// is sent when they're removed or renamed. Symlinks to files are
+		// watched directly, as the directory doesn't get events for the
+		// target.
+		if fi, err := os.Lstat(name); err == nil && !fi.IsDir() && fi.Mode()&os.ModeSymlink == 0 && !with.internal {
+			return w.addFile(name, fi, with)
+		}
+		if err := w.add(name, with, false, false); err != nil {
+			return err
+		}
+		w.scans.run(name, false, with, w.pipe, w.Events, w.abort, &w.stats)
+		return nil
+	}
+
+	skipped := newSkippedError(with)
+	dirs, err := findDirs(name, w.pipe, with.follow, with.maxDepth, skipped)
+	if err != nil {
+		return err
+	}
+	var added []string // Directories that weren't watched yet, to remove again on errors.
+	for i, dir := range dirs {
+		w.mu.Lock()
+		_, watched := w.watches[dir]
+		w.mu.Unlock()
+
+		err := w.add(dir, with, true, i > 0)
+		if err == nil {
+			if !watched {
+				added = append(added, dir)
+			}
+			continue
+		}
+		if i > 0 && skipped.skip(&WatchError{Path: dir, Op: "add", Err: err}) {
+			continue
+		}
+
+		w.mu.Lock()
+		for j := len(added) - 1; j >= 0; j-- {
+			if watch, ok := w.watches[added[j]]; ok {
+				w.remove(added[j], watch)
+			}
+		}
+		w.mu.Unlock()
+		return err
+	}
+	w.scans.run(name, true, with, w.pipe, w.Events, w.abort, &w.stats)
+	return skipped.err()
+}
+
+// add a watch for one path; recurse is set for all directories that are part
+// of a recursive watch, and internal for all of those except the root.
+func (w *inotify) add(name string, with withOpts, recurse, internal bool) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	// Directory that's waited in by the rewatcher, which is already watched:
+	// use that watch (see rewatcher.hold()).
+	watchEntry := w.watches[name]
+	if watchEntry != nil && with.internal && !watchEntry.with.internal {
+		flags := w.toFlags(parentOps, false)
+		if wd, errno := unix.InotifyAddWatch(w.fd, name, flags|unix.IN_MASK_ADD); wd == -1 {
+			return errno
+		}
+		watchEntry.flags |= flags
+		return errAlreadyWatched
+	}
+
+	// Don't overwrite the options the user set when adding a subdirectory of a
+	// recursive watch. A watch that was only added for the rewatcher is taken
+	// over.
+	waitOnly := watchEntry != nil && watchEntry.with.internal
+	if watchEntry != nil && internal && !watchEntry.internal && !waitOnly {
+		with = watchEntry.with
+	}
+
+	// This replaces the flags if the path is already watched.
+	flags := w.toFlags(with.ops, recurse || (watchEntry != nil && watchEntry.recurse))
+	if w.auto.holds(name) {
+		flags |= w.toFlags(parentOps, false)
+	}
+	if with.noFollow {
+		flags |= unix.IN_DONT_FOLLOW
+	}
+	if with.atomicSave {
+		flags |= unix.IN_MOVED_FROM | unix.IN_MOVED_TO
+	}
+	if with.closeWrite && flags&unix.IN_MODIFY != 0 {
+		flags = flags&^unix.IN_MODIFY | unix.IN_CLOSE_WRITE
+	}
+	if watchEntry != nil {
+		flags |= w.fileFlags(watchEntry.files)
+	}
+	wd, errno := unix.InotifyAddWatch(w.fd, name, flags)
+	if wd == -1 {
+		if errno == unix.ENOSPC {
+			return fmt.Errorf("%w: %s: %s", ErrWatchLimitReached, name, errno)
+		}
+		return errno
+	}
+
+	// inotify returns the same watch descriptor for the same inode, so if a
+	// directory inside a recursive watch was moved to another location inside
+	// the recursive watch we just need to update the path.
+	//
+	// With WithFollowSymlinks() it may also be the same directory through a
+	// symlink, in which case it's already watched.
+	if old, ok := w.paths[wd]; watchEntry == nil && internal && ok && old != name && with.follow {
+		if _, err := os.Lstat(old); err == nil {
+			return nil
+		}
+	}
+	if old, ok := w.paths[wd]; watchEntry == nil && internal && ok && old != name && w.watches[old].internal {
+		watchEntry = w.watches[old]
+		watchEntry.moved = true
+		delete(w.watches, old)
+		w.watches[name] = watchEntry
+		w.paths[wd] = name
+	}
+
+	if watchEntry == nil {
+		w.watches[name] = &watch{wd: uint32(wd), flags: flags, with: with, recurse: recurse, internal: internal}
+		w.paths[wd] = name
+		if internal {
+			w.rewatch()
+		}
+	} else {
+		watchEntry.wd = uint32(wd)
+		watchEntry.flags = flags
+		watchEntry.with = with
+		watchEntry.recurse = watchEntry.recurse || recurse
+		watchEntry.internal = (watchEntry.internal || waitOnly) && internal
+		watchEntry.parent = false
+	}
+
+	if with.targets {
+		w.addTargets(name, with)
+	}
+	return nil
+}
+
+// addFile watches a file through its parent directory.
 //
-// A path can only be watched once; attempting to watch it more than once will
-// return an error. Paths that do not yet exist on the filesystem cannot be
-// added.
+// Files with more than one hard link are also watched directly, as writes
+// through one of the other links are only sent to the directory that link is
+// in. So are named pipes and device files, as writes to those are never sent
+// to the directory.
+func (w *inotify) addFile(name string, fi os.FileInfo, with withOpts) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	dir, base := filepath.Dir(name), filepath.Base(name)
+	watchEntry := w.watches[dir]
+	files := map[string]withOpts{base: with}
+	var flags uint32 = unix.IN_MOVE_SELF | unix.IN_DELETE_SELF
+	if watchEntry != nil {
+		for n, o := range watchEntry.files {
+			if n != base {
+				files[n] = o
+			}
+		}
+		if !watchEntry.parent {
+			flags = watchEntry.flags
+		}
+	}
+	flags |= w.fileFlags(files)
+	if w.auto.holds(dir) {
+		flags |= w.toFlags(parentOps, false)
+	}
+
+	wd, errno := unix.InotifyAddWatch(w.fd, dir, flags)
+	if wd == -1 {
+		if errno == unix.ENOSPC {
+			return fmt.Errorf("%w: %s: %s", ErrWatchLimitReached, name, errno)
+		}
+		return errno
+	}
+
+	if watchEntry == nil {
+		watchEntry = &watch{wd: uint32(wd), with: defaultOpts, internal: true, parent: true}
+		w.watches[dir] = watchEntry
+		w.paths[wd] = dir
+	}
+	watchEntry.flags, watchEntry.files = flags, files
+	if with.trackInode {
+		w.tracked[name] = fi
+	} else {
+		delete(w.tracked, name)
+	}
+
+	if fi.Mode()&(os.ModeNamedPipe|os.ModeDevice) != 0 {
+		return w.addLink(name, with)
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok && st.Nlink > 1 {
+		return w.addLink(name, with)
+	}
+	return nil
+}
+
+// addLink watches the inode of a file that has hard links (or a named pipe or
+// device file), for the Write and Chmod events. The directory still sends
+// everything else.
 //
-// A watch will be automatically removed if the watched path is deleted or
-// renamed. The exception is the Windows backend, which doesn't remove the
-// watcher on renames.
+// Unlocked!
+func (w *inotify) addLink(name string, with withOpts) error {
+	var flags uint32
+	if with.ops.Has(Write) {
+		flags |= writeFlag(with)
+	}
+	if with.ops.Has(Chmod) {
+		flags |= unix.IN_ATTRIB
+	}
+	if flags == 0 {
+		return nil
+	}
+
+	// Another link to the same inode may already be watched, in which case
+	// the same watch descriptor is returned.
+	wd, errno := unix.InotifyAddWatch(w.fd, name, flags|unix.IN_MASK_ADD)
+	if wd == -1 {
+		if errno == unix.ENOSPC {
+			return fmt.Errorf("%w: %s: %s", ErrWatchLimitReached, name, errno)
+		}
+		return errno
+	}
+	// Already watched directly, e.g. through a symlink.
+	if _, ok := w.paths[wd]; ok {
+		return nil
+	}
+	for _, l := range w.links[wd] {
+		if l == name {
+			return nil
+		}
+	}
+	w.links[wd] = append(w.links[wd], name)
+	return nil
+}
+
+// isLink reports if name is a file with hard links that's watched directly.
+//
+// Unlocked!
+func (w *inotify) isLink(name string) bool {
+	for _, names := range w.links {
+		for _, l := range names {
+			if l == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// fileFlags gets the inotify flags for a directory to watch the files in it
+// that were added with Add(). Removes and renames are always needed to know
+// when a file is gone.
+func (w *inotify) fileFlags(files map[string]withOpts) uint32 {
+	var flags uint32
+	for _, with := range files {
+		flags |= unix.IN_DELETE | unix.IN_MOVED_FROM | unix.IN_MOVED_TO
+		if with.ops.Has(Write) {
+			flags |= writeFlag(with)
+		}
+		if with.ops.Has(Chmod) {
+			flags |= unix.IN_ATTRIB
+		}
+	}
+	return flags
+}
+
+// removeFile stops watching a file that was added with Add(), and removes the
+// watch for the directory if it was only watched for the files in it. If the
+// rewatcher still waits in the directory it takes over the watch instead.
 //
-// Notifications on network filesystems (NFS, SMB, FUSE, etc.) or special
-// filesystems (/proc, /sys, etc.) generally don't work.
+// Unlocked!
+func (w *inotify) removeFile(dir, base string, watch *watch) error {
+	delete(watch.files, base)
+	delete(w.tracked, filepath.Join(dir, base))
+	w.removeLink(filepath.Join(dir, base))
+	if watch.parent && len(watch.files) == 0 {
+		if w.auto.own(dir) {
+			watch.with, watch.internal, watch.parent = parentOpts(), false, false
+			return nil
+		}
+		return w.remove(dir, watch)
+	}
+	return nil
+}
+
+// moveFile moves a file added with Add() that was renamed in the directory it's
+// in, for WithTrackInode().
 //
-// Returns [ErrClosed] if [Watcher.Close] was called.
+// Unlocked!
+func (w *inotify) moveFile(dir, from, to string, watch *watch) {
+	watch.files[to] = watch.files[from]
+	delete(watch.files, from)
+
+	old, path := filepath.Join(dir, from), filepath.Join(dir, to)
+	w.tracked[path] = w.tracked[old]
+	delete(w.tracked, old)
+	for _, names := range w.links {
+		for i, l := range names {
+			if l == old {
+				names[i] = path
+			}
+		}
+	}
+}
+
+// removeLink stops watching the inode of a file with hard links, once none of
+// the links are watched.
 //
-// # Watching directories
+// Unlocked!
+func (w *inotify) removeLink(name string) {
+	for wd, names := range w.links {
+		for i, l := range names {
+			if l != name {
+				continue
+			}
+			names = append(names[:i], names[i+1:]...)
+			if len(names) > 0 {
+				w.links[wd] = names
+				return
+			}
+			delete(w.links, wd)
+			// Can fail if the watch was already removed by the kernel, which
+			// is fine.
+			_, _ = unix.InotifyRmWatch(w.fd, uint32(wd))
+			return
+		}
+	}
+}
+
+// linkEvents gets the events for a watch on a file with hard links, for every
+// link that was added with Add(). Returns false if wd isn't such a watch.
+func (w *inotify) linkEvents(wd int, mask uint32, now time.Time) ([]Event, []withOpts, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	names, ok := w.links[wd]
+	if !ok {
+		return nil, nil, false
+	}
+	if mask&unix.IN_IGNORED == unix.IN_IGNORED {
+		delete(w.links, wd)
+		return nil, nil, true
+	}
+	// Removes, renames, and anything else are sent by the directory.
+	if mask&(unix.IN_MODIFY|unix.IN_CLOSE_WRITE|unix.IN_ATTRIB) == 0 {
+		return nil, nil, true
+	}
+
+	var (
+		events = make([]Event, 0, len(names))
+		opts   = make([]withOpts, 0, len(names))
+	)
+	for _, name := range names {
+		watch, ok := w.watches[filepath.Dir(name)]
+		if !ok {
+			continue
+		}
+		with, ok := watch.files[filepath.Base(name)]
+		if !ok {
+			continue
+		}
+		// Removing a link changes the link count, which is sent for all the
+		// other links too; the directory sends a Remove for the removed link.
+		if mask&(unix.IN_MODIFY|unix.IN_CLOSE_WRITE) == 0 {
+			if _, err := os.Lstat(name); err != nil {
+				continue
+			}
+		}
+		event := w.newEvent(name, mask)
+		event.Time = now
+		event.Op &= with.ops &^ wrongWrite(mask, with.closeWrite)
+		if event.Op != 0 {
+			events, opts = append(events, event), append(opts, with)
+		}
+	}
+	return events, opts, true
+}
+
+// keepFiles keeps the watch for a directory that is no longer watched, if
+// there are still files in it that were added with Add().
 //
-// All files in a directory are monitored, including new files that are created
-// after the watcher is started. Subdirectories are not watched (i.e. it's
-// non-recursive).
+// Unlocked!
+func (w *inotify) keepFiles(name string, watch *watch) (bool, error) {
+	if len(watch.files) == 0 {
+		return false, nil
+	}
+	flags := unix.IN_MOVE_SELF | unix.IN_DELETE_SELF | w.fileFlags(watch.files)
+	if w.auto.holds(name) {
+		flags |= w.toFlags(parentOps, false)
+	}
+	if wd, errno := unix.InotifyAddWatch(w.fd, name, flags); wd == -1 {
+		return true, errno
+	}
+	watch.flags, watch.with = flags, defaultOpts
+	watch.recurse, watch.internal, watch.parent = false, true, true
+	return true, nil
+}
+
+// addTargets watches the targets of all symlinks in the directory name, for
+// WithResolveTargets().
 //
-// # Watching files
+// Unlocked!
+func (w *inotify) addTargets(name string, with withOpts) {
+	entries, err := os.ReadDir(name)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		if e.Type()&os.ModeSymlink != 0 {
+			w.addTarget(filepath.Join(name, e.Name()), with)
+		}
+	}
+}
+
+// addTarget watches the file that the symlink link points to. Returns false if
+// it's not a symlink to a file (including symlinks that loop), or can't be
+// watched.
 //
-// Watching individual files (rather than directories) is generally not
-// recommended as many tools update files atomically. Instead of "just" writing
-// to the file a temporary file will be written to first, and if successful the
-// temporary file is moved to to destination removing the original, or some
-// variant thereof. The watcher on the original file is now lost, as it no
-// longer exists.
+// Unlocked!
+func (w *inotify) addTarget(link string, with withOpts) bool {
+	if w.pipe.match(link) {
+		return false
+	}
+	if fi, err := os.Lstat(link); err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		return false
+	}
+	fi, err := os.Stat(link)
+	if err != nil || !fi.Mode().IsRegular() {
+		return false
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return false
+	}
+
+	// inotify_add_watch() follows the symlink (and any symlinks the target is,
+	// up to a limit); another symlink to the same file gets the same watch
+	// descriptor.
+	flags := unix.IN_MODIFY | unix.IN_CLOSE_WRITE | unix.IN_ATTRIB | unix.IN_DELETE_SELF | unix.IN_MOVE_SELF
+	wd, _ := unix.InotifyAddWatch(w.fd, link, uint32(flags)|unix.IN_MASK_ADD)
+	if wd == -1 {
+		return false
+	}
+	// Already watched directly, e.g. a symlink to a file added with Add().
+	if _, ok := w.paths[wd]; ok {
+		return false
+	}
+	t, ok := w.targets[wd]
+	if !ok {
+		t = &target{dev: uint64(st.Dev), ino: uint64(st.Ino)}
+		w.targets[wd] = t
+	}
+	for _, l := range t.links {
+		if l == link {
+			return true
+		}
+	}
+	t.links = append(t.links, link)
+	return true
+}
+
+// pointsTo reports if the symlink link still points to the target t.
+func (t *target) pointsTo(link string) bool {
+	fi, err := os.Stat(link)
+	if err != nil {
+		return false
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	return ok && uint64(st.Dev) == t.dev && uint64(st.Ino) == t.ino
+}
+
+// removeTarget stops watching the target of the symlink link, once no other
+// symlinks to it are watched.
 //
-// Instead, watch the parent directory and use Event.Name to filter out files
-// you're not interested in. There is an example of this in [cmd/fsnotify/file.go].
-func (w *Watcher) Add(name string) error {
-	name = filepath.Clean(name)
-	if w.isClosed() {
-		return ErrClosed
+// Unlocked!
+func (w *inotify) removeTarget(link string) {
+	for wd, t := range w.targets {
+		for i, l := range t.links {
+			if l != link {
+				continue
+			}
+			t.links = append(t.links[:i], t.links[i+1:]...)
+			if len(t.links) > 0 {
+				return
+			}
+			delete(w.targets, wd)
+			// Also used for a file with hard links.
+			if _, ok := w.links[wd]; !ok {
+				_, _ = unix.InotifyRmWatch(w.fd, uint32(wd))
+			}
+			return
+		}
 	}
+}
 
-	var flags uint32 = unix.IN_MOVED_TO | unix.IN_MOVED_FROM |
-		unix.IN_CREATE | unix.IN_ATTRIB | unix.IN_MODIFY |
-		unix.IN_MOVE_SELF | unix.IN_DELETE | unix.IN_DELETE_SELF
+// removeTargets stops watching the targets of all symlinks in the directory
+// name.
+//
+// Unlocked!
+func (w *inotify) removeTargets(name string) {
+	var remove []string
+	for _, t := range w.targets {
+		for _, l := range t.links {
+			if filepath.Dir(l) == name {
+				remove = append(remove, l)
+			}
+		}
+	}
+	for _, l := range remove {
+		w.removeTarget(l)
+	}
+}
 
+// targetEvents gets the events for a watch on the target of symlinks, for
+// every symlink to it. Returns false if wd isn't such a watch.
+//
+// If the target is removed or renamed the symlinks are watched again, as they
+// may point to a new file now (that's how most editors save files); a Write is
+// sent for the symlinks that do.
+func (w *inotify) targetEvents(wd int, mask uint32, now time.Time) ([]Event, []withOpts, bool) {
 	w.mu.Lock()
 	defer w.mu.Unlock()
-	watchEntry := w.watches[name]
-	if watchEntry != nil {
-		flags |= watchEntry.flags | unix.IN_MASK_ADD
+
+	t, ok := w.targets[wd]
+	if !ok {
+		return nil, nil, false
 	}
-	wd, errno := unix.InotifyAddWatch(w.fd, name, flags)
-	if wd == -1 {
-		return errno
+	if mask&unix.IN_IGNORED == unix.IN_IGNORED {
+		delete(w.targets, wd)
+		return nil, nil, true
+	}
+
+	var (
+		events = make([]Event, 0, len(t.links))
+		opts   = make([]withOpts, 0, len(t.links))
+		gone   = mask&(unix.IN_DELETE_SELF|unix.IN_MOVE_SELF) != 0
+	)
+	if gone {
+		delete(w.targets, wd)
+		if _, ok := w.links[wd]; !ok {
+			_, _ = unix.InotifyRmWatch(w.fd, uint32(wd))
+		}
+	}
+	for _, link := range t.links {
+		watch, ok := w.watches[filepath.Dir(link)]
+		if !ok || !watch.with.targets {
+			continue
+		}
+		with := watch.with
+
+		var event Event
+		switch {
+		case gone:
+			if !w.addTarget(link, with) {
+				continue
+			}
+			event = Event{Name: link, Op: Write}
+		// The link count also changes if the target is removed or replaced;
+		// don't send a Chmod for symlinks that no longer point to it.
+		case mask&(unix.IN_MODIFY|unix.IN_CLOSE_WRITE) == 0 && !t.pointsTo(link):
+			continue
+		default:
+			event = w.newEvent(link, mask)
+			event.Op &^= wrongWrite(mask, with.closeWrite)
+		}
+		event.Time = now
+		event.Op &= with.ops
+		if event.Op != 0 {
+			events, opts = append(events, event), append(opts, with)
+		}
 	}
+	return events, opts, true
+}
 
-	if watchEntry == nil {
-		w.watches[name] = &watch{wd: uint32(wd), flags: flags}
-		w.paths[wd] = name
-	} else {
-		watchEntry.wd = uint32(wd)
-		watchEntry.flags = flags
+// writeFlag gets the inotify flag that's sent as a Write: IN_MODIFY, or
+// IN_CLOSE_WRITE with WithCloseWriteOnly().
+func writeFlag(with withOpts) uint32 {
+	if with.closeWrite {
+		return unix.IN_CLOSE_WRITE
 	}
+	return unix.IN_MODIFY
+}
 
-	return nil
+// wrongWrite gets Write if mask is the flag that shouldn't be sent as a Write
+// for this watch. The same inotify watch gets both IN_MODIFY and IN_CLOSE_WRITE
+// if a directory and a file in it were added with and without
+// WithCloseWriteOnly().
+func wrongWrite(mask uint32, closeWrite bool) Op {
+	if (closeWrite && mask&unix.IN_MODIFY != 0) || (!closeWrite && mask&unix.IN_CLOSE_WRITE != 0) {
+		return Write
+	}
+	return 0
 }
 
-// Remove stops monitoring the path for changes.
+// toFlags gets the inotify flags to only receive the events for ops from the
+// kernel.
 //
-// Directories are always removed non-recursively. For example, if you added
-// /tmp/dir and /tmp/dir/subdir then you will need to remove both.
-//
-// Removing a path that has not yet been added returns [ErrNonExistentWatch].
-func (w *Watcher) Remove(name string) error {
+// IN_DELETE_SELF and IN_MOVE_SELF are always needed to keep track of the
+// watches, and recursive watches need IN_CREATE and IN_MOVED_TO to watch new
+// directories. Anything that wasn't asked for is dropped in readEvents().
+func (w *inotify) toFlags(ops Op, recurse bool) uint32 {
+	var flags uint32 = unix.IN_MOVE_SELF | unix.IN_DELETE_SELF
+	if ops.Has(Create) || recurse {
+		flags |= unix.IN_CREATE | unix.IN_MOVED_TO
+	}
+	if ops.Has(Create) || ops.Has(Rename) {
+		// Also needed for Create to set Event.RenamedFrom.
+		flags |= unix.IN_MOVED_FROM
+	}
+	if ops.Has(Write) {
+		flags |= unix.IN_MODIFY
+	}
+	if ops.Has(Remove) {
+		flags |= unix.IN_DELETE
+	}
+	if ops.Has(Chmod) {
+		flags |= unix.IN_ATTRIB
+	}
+	return flags
+}
+
+func (w *inotify) Remove(name string) error {
 	if w.isClosed() {
-		return nil
+		return ErrClosed
 	}
 
-	name = filepath.Clean(name)
+	name, recurse := recursivePath(filepath.Clean(name))
+	if w.auto.stop(name) {
+		return nil
+	}
+	if w.auto.owns(name) {
+		return fmt.Errorf("%w: %s", ErrNonExistentWatch, name)
+	}
+	defer w.auto.rehold(name, recurse)
 
 	// Fetch the watch.
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
+	if dir, ok := w.watches[filepath.Dir(name)]; ok && !recurse {
+		if _, ok := dir.files[filepath.Base(name)]; ok {
+			return w.removeFile(filepath.Dir(name), filepath.Base(name), dir)
+		}
+	}
+
 	watch, ok := w.watches[name]
-	if !ok {
+	if !ok || watch.internal || (recurse && !watch.recurse) {
 		return fmt.Errorf("%w: %s", ErrNonExistentWatch, name)
 	}
 
+	if watch.recurse {
+		// Still needed for a recursive watch on one of the parents; just make
+		// it internal again.
+		if w.hasRecursiveParent(name) {
+			watch.internal = true
+			return nil
+		}
+		w.removeSubdirs(name)
+	}
+	if ok, err := w.keepFiles(name, watch); ok {
+		return err
+	}
 	return w.remove(name, watch)
 }
 
+// hasRecursiveParent reports if any of the parent directories of name was
+// added recursively by the user.
+//
+// Unlocked!
+func (w *inotify) hasRecursiveParent(name string) bool {
+	for path, watch := range w.watches {
+		if !watch.internal && watch.recurse && strings.HasPrefix(name, path+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
 // Unlocked!
-func (w *Watcher) remove(name string, watch *watch) error {
+func (w *inotify) remove(name string, watch *watch) error {
 	delete(w.paths, int(watch.wd))
 	delete(w.watches, name)
+	w.removeTargets(name)
 
 	success, errno := unix.InotifyRmWatch(w.fd, watch.wd)
 	if success == -1 {
@@ -322,42 +947,157 @@ func (w *Watcher) remove(name string, watch *watch) error {
 	return nil
 }
 
-// WatchList returns all paths added with [Add] (and are not yet removed).
-//
-// Returns nil if [Watcher.Close] was called.
-func (w *Watcher) WatchList() []string {
+func (w *inotify) WatchList() []string {
 	if w.isClosed() {
-		return nil
+		return []string{}
 	}
 
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
 	entries := make([]string, 0, len(w.watches))
-	for pathname := range w.watches {
-		entries = append(entries, pathname)
+	for pathname, watch := range w.watches {
+		switch {
+		case watch.internal:
+		case watch.recurse:
+			entries = append(entries, filepath.Join(pathname, "..."))
+		default:
+			entries = append(entries, pathname)
+		}
+		for name := range watch.files {
+			entries = append(entries, filepath.Join(pathname, name))
+		}
+	}
+
+	return w.auto.hide(entries)
+}
+
+func (w *inotify) IsWatched(name string) bool {
+	if w.isClosed() {
+		return false
+	}
+
+	name, recurse := recursivePath(filepath.Clean(name))
+	if w.auto.owns(name) {
+		return false
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if dir, ok := w.watches[filepath.Dir(name)]; ok && !recurse {
+		if _, ok := dir.files[filepath.Base(name)]; ok {
+			return true
+		}
+	}
+	watch, ok := w.watches[name]
+	return ok && !watch.internal && (!recurse || watch.recurse)
+}
+
+func (w *inotify) Sync(ctx context.Context) error {
+	return w.reads.sync(ctx, w.doneResp, func() bool {
+		w.mu.Lock()
+		fds := []unix.PollFd{{Fd: int32(w.fd), Events: unix.POLLIN}}
+		w.mu.Unlock()
+		n, err := unix.Poll(fds, 0)
+		return n > 0 || err == unix.EINTR
+	})
+}
+
+func (w *inotify) Heartbeat(d time.Duration) <-chan time.Time {
+	return w.reads.heartbeat(d, w.doneResp)
+}
+
+func (w *inotify) rescan(events []Event) {
+	w.scans.send(events, w.pipe, w.Events, w.abort, &w.stats)
+}
+
+// DryRunAdd counts the directories that aren't watched yet; files are watched
+// through their parent directory.
+func (w *inotify) DryRunAdd(name string, opts ...addOpt) (int, error) {
+	with, err := getOptions(opts...)
+	if err != nil {
+		return 0, err
+	}
+	dirs, err := dryRunDirs(filepath.Clean(name), with, w.pipe)
+	for i, d := range dirs {
+		if fi, err := os.Lstat(d); err == nil && !fi.IsDir() && fi.Mode()&os.ModeSymlink == 0 {
+			dirs[i] = filepath.Dir(d)
+		}
+	}
+
+	w.mu.Lock()
+	n, used := 0, len(w.watches)
+	for _, d := range dirs {
+		if _, ok := w.watches[d]; !ok {
+			n++
+		}
+	}
+	w.mu.Unlock()
+	if err != nil {
+		return n, err
+	}
+
+	if max, ok := maxUserWatches(); ok && n > max-used {
+		return n, fmt.Errorf("%w: %s: needs %d watches, and only %d are left",
+			ErrWatchLimitReached, name, n, max-used)
+	}
+	return n, nil
+}
+
+// maxUserWatches reads the fs.inotify.max_user_watches sysctl.
+func maxUserWatches() (int, bool) {
+	b, err := os.ReadFile("/proc/sys/fs/inotify/max_user_watches")
+	if err != nil {
+		return 0, false
 	}
+	n, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	return n, err == nil
+}
 
-	return entries
+func (w *inotify) Fd() (uintptr, bool) {
+	if w.isClosed() {
+		return 0, false
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return uintptr(w.fd), true
 }
 
+func (w *inotify) SupportsRecursion() bool { return true }
+
 type watch struct {
-	wd    uint32 // Watch descriptor (as returned by the inotify_add_watch() syscall)
-	flags uint32 // inotify flags of this watch (see inotify(7) for the list of valid flags)
+	wd       uint32   // Watch descriptor (as returned by the inotify_add_watch() syscall)
+	flags    uint32   // inotify flags of this watch (see inotify(7) for the list of valid flags)
+	with     withOpts // Options from AddWith(); the same as the root of a recursive watch for subdirectories.
+	recurse  bool     // Watch new subdirectories (Add("dir/...")).
+	internal bool     // Subdirectory of a recursive watch, rather than added by the user.
+	moved    bool     // Moved to a path we know about; ignore the next IN_MOVE_SELF.
+
+	// Files in this directory added with Add() (key: name), which are watched
+	// through the directory. If parent is set the directory itself isn't
+	// watched, and it's only used for the files.
+	files  map[string]withOpts
+	parent bool
 }
 
 // readEvents reads from the inotify file descriptor, converts the
 // received events into Event objects and sends them via the Events channel
-func (w *Watcher) readEvents() {
+func (w *inotify) readEvents() {
 	defer func() {
-		close(w.doneResp)
+		w.auto.close()
+		w.scans.close()
+		w.pipe.closeHeld()
 		close(w.Errors)
 		close(w.Events)
+		close(w.doneResp)
 	}()
 
 	var (
-		buf   [unix.SizeofInotifyEvent * 4096]byte // Buffer for a maximum of 4096 raw events
-		errno error                                // Syscall errno
+		// Buffer for a maximum of 4096 raw events without a name; this always
+		// fits at least one event with the longest possible name
+		// (unix.SizeofInotifyEvent + unix.NAME_MAX + 1).
+		buf   [unix.SizeofInotifyEvent * 4096]byte
+		carry int   // Bytes of an incomplete event at the start of buf
+		errno error // Syscall errno
 	)
 	for {
 		// See if we have been closed.
@@ -365,10 +1105,40 @@ func (w *Watcher) readEvents() {
 			return
 		}
 
-		n, err := w.inotifyFile.Read(buf[:])
+		w.reads.idle()
+		w.mu.Lock()
+		file := w.inotifyFile
+		w.mu.Unlock()
+		n, err := file.Read(buf[carry:])
+		w.reads.start()
+		now := time.Now()
 		switch {
 		case errors.Unwrap(err) == os.ErrClosed:
-			return
+			if w.isClosed() {
+				return
+			}
+			// Replaced by reset(); read from the new fd.
+			select {
+			case <-w.resetC:
+			default:
+			}
+			carry = 0
+			continue
+		case errors.Is(err, io.EOF), errors.Is(err, unix.EBADF), errors.Is(err, unix.EINVAL):
+			// The fd was closed, or replaced with something that isn't an
+			// inotify instance; reading it again won't work. Wait for
+			// Watcher.Reset() or Close().
+			if w.isClosed() || !w.sendError(&DiedError{Err: err}) {
+				return
+			}
+			w.reads.idle()
+			select {
+			case <-w.done:
+				return
+			case <-w.resetC:
+				carry = 0
+				continue
+			}
 		case err != nil:
 			if !w.sendError(err) {
 				return
@@ -376,37 +1146,40 @@ func (w *Watcher) readEvents() {
 			continue
 		}
 
-		if n < unix.SizeofInotifyEvent {
+		if n <= 0 {
 			var err error
 			if n == 0 {
 				// If EOF is received. This should really never happen.
 				err = io.EOF
-			} else if n < 0 {
+			} else {
 				// If an error occurred while reading.
 				err = errno
-			} else {
-				// Read was too short.
-				err = errors.New("notify: short read in readEvents()")
 			}
 			if !w.sendError(err) {
 				return
 			}
 			continue
 		}
+		n += carry
 
 		var offset uint32
 		// We don't know how many events we just read into the buffer
 		// While the offset points to at least one whole event...
-		for offset <= uint32(n-unix.SizeofInotifyEvent) {
+		for n-int(offset) >= unix.SizeofInotifyEvent {
 			var (
 				// Point "raw" to the event in the buffer
 				raw     = (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
 				mask    = uint32(raw.Mask)
 				nameLen = uint32(raw.Len)
 			)
+			// The kernel only returns whole events, but don't rely on it: the
+			// rest of the name is read with the next read.
+			if n-int(offset) < unix.SizeofInotifyEvent+int(nameLen) {
+				break
+			}
 
 			if mask&unix.IN_Q_OVERFLOW != 0 {
-				if !w.sendError(ErrEventOverflow) {
+				if !w.sendError(&OverflowError{Dropped: -1}) {
 					return
 				}
 			}
@@ -415,59 +1188,482 @@ func (w *Watcher) readEvents() {
 			// doesn't append the filename to the event, but we would like to always fill the
 			// the "Name" field with a valid filename. We retrieve the path of the watch from
 			// the "paths" map.
+			var child string
+			if nameLen > 0 {
+				// Point "bytes" at the first byte of the filename
+				bytes := (*[unix.PathMax]byte)(unsafe.Pointer(&buf[offset+unix.SizeofInotifyEvent]))[:nameLen:nameLen]
+				// The filename is padded with NULL bytes. TrimRight() gets rid of those.
+				child = strings.TrimRight(string(bytes[0:nameLen]), "\000")
+			}
+
+			// Writes and chmods for files with hard links, from the watch on
+			// the file itself, and for the targets of symlinks. Both can use
+			// the same watch.
+			rawEvent := RawInotifyEvent{Wd: raw.Wd, Mask: raw.Mask, Cookie: raw.Cookie, Name: child}
+			events, opts, isLink := w.linkEvents(int(raw.Wd), mask, now)
+			targetEvents, targetOpts, isTarget := w.targetEvents(int(raw.Wd), mask, now)
+			if isLink || isTarget {
+				events, opts = append(events, targetEvents...), append(opts, targetOpts...)
+				for i, event := range events {
+					if opts[i].raw {
+						event.Raw = rawEvent
+					}
+					if !w.sendEvent(event) {
+						return
+					}
+				}
+				offset += unix.SizeofInotifyEvent + nameLen
+				continue
+			}
+
 			w.mu.Lock()
 			name, ok := w.paths[int(raw.Wd)]
+			var (
+				recurse, internal, moved, parent, isFile, waitOnly bool
+				with                                               = defaultOpts
+				fileWith                                           withOpts
+			)
+			if ok {
+				watch := w.watches[name]
+				recurse, internal, with, parent = watch.recurse, watch.internal, watch.with, watch.parent
+				waitOnly = watch.with.internal
+				fileWith, isFile = watch.files[child]
+			}
+			// Sent by the watch on the file itself.
+			if isFile && mask&(unix.IN_MODIFY|unix.IN_ATTRIB) != 0 && w.isLink(filepath.Join(name, child)) {
+				isFile = false
+			}
+			// Keep watching files added with WithTrackInode() that are renamed
+			// in the same directory, under the new name.
+			var trackedTo string
+			if isFile && fileWith.trackInode && mask&unix.IN_MOVED_FROM == unix.IN_MOVED_FROM {
+				old := filepath.Join(name, child)
+				if trackedTo = findSameFile(name, old, w.tracked[old]); trackedTo != "" {
+					w.moveFile(name, child, filepath.Base(trackedTo), w.watches[name])
+					w.trackCookie = raw.Cookie
+				}
+			}
+			trackedMove := mask&unix.IN_MOVED_TO == unix.IN_MOVED_TO && raw.Cookie != 0 && raw.Cookie == w.trackCookie
+			if trackedMove {
+				w.trackCookie = 0
+			}
+			// Stop watching files added with Add() once they're removed,
+			// renamed, or replaced by another file. With atomic save detection
+			// the new file is watched instead.
+			gone := isFile && mask&(unix.IN_DELETE|unix.IN_MOVED_FROM|unix.IN_MOVED_TO) != 0 &&
+				!(mask&unix.IN_MOVED_TO == unix.IN_MOVED_TO && fileWith.atomicSave) && trackedTo == "" && !trackedMove
+			if gone {
+				w.removeFile(name, child, w.watches[name])
+			}
 			// inotify will automatically remove the watch on deletes; just need
-			// to clean our state here.
-			if ok && mask&unix.IN_DELETE_SELF == unix.IN_DELETE_SELF {
+			// to clean our state here. IN_UNMOUNT is the same, except that
+			// nothing is sent for the files and directories in it.
+			var orphans []orphan
+			if ok && mask&(unix.IN_DELETE_SELF|unix.IN_UNMOUNT) != 0 {
+				orphans = w.orphans(name)
 				delete(w.paths, int(raw.Wd))
 				delete(w.watches, name)
+				w.removeTargets(name)
 			}
 			// We can't really update the state when a watched path is moved;
 			// only IN_MOVE_SELF is sent and not IN_MOVED_{FROM,TO}. So remove
 			// the watch.
+			//
+			// Directories that were moved to another watched directory were
+			// already updated when the parent's IN_MOVED_TO was processed.
 			if ok && mask&unix.IN_MOVE_SELF == unix.IN_MOVE_SELF {
-				err := w.remove(name, w.watches[name])
-				if err != nil {
-					if !w.sendError(err) {
-						return
+				if watch := w.watches[name]; watch.moved {
+					watch.moved, moved = false, true
+				} else {
+					orphans = w.orphans(name)
+					if watch.recurse {
+						w.removeSubdirs(name)
 					}
+					err := w.remove(name, watch)
+					if err != nil {
+						if !w.sendError(&WatchError{Path: name, Op: "remove", Err: err}) {
+							return
+						}
+					}
+				}
+			}
+			// Directory in a watched directory that was removed or renamed;
+			// if it's watched itself this was already done when its watch got
+			// the IN_DELETE_SELF or IN_MOVE_SELF, or is done once it does.
+			if ok && nameLen > 0 && mask&unix.IN_ISDIR == unix.IN_ISDIR && mask&(unix.IN_DELETE|unix.IN_MOVED_FROM) != 0 {
+				if _, watched := w.watches[filepath.Join(name, child)]; !watched {
+					orphans = w.orphans(filepath.Join(name, child))
+				}
+			}
+			// Symlink that was removed, or created or replaced with another
+			// one.
+			if ok && nameLen > 0 && with.targets && mask&unix.IN_ISDIR == 0 &&
+				mask&(unix.IN_CREATE|unix.IN_DELETE|unix.IN_MOVED_FROM|unix.IN_MOVED_TO) != 0 {
+				link := filepath.Join(name, child)
+				w.removeTarget(link)
+				if mask&(unix.IN_CREATE|unix.IN_MOVED_TO) != 0 {
+					w.addTarget(link, with)
 				}
 			}
 			w.mu.Unlock()
 
 			if nameLen > 0 {
-				// Point "bytes" at the first byte of the filename
-				bytes := (*[unix.PathMax]byte)(unsafe.Pointer(&buf[offset+unix.SizeofInotifyEvent]))[:nameLen:nameLen]
-				// The filename is padded with NULL bytes. TrimRight() gets rid of those.
-				name += "/" + strings.TrimRight(string(bytes[0:nameLen]), "\000")
+				name += "/" + child
 			}
 
 			event := w.newEvent(name, mask)
+			event.Time = now
+			if nameLen == 0 && ok {
+				event.isDir = true // Files are watched through the directory they're in.
+			}
+
+			if mask&unix.IN_MOVED_FROM == unix.IN_MOVED_FROM {
+				w.cookies[w.cookieIndex] = moveCookie{cookie: raw.Cookie, path: event.Name}
+				w.cookieIndex = (w.cookieIndex + 1) % len(w.cookies)
+			}
+			if mask&unix.IN_MOVED_TO == unix.IN_MOVED_TO {
+				for _, c := range w.cookies {
+					if c.cookie == raw.Cookie && c.path != "" {
+						event.RenamedFrom = c.path
+						break
+					}
+				}
+			}
+
+			// A watched directory was moved to a directory we're watching:
+			// keep watching it under the new name. Subdirectories of a
+			// recursive watch are only kept if they're still inside a
+			// recursive watch.
+			if event.RenamedFrom != "" && mask&unix.IN_ISDIR == unix.IN_ISDIR {
+				w.mu.Lock()
+				if watch, ok := w.watches[event.RenamedFrom]; ok && (recurse || !watch.internal) && !watch.with.internal {
+					w.moveWatch(event.RenamedFrom, event.Name)
+				}
+				w.mu.Unlock()
+			}
+
+			// Watch new directories inside a recursive watch, and any
+			// directories that may already have been created inside it (e.g.
+			// "mkdir -p a/b/c").
+			var scanned []Event
+			if recurse && (mask&unix.IN_CREATE == unix.IN_CREATE || mask&unix.IN_MOVED_TO == unix.IN_MOVED_TO) &&
+				(mask&unix.IN_ISDIR == unix.IN_ISDIR || (with.follow && isDirLink(event.Name))) {
+				var err error
+				scanned, err = w.addRecursive(event.Name, with, mask&unix.IN_CREATE == unix.IN_CREATE)
+				if err != nil {
+					if !w.sendError(err) {
+						return
+					}
+				}
+			}
+
+			// Files added with Add() get a Remove when they're gone, rather
+			// than the events for the directory. If the directory is also
+			// watched its events are sent as usual, with the operations for
+			// both.
+			switch {
+			case isFile && (parent || waitOnly):
+				switch {
+				case gone:
+					event.Op = Remove
+				case mask&unix.IN_MOVED_TO == unix.IN_MOVED_TO:
+					event.Op = Write // Replaced with WithAtomicSaveDetection().
+				}
+				event.RenamedFrom, event.Moved, with = "", false, fileWith
+				if trackedTo != "" {
+					event.Name, event.Op, event.RenamedFrom = trackedTo, Rename, event.Name
+				}
+			case isFile:
+				with.ops |= fileWith.ops
+				with.closeWrite = with.closeWrite && fileWith.closeWrite
+				with.raw = with.raw || fileWith.raw
+			}
+			if with.raw {
+				event.Raw = rawEvent
+			}
+
+			// The parent directory already sends a Remove or Rename for
+			// directories inside a recursive watch and for directories that
+			// were moved to a watched directory; don't send it twice.
+			//
+			// Directories that are only watched for the files in them (or for
+			// the rewatcher) don't send anything for other paths, and neither
+			// do watches that were already removed.
+			dupe := (internal && mask&(unix.IN_DELETE_SELF|unix.IN_MOVE_SELF) != 0) || moved ||
+				((parent || waitOnly) && (!isFile || trackedMove)) || !ok
+			if ok {
+				w.auto.notify(event.Name)
+			}
+
+			// Drop operations that weren't asked for with WithOps().
+			filtered := event.Op != 0 && event.Op&(with.ops&^wrongWrite(mask, with.closeWrite)) == 0
+			event.Op &= with.ops &^ wrongWrite(mask, with.closeWrite)
 
 			// Send the events that are not ignored on the events channel
-			if mask&unix.IN_IGNORED == 0 {
+			if mask&unix.IN_IGNORED == 0 && !dupe && !filtered {
 				if !w.sendEvent(event) {
 					return
 				}
 			}
 
+			// Only once for every watch that was added, not for all the
+			// subdirectories of a recursive watch.
+			if ok && !internal && !waitOnly && mask&unix.IN_UNMOUNT == unix.IN_UNMOUNT {
+				if !w.sendError(&WatchError{Path: name, Op: "read", Err: ErrUnmounted}) {
+					return
+				}
+			}
+
+			for _, e := range scanned {
+				if !w.sendEvent(e) {
+					return
+				}
+			}
+
+			if gone && fileWith.autoRewatch {
+				w.auto.start(event.Name, fileWith, &w.stats, w.sendEvent, w.sendError)
+			}
+			if !sendOrphans(orphans, now, &w.auto, &w.stats, w.sendEvent, w.sendError) {
+				return
+			}
+
+			// A file in a watched directory was renamed to this path, which
+			// is how most editors save files. There's no way to tell if the
+			// path already existed, so this is sent for every rename inside
+			// the watched directories.
+			if with.atomicSave && event.RenamedFrom != "" && mask&unix.IN_ISDIR == 0 && with.ops.Has(Write) {
+				if !w.sendEvent(Event{Name: event.Name, Op: Write, Time: now}) {
+					return
+				}
+			}
+
 			// Move to the next event in the buffer
 			offset += unix.SizeofInotifyEvent + nameLen
 		}
+
+		// Keep a short read at the end for the next read.
+		carry = copy(buf[:], buf[offset:n])
+	}
+}
+
+// isDirLink reports if path is a symlink to a directory.
+func isDirLink(path string) bool {
+	fi, err := os.Lstat(path)
+	if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		return false
+	}
+	fi, err = os.Stat(path)
+	return err == nil && fi.IsDir()
+}
+
+// addRecursive watches a directory that was created inside a recursive watch,
+// including all directories below it. The new watches use the same options as
+// the parent.
+//
+// If scan is set it returns a Create for everything that's already in the new
+// directories, as nothing is sent for paths that were created before the watch
+// was added; this isn't done for directories that were moved in, to be
+// consistent with non-recursive watches.
+func (w *inotify) addRecursive(name string, with withOpts, scan bool) ([]Event, error) {
+	if w.pipe.match(name) {
+		return nil, nil
+	}
+
+	maxDepth := with.maxDepth
+	if maxDepth >= 0 {
+		w.mu.Lock()
+		maxDepth -= w.depth(filepath.Dir(name)) + 1
+		w.mu.Unlock()
+		if maxDepth < 0 {
+			return nil, nil
+		}
+	}
+
+	skipped := newSkippedError(with)
+	dirs, err := findDirs(name, w.pipe, with.follow, maxDepth, skipped)
+	if err != nil {
+		// Already removed again; nothing to watch.
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		err = &WatchError{Path: name, Op: "add", Err: err}
+		if skipped.skip(err) {
+			return nil, skipped
+		}
+		return nil, err
+	}
+	with.noFollow = false // Only applies to the root of the watch.
+	for _, dir := range dirs {
+		err := w.add(dir, with, true, true)
+		if err != nil && !errors.Is(err, unix.ENOENT) {
+			err = &WatchError{Path: dir, Op: "add", Err: err}
+			if skipped.skip(err) {
+				continue
+			}
+			return nil, err
+		}
+	}
+
+	// Only the directory that was moved gets an IN_MOVE_SELF; not the
+	// directories below it.
+	w.mu.Lock()
+	for _, dir := range dirs[1:] {
+		if watch, ok := w.watches[dir]; ok {
+			watch.moved = false
+		}
+	}
+	w.mu.Unlock()
+
+	if !scan || !with.ops.Has(Create) {
+		return nil, skipped.err()
+	}
+	var (
+		now    = time.Now()
+		events []Event
+	)
+	for _, dir := range dirs {
+		ls, _ := os.ReadDir(dir)
+		for _, d := range ls {
+			events = append(events, Event{Name: filepath.Join(dir, d.Name()), Op: Create, Time: now, isDir: d.IsDir(), scanned: true})
+		}
+	}
+	return events, skipped.err()
+}
+
+// depth gets the number of levels the watched directory name is below the root
+// of the recursive watch it's part of.
+//
+// Unlocked!
+func (w *inotify) depth(name string) int {
+	for d := 0; ; d++ {
+		watch, ok := w.watches[name]
+		if !ok || !watch.internal {
+			return d
+		}
+		name = filepath.Dir(name)
+	}
+}
+
+// moveWatch updates the path of the watch for a directory that was renamed
+// from old to name, and the paths of all watches below it.
+//
+// Unlocked!
+func (w *inotify) moveWatch(old, name string) {
+	prefix := old + string(filepath.Separator)
+	var move []string
+	for path := range w.watches {
+		if path == old || strings.HasPrefix(path, prefix) {
+			move = append(move, path)
+		}
+	}
+
+	for _, path := range move {
+		watch, newPath := w.watches[path], name+strings.TrimPrefix(path, old)
+		// Directory that was overwritten by the rename; its IN_DELETE_SELF
+		// shouldn't remove the moved watch.
+		if over, ok := w.watches[newPath]; ok {
+			delete(w.paths, int(over.wd))
+		}
+		delete(w.watches, path)
+		w.watches[newPath] = watch
+		w.paths[int(watch.wd)] = newPath
+	}
+	// Only the directory that was moved gets an IN_MOVE_SELF; not the
+	// directories below it.
+	w.watches[name].moved = true
+	w.rewatch()
+}
+
+// removeSubdirs removes the watches for all directories below name that were
+// added as part of a recursive watch.
+//
+// Unlocked!
+func (w *inotify) removeSubdirs(name string) {
+	prefix := name + string(filepath.Separator)
+
+	// Directories below another recursive watch inside name still belong to
+	// that watch.
+	var keep []string
+	for path, watch := range w.watches {
+		if !watch.internal && watch.recurse && strings.HasPrefix(path, prefix) {
+			keep = append(keep, path+string(filepath.Separator))
+		}
+	}
+
+outer:
+	for path, watch := range w.watches {
+		if watch.internal && strings.HasPrefix(path, prefix) {
+			for _, k := range keep {
+				if strings.HasPrefix(path, k) {
+					continue outer
+				}
+			}
+			// Not much sense in reporting errors for paths the user didn't
+			// explicitly add.
+			if ok, _ := w.keepFiles(path, watch); !ok {
+				w.remove(path, watch)
+			}
+		}
+	}
+}
+
+// orphans stops watching the paths below the directory name that were added
+// with Add(), as they're gone once it's removed or renamed: files in name or
+// any directory below it, and the directories below it. The kernel doesn't
+// send anything for these if only an ancestor is renamed.
+//
+// The watch for name itself is left to the caller.
+//
+// Unlocked!
+func (w *inotify) orphans(name string) []orphan {
+	var (
+		prefix = name + string(filepath.Separator)
+		found  []orphan
+		remove []string
+	)
+	for path, watch := range w.watches {
+		if path != name && !strings.HasPrefix(path, prefix) {
+			continue
+		}
+		for base, with := range watch.files {
+			found = append(found, orphan{name: filepath.Join(path, base), with: with})
+			w.removeLink(filepath.Join(path, base))
+		}
+		watch.files = nil
+		if path != name && (!watch.internal || watch.parent) {
+			remove = append(remove, path)
+		}
+	}
+
+	for _, path := range remove {
+		watch, ok := w.watches[path]
+		if !ok {
+			continue
+		}
+		if !watch.internal {
+			found = append(found, orphan{name: path, isDir: true, with: watch.with})
+			if watch.recurse {
+				w.removeSubdirs(path)
+			}
+		}
+		// Fails if the kernel already removed it, which is fine.
+		_ = w.remove(path, watch)
 	}
+	return found
 }
 
 // newEvent returns an platform-independent Event based on an inotify mask.
-func (w *Watcher) newEvent(name string, mask uint32) Event {
-	e := Event{Name: name}
+func (w *inotify) newEvent(name string, mask uint32) Event {
+	e := Event{Name: name, isDir: mask&unix.IN_ISDIR == unix.IN_ISDIR}
 	if mask&unix.IN_CREATE == unix.IN_CREATE || mask&unix.IN_MOVED_TO == unix.IN_MOVED_TO {
 		e.Op |= Create
+		e.Moved = mask&unix.IN_MOVED_TO == unix.IN_MOVED_TO
 	}
-	if mask&unix.IN_DELETE_SELF == unix.IN_DELETE_SELF || mask&unix.IN_DELETE == unix.IN_DELETE {
+	if mask&unix.IN_DELETE_SELF == unix.IN_DELETE_SELF || mask&unix.IN_DELETE == unix.IN_DELETE ||
+		mask&unix.IN_UNMOUNT == unix.IN_UNMOUNT {
 		e.Op |= Remove
 	}
-	if mask&unix.IN_MODIFY == unix.IN_MODIFY {
+	if mask&unix.IN_MODIFY == unix.IN_MODIFY || mask&unix.IN_CLOSE_WRITE == unix.IN_CLOSE_WRITE {
 		e.Op |= Write
 	}
 	if mask&unix.IN_MOVE_SELF == unix.IN_MOVE_SELF || mask&unix.IN_MOVED_FROM == unix.IN_MOVED_FROM {
@@ -6,12 +6,17 @@ package fsnotify
 import (
 	"errors"
 	"fmt"
+	"io"
 	"os"
+	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"testing"
 	"time"
+
+	"golang.org/x/sys/unix"
 )
 
 // Make sure there are no additional threads being created.
@@ -38,7 +43,7 @@ func TestInotifyNoBlockingSyscalls(t *testing.T) {
 		// Call readEvents a bunch of times; if this function has a blocking raw
 		// syscall, it'll create many new kthreads
 		for i := 0; i <= 60; i++ {
-			go w.readEvents()
+			go w.b.(*inotify).readEvents()
 		}
 
 		time.Sleep(2 * time.Second)
@@ -106,6 +111,10 @@ func TestInotifyOverflow(t *testing.T) {
 			if !errors.Is(err, ErrEventOverflow) {
 				t.Fatalf("unexpected error from watcher: %v", err)
 			}
+			var oErr *OverflowError
+			if !errors.As(err, &oErr) || oErr.Dropped != -1 {
+				t.Fatalf("not an OverflowError: %#v", err)
+			}
 			overflows++
 		case e := <-w.Events:
 			if !strings.HasPrefix(e.Name, tmp) {
@@ -126,6 +135,184 @@ func TestInotifyOverflow(t *testing.T) {
 	}
 }
 
+// Events with the longest possible names don't fit evenly in the read buffer,
+// so there are events on the boundary of reads.
+func TestInotifyLongNames(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	w, err := NewBufferedWatcher(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	addWatch(t, w, tmp)
+
+	// createFiles() appends 11 characters.
+	var (
+		prefix   = strings.Repeat("x", unix.NAME_MAX-11)
+		numFiles = 2000
+	)
+	done := make(chan struct{})
+	defer func() { <-done }()
+	go func() {
+		defer close(done)
+		createFiles(t, tmp, prefix, numFiles, 10*time.Second)
+	}()
+
+	seen := make(map[string]struct{})
+	for len(seen) < numFiles {
+		select {
+		case <-time.After(10 * time.Second):
+			t.Fatalf("Not done: have %d creates", len(seen))
+		case err := <-w.Errors:
+			t.Fatalf("unexpected error from watcher: %v", err)
+		case e := <-w.Events:
+			name := strings.TrimPrefix(e.Name, tmp+"/")
+			if len(name) != unix.NAME_MAX || !strings.HasPrefix(name, prefix) {
+				t.Fatalf("malformed name: %q", e.Name)
+			}
+			if e.Has(Create) {
+				seen[name] = struct{}{}
+			}
+		}
+	}
+}
+
+func TestInotifyDied(t *testing.T) {
+	t.Parallel()
+
+	w := newWatcher(t, t.TempDir())
+	defer w.Close()
+	b := w.b.(*inotify)
+
+	// Replace the inotify fd with /dev/null, and set a deadline to return from
+	// the blocking read.
+	null, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer null.Close()
+	if err := unix.Dup3(int(null.Fd()), b.fd, unix.O_CLOEXEC); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.inotifyFile.SetReadDeadline(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case <-timeout:
+			t.Fatal("no DiedError")
+		case err := <-w.Errors:
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				b.inotifyFile.SetReadDeadline(time.Time{})
+				continue
+			}
+			var died *DiedError
+			if !errors.Is(err, ErrWatcherDied) || !errors.As(err, &died) || !errors.Is(err, io.EOF) {
+				t.Fatalf("wrong error: %#v", err)
+			}
+
+			// Kept open for Reset().
+			select {
+			case <-w.Events:
+				t.Fatal("Events closed")
+			case <-time.After(100 * time.Millisecond):
+			}
+			w.Close()
+			if _, ok := <-w.Events; ok {
+				t.Error("Events not closed")
+			}
+			if _, ok := <-w.Errors; ok {
+				t.Error("Errors not closed")
+			}
+			return
+		}
+	}
+}
+
+func TestInotifyReset(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	mkdirAll(t, tmp, "dir", "sub")
+	mkdir(t, tmp, "gone")
+
+	w := newCollector(t)
+	addWatch(t, w.w, tmp, "dir", "...")
+	addWatch(t, w.w, tmp, "gone")
+	b := w.w.b.(*inotify)
+
+	// Kill it as in TestInotifyDied.
+	events, errs := w.w.Events, w.w.Errors
+	null, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer null.Close()
+	if err := unix.Dup3(int(null.Fd()), b.fd, unix.O_CLOEXEC); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.inotifyFile.SetReadDeadline(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	for err := range w.w.Errors {
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			b.inotifyFile.SetReadDeadline(time.Time{})
+			continue
+		}
+		if !errors.Is(err, ErrWatcherDied) {
+			t.Fatalf("wrong error: %#v", err)
+		}
+		break
+	}
+
+	rm(t, tmp, "gone")
+	err = w.w.Reset()
+	var rErr *MultiError
+	if !errors.As(err, &rErr) || len(rErr.Errs) != 1 || !errors.Is(err, ErrNotExist) {
+		t.Fatalf("wrong error: %v", err)
+	}
+	if w.w.Events != events || w.w.Errors != errs {
+		t.Error("channels replaced")
+	}
+	if have, want := w.w.WatchList(), []string{join(tmp, "dir", "...")}; !reflect.DeepEqual(have, want) {
+		t.Errorf("\nhave: %q\nwant: %q", have, want)
+	}
+
+	w.collect(t)
+	touch(t, tmp, "dir", "file")
+	touch(t, tmp, "dir", "sub", "file")
+	cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+		create  /dir/file
+		create  /dir/sub/file
+	`))
+
+	if err := w.w.Reset(); !errors.Is(err, ErrClosed) {
+		t.Errorf("wrong error after Close: %v", err)
+	}
+
+	t.Run("not died", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		w := newCollector(t, tmp)
+		fd, _ := w.w.Fd()
+		if err := w.w.Reset(); err != nil {
+			t.Fatal(err)
+		}
+		if newFd, _ := w.w.Fd(); newFd == fd {
+			t.Errorf("same fd after Reset: %d", fd)
+		}
+
+		w.collect(t)
+		touch(t, tmp, "file")
+		cmpEvents(t, tmp, w.stop(t), newEvents(t, `create /file`))
+	})
+}
+
 // Test inotify's "we don't send REMOVE until all file descriptors are removed"
 // behaviour.
 func TestInotifyDeleteOpenFile(t *testing.T) {
@@ -144,13 +331,15 @@ func TestInotifyDeleteOpenFile(t *testing.T) {
 	w := newCollector(t, file)
 	w.collect(t)
 
+	// Files are watched through the directory, so the Remove is sent right
+	// away rather than when the file is closed.
 	rm(t, file)
 	e := w.events(t)
-	cmpEvents(t, tmp, e, newEvents(t, `chmod /file`))
+	cmpEvents(t, tmp, e, newEvents(t, `remove /file`))
 
 	fp.Close()
 	e = w.stop(t)
-	cmpEvents(t, tmp, e, newEvents(t, `remove /file`))
+	cmpEvents(t, tmp, e, newEvents(t, `empty`))
 }
 
 func TestRemoveState(t *testing.T) {
@@ -168,11 +357,12 @@ func TestRemoveState(t *testing.T) {
 
 	check := func(want int) {
 		t.Helper()
-		if len(w.watches) != want {
-			t.Error(w.watches)
+		b := w.b.(*inotify)
+		if len(b.watches) != want {
+			t.Error(b.watches)
 		}
-		if len(w.paths) != want {
-			t.Error(w.paths)
+		if len(b.paths) != want {
+			t.Error(b.paths)
 		}
 	}
 
@@ -188,3 +378,759 @@ func TestRemoveState(t *testing.T) {
 	}
 	check(0)
 }
+
+func TestInotifyRecursive(t *testing.T) {
+	t.Parallel()
+
+	var (
+		tmp = t.TempDir()
+		one = join(tmp, "one")
+		two = join(tmp, "two")
+	)
+	mkdirAll(t, one, "sub", "subsub")
+	mkdir(t, two)
+
+	w := newCollector(t, join(tmp, "..."))
+	w.collect(t)
+
+	check := func(want ...string) {
+		t.Helper()
+		b := w.w.b.(*inotify)
+		b.mu.Lock()
+		have := make([]string, 0, len(b.watches))
+		for p := range b.watches {
+			have = append(have, strings.TrimPrefix(p, tmp))
+		}
+		b.mu.Unlock()
+		sort.Strings(have)
+		sort.Strings(want)
+		if !reflect.DeepEqual(have, want) {
+			t.Errorf("\nhave: %s\nwant: %s", have, want)
+		}
+	}
+
+	check("", "/one", "/one/sub", "/one/sub/subsub", "/two")
+	if l := w.w.WatchList(); !reflect.DeepEqual(l, []string{join(tmp, "...")}) {
+		t.Errorf("wrong WatchList: %s", l)
+	}
+
+	// Move inside the watch.
+	mv(t, join(one, "sub"), two, "sub")
+	check("", "/one", "/two", "/two/sub", "/two/sub/subsub")
+
+	// Move outside the watch.
+	mv(t, join(two, "sub"), t.TempDir(), "sub")
+	check("", "/one", "/two")
+
+	touch(t, two, "file")
+	cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+		rename    /one/sub
+		create    /two/sub
+		rename    /two/sub
+		create    /two/file
+	`))
+}
+
+// Paths created in a new directory before it's watched are sent as a Create
+// with IsScanned() set.
+func TestInotifyRecursiveScan(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	w := newWatcher(t, join(tmp, "..."))
+	defer w.Close()
+
+	// Nothing reads from Events yet, so the Create for first blocks the
+	// reader until everything else is created.
+	touch(t, tmp, "first")
+	mkdirAll(t, tmp, "dir", "sub")
+	touch(t, tmp, "dir", "file")
+	touch(t, tmp, "dir", "sub", "file")
+
+	want := map[string]bool{
+		"/first":        false,
+		"/dir":          false,
+		"/dir/file":     true,
+		"/dir/sub":      true,
+		"/dir/sub/file": true,
+	}
+	timeout := time.After(5 * time.Second)
+	for len(want) > 0 {
+		select {
+		case <-timeout:
+			t.Fatalf("no events for %v", want)
+		case err := <-w.Errors:
+			t.Fatal(err)
+		case e := <-w.Events:
+			name := strings.TrimPrefix(e.Name, tmp)
+			scanned, ok := want[name]
+			if !ok || !e.Has(Create) || e.IsScanned() != scanned {
+				t.Fatalf("unexpected event: %s (IsScanned: %t)", e, e.IsScanned())
+			}
+			delete(want, name)
+		}
+	}
+}
+
+func TestInotifyRemoveRecursive(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	mkdirAll(t, tmp, "one", "sub")
+	mkdirAll(t, tmp, "two", "sub")
+
+	w := newWatcher(t)
+	defer w.Close()
+	addWatch(t, w, tmp, "...")
+	addWatch(t, w, tmp, "two", "...")
+
+	check := func(want ...string) {
+		t.Helper()
+		b := w.b.(*inotify)
+		b.mu.Lock()
+		have := make([]string, 0, len(b.watches))
+		for p := range b.watches {
+			have = append(have, strings.TrimPrefix(p, tmp))
+		}
+		if len(b.paths) != len(b.watches) {
+			t.Errorf("paths and watches out of sync:\n%v\n%v", b.paths, b.watches)
+		}
+		b.mu.Unlock()
+		sort.Strings(have)
+		sort.Strings(want)
+		if strings.Join(have, " ") != strings.Join(want, " ") {
+			t.Errorf("\nhave: %s\nwant: %s", have, want)
+		}
+	}
+	check("", "/one", "/one/sub", "/two", "/two/sub")
+
+	// Internal watches can't be removed.
+	if err := w.Remove(join(tmp, "one")); !errors.Is(err, ErrNonExistentWatch) {
+		t.Fatalf("wrong error: %v", err)
+	}
+
+	// Still used by the parent watch.
+	if err := w.Remove(join(tmp, "two", "...")); err != nil {
+		t.Fatal(err)
+	}
+	check("", "/one", "/one/sub", "/two", "/two/sub")
+	if l := w.WatchList(); !reflect.DeepEqual(l, []string{join(tmp, "...")}) {
+		t.Errorf("wrong WatchList: %s", l)
+	}
+
+	// Keep the nested recursive watch.
+	addWatch(t, w, tmp, "two", "...")
+	if err := w.Remove(join(tmp, "...")); err != nil {
+		t.Fatal(err)
+	}
+	check("/two", "/two/sub")
+
+	if err := w.Remove(join(tmp, "two")); err != nil {
+		t.Fatal(err)
+	}
+	check()
+}
+
+func TestInotifyIgnore(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	mkdirAll(t, tmp, "node_modules", "pkg")
+	mkdirAll(t, tmp, "dir", "node_modules")
+
+	w := newWatcher(t)
+	defer w.Close()
+	if err := w.Ignore("node_modules"); err != nil {
+		t.Fatal(err)
+	}
+	addWatch(t, w, tmp, "...")
+
+	mkdirAll(t, tmp, "new", "node_modules")
+	eventSeparator()
+
+	b := w.b.(*inotify)
+	b.mu.Lock()
+	have := make([]string, 0, len(b.watches))
+	for p := range b.watches {
+		have = append(have, strings.TrimPrefix(p, tmp))
+	}
+	b.mu.Unlock()
+	sort.Strings(have)
+	if want := []string{"", "/dir", "/new"}; !reflect.DeepEqual(have, want) {
+		t.Errorf("\nhave: %s\nwant: %s", have, want)
+	}
+}
+
+func TestInotifyFollowSymlinks(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	mkdirAll(t, tmp, "releases", "v1", "sub")
+	mkdirAll(t, tmp, "releases", "v2")
+	mkdir(t, tmp, "tree")
+	symlink(t, join(tmp, "releases", "v1"), tmp, "tree", "current")
+	symlink(t, join(tmp, "tree"), tmp, "tree", "loop")
+
+	check := func(w *Watcher, want ...string) {
+		t.Helper()
+		b := w.b.(*inotify)
+		b.mu.Lock()
+		have := make([]string, 0, len(b.watches))
+		for p := range b.watches {
+			have = append(have, strings.TrimPrefix(p, tmp))
+		}
+		b.mu.Unlock()
+		sort.Strings(have)
+		if !reflect.DeepEqual(have, want) {
+			t.Errorf("\nhave: %s\nwant: %s", have, want)
+		}
+	}
+
+	// Default is to not follow.
+	w := newWatcher(t)
+	addWatch(t, w, tmp, "tree", "...")
+	check(w, "/tree")
+	w.Close()
+
+	c := newCollector(t)
+	if err := c.w.AddWith(join(tmp, "tree", "..."), WithFollowSymlinks()); err != nil {
+		t.Fatal(err)
+	}
+	check(c.w, "/tree", "/tree/current", "/tree/current/sub")
+
+	c.collect(t)
+	touch(t, tmp, "releases", "v1", "sub", "file")
+	symlink(t, join(tmp, "releases", "v2"), tmp, "tree", "next")
+	touch(t, tmp, "releases", "v2", "file")
+	cmpEvents(t, tmp, c.stop(t), newEvents(t, `
+		create  /tree/current/sub/file
+		create  /tree/next
+		create  /tree/next/file
+	`))
+}
+
+func TestInotifyResolveTargets(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []addOpt
+		ops  func(t *testing.T, tmp string)
+		want string
+	}{
+		{"write", []addOpt{WithResolveTargets()}, func(t *testing.T, tmp string) {
+			cat(t, "data", tmp, "opt", "app.conf")
+			chmod(t, 0o600, tmp, "opt", "app.conf")
+		}, `
+			write  /conf.d/app.conf
+			chmod  /conf.d/app.conf
+		`},
+
+		{"without", nil, func(t *testing.T, tmp string) {
+			cat(t, "data", tmp, "opt", "app.conf")
+		}, ``},
+
+		{"two links", []addOpt{WithResolveTargets()}, func(t *testing.T, tmp string) {
+			symlink(t, join(tmp, "opt", "app.conf"), tmp, "conf.d", "other.conf")
+			cat(t, "data", tmp, "opt", "app.conf")
+		}, `
+			create  /conf.d/other.conf
+			write   /conf.d/app.conf
+			write   /conf.d/other.conf
+		`},
+
+		{"remove link", []addOpt{WithResolveTargets()}, func(t *testing.T, tmp string) {
+			rm(t, tmp, "conf.d", "app.conf")
+			cat(t, "data", tmp, "opt", "app.conf")
+		}, `
+			remove  /conf.d/app.conf
+		`},
+
+		{"retarget", []addOpt{WithResolveTargets()}, func(t *testing.T, tmp string) {
+			touch(t, tmp, "opt", "new.conf")
+			symlink(t, join(tmp, "opt", "new.conf"), tmp, "conf.d", "tmp")
+			mv(t, join(tmp, "conf.d", "tmp"), tmp, "conf.d", "app.conf")
+			cat(t, "data", tmp, "opt", "app.conf")
+			cat(t, "data", tmp, "opt", "new.conf")
+		}, `
+			create  /conf.d/tmp
+			rename  /conf.d/tmp
+			create  /conf.d/app.conf
+			write   /conf.d/app.conf
+		`},
+
+		{"replace target", []addOpt{WithResolveTargets()}, func(t *testing.T, tmp string) {
+			cat(t, "new", tmp, "opt", "tmp")
+			mv(t, join(tmp, "opt", "tmp"), tmp, "opt", "app.conf")
+			cat(t, "data", tmp, "opt", "app.conf")
+		}, `
+			write  /conf.d/app.conf
+			write  /conf.d/app.conf
+		`},
+
+		{"remove target", []addOpt{WithResolveTargets()}, func(t *testing.T, tmp string) {
+			rm(t, tmp, "opt", "app.conf")
+			touch(t, tmp, "opt", "app.conf")
+			cat(t, "data", tmp, "opt", "app.conf")
+		}, ``},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			tmp := t.TempDir()
+			mkdir(t, tmp, "opt")
+			mkdir(t, tmp, "conf.d")
+			touch(t, tmp, "opt", "app.conf")
+			symlink(t, join(tmp, "opt", "app.conf"), tmp, "conf.d", "app.conf")
+
+			w := newCollector(t)
+			if err := w.w.AddWith(join(tmp, "conf.d"), tt.opts...); err != nil {
+				t.Fatal(err)
+			}
+			w.collect(t)
+			tt.ops(t, tmp)
+			cmpEvents(t, tmp, w.stop(t), newEvents(t, tt.want))
+		})
+	}
+
+	t.Run("skipped", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		mkdir(t, tmp, "dir")
+		symlink(t, join(tmp, "dir"), tmp, "to-dir")
+		symlink(t, join(tmp, "b"), tmp, "a")
+		symlink(t, join(tmp, "a"), tmp, "b")
+		symlink(t, join(tmp, "missing"), tmp, "broken")
+
+		w := newCollector(t)
+		if err := w.w.AddWith(tmp, WithResolveTargets()); err != nil {
+			t.Fatal(err)
+		}
+		w.collect(t)
+		b := w.w.b.(*inotify)
+		b.mu.Lock()
+		n := len(b.targets)
+		b.mu.Unlock()
+		if n != 0 {
+			t.Errorf("%d targets watched; want 0", n)
+		}
+
+		// And cleaned up once the directory is removed.
+		touch(t, tmp, "file")
+		symlink(t, join(tmp, "file"), tmp, "link")
+		waitForEvents()
+		b.mu.Lock()
+		n = len(b.targets)
+		b.mu.Unlock()
+		if n != 1 {
+			t.Errorf("%d targets watched; want 1", n)
+		}
+		if err := w.w.Remove(tmp); err != nil {
+			t.Fatal(err)
+		}
+		b.mu.Lock()
+		n = len(b.targets)
+		b.mu.Unlock()
+		if n != 0 {
+			t.Errorf("%d targets watched after Remove; want 0", n)
+		}
+		w.stop(t)
+	})
+}
+
+func TestInotifyWithOps(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	w := newWatcher(t)
+	defer w.Close()
+
+	flags := func() uint32 {
+		b := w.b.(*inotify)
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		return b.watches[tmp].flags
+	}
+
+	if err := w.AddWith(tmp, WithOps(Write)); err != nil {
+		t.Fatal(err)
+	}
+	if f := flags(); f != unix.IN_MODIFY|unix.IN_MOVE_SELF|unix.IN_DELETE_SELF {
+		t.Errorf("wrong flags: %#x", f)
+	}
+
+	// Adding it again replaces the flags.
+	if err := w.Add(tmp); err != nil {
+		t.Fatal(err)
+	}
+	if f := flags(); f&unix.IN_ATTRIB == 0 || f&unix.IN_CREATE == 0 {
+		t.Errorf("wrong flags: %#x", f)
+	}
+}
+
+func TestInotifyRenameWatchedDir(t *testing.T) {
+	t.Run("to watched dir", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		mkdir(t, tmp, "dir")
+		w := newCollector(t, tmp, join(tmp, "dir"))
+		w.collect(t)
+
+		mv(t, join(tmp, "dir"), tmp, "renamed")
+		touch(t, tmp, "renamed", "file")
+
+		cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+			rename  /dir
+			create  /renamed
+			create  /renamed/file
+		`))
+	})
+
+	t.Run("watch list", func(t *testing.T) {
+		t.Parallel()
+
+		tmp, other := t.TempDir(), t.TempDir()
+		mkdirAll(t, tmp, "dir", "sub")
+		w := newCollector(t, tmp, other, join(tmp, "dir", "..."))
+		w.collect(t)
+
+		mv(t, join(tmp, "dir"), other, "dir")
+		touch(t, other, "dir", "sub", "file")
+		waitForEvents()
+
+		have := w.w.WatchList()
+		sort.Strings(have)
+		want := []string{tmp, other, join(other, "dir", "...")}
+		sort.Strings(want)
+		if !reflect.DeepEqual(have, want) {
+			t.Errorf("\nhave: %s\nwant: %s", have, want)
+		}
+		if !w.w.IsWatched(join(other, "dir", "...")) {
+			t.Error("dir/... not watched")
+		}
+
+		cmpEvents(t, tmp, w.stop(t), newEvents(t, fmt.Sprintf(`
+			rename  /dir
+			create  %[1]s/dir
+			create  %[1]s/dir/sub/file
+		`, other)))
+	})
+}
+
+func TestInotifyStatsRewatches(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	w := newCollector(t, join(tmp, "..."))
+	w.collect(t)
+
+	mkdirAll(t, tmp, "one", "two")
+	waitForEvents()
+	if s := w.w.Stats(); s.Rewatches != 2 || s.ActiveWatches != 1 {
+		t.Errorf("wrong Stats: %+v", s)
+	}
+	w.stop(t)
+}
+
+func TestInotifyHardLink(t *testing.T) {
+	t.Parallel()
+
+	t.Run("write through other link", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		mkdir(t, tmp, "other")
+		touch(t, tmp, "file")
+		if err := os.Link(join(tmp, "file"), join(tmp, "other", "link")); err != nil {
+			t.Fatal(err)
+		}
+
+		w := newCollector(t, join(tmp, "file"))
+		w.collect(t)
+
+		cat(t, "data", tmp, "other", "link")
+		eventSeparator()
+		cat(t, "data", tmp, "file")
+		eventSeparator()
+		rm(t, tmp, "file")
+
+		cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+			write  /file
+			write  /file
+			remove /file
+		`))
+	})
+
+	t.Run("watch both links", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		touch(t, tmp, "file")
+		if err := os.Link(join(tmp, "file"), join(tmp, "link")); err != nil {
+			t.Fatal(err)
+		}
+
+		w := newCollector(t, join(tmp, "file"), join(tmp, "link"))
+		w.collect(t)
+
+		cat(t, "data", tmp, "link")
+		eventSeparator()
+		rm(t, tmp, "link")
+		eventSeparator()
+		cat(t, "data", tmp, "file")
+
+		cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+			write  /file
+			write  /link
+			chmod  /file
+			remove /link
+			write  /file
+		`))
+	})
+}
+
+func TestInotifyUnmount(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	mnt := join(tmp, "mnt")
+	mkdir(t, mnt)
+	if err := unix.Mount("fsnotify", mnt, "tmpfs", 0, ""); err != nil {
+		t.Skipf("can't mount tmpfs: %s", err)
+	}
+	mkdir(t, mnt, "dir")
+
+	w := newWatcher(t, mnt, join(mnt, "dir"))
+	if err := unix.Unmount(mnt, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		removed  []string
+		errPaths []string
+	)
+	for timeout := time.After(2 * time.Second); len(removed) < 2 || len(errPaths) < 2; {
+		select {
+		case e := <-w.Events:
+			if e.Has(Remove) {
+				removed = append(removed, strings.TrimPrefix(e.Name, tmp))
+			}
+		case err := <-w.Errors:
+			var wErr *WatchError
+			if !errors.Is(err, ErrUnmounted) || !errors.As(err, &wErr) {
+				t.Fatalf("wrong error: %v", err)
+			}
+			errPaths = append(errPaths, strings.TrimPrefix(wErr.Path, tmp))
+		case <-timeout:
+			t.Fatalf("timeout; removed: %q; errors: %q", removed, errPaths)
+		}
+	}
+	sort.Strings(removed)
+	sort.Strings(errPaths)
+	want := []string{"/mnt", "/mnt/dir"}
+	if !reflect.DeepEqual(removed, want) {
+		t.Errorf("wrong Remove events\nhave: %q\nwant: %q", removed, want)
+	}
+	if !reflect.DeepEqual(errPaths, want) {
+		t.Errorf("wrong errors\nhave: %q\nwant: %q", errPaths, want)
+	}
+	if w.IsWatched(mnt) {
+		t.Error("still watched after unmount")
+	}
+}
+
+func TestInotifyDryRunAdd(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	mkdirAll(t, tmp, "a", "b")
+	mkdir(t, tmp, "c")
+	touch(t, tmp, "file")
+	touch(t, tmp, "a", "file")
+
+	w := newWatcher(t)
+	tests := []struct {
+		name string
+		opts []addOpt
+		want int
+	}{
+		{tmp, nil, 1},
+		{join(tmp, "file"), nil, 1},
+		{join(tmp, "..."), nil, 4},
+		{join(tmp, "..."), []addOpt{WithMaxDepth(1)}, 3},
+		{join(tmp, "a", "..."), nil, 2},
+	}
+	for _, tt := range tests {
+		n, err := w.DryRunAdd(tt.name, tt.opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != tt.want {
+			t.Errorf("%s: count is %d; want %d", strings.TrimPrefix(tt.name, tmp), n, tt.want)
+		}
+	}
+
+	// Already watched directories don't need a new watch.
+	addWatch(t, w, tmp, "a", "...")
+	if n, err := w.DryRunAdd(join(tmp, "...")); err != nil || n != 2 {
+		t.Errorf("count is %d (error %v); want 2", n, err)
+	}
+	if n, err := w.DryRunAdd(join(tmp, "a", "file")); err != nil || n != 0 {
+		t.Errorf("count is %d (error %v); want 0", n, err)
+	}
+}
+
+func TestInotifyCloseWriteOnly(t *testing.T) {
+	// Write to the file twice before closing it.
+	write := func(t *testing.T, path ...string) {
+		t.Helper()
+		fp, err := os.OpenFile(join(path...), os.O_WRONLY|os.O_APPEND, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer fp.Close()
+		for i := 0; i < 2; i++ {
+			if _, err := fp.WriteString("data"); err != nil {
+				t.Fatal(err)
+			}
+			eventSeparator()
+		}
+	}
+
+	tests := []testCase{
+		{"dir", func(t *testing.T, w *Watcher, tmp string) {
+			touch(t, tmp, "file")
+			if err := w.AddWith(tmp, WithCloseWriteOnly()); err != nil {
+				t.Fatal(err)
+			}
+			write(t, tmp, "file")
+		}, `
+			write  /file
+		`},
+
+		{"file", func(t *testing.T, w *Watcher, tmp string) {
+			touch(t, tmp, "file")
+			if err := w.AddWith(join(tmp, "file"), WithCloseWriteOnly()); err != nil {
+				t.Fatal(err)
+			}
+			write(t, tmp, "file")
+		}, `
+			write  /file
+		`},
+
+		{"without", func(t *testing.T, w *Watcher, tmp string) {
+			touch(t, tmp, "file")
+			addWatch(t, w, tmp)
+			write(t, tmp, "file")
+		}, `
+			write  /file
+			write  /file
+		`},
+
+		{"file without in dir with", func(t *testing.T, w *Watcher, tmp string) {
+			touch(t, tmp, "file")
+			touch(t, tmp, "other")
+			if err := w.AddWith(tmp, WithCloseWriteOnly()); err != nil {
+				t.Fatal(err)
+			}
+			addWatch(t, w, tmp, "file")
+			write(t, tmp, "file")
+			write(t, tmp, "other")
+		}, `
+			write  /file
+			write  /file
+			write  /other
+		`},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		tt.run(t)
+	}
+}
+
+func TestInotifyRawEvents(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	touch(t, tmp, "other")
+
+	w := newCollector(t)
+	if err := w.w.AddWith(tmp, WithRawEvents()); err != nil {
+		t.Fatal(err)
+	}
+	addWatch(t, w.w, tmp, "other")
+	w.collect(t)
+
+	mkdir(t, tmp, "dir")
+	cat(t, "data", tmp, "other")
+	have := w.stop(t)
+	if len(have) != 2 {
+		t.Fatalf("wrong number of events:\n%s", indent(have))
+	}
+
+	raw, ok := have[0].Raw.(RawInotifyEvent)
+	if !ok {
+		t.Fatalf("Raw is %T; want RawInotifyEvent", have[0].Raw)
+	}
+	if raw.Mask != unix.IN_CREATE|unix.IN_ISDIR || raw.Name != "dir" || raw.Wd <= 0 {
+		t.Errorf("wrong raw event for mkdir: %+v", raw)
+	}
+	// The watch for the file itself is added without WithRawEvents(), but
+	// the directory it's in is.
+	if raw, ok := have[1].Raw.(RawInotifyEvent); !ok || raw.Mask != unix.IN_MODIFY || raw.Name != "other" {
+		t.Errorf("wrong raw event for write: %#v", have[1].Raw)
+	}
+
+	t.Run("without", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		w := newCollector(t, tmp)
+		w.collect(t)
+		touch(t, tmp, "file")
+		for _, e := range w.stop(t) {
+			if e.Raw != nil {
+				t.Errorf("Raw set for %s: %#v", e, e.Raw)
+			}
+		}
+	})
+}
+
+func TestInotifyMoved(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	outside := t.TempDir()
+	mkdir(t, tmp, "dir")
+	touch(t, outside, "file")
+
+	w := newCollector(t, join(tmp, "dir"))
+	w.collect(t)
+
+	mv(t, join(outside, "file"), tmp, "dir", "file")
+	mv(t, join(tmp, "dir", "file"), tmp, "dir", "renamed")
+	touch(t, tmp, "dir", "new")
+	have := w.stop(t)
+	cmpEvents(t, tmp, have, newEvents(t, `
+		create  /dir/file
+		rename  /dir/file
+		create  /dir/renamed
+		create  /dir/new
+	`))
+	if len(have) != 4 {
+		return
+	}
+
+	for i, want := range []bool{true, false, true, false} {
+		if have[i].Moved != want {
+			t.Errorf("Moved is %t for %s; want %t", have[i].Moved, have[i], want)
+		}
+	}
+	if have[0].RenamedFrom != "" || have[2].RenamedFrom != join(tmp, "dir", "file") {
+		t.Errorf("wrong RenamedFrom:\n%s", indent(have))
+	}
+}
@@ -4,132 +4,55 @@
 package fsnotify
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
+	"syscall"
+	"time"
 
 	"golang.org/x/sys/unix"
 )
 
-// Watcher watches a set of paths, delivering events on a channel.
-//
-// A watcher should not be copied (e.g. pass it by pointer, rather than by
-// value).
-//
-// # Linux notes
-//
-// When a file is removed a Remove event won't be emitted until all file
-// descriptors are closed, and deletes will always emit a Chmod. For example:
-//
-//     fp := os.Open("file")
-//     os.Remove("file")        // Triggers Chmod
-//     fp.Close()               // Triggers Remove
-//
-// This is the event that inotify sends, so not much can be changed about this.
-//
-// The fs.inotify.max_user_watches sysctl variable specifies the upper limit
-// for the number of watches per user, and fs.inotify.max_user_instances
-// specifies the maximum number of inotify instances per user. Every Watcher you
-// create is an "instance", and every path you add is a "watch".
-//
-// These are also exposed in /proc as /proc/sys/fs/inotify/max_user_watches and
-// /proc/sys/fs/inotify/max_user_instances
-//
-// To increase them you can use sysctl or write the value to the /proc file:
-//
-//     # Default values on Linux 5.18
-//     sysctl fs.inotify.max_user_watches=124983
-//     sysctl fs.inotify.max_user_instances=128
-//
-// To make the changes persist on reboot edit /etc/sysctl.conf or
-// /usr/lib/sysctl.d/50-default.conf (details differ per Linux distro; check
-// your distro's documentation):
-//
-//     fs.inotify.max_user_watches=124983
-//     fs.inotify.max_user_instances=128
-//
-// Reaching the limit will result in a "no space left on device" or "too many open
-// files" error.
-//
-// # kqueue notes (macOS, BSD)
-//
-// kqueue requires opening a file descriptor for every file that's being watched;
-// so if you're watching a directory with five files then that's six file
-// descriptors. You will run in to your system's "max open files" limit faster on
-// these platforms.
-//
-// The sysctl variables kern.maxfiles and kern.maxfilesperproc can be used to
-// control the maximum number of open files, as well as /etc/login.conf on BSD
-// systems.
-//
-// # macOS notes
-//
-// Spotlight indexing on macOS can result in multiple events (see [#15]). A
-// temporary workaround is to add your folder(s) to the "Spotlight Privacy
-// Settings" until we have a native FSEvents implementation (see [#11]).
-//
-// [#11]: https://github.com/fsnotify/fsnotify/issues/11
-// [#15]: https://github.com/fsnotify/fsnotify/issues/15
-type Watcher struct {
-	// Events sends the filesystem change events.
-	//
-	// fsnotify can send the following events; a "path" here can refer to a
-	// file, directory, symbolic link, or special file like a FIFO.
-	//
-	//   fsnotify.Create    A new path was created; this may be followed by one
-	//                      or more Write events if data also gets written to a
-	//                      file.
-	//
-	//   fsnotify.Remove    A path was removed.
-	//
-	//   fsnotify.Rename    A path was renamed. A rename is always sent with the
-	//                      old path as Event.Name, and a Create event will be
-	//                      sent with the new name. Renames are only sent for
-	//                      paths that are currently watched; e.g. moving an
-	//                      unmonitored file into a monitored directory will
-	//                      show up as just a Create. Similarly, renaming a file
-	//                      to outside a monitored directory will show up as
-	//                      only a Rename.
-	//
-	//   fsnotify.Write     A file or named pipe was written to. A Truncate will
-	//                      also trigger a Write. A single "write action"
-	//                      initiated by the user may show up as one or multiple
-	//                      writes, depending on when the system syncs things to
-	//                      disk. For example when compiling a large Go program
-	//                      you may get hundreds of Write events, so you
-	//                      probably want to wait until you've stopped receiving
-	//                      them (see the dedup example in cmd/fsnotify).
-	//
-	//   fsnotify.Chmod     Attributes were changed. On Linux this is also sent
-	//                      when a file is removed (or more accurately, when a
-	//                      link to an inode is removed). On kqueue it's sent
-	//                      and on kqueue when a file is truncated. On Windows
-	//                      it's never sent.
-	Events chan Event
+type kqueue struct {
+	stats // Counters for Watcher.Stats()
 
-	// Errors sends any errors.
-	//
-	// [ErrEventOverflow] is used to indicate ther are too many events:
-	//
-	//  - inotify: there are too many queued events (fs.inotify.max_queued_events sysctl)
-	//  - windows: The buffer size is too small.
-	//  - kqueue, fen: not used.
+	Events chan Event
 	Errors chan error
+	pipe   *pipeline   // Filters, changes, and sends events; shared with the Watcher.
+	auto   rewatcher   // Removed files to watch again once they're recreated, for WithAutoRewatch()
+	scans  initialScan // Existing paths to send a Create for, for WithInitialScan()
+	reads  reader      // If the reader goroutine is busy, for Watcher.Sync()
 
-	done         chan struct{}
+	done         chan struct{}               // Stop sending events; closed by Close, or by CloseWait if ctx is done
+	doneResp     chan struct{}               // Closed when the reader goroutine exits
 	kq           int                         // File descriptor (as returned by the kqueue() syscall).
 	closepipe    [2]int                      // Pipe used for closing.
 	mu           sync.Mutex                  // Protects access to watcher data
 	watches      map[string]int              // Watched file descriptors (key: path).
 	watchesByDir map[string]map[int]struct{} // Watched file descriptors indexed by the parent directory (key: dirname(path)).
-	userWatches  map[string]struct{}         // Watches added with Watcher.Add()
+	userWatches  map[string]withOpts         // Watches added with Watcher.Add(), and the options for them.
 	dirFlags     map[string]uint32           // Watched directories to fflags used in kqueue.
 	paths        map[int]pathInfo            // File descriptors to path names for processing kqueue events.
 	fileExists   map[string]struct{}         // Keep track of if we know this file exists (to stop duplicate create events).
+	tracked      map[string]os.FileInfo      // Files added with WithTrackInode(), to find them again once they're renamed.
 	isClosed     bool                        // Set to true when Close() is first called
+	maxWatches   int                         // Maximum number of open file descriptors, from Watcher.SetMaxWatches(); 0 for no limit.
+	opening      int                         // File descriptors that are being opened, for maxWatches.
+
+	// Recently renamed paths, so that the Create for the new name can be
+	// paired by inode. Only accessed from the readEvents() goroutine.
+	renamed      [10]renamedPath
+	renamedIndex int
+
+	// Time the last batch of kevents was read, for Event.Time. Only accessed
+	// from the readEvents() goroutine.
+	readTime time.Time
 }
 
 type pathInfo struct {
@@ -137,14 +60,18 @@ type pathInfo struct {
 	isDir bool
 }
 
-// NewWatcher creates a new Watcher.
-func NewWatcher() (*Watcher, error) {
+type renamedPath struct {
+	dev, ino uint64
+	name     string
+}
+
+func newBackend(ev chan Event, errs chan error, pipe *pipeline) (backend, error) {
 	kq, closepipe, err := newKqueue()
 	if err != nil {
 		return nil, err
 	}
 
-	w := &Watcher{
+	w := &kqueue{
 		kq:           kq,
 		closepipe:    closepipe,
 		watches:      make(map[string]int),
@@ -152,11 +79,15 @@ func NewWatcher() (*Watcher, error) {
 		dirFlags:     make(map[string]uint32),
 		paths:        make(map[int]pathInfo),
 		fileExists:   make(map[string]struct{}),
-		userWatches:  make(map[string]struct{}),
-		Events:       make(chan Event),
-		Errors:       make(chan error),
+		tracked:      make(map[string]os.FileInfo),
+		userWatches:  make(map[string]withOpts),
+		Events:       ev,
+		Errors:       errs,
+		pipe:         pipe,
 		done:         make(chan struct{}),
+		doneResp:     make(chan struct{}),
 	}
+	w.auto.b = w
 
 	go w.readEvents()
 	return w, nil
@@ -198,31 +129,71 @@ func newKqueue() (kq int, closepipe [2]int, err error) {
 }
 
 // Returns true if the event was sent, or false if watcher is closed.
-func (w *Watcher) sendEvent(e Event) bool {
-	select {
-	case w.Events <- e:
+func (w *kqueue) sendEvent(e Event) bool {
+	e.Seq = w.pipe.nextSeq()
+	if w.auto.route(e.Name, w.IsWatched) {
 		return true
-	case <-w.done:
 	}
-	return false
+	if w.pipe.match(e.Name) {
+		return true
+	}
+
+	// Drop operations that weren't asked for with WithOps().
+	if e.Op != 0 {
+		e.Op &= w.opsFor(e.Name)
+		if e.Op == 0 {
+			return true
+		}
+	}
+
+	if w.pipe.dropExt(e) || w.pipe.dropPaused() {
+		return true
+	}
+	w.scans.wait()
+	return w.pipe.send(w.Events, e, w.done, &w.stats)
 }
 
 // Returns true if the error was sent, or false if watcher is closed.
-func (w *Watcher) sendError(err error) bool {
+func (w *kqueue) sendError(err error) bool {
 	select {
 	case w.Errors <- err:
+		w.sentError(err)
 		return true
 	case <-w.done:
 	}
 	return false
 }
 
-// Close removes all watches and closes the events channel.
-func (w *Watcher) Close() error {
+func (w *kqueue) Close() error {
+	if w.close() {
+		close(w.done)
+	}
+	return nil
+}
+
+func (w *kqueue) CloseWait(ctx context.Context) error {
+	if !w.close() {
+		return nil
+	}
+
+	select {
+	case <-w.doneResp:
+		return nil
+	case <-ctx.Done():
+		close(w.done)
+		<-w.doneResp
+		return ctx.Err()
+	}
+}
+
+// close removes all watches and tells the reader goroutine to stop after it
+// processed all events it already read. Returns false if the watcher was
+// already closed.
+func (w *kqueue) close() bool {
 	w.mu.Lock()
 	if w.isClosed {
 		w.mu.Unlock()
-		return nil
+		return false
 	}
 	w.isClosed = true
 
@@ -238,62 +209,177 @@ func (w *Watcher) Close() error {
 
 	// Send "quit" message to the reader goroutine.
 	unix.Close(w.closepipe[1])
-	close(w.done)
+	return true
+}
+
+func (w *kqueue) AddWith(name string, opts ...addOpt) error {
+	name = filepath.Clean(name)
+	if _, recurse := recursivePath(name); recurse {
+		return ErrRecursionUnsupported
+	}
+	with, err := getOptions(opts...)
+	if err != nil {
+		return err
+	}
+	if with.createWatch {
+		if waiting, err := w.auto.create(name, with, w.sendEvent, w.sendError); waiting || err != nil {
+			return err
+		}
+	}
+	// These are skipped in directories (see addWatch()), but don't silently
+	// watch nothing if they're added.
+	stat := os.Stat
+	if with.noFollow {
+		stat = os.Lstat
+	}
+	fi, statErr := stat(name)
+	if statErr == nil && fi.Mode()&(os.ModeSocket|os.ModeNamedPipe) != 0 {
+		return fmt.Errorf("%w: %s", ErrSpecialFileUnsupported, name)
+	}
+	if with.initialScan {
+		w.scans.begin()
+		defer w.scans.end()
+	}
 
+	w.mu.Lock()
+	prevOpts, alreadyWatching := w.userWatches[name]
+	_, wasOpen := w.watches[name]
+	if with.internal && alreadyWatching && !prevOpts.internal {
+		// Directory that's waited in by the rewatcher; see rewatcher.hold().
+		w.mu.Unlock()
+		return errAlreadyWatched
+	}
+	w.userWatches[name] = with
+	w.mu.Unlock()
+	if !with.internal {
+		w.auto.claim(name)
+	}
+	watched, err := w.addWatch(name, noteAllEvents, with.noFollow)
+	if err != nil {
+		w.mu.Lock()
+		if alreadyWatching {
+			w.userWatches[name] = prevOpts
+		} else {
+			delete(w.userWatches, name)
+		}
+		w.mu.Unlock()
+		// Don't keep the files in a directory if only some of them could be
+		// watched.
+		if !wasOpen && errors.Is(err, ErrWatchLimitReached) {
+			w.remove(name, true)
+		}
+		return err
+	}
+	w.mu.Lock()
+	if with.trackInode && statErr == nil && !fi.IsDir() {
+		w.tracked[name] = fi
+	} else {
+		delete(w.tracked, name)
+	}
+	w.mu.Unlock()
+	// The files in a directory are watched with the flags for its operations;
+	// update them if the operations changed.
+	if alreadyWatching && prevOpts.ops != with.ops {
+		w.mu.Lock()
+		isDir := w.paths[w.watches[watched]].isDir
+		w.mu.Unlock()
+		if isDir {
+			if err := w.watchDirectoryFiles(watched); err != nil {
+				return err
+			}
+		}
+	}
+	w.scans.run(name, false, with, w.pipe, w.Events, w.done, &w.stats)
 	return nil
 }
 
-// Add starts monitoring the path for changes.
-//
-// A path can only be watched once; attempting to watch it more than once will
-// return an error. Paths that do not yet exist on the filesystem cannot be
-// added.
-//
-// A watch will be automatically removed if the watched path is deleted or
-// renamed. The exception is the Windows backend, which doesn't remove the
-// watcher on renames.
-//
-// Notifications on network filesystems (NFS, SMB, FUSE, etc.) or special
-// filesystems (/proc, /sys, etc.) generally don't work.
-//
-// Returns [ErrClosed] if [Watcher.Close] was called.
-//
-// # Watching directories
-//
-// All files in a directory are monitored, including new files that are created
-// after the watcher is started. Subdirectories are not watched (i.e. it's
-// non-recursive).
-//
-// # Watching files
-//
-// Watching individual files (rather than directories) is generally not
-// recommended as many tools update files atomically. Instead of "just" writing
-// to the file a temporary file will be written to first, and if successful the
-// temporary file is moved to to destination removing the original, or some
-// variant thereof. The watcher on the original file is now lost, as it no
-// longer exists.
-//
-// Instead, watch the parent directory and use Event.Name to filter out files
-// you're not interested in. There is an example of this in [cmd/fsnotify/file.go].
-func (w *Watcher) Add(name string) error {
+// opsFor gets the operations to send for a path: the ops for the path itself if
+// it was added with Add(), and the ops of the parent directory if that was
+// added. All ops are sent if neither was added.
+func (w *kqueue) opsFor(name string) Op {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	with, ok := w.userWatches[name]
+	dirWith, dirOk := w.userWatches[filepath.Dir(name)]
+	if !ok && !dirOk {
+		return AllOps
+	}
+	return with.ops | dirWith.ops
+}
+
+// atomicSaveFor reports if WithAtomicSaveDetection() was used for the path or
+// its parent directory.
+func (w *kqueue) atomicSaveFor(name string) bool {
 	w.mu.Lock()
-	w.userWatches[name] = struct{}{}
+	defer w.mu.Unlock()
+	return w.userWatches[name].atomicSave || w.userWatches[filepath.Dir(name)].atomicSave
+}
+
+// rawFor reports if WithRawEvents() was used for the path or its parent
+// directory.
+func (w *kqueue) rawFor(name string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.userWatches[name].raw || w.userWatches[filepath.Dir(name)].raw
+}
+
+// trackRename keeps watching a file added with WithTrackInode() that was
+// renamed in the same directory under the new name, if it can be found.
+// Returns the new name, or an empty string if the file isn't followed.
+func (w *kqueue) trackRename(watchfd int, name string) string {
+	w.mu.Lock()
+	fi, ok := w.tracked[name]
 	w.mu.Unlock()
-	_, err := w.addWatch(name, noteAllEvents)
-	return err
+	if !ok {
+		return ""
+	}
+	to := findSameFile(filepath.Dir(name), name, fi)
+	if to == "" {
+		return ""
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.watches[to], w.userWatches[to], w.tracked[to] = watchfd, w.userWatches[name], fi
+	delete(w.watches, name)
+	delete(w.userWatches, name)
+	delete(w.tracked, name)
+	w.paths[watchfd] = pathInfo{name: to}
+	if _, ok := w.fileExists[name]; ok {
+		w.fileExists[to] = struct{}{}
+		delete(w.fileExists, name)
+	}
+	return to
 }
 
-// Remove stops monitoring the path for changes.
-//
-// Directories are always removed non-recursively. For example, if you added
-// /tmp/dir and /tmp/dir/subdir then you will need to remove both.
-//
-// Removing a path that has not yet been added returns [ErrNonExistentWatch].
-func (w *Watcher) Remove(name string) error {
+// isUserFile reports if the path was added with Add(), and the parent
+// directory wasn't.
+func (w *kqueue) isUserFile(name string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, ok := w.userWatches[name]
+	dirWith, dirOk := w.userWatches[filepath.Dir(name)]
+	return ok && (!dirOk || dirWith.internal)
+}
+
+func (w *kqueue) Remove(name string) error {
+	w.mu.Lock()
+	closed := w.isClosed
+	w.mu.Unlock()
+	if closed {
+		return ErrClosed
+	}
+	if w.auto.stop(filepath.Clean(name)) {
+		return nil
+	}
+	if w.auto.owns(filepath.Clean(name)) {
+		return fmt.Errorf("%w: %s", ErrNonExistentWatch, filepath.Clean(name))
+	}
+	defer w.auto.rehold(filepath.Clean(name), false)
 	return w.remove(name, true)
 }
 
-func (w *Watcher) remove(name string, unwatchFiles bool) error {
+func (w *kqueue) remove(name string, unwatchFiles bool) error {
 	name = filepath.Clean(name)
 	w.mu.Lock()
 	if w.isClosed {
@@ -328,6 +414,7 @@ func (w *Watcher) remove(name string, unwatchFiles bool) error {
 	delete(w.paths, watchfd)
 	delete(w.dirFlags, name)
 	delete(w.fileExists, name)
+	delete(w.tracked, name)
 	w.mu.Unlock()
 
 	// Find all watched paths that are in this directory that are not external.
@@ -351,14 +438,11 @@ func (w *Watcher) remove(name string, unwatchFiles bool) error {
 	return nil
 }
 
-// WatchList returns all paths added with [Add] (and are not yet removed).
-//
-// Returns nil if [Watcher.Close] was called.
-func (w *Watcher) WatchList() []string {
+func (w *kqueue) WatchList() []string {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 	if w.isClosed {
-		return nil
+		return []string{}
 	}
 
 	entries := make([]string, 0, len(w.userWatches))
@@ -366,16 +450,99 @@ func (w *Watcher) WatchList() []string {
 		entries = append(entries, pathname)
 	}
 
-	return entries
+	return w.auto.hide(entries)
+}
+
+func (w *kqueue) IsWatched(name string) bool {
+	if w.auto.owns(filepath.Clean(name)) {
+		return false
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.isClosed {
+		return false
+	}
+	_, ok := w.userWatches[filepath.Clean(name)]
+	return ok
+}
+
+func (w *kqueue) Sync(ctx context.Context) error {
+	return w.reads.sync(ctx, w.doneResp, func() bool {
+		fds := []unix.PollFd{{Fd: int32(w.kq), Events: unix.POLLIN}}
+		n, err := unix.Poll(fds, 0)
+		return n > 0 || err == unix.EINTR
+	})
+}
+
+func (w *kqueue) Fd() (uintptr, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.isClosed {
+		return 0, false
+	}
+	return uintptr(w.kq), true
+}
+
+func (w *kqueue) Heartbeat(d time.Duration) <-chan time.Time {
+	return w.reads.heartbeat(d, w.doneResp)
+}
+
+func (w *kqueue) rescan(events []Event) {
+	w.scans.send(events, w.pipe, w.Events, w.done, &w.stats)
+}
+
+func (w *kqueue) reset() error { return ErrResetUnsupported }
+
+// DryRunAdd counts the file descriptors for the path, and for every file in it
+// if it's a directory.
+func (w *kqueue) DryRunAdd(name string, opts ...addOpt) (int, error) {
+	if _, recurse := recursivePath(name); recurse {
+		return 0, ErrRecursionUnsupported
+	}
+	with, err := getOptions(opts...)
+	if err != nil {
+		return 0, err
+	}
+	name = filepath.Clean(name)
+	if _, err := dryRunDirs(name, with, w.pipe); err != nil {
+		return 0, err
+	}
+
+	n := 1
+	if ls, err := os.ReadDir(name); err == nil {
+		for _, f := range ls {
+			if !w.pipe.match(filepath.Join(name, f.Name())) {
+				n++
+			}
+		}
+	}
+	w.mu.Lock()
+	used, limit := len(w.watches), w.maxWatches
+	w.mu.Unlock()
+	if limit > 0 && n > limit-used {
+		return n, fmt.Errorf("%w: %s: needs %d watches, and only %d are left",
+			ErrWatchLimitReached, name, n, limit-used)
+	}
+	return n, nil
 }
 
-// Watch all events (except NOTE_EXTEND, NOTE_LINK, NOTE_REVOKE)
-const noteAllEvents = unix.NOTE_DELETE | unix.NOTE_WRITE | unix.NOTE_ATTRIB | unix.NOTE_RENAME
+func (w *kqueue) SupportsRecursion() bool { return false }
+
+// Watch all events (except NOTE_EXTEND and NOTE_LINK). NOTE_REVOKE is sent if
+// the filesystem is unmounted, and is sent as a Remove.
+const noteAllEvents = unix.NOTE_DELETE | unix.NOTE_WRITE | unix.NOTE_ATTRIB | unix.NOTE_RENAME | unix.NOTE_REVOKE
+
+func (w *kqueue) setMaxWatches(n int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.maxWatches = n
+}
 
 // addWatch adds name to the watched file set.
 // The flags are interpreted as described in kevent(2).
 // Returns the real path to the file which was added, if any, which may be different from the one passed in the case of symlinks.
-func (w *Watcher) addWatch(name string, flags uint32) (string, error) {
+// Symlinks are watched themselves if noFollow is set.
+func (w *kqueue) addWatch(name string, flags uint32, noFollow bool) (string, error) {
 	var isDir bool
 	name = filepath.Clean(name)
 
@@ -409,7 +576,7 @@ func (w *Watcher) addWatch(name string, flags uint32) (string, error) {
 		// will act like everything is fine if the link can't be resolved.
 		// There will simply be no file events for broken symlinks. Hence the
 		// returns of nil on errors.
-		if fi.Mode()&os.ModeSymlink == os.ModeSymlink {
+		if fi.Mode()&os.ModeSymlink == os.ModeSymlink && !noFollow {
 			name, err = filepath.EvalSymlinks(name)
 			if err != nil {
 				return "", nil
@@ -429,10 +596,18 @@ func (w *Watcher) addWatch(name string, flags uint32) (string, error) {
 			}
 		}
 
+		if !w.reserve() {
+			return "", fmt.Errorf("%w: %s", ErrWatchLimitReached, name)
+		}
+
 		// Retry on EINTR; open() can return EINTR in practice on macOS.
 		// See #354, and go issues 11180 and 39237.
+		mode := openMode
+		if noFollow {
+			mode = openModeNoFollow
+		}
 		for {
-			watchfd, err = unix.Open(name, openMode, 0)
+			watchfd, err = unix.Open(name, mode, 0)
 			if err == nil {
 				break
 			}
@@ -440,6 +615,7 @@ func (w *Watcher) addWatch(name string, flags uint32) (string, error) {
 				continue
 			}
 
+			w.release()
 			return "", err
 		}
 
@@ -449,6 +625,9 @@ func (w *Watcher) addWatch(name string, flags uint32) (string, error) {
 	err := w.register([]int{watchfd}, unix.EV_ADD|unix.EV_CLEAR|unix.EV_ENABLE, flags)
 	if err != nil {
 		unix.Close(watchfd)
+		if !alreadyWatching {
+			w.release()
+		}
 		return "", err
 	}
 
@@ -456,6 +635,7 @@ func (w *Watcher) addWatch(name string, flags uint32) (string, error) {
 		w.mu.Lock()
 		parentName := filepath.Dir(name)
 		w.watches[name] = watchfd
+		w.opening--
 
 		watchesByDir, ok := w.watchesByDir[parentName]
 		if !ok {
@@ -488,22 +668,60 @@ func (w *Watcher) addWatch(name string, flags uint32) (string, error) {
 	return name, nil
 }
 
+// reserve reserves a file descriptor to open, or returns false if that would
+// exceed the limit set with Watcher.SetMaxWatches(). Every successful call must be
+// followed by either adding the file descriptor to w.watches or release().
+func (w *kqueue) reserve() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.maxWatches > 0 && len(w.watches)+w.opening >= w.maxWatches {
+		return false
+	}
+	w.opening++
+	return true
+}
+
+func (w *kqueue) release() {
+	w.mu.Lock()
+	w.opening--
+	w.mu.Unlock()
+}
+
 // readEvents reads from kqueue and converts the received kevents into
 // Event values that it sends down the Events channel.
-func (w *Watcher) readEvents() {
+func (w *kqueue) readEvents() {
+	var died bool // Sent a DiedError
 	defer func() {
+		w.auto.close()
+		w.scans.close()
+		w.pipe.closeHeld()
 		err := unix.Close(w.kq)
-		if err != nil {
+		if err != nil && !died {
 			w.Errors <- err
 		}
 		unix.Close(w.closepipe[0])
 		close(w.Events)
 		close(w.Errors)
+		close(w.doneResp)
 	}()
 
 	eventBuffer := make([]unix.Kevent_t, 10)
 	for closed := false; !closed; {
+		w.reads.idle()
 		kevents, err := w.read(eventBuffer)
+		w.reads.start()
+		w.readTime = time.Now()
+		// The kqueue was closed or is no longer a kqueue, so kevent() will
+		// keep failing.
+		if err == unix.EBADF || err == unix.EINVAL {
+			select {
+			case <-w.done:
+			default:
+				died = true
+				w.sendError(&DiedError{Err: err})
+			}
+			return
+		}
 		// EINTR is okay, the syscall was interrupted before timeout expired.
 		if err != nil && err != unix.EINTR {
 			if !w.sendError(fmt.Errorf("fsnotify.readEvents: %w", err)) {
@@ -526,13 +744,54 @@ func (w *Watcher) readEvents() {
 				continue
 			}
 
+			// The device was removed before the NOTE_REVOKE was read.
+			if kevent.Flags&unix.EV_ERROR != 0 && unix.Errno(kevent.Data) == unix.ENXIO {
+				mask |= unix.NOTE_REVOKE
+			}
+
 			w.mu.Lock()
-			path := w.paths[watchfd]
+			path, ok := w.paths[watchfd]
+			_, user := w.userWatches[path.name]
 			w.mu.Unlock()
+			// Already removed while handling an earlier event in this batch.
+			if !ok {
+				continue
+			}
+			unmounted := user && mask&unix.NOTE_REVOKE == unix.NOTE_REVOKE
 
 			event := w.newEvent(path.name, mask)
+			event.isDir = path.isDir
+			tracked := false
+			if w.rawFor(event.Name) {
+				event.Raw = RawKqueueEvent{Ident: uint64(kevent.Ident), Filter: int32(kevent.Filter),
+					Flags: uint32(kevent.Flags), Fflags: uint32(kevent.Fflags), Data: int64(kevent.Data)}
+			}
 
-			if event.Has(Rename) || event.Has(Remove) {
+			if event.Has(Rename) {
+				var st unix.Stat_t
+				if err := unix.Fstat(watchfd, &st); err == nil {
+					w.renamed[w.renamedIndex] = renamedPath{dev: uint64(st.Dev), ino: uint64(st.Ino), name: event.Name}
+					w.renamedIndex = (w.renamedIndex + 1) % len(w.renamed)
+				}
+
+				// A file added with Add() that's renamed is gone, as on
+				// the other platforms, unless it's followed with
+				// WithTrackInode().
+				if !path.isDir && w.isUserFile(event.Name) {
+					if to := w.trackRename(watchfd, event.Name); to != "" {
+						event.Name, event.RenamedFrom, tracked = to, event.Name, true
+					} else {
+						event.Op = event.Op&^Rename | Remove
+					}
+				}
+			}
+			var rewatch withOpts
+			if (event.Has(Rename) || event.Has(Remove)) && !tracked {
+				w.mu.Lock()
+				if with, ok := w.userWatches[event.Name]; ok && !path.isDir && with.autoRewatch {
+					rewatch = with
+				}
+				w.mu.Unlock()
 				w.remove(event.Name, false)
 				w.mu.Lock()
 				delete(w.fileExists, event.Name)
@@ -548,6 +807,18 @@ func (w *Watcher) readEvents() {
 				}
 			}
 
+			if unmounted && !w.sendError(&WatchError{Path: event.Name, Op: "read", Err: ErrUnmounted}) {
+				closed = true
+				continue
+			}
+
+			if path.isDir && (event.Has(Rename) || event.Has(Remove)) {
+				if !sendOrphans(w.orphans(event.Name), w.readTime, &w.auto, &w.stats, w.sendEvent, w.sendError) {
+					closed = true
+					continue
+				}
+			}
+
 			if event.Has(Remove) {
 				// Look for a file that may have overwritten this.
 				// For example, mv f1 f2 will delete f2, then create f2.
@@ -559,21 +830,58 @@ func (w *Watcher) readEvents() {
 					if found {
 						w.sendDirectoryChangeEvents(fileDir, true)
 					}
-				} else {
+				} else if !rewatch.autoRewatch { // Watched again below.
 					filePath := filepath.Clean(event.Name)
 					if fileInfo, err := os.Lstat(filePath); err == nil {
 						w.sendFileCreatedEventIfNew(filePath, fileInfo)
+
+						// The file was replaced by another file.
+						if w.atomicSaveFor(filePath) {
+							if !w.sendEvent(Event{Name: filePath, Op: Write, Time: w.readTime}) {
+								closed = true
+								continue
+							}
+						}
 					}
 				}
 			}
+
+			if rewatch.autoRewatch {
+				w.auto.start(event.Name, rewatch, &w.stats, w.sendEvent, w.sendError)
+			}
 		}
 	}
 }
 
+// orphans stops watching the paths below the directory name that were added
+// with Add(), as they're gone once it's removed or renamed. Nothing is sent
+// for these if only an ancestor is renamed, as the watches are for the file
+// descriptors.
+func (w *kqueue) orphans(name string) []orphan {
+	var (
+		prefix = name + string(filepath.Separator)
+		found  []orphan
+	)
+	w.mu.Lock()
+	for path, with := range w.userWatches {
+		if strings.HasPrefix(path, prefix) {
+			fd, ok := w.watches[path]
+			found = append(found, orphan{name: path, isDir: ok && w.paths[fd].isDir, with: with})
+		}
+	}
+	w.mu.Unlock()
+
+	for _, o := range found {
+		// Only fails if it was already removed.
+		_ = w.remove(o.name, true)
+	}
+	return found
+}
+
 // newEvent returns an platform-independent Event based on kqueue Fflags.
-func (w *Watcher) newEvent(name string, mask uint32) Event {
-	e := Event{Name: name}
-	if mask&unix.NOTE_DELETE == unix.NOTE_DELETE {
+func (w *kqueue) newEvent(name string, mask uint32) Event {
+	e := Event{Name: name, Time: w.readTime}
+	if mask&unix.NOTE_DELETE == unix.NOTE_DELETE || mask&unix.NOTE_REVOKE == unix.NOTE_REVOKE {
 		e.Op |= Remove
 	}
 	if mask&unix.NOTE_WRITE == unix.NOTE_WRITE {
@@ -594,7 +902,7 @@ func (w *Watcher) newEvent(name string, mask uint32) Event {
 }
 
 // watchDirectoryFiles to mimic inotify when adding a watch on a directory
-func (w *Watcher) watchDirectoryFiles(dirPath string) error {
+func (w *kqueue) watchDirectoryFiles(dirPath string) error {
 	// Get all files
 	files, err := ioutil.ReadDir(dirPath)
 	if err != nil {
@@ -603,6 +911,9 @@ func (w *Watcher) watchDirectoryFiles(dirPath string) error {
 
 	for _, fileInfo := range files {
 		path := filepath.Join(dirPath, fileInfo.Name())
+		if w.pipe.match(path) {
+			continue
+		}
 
 		cleanPath, err := w.internalWatch(path, fileInfo)
 		if err != nil {
@@ -626,20 +937,23 @@ func (w *Watcher) watchDirectoryFiles(dirPath string) error {
 	return nil
 }
 
-// Search the directory for new files and send an event for them.
+// Search the directory for new files and send an event for them, and for
+// files that are gone without sending an event of their own.
 //
 // This functionality is to have the BSD watcher match the inotify, which sends
 // a create event for files created in a watched directory.
-func (w *Watcher) sendDirectoryChangeEvents(dir string, ignoreNotExists bool) {
+func (w *kqueue) sendDirectoryChangeEvents(dir string, ignoreNotExists bool) {
 	files, err := ioutil.ReadDir(dir)
 	if err != nil {
 		// Directory could have been deleted already; just ignore that.
 		if ignoreNotExists && errors.Is(err, os.ErrNotExist) {
 			return
 		}
-		if !w.sendError(fmt.Errorf("fsnotify.sendDirectoryChangeEvents: %w", err)) {
+		if !w.sendError(&WatchError{Path: dir, Op: "read", Err: err}) {
 			return
 		}
+	} else if !w.sendRemovedEvents(dir, files) {
+		return
 	}
 
 	for _, fi := range files {
@@ -650,21 +964,73 @@ func (w *Watcher) sendDirectoryChangeEvents(dir string, ignoreNotExists bool) {
 	}
 }
 
+// sendRemovedEvents sends a Remove for the files that were in dir, but are no
+// longer in the listing. Files that are watched aren't included, as the
+// NOTE_DELETE or NOTE_RENAME for the file itself is used for those (which can
+// also tell a rename apart from a remove); this is for files that couldn't be
+// watched, such as files without read permission, or new files once the
+// Watcher.SetMaxWatches() limit is reached.
+func (w *kqueue) sendRemovedEvents(dir string, files []os.FileInfo) bool {
+	listed := make(map[string]struct{}, len(files))
+	for _, fi := range files {
+		listed[fi.Name()] = struct{}{}
+	}
+
+	var gone []string
+	w.mu.Lock()
+	for path := range w.fileExists {
+		if filepath.Dir(path) != dir {
+			continue
+		}
+		if _, ok := listed[filepath.Base(path)]; ok {
+			continue
+		}
+		if _, ok := w.watches[path]; ok {
+			continue
+		}
+		delete(w.fileExists, path)
+		gone = append(gone, path)
+	}
+	w.mu.Unlock()
+
+	sort.Strings(gone)
+	for _, path := range gone {
+		if !w.sendEvent(Event{Name: path, Op: Remove, Time: w.readTime}) {
+			return false
+		}
+	}
+	return true
+}
+
 // sendFileCreatedEvent sends a create event if the file isn't already being tracked.
-func (w *Watcher) sendFileCreatedEventIfNew(filePath string, fileInfo os.FileInfo) (err error) {
+func (w *kqueue) sendFileCreatedEventIfNew(filePath string, fileInfo os.FileInfo) (err error) {
+	// Don't open a file descriptor for ignored files.
+	if w.pipe.match(filePath) {
+		return nil
+	}
+
 	w.mu.Lock()
 	_, doesExist := w.fileExists[filePath]
 	w.mu.Unlock()
 	if !doesExist {
-		if !w.sendEvent(Event{Name: filePath, Op: Create}) {
+		from := w.renamedFrom(fileInfo)
+		if !w.sendEvent(Event{Name: filePath, Op: Create, RenamedFrom: from, Moved: from != "", Time: w.readTime, isDir: fileInfo.IsDir()}) {
 			return
 		}
 	}
 
 	// like watchDirectoryFiles (but without doing another ReadDir)
-	filePath, err = w.internalWatch(filePath, fileInfo)
-	if err != nil {
+	watched, err := w.internalWatch(filePath, fileInfo)
+	switch {
+	case errors.Is(err, ErrWatchLimitReached):
+		// Still add it to w.fileExists, so the Create isn't sent again.
+		if !w.sendError(&WatchError{Path: filePath, Op: "add", Err: err}) {
+			return err
+		}
+	case err != nil:
 		return err
+	default:
+		filePath = watched
 	}
 
 	w.mu.Lock()
@@ -674,7 +1040,22 @@ func (w *Watcher) sendFileCreatedEventIfNew(filePath string, fileInfo os.FileInf
 	return nil
 }
 
-func (w *Watcher) internalWatch(name string, fileInfo os.FileInfo) (string, error) {
+// renamedFrom gets the old path if this inode was recently renamed.
+func (w *kqueue) renamedFrom(fileInfo os.FileInfo) string {
+	st, ok := fileInfo.Sys().(*syscall.Stat_t)
+	if !ok {
+		return ""
+	}
+	for i, r := range w.renamed {
+		if r.name != "" && r.dev == uint64(st.Dev) && r.ino == uint64(st.Ino) {
+			w.renamed[i] = renamedPath{}
+			return r.name
+		}
+	}
+	return ""
+}
+
+func (w *kqueue) internalWatch(name string, fileInfo os.FileInfo) (string, error) {
 	if fileInfo.IsDir() {
 		// mimic Linux providing delete events for subdirectories, but preserve
 		// the flags used if currently watching subdirectory
@@ -683,15 +1064,39 @@ func (w *Watcher) internalWatch(name string, fileInfo os.FileInfo) (string, erro
 		w.mu.Unlock()
 
 		flags |= unix.NOTE_DELETE | unix.NOTE_RENAME
-		return w.addWatch(name, flags)
+		return w.addWatch(name, flags, false)
 	}
 
 	// watch file to mimic Linux inotify
-	return w.addWatch(name, noteAllEvents)
+	return w.addWatch(name, w.fileFlags(name), false)
+}
+
+// fileFlags gets the flags to watch a file inside a watched directory with:
+// only the events for the operations of the directory, unless the file itself
+// was added with Add(). NOTE_DELETE and NOTE_RENAME are always needed to close
+// the file descriptor once the file is gone.
+func (w *kqueue) fileFlags(name string) uint32 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, ok := w.userWatches[name]; ok {
+		return noteAllEvents
+	}
+	dirWith, ok := w.userWatches[filepath.Dir(name)]
+	if !ok {
+		return noteAllEvents
+	}
+	var flags uint32 = unix.NOTE_DELETE | unix.NOTE_RENAME
+	if dirWith.ops.Has(Write) {
+		flags |= unix.NOTE_WRITE
+	}
+	if dirWith.ops.Has(Chmod) {
+		flags |= unix.NOTE_ATTRIB
+	}
+	return flags
 }
 
 // Register events with the queue.
-func (w *Watcher) register(fds []int, flags int, fflags uint32) error {
+func (w *kqueue) register(fds []int, flags int, fflags uint32) error {
 	changes := make([]unix.Kevent_t, len(fds))
 	for i, fd := range fds {
 		// SetKevent converts int to the platform-specific types.
@@ -708,7 +1113,7 @@ func (w *Watcher) register(fds []int, flags int, fflags uint32) error {
 }
 
 // read retrieves pending events, or waits until an event occurs.
-func (w *Watcher) read(events []unix.Kevent_t) ([]unix.Kevent_t, error) {
+func (w *kqueue) read(events []unix.Kevent_t) ([]unix.Kevent_t, error) {
 	n, err := unix.Kevent(w.kq, nil, events, nil)
 	if err != nil {
 		return nil, err
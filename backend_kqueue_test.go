@@ -4,9 +4,11 @@
 package fsnotify
 
 import (
+	"errors"
 	"fmt"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestRemoveState(t *testing.T) {
@@ -19,35 +21,36 @@ func TestRemoveState(t *testing.T) {
 	touch(t, file)
 
 	w := newWatcher(t, tmp)
+	b := w.b.(*kqueue)
 	addWatch(t, w, tmp)
 	addWatch(t, w, file)
 
 	check := func(wantUser, wantTotal int) {
 		t.Helper()
 
-		if len(w.watches) != wantTotal {
+		if len(b.watches) != wantTotal {
 			var d []string
-			for k, v := range w.watches {
+			for k, v := range b.watches {
 				d = append(d, fmt.Sprintf("%#v = %#v", k, v))
 			}
 			t.Errorf("unexpected number of entries in w.watches (have %d, want %d):\n%v",
-				len(w.watches), wantTotal, strings.Join(d, "\n"))
+				len(b.watches), wantTotal, strings.Join(d, "\n"))
 		}
-		if len(w.paths) != wantTotal {
+		if len(b.paths) != wantTotal {
 			var d []string
-			for k, v := range w.paths {
+			for k, v := range b.paths {
 				d = append(d, fmt.Sprintf("%#v = %#v", k, v))
 			}
 			t.Errorf("unexpected number of entries in w.paths (have %d, want %d):\n%v",
-				len(w.paths), wantTotal, strings.Join(d, "\n"))
+				len(b.paths), wantTotal, strings.Join(d, "\n"))
 		}
-		if len(w.userWatches) != wantUser {
+		if len(b.userWatches) != wantUser {
 			var d []string
-			for k, v := range w.userWatches {
+			for k, v := range b.userWatches {
 				d = append(d, fmt.Sprintf("%#v = %#v", k, v))
 			}
 			t.Errorf("unexpected number of entries in w.userWatches (have %d, want %d):\n%v",
-				len(w.userWatches), wantUser, strings.Join(d, "\n"))
+				len(b.userWatches), wantUser, strings.Join(d, "\n"))
 		}
 	}
 
@@ -67,30 +70,191 @@ func TestRemoveState(t *testing.T) {
 	// of files watches. Just make sure they're 0 after everything is removed.
 	{
 		want := 0
-		if len(w.watchesByDir) != want {
+		if len(b.watchesByDir) != want {
 			var d []string
-			for k, v := range w.watchesByDir {
+			for k, v := range b.watchesByDir {
 				d = append(d, fmt.Sprintf("%#v = %#v", k, v))
 			}
 			t.Errorf("unexpected number of entries in w.watchesByDir (have %d, want %d):\n%v",
-				len(w.watchesByDir), want, strings.Join(d, "\n"))
+				len(b.watchesByDir), want, strings.Join(d, "\n"))
 		}
-		if len(w.dirFlags) != want {
+		if len(b.dirFlags) != want {
 			var d []string
-			for k, v := range w.dirFlags {
+			for k, v := range b.dirFlags {
 				d = append(d, fmt.Sprintf("%#v = %#v", k, v))
 			}
 			t.Errorf("unexpected number of entries in w.dirFlags (have %d, want %d):\n%v",
-				len(w.dirFlags), want, strings.Join(d, "\n"))
+				len(b.dirFlags), want, strings.Join(d, "\n"))
 		}
 
-		if len(w.fileExists) != want {
+		if len(b.fileExists) != want {
 			var d []string
-			for k, v := range w.fileExists {
+			for k, v := range b.fileExists {
 				d = append(d, fmt.Sprintf("%#v = %#v", k, v))
 			}
 			t.Errorf("unexpected number of entries in w.fileExists (have %d, want %d):\n%v",
-				len(w.fileExists), want, strings.Join(d, "\n"))
+				len(b.fileExists), want, strings.Join(d, "\n"))
 		}
 	}
 }
+
+func TestKqueueNewFile(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	w := newCollector(t, tmp)
+	b := w.w.b.(*kqueue)
+	w.collect(t)
+
+	watches := func() int {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		return len(b.watches)
+	}
+
+	// New files are watched, so writes are sent without adding them.
+	touch(t, tmp, "file")
+	eventSeparator()
+	cat(t, "data", tmp, "file")
+	eventSeparator()
+	if n := watches(); n != 2 {
+		t.Errorf("%d watches; want 2", n)
+	}
+
+	// And the file descriptor is closed once the file is removed.
+	rm(t, tmp, "file")
+	waitForEvents()
+	if n := watches(); n != 1 {
+		t.Errorf("%d watches; want 1", n)
+	}
+
+	cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+		create /file
+		write  /file
+		remove /file
+	`))
+}
+
+func TestKqueueMaxWatches(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	touch(t, tmp, "file1")
+	touch(t, tmp, "file2")
+	touch(t, tmp, "file3")
+
+	w := newWatcher(t)
+	defer w.Close()
+	b := w.b.(*kqueue)
+	watches := func() int {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		return len(b.watches)
+	}
+
+	// The directory and three files need four file descriptors.
+	if err := w.SetMaxWatches(3); err != nil {
+		t.Fatal(err)
+	}
+	err := w.Add(tmp)
+	if !errors.Is(err, ErrWatchLimitReached) {
+		t.Fatalf("wrong error: %v", err)
+	}
+	if n := watches(); n != 0 {
+		t.Fatalf("%d watches left after error", n)
+	}
+	if l := w.WatchList(); len(l) != 0 {
+		t.Fatalf("WatchList not empty: %#v", l)
+	}
+
+	if err := w.SetMaxWatches(4); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Add(tmp); err != nil {
+		t.Fatal(err)
+	}
+	if n := watches(); n != 4 {
+		t.Fatalf("%d watches; want 4", n)
+	}
+
+	// New files are no longer watched.
+	touch(t, tmp, "file4")
+	timeout := time.After(5 * time.Second)
+	var gotCreate, gotErr bool
+	for !gotCreate || !gotErr {
+		select {
+		case e := <-w.Events:
+			if e.Name == join(tmp, "file4") && e.Has(Create) {
+				gotCreate = true
+			}
+		case err := <-w.Errors:
+			var werr *WatchError
+			if !errors.As(err, &werr) || !errors.Is(err, ErrWatchLimitReached) || werr.Path != join(tmp, "file4") {
+				t.Fatalf("wrong error: %v", err)
+			}
+			gotErr = true
+		case <-timeout:
+			t.Fatalf("timeout; create: %t, error: %t", gotCreate, gotErr)
+		}
+	}
+	if n := watches(); n != 4 {
+		t.Fatalf("%d watches; want 4", n)
+	}
+}
+
+func TestKqueueUnwatchedRemove(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	w := newWatcher(t)
+	if err := w.SetMaxWatches(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Add(tmp); err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		events Events
+		done   = make(chan struct{})
+	)
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case e, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				events = append(events, e)
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				// New files can't be watched.
+				if !errors.Is(err, ErrWatchLimitReached) {
+					t.Error(err)
+				}
+			}
+		}
+	}()
+
+	// So the Remove comes from reading the directory.
+	touch(t, tmp, "file1")
+	touch(t, tmp, "file2")
+	eventSeparator()
+	rm(t, tmp, "file1")
+	eventSeparator()
+	mv(t, join(tmp, "file2"), tmp, "file3")
+	waitForEvents()
+	w.Close()
+	<-done
+
+	cmpEvents(t, tmp, events, newEvents(t, `
+		create /file1
+		create /file2
+		remove /file1
+		remove /file2
+		create /file3
+	`))
+}
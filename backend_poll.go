@@ -0,0 +1,505 @@
+package fsnotify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// polling is a backend that periodically stats all watched paths, for
+// filesystems where the OS doesn't send (reliable) notifications.
+type polling struct {
+	stats // Counters for Watcher.Stats()
+
+	Events chan Event
+	Errors chan error
+	pipe   *pipeline   // Filters, changes, and sends events; shared with the Watcher.
+	auto   rewatcher   // Removed files to watch again once they're recreated, for WithAutoRewatch()
+	scans  initialScan // Existing paths to send a Create for, for WithInitialScan()
+	reads  reader      // If the poll goroutine is busy, for Watcher.Heartbeat()
+
+	interval time.Duration
+	mu       sync.Mutex            // Protects access to watches, closed
+	watches  map[string]*pollWatch // Watches added with Add() (key: path)
+	closed   bool                  // Set to true when Close() or CloseWait() is first called
+	done     chan struct{}         // Channel for sending a "quit message" to the poll goroutine
+	doneResp chan struct{}         // Closed when the poll goroutine exits
+	abort    chan struct{}         // Stop sending events; closed by Close, or by CloseWait if ctx is done
+	syncs    chan chan struct{}    // Poll right away for Sync(), and close the channel once done
+}
+
+type pollWatch struct {
+	recurse bool
+	with    withOpts
+
+	// Everything that was seen for this watch in the last poll (key: path).
+	// Only accessed from the poll goroutine once the watch is added.
+	files map[string]fs.FileInfo
+}
+
+func newPolling(interval time.Duration, ev chan Event, errs chan error, pipe *pipeline) *polling {
+	w := &polling{
+		Events:   ev,
+		Errors:   errs,
+		pipe:     pipe,
+		interval: interval,
+		watches:  make(map[string]*pollWatch),
+		done:     make(chan struct{}),
+		doneResp: make(chan struct{}),
+		abort:    make(chan struct{}),
+		syncs:    make(chan chan struct{}),
+	}
+	w.auto.b = w
+	go w.poll()
+	return w
+}
+
+// Returns true if the event was sent, or false if watcher is closed.
+func (w *polling) sendEvent(e Event) bool {
+	e.Seq = w.pipe.nextSeq()
+	if w.pipe.dropExt(e) || w.pipe.dropPaused() {
+		return true
+	}
+	w.scans.wait()
+	return w.pipe.send(w.Events, e, w.abort, &w.stats)
+}
+
+// Returns true if the error was sent, or false if watcher is closed.
+func (w *polling) sendError(err error) bool {
+	select {
+	case w.Errors <- err:
+		w.sentError(err)
+		return true
+	case <-w.abort:
+		return false
+	}
+}
+
+func (w *polling) isClosed() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.closed
+}
+
+func (w *polling) Close() error {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return nil
+	}
+	w.closed = true
+	close(w.done)
+	close(w.abort)
+	w.mu.Unlock()
+
+	<-w.doneResp
+	return nil
+}
+
+func (w *polling) CloseWait(ctx context.Context) error {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return nil
+	}
+	w.closed = true
+	close(w.done)
+	w.mu.Unlock()
+
+	select {
+	case <-w.doneResp:
+		return nil
+	case <-ctx.Done():
+		close(w.abort)
+		<-w.doneResp
+		return ctx.Err()
+	}
+}
+
+func (w *polling) AddWith(name string, opts ...addOpt) error {
+	if w.isClosed() {
+		return ErrClosed
+	}
+	with, err := getOptions(opts...)
+	if err != nil {
+		return err
+	}
+	if with.trackInode {
+		return ErrInodeUnsupported
+	}
+	if with.createWatch {
+		if waiting, err := w.auto.create(filepath.Clean(name), with, w.sendEvent, w.sendError); waiting || err != nil {
+			return err
+		}
+	}
+	if with.initialScan {
+		w.scans.begin()
+		defer w.scans.end()
+	}
+
+	name, recurse := recursivePath(filepath.Clean(name))
+	if with.internal {
+		// Directory that's waited in by the rewatcher; see rewatcher.hold().
+		w.mu.Lock()
+		watch, ok := w.watches[name]
+		w.mu.Unlock()
+		if ok && !watch.with.internal {
+			return errAlreadyWatched
+		}
+	} else {
+		w.auto.claim(name)
+	}
+	skipped := newSkippedError(with)
+	files, err := w.scan(name, recurse, with.noFollow, with.maxDepth, skipped)
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return ErrClosed
+	}
+	w.watches[name] = &pollWatch{recurse: recurse, with: with, files: files}
+	w.scans.run(name, recurse, with, w.pipe, w.Events, w.abort, &w.stats)
+	return skipped.err()
+}
+
+func (w *polling) Remove(name string) error {
+	if w.isClosed() {
+		return ErrClosed
+	}
+
+	name, recurse := recursivePath(filepath.Clean(name))
+	if w.auto.stop(name) {
+		return nil
+	}
+	if w.auto.owns(name) {
+		return fmt.Errorf("%w: %s", ErrNonExistentWatch, name)
+	}
+	defer w.auto.rehold(name, recurse)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if watch, ok := w.watches[name]; !ok || (recurse && !watch.recurse) {
+		return fmt.Errorf("%w: %s", ErrNonExistentWatch, name)
+	}
+	delete(w.watches, name)
+	return nil
+}
+
+func (w *polling) WatchList() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return []string{}
+	}
+
+	entries := make([]string, 0, len(w.watches))
+	for p, watch := range w.watches {
+		if watch.recurse {
+			p = filepath.Join(p, "...")
+		}
+		entries = append(entries, p)
+	}
+	return w.auto.hide(entries)
+}
+
+func (w *polling) IsWatched(name string) bool {
+	name, recurse := recursivePath(filepath.Clean(name))
+	if w.auto.owns(name) {
+		return false
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return false
+	}
+	watch, ok := w.watches[name]
+	return ok && (!recurse || watch.recurse)
+}
+
+// Sync polls all watches right away, rather than waiting for the next tick.
+func (w *polling) Sync(ctx context.Context) error {
+	synced := make(chan struct{})
+	select {
+	case w.syncs <- synced:
+	case <-w.doneResp:
+		return ErrClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-synced:
+		return nil
+	case <-w.doneResp:
+		return ErrClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (w *polling) Fd() (uintptr, bool) { return 0, false }
+
+func (w *polling) Heartbeat(d time.Duration) <-chan time.Time {
+	return w.reads.heartbeat(d, w.doneResp)
+}
+
+func (w *polling) rescan(events []Event) {
+	w.scans.send(events, w.pipe, w.Events, w.abort, &w.stats)
+}
+
+func (w *polling) reset() error { return ErrResetUnsupported }
+
+// DryRunAdd doesn't need any OS resources, but still scans everything to see if
+// it would fail.
+func (w *polling) DryRunAdd(name string, opts ...addOpt) (int, error) {
+	with, err := getOptions(opts...)
+	if err != nil {
+		return 0, err
+	}
+	name, recurse := recursivePath(filepath.Clean(name))
+	skipped := newSkippedError(with)
+	if _, err := w.scan(name, recurse, with.noFollow, with.maxDepth, skipped); err != nil {
+		return 0, err
+	}
+	return 0, skipped.err()
+}
+
+func (w *polling) SupportsRecursion() bool { return true }
+
+func (w *polling) setMaxWatches(int) {}
+
+// scan gets the current state of the watched path: the path itself, and
+// everything in it if it's a directory (or everything below it if recurse is
+// set, up to maxDepth levels of directories if it's not negative). Symlinks
+// inside directories are never followed.
+func (w *polling) scan(root string, recurse, noFollow bool, maxDepth int, skipped *SkippedError) (map[string]fs.FileInfo, error) {
+	stat := os.Stat
+	if noFollow {
+		stat = os.Lstat
+	}
+	fi, err := stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if recurse && !fi.IsDir() {
+		return nil, errRecursiveFile(root)
+	}
+
+	files := map[string]fs.FileInfo{root: fi}
+	if !fi.IsDir() {
+		return files, nil
+	}
+	if !recurse {
+		ls, err := os.ReadDir(root)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range ls {
+			fi, err := f.Info()
+			if err != nil {
+				continue // Removed since the ReadDir()
+			}
+			files[filepath.Join(root, f.Name())] = fi
+		}
+		return files, nil
+	}
+
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if path == root {
+			return err
+		}
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) || skipped.skip(err) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() && w.pipe.match(path) {
+			return filepath.SkipDir
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return nil // Removed since reading the directory
+		}
+		files[path] = fi
+		if d.IsDir() && maxDepth >= 0 && depth(root, path) > maxDepth {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return files, err
+}
+
+// poll all watches every interval, until the watcher is closed.
+func (w *polling) poll() {
+	defer func() {
+		w.auto.close()
+		w.scans.close()
+		w.pipe.closeHeld()
+		close(w.Errors)
+		close(w.Events)
+		close(w.doneResp)
+	}()
+
+	t := time.NewTicker(w.interval)
+	defer t.Stop()
+	for {
+		var synced chan struct{}
+		w.reads.idle()
+		select {
+		case <-w.done:
+			return
+		case <-t.C:
+		case synced = <-w.syncs:
+		}
+		w.reads.start()
+
+		w.mu.Lock()
+		names := make([]string, 0, len(w.watches))
+		watches := make(map[string]*pollWatch, len(w.watches))
+		for name, watch := range w.watches {
+			names = append(names, name)
+			watches[name] = watch
+		}
+		w.mu.Unlock()
+		sort.Strings(names)
+
+		for _, name := range names {
+			if !w.pollWatch(name, watches[name]) {
+				return
+			}
+		}
+		if synced != nil {
+			close(synced)
+		}
+	}
+}
+
+// pollWatch scans one watch and sends events for everything that changed since
+// the last poll. Returns false if the watcher was closed.
+func (w *polling) pollWatch(name string, watch *pollWatch) bool {
+	now := time.Now()
+	var rewatch bool
+	// Skipped directories were already reported by AddWith().
+	files, err := w.scan(name, watch.recurse, watch.with.noFollow, watch.with.maxDepth, newSkippedError(watch.with))
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) && !errors.Is(err, ErrNotDirectory) {
+			return w.sendError(&WatchError{Path: name, Op: "read", Err: err})
+		}
+
+		// The watched path is gone, or replaced with a file; remove the watch
+		// like the other backends do.
+		files = nil
+		w.mu.Lock()
+		if w.watches[name] == watch {
+			delete(w.watches, name)
+			rewatch = watch.with.autoRewatch && !watch.files[name].IsDir()
+		}
+		w.mu.Unlock()
+	}
+
+	var (
+		removed, created, changed []string
+		renamedFrom               = make(map[string]string)
+		replaced                  = make(map[string]struct{})
+	)
+	for path, old := range watch.files {
+		fi, ok := files[path]
+		switch {
+		case !ok:
+			removed = append(removed, path)
+		case !os.SameFile(old, fi):
+			// Replaced with a different file (e.g. a new file was renamed over
+			// it), which may have the same size and mtime.
+			removed = append(removed, path)
+			created = append(created, path)
+			if !fi.IsDir() {
+				replaced[path] = struct{}{}
+			}
+		case old.Mode() != fi.Mode() || (!fi.IsDir() && (old.Size() != fi.Size() || !old.ModTime().Equal(fi.ModTime()))):
+			changed = append(changed, path)
+		}
+	}
+	for path, fi := range files {
+		if _, ok := watch.files[path]; !ok {
+			created = append(created, path)
+		}
+		// Pair new paths with removed ones if it's the same file.
+		for _, r := range removed {
+			if r != path && os.SameFile(watch.files[r], fi) {
+				renamedFrom[path] = r
+				break
+			}
+		}
+	}
+	sort.Strings(removed)
+	sort.Strings(created)
+	sort.Strings(changed)
+
+	renamed := make(map[string]struct{}, len(renamedFrom))
+	for _, r := range renamedFrom {
+		renamed[r] = struct{}{}
+	}
+
+	send := func(e Event) bool {
+		// Watches that were only added for the rewatcher don't send anything.
+		w.auto.notify(e.Name)
+		if watch.with.internal || w.pipe.matchBelow(name, e.Name) {
+			return true
+		}
+		e.Op &= watch.with.ops
+		if e.Op == 0 {
+			return true
+		}
+		e.Time = now
+		return w.sendEvent(e)
+	}
+	// Send removes in reverse, so that the contents of a directory are
+	// removed before the directory itself.
+	for i := len(removed) - 1; i >= 0; i-- {
+		op := Remove
+		if _, ok := renamed[removed[i]]; ok {
+			op = Rename
+		}
+		if !send(Event{Name: removed[i], Op: op, isDir: watch.files[removed[i]].IsDir()}) {
+			return false
+		}
+	}
+	for _, path := range created {
+		from := renamedFrom[path]
+		if !send(Event{Name: path, Op: Create, RenamedFrom: from, Moved: from != "", isDir: files[path].IsDir()}) {
+			return false
+		}
+		if _, ok := replaced[path]; ok && watch.with.atomicSave {
+			if !send(Event{Name: path, Op: Write}) {
+				return false
+			}
+		}
+	}
+	for _, path := range changed {
+		old, fi := watch.files[path], files[path]
+		var op Op
+		if !fi.IsDir() && (old.Size() != fi.Size() || !old.ModTime().Equal(fi.ModTime())) {
+			op |= Write
+		}
+		if old.Mode() != fi.Mode() {
+			op |= Chmod
+		}
+		if !send(Event{Name: path, Op: op, isDir: fi.IsDir()}) {
+			return false
+		}
+	}
+
+	watch.files = files
+	if rewatch {
+		w.auto.start(name, watch.with, &w.stats, w.sendEvent, w.sendError)
+	}
+	return true
+}
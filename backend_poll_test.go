@@ -0,0 +1,366 @@
+package fsnotify
+
+import (
+	"context"
+	"errors"
+	"os"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func newPollingCollector(t *testing.T, add ...string) *eventCollector {
+	t.Helper()
+	w, err := NewPollingWatcher(10 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range add {
+		if err := w.Add(a); err != nil {
+			t.Fatalf("add %q: %s", a, err)
+		}
+	}
+	return &eventCollector{w: w, done: make(chan struct{}), e: make(Events, 0, 8)}
+}
+
+func TestPolling(t *testing.T) {
+	tests := []struct {
+		name string
+		ops  func(t *testing.T, tmp string)
+		want string
+	}{
+		{"create write remove", func(t *testing.T, tmp string) {
+			touch(t, tmp, "file")
+			cat(t, "data", tmp, "file")
+			rm(t, tmp, "file")
+		}, `
+			create  /file
+			write   /file
+			remove  /file
+		`},
+
+		{"create dir", func(t *testing.T, tmp string) {
+			mkdir(t, tmp, "dir")
+			touch(t, tmp, "dir", "file") // Not recursive, so no event.
+		}, `
+			create  /dir
+		`},
+
+		{"chmod", func(t *testing.T, tmp string) {
+			if runtime.GOOS == "windows" {
+				t.Skip("chmod doesn't work on Windows")
+			}
+			touch(t, tmp, "file")
+			chmod(t, 0o700, tmp, "file")
+		}, `
+			create  /file
+			chmod   /file
+		`},
+
+		{"rename", func(t *testing.T, tmp string) {
+			touch(t, tmp, "file")
+			eventSeparator() // Make sure it's seen before the rename.
+			mv(t, join(tmp, "file"), tmp, "renamed")
+		}, `
+			create  /file
+			rename  /file
+			create  /renamed
+		`},
+
+		{"replace with same size", func(t *testing.T, tmp string) {
+			cat(t, "aaaa", tmp, "file")
+			fi, err := os.Stat(join(tmp, "file"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Same size and mtime, but a different file.
+			tmp2 := t.TempDir()
+			cat(t, "bbbb", tmp2, "file")
+			os.Chtimes(join(tmp2, "file"), fi.ModTime(), fi.ModTime())
+			mv(t, join(tmp2, "file"), tmp, "file")
+		}, `
+			create  /file
+			write   /file
+			remove  /file
+			create  /file
+		`},
+
+		{"named pipe", func(t *testing.T, tmp string) {
+			if runtime.GOOS == "windows" {
+				t.Skip("no named pipes on Windows")
+			}
+			mkfifo(t, tmp, "fifo")
+			fp, err := os.OpenFile(join(tmp, "fifo"), os.O_RDWR, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := fp.Write([]byte("data")); err != nil {
+				t.Fatal(err)
+			}
+			fp.Close()
+			eventSeparator()
+			rm(t, tmp, "fifo")
+		}, `
+			create  /fifo
+			write   /fifo
+			remove  /fifo
+		`},
+
+		{"remove root", func(t *testing.T, tmp string) {
+			touch(t, tmp, "file")
+			rmAll(t, tmp)
+		}, `
+			create  /file
+			remove  /file
+			remove  /
+		`},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			tmp := t.TempDir()
+			w := newPollingCollector(t, tmp)
+			w.collect(t)
+			tt.ops(t, tmp)
+			cmpEvents(t, tmp, w.stop(t), newEvents(t, tt.want))
+		})
+	}
+}
+
+func TestPollingRecursive(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	w := newPollingCollector(t, join(tmp, "..."))
+	w.collect(t)
+
+	mkdirAll(t, tmp, "one", "two")
+	touch(t, tmp, "one", "two", "file")
+	rmAll(t, tmp, "one")
+
+	cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+		create  /one
+		create  /one/two
+		create  /one/two/file
+		remove  /one/two/file
+		remove  /one/two
+		remove  /one
+	`))
+
+	if l := w.w.WatchList(); !reflect.DeepEqual(l, []string{}) {
+		t.Errorf("wrong WatchList after Close: %s", l)
+	}
+}
+
+func TestPollingMaxDepth(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	mkdirAll(t, tmp, "one", "two")
+	w := newPollingCollector(t)
+	if err := w.w.AddWith(join(tmp, "..."), WithMaxDepth(1)); err != nil {
+		t.Fatal(err)
+	}
+	w.collect(t)
+
+	touch(t, tmp, "one", "file")
+	touch(t, tmp, "one", "two", "file") // Too deep.
+	mkdir(t, tmp, "one", "three")
+
+	cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+		create  /one/file
+		create  /one/three
+	`))
+}
+
+func TestPollingWatcher(t *testing.T) {
+	t.Run("interval", func(t *testing.T) {
+		t.Parallel()
+
+		if _, err := NewPollingWatcher(0); err == nil {
+			t.Fatal("no error for interval of 0")
+		}
+	})
+
+	t.Run("add remove", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		touch(t, tmp, "file")
+		w := newPollingCollector(t)
+		defer w.w.Close()
+
+		if err := w.w.Add(join(tmp, "nonexistent")); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("wrong error: %v", err)
+		}
+		if err := w.w.Add(join(tmp, "file", "...")); !errors.Is(err, ErrNotDirectory) {
+			t.Errorf("wrong error: %v", err)
+		}
+		addWatch(t, w.w, tmp, "...")
+		if l := w.w.WatchList(); !reflect.DeepEqual(l, []string{join(tmp, "...")}) {
+			t.Errorf("wrong WatchList: %s", l)
+		}
+		if err := w.w.Remove(join(tmp, "...")); err != nil {
+			t.Error(err)
+		}
+		if err := w.w.Remove(tmp); !errors.Is(err, ErrNonExistentWatch) {
+			t.Errorf("wrong error: %v", err)
+		}
+	})
+
+	t.Run("with ops", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		w := newPollingCollector(t)
+		if err := w.w.AddWith(tmp, WithOps(Remove)); err != nil {
+			t.Fatal(err)
+		}
+		w.collect(t)
+
+		touch(t, tmp, "file")
+		cat(t, "data", tmp, "file")
+		rm(t, tmp, "file")
+		cmpEvents(t, tmp, w.stop(t), newEvents(t, `remove /file`))
+	})
+
+	t.Run("atomic save", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		cat(t, "aaaa", tmp, "file")
+		w := newPollingCollector(t)
+		if err := w.w.AddWith(tmp, WithAtomicSaveDetection()); err != nil {
+			t.Fatal(err)
+		}
+		w.collect(t)
+
+		tmp2 := t.TempDir()
+		cat(t, "bbbb", tmp2, "file")
+		mv(t, join(tmp2, "file"), tmp, "file")
+		cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+			remove  /file
+			create  /file
+			write   /file
+		`))
+	})
+
+	t.Run("auto rewatch", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		file := join(tmp, "file")
+		touch(t, file)
+		w := newPollingCollector(t)
+		if err := w.w.AddWith(file, WithAutoRewatch()); err != nil {
+			t.Fatal(err)
+		}
+		w.collect(t)
+
+		rm(t, file)
+		eventSeparator()
+		touch(t, file)
+		waitForEvents()
+		cat(t, "data", file)
+		cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+			remove  /file
+			create  /file
+			write   /file
+		`))
+		if s := w.w.Stats(); s.Rewatches != 1 {
+			t.Errorf("Rewatches = %d; want 1", s.Rewatches)
+		}
+	})
+
+	t.Run("create watch", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		file := join(tmp, "dir", "file")
+		w := newPollingCollector(t)
+		if err := w.w.AddWith(file, WithCreateWatch()); err != nil {
+			t.Fatal(err)
+		}
+		w.collect(t)
+
+		mkdir(t, tmp, "dir")
+		waitForEvents()
+		touch(t, file)
+		waitForEvents()
+		cat(t, "data", file)
+		cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+			create  /dir/file
+			write   /dir/file
+		`))
+	})
+
+	t.Run("ignore", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		mkdir(t, tmp, "node_modules")
+		w := newPollingCollector(t)
+		if err := w.w.Ignore("node_modules"); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.w.Ignore("*.tmp"); err != nil {
+			t.Fatal(err)
+		}
+		addWatch(t, w.w, tmp, "...")
+		w.collect(t)
+
+		touch(t, tmp, "node_modules", "file")
+		touch(t, tmp, "file.tmp")
+		touch(t, tmp, "file")
+		cmpEvents(t, tmp, w.stop(t), newEvents(t, `create /file`))
+	})
+
+	t.Run("close wait", func(t *testing.T) {
+		t.Parallel()
+
+		w := newPollingCollector(t, t.TempDir())
+		if err := w.w.CloseWait(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := <-w.w.Events; ok {
+			t.Fatal("Events not closed")
+		}
+		if err := w.w.Add(t.TempDir()); !errors.Is(err, ErrClosed) {
+			t.Errorf("wrong error: %v", err)
+		}
+	})
+
+	t.Run("sync", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		w, err := NewPollingWatcher(time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer w.Close()
+		addWatch(t, w, tmp)
+
+		touch(t, tmp, "file")
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		errC := make(chan error)
+		go func() { errC <- w.Sync(ctx) }()
+		select {
+		case e := <-w.Events:
+			if want := join(tmp, "file"); e.Name != want || !e.Has(Create) {
+				t.Errorf("wrong event: %s", e)
+			}
+		case <-ctx.Done():
+			t.Fatal("no event after Sync")
+		}
+		if err := <-errC; err != nil {
+			t.Fatal(err)
+		}
+	})
+}
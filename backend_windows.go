@@ -4,6 +4,7 @@
 package fsnotify
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"os"
@@ -12,182 +13,155 @@ import (
 	"runtime"
 	"strings"
 	"sync"
+	"time"
 	"unsafe"
 
 	"golang.org/x/sys/windows"
 )
 
-// Watcher watches a set of paths, delivering events on a channel.
-//
-// A watcher should not be copied (e.g. pass it by pointer, rather than by
-// value).
-//
-// # Linux notes
-//
-// When a file is removed a Remove event won't be emitted until all file
-// descriptors are closed, and deletes will always emit a Chmod. For example:
-//
-//     fp := os.Open("file")
-//     os.Remove("file")        // Triggers Chmod
-//     fp.Close()               // Triggers Remove
-//
-// This is the event that inotify sends, so not much can be changed about this.
-//
-// The fs.inotify.max_user_watches sysctl variable specifies the upper limit
-// for the number of watches per user, and fs.inotify.max_user_instances
-// specifies the maximum number of inotify instances per user. Every Watcher you
-// create is an "instance", and every path you add is a "watch".
-//
-// These are also exposed in /proc as /proc/sys/fs/inotify/max_user_watches and
-// /proc/sys/fs/inotify/max_user_instances
-//
-// To increase them you can use sysctl or write the value to the /proc file:
-//
-//     # Default values on Linux 5.18
-//     sysctl fs.inotify.max_user_watches=124983
-//     sysctl fs.inotify.max_user_instances=128
-//
-// To make the changes persist on reboot edit /etc/sysctl.conf or
-// /usr/lib/sysctl.d/50-default.conf (details differ per Linux distro; check
-// your distro's documentation):
-//
-//     fs.inotify.max_user_watches=124983
-//     fs.inotify.max_user_instances=128
-//
-// Reaching the limit will result in a "no space left on device" or "too many open
-// files" error.
-//
-// # kqueue notes (macOS, BSD)
-//
-// kqueue requires opening a file descriptor for every file that's being watched;
-// so if you're watching a directory with five files then that's six file
-// descriptors. You will run in to your system's "max open files" limit faster on
-// these platforms.
-//
-// The sysctl variables kern.maxfiles and kern.maxfilesperproc can be used to
-// control the maximum number of open files, as well as /etc/login.conf on BSD
-// systems.
-//
-// # macOS notes
-//
-// Spotlight indexing on macOS can result in multiple events (see [#15]). A
-// temporary workaround is to add your folder(s) to the "Spotlight Privacy
-// Settings" until we have a native FSEvents implementation (see [#11]).
-//
-// [#11]: https://github.com/fsnotify/fsnotify/issues/11
-// [#15]: https://github.com/fsnotify/fsnotify/issues/15
-type Watcher struct {
-	// Events sends the filesystem change events.
-	//
-	// fsnotify can send the following events; a "path" here can refer to a
-	// file, directory, symbolic link, or special file like a FIFO.
-	//
-	//   fsnotify.Create    A new path was created; this may be followed by one
-	//                      or more Write events if data also gets written to a
-	//                      file.
-	//
-	//   fsnotify.Remove    A path was removed.
-	//
-	//   fsnotify.Rename    A path was renamed. A rename is always sent with the
-	//                      old path as Event.Name, and a Create event will be
-	//                      sent with the new name. Renames are only sent for
-	//                      paths that are currently watched; e.g. moving an
-	//                      unmonitored file into a monitored directory will
-	//                      show up as just a Create. Similarly, renaming a file
-	//                      to outside a monitored directory will show up as
-	//                      only a Rename.
-	//
-	//   fsnotify.Write     A file or named pipe was written to. A Truncate will
-	//                      also trigger a Write. A single "write action"
-	//                      initiated by the user may show up as one or multiple
-	//                      writes, depending on when the system syncs things to
-	//                      disk. For example when compiling a large Go program
-	//                      you may get hundreds of Write events, so you
-	//                      probably want to wait until you've stopped receiving
-	//                      them (see the dedup example in cmd/fsnotify).
-	//
-	//   fsnotify.Chmod     Attributes were changed. On Linux this is also sent
-	//                      when a file is removed (or more accurately, when a
-	//                      link to an inode is removed). On kqueue it's sent
-	//                      and on kqueue when a file is truncated. On Windows
-	//                      it's never sent.
-	Events chan Event
+type readDirChangesW struct {
+	stats // Counters for Watcher.Stats()
 
-	// Errors sends any errors.
-	//
-	// [ErrEventOverflow] is used to indicate ther are too many events:
-	//
-	//  - inotify: there are too many queued events (fs.inotify.max_queued_events sysctl)
-	//  - windows: The buffer size is too small.
-	//  - kqueue, fen: not used.
+	Events chan Event
 	Errors chan error
+	pipe   *pipeline   // Filters, changes, and sends events; shared with the Watcher.
+	auto   rewatcher   // Removed files to watch again once they're recreated, for WithAutoRewatch()
+	scans  initialScan // Existing paths to send a Create for, for WithInitialScan()
+	reads  reader      // If the reader goroutine is busy, for Watcher.Sync()
 
 	port  windows.Handle // Handle to completion port
 	input chan *input    // Inputs to the reader are sent on this channel
 	quit  chan chan<- error
+	abort chan struct{} // Stop sending events; closed by Close, or by CloseWait if ctx is done
+	exit  chan struct{} // Closed when the I/O thread exits
+
+	mu      sync.Mutex          // Protects access to watches, opts, closed
+	watches watchMap            // Map of watches (key: i-number)
+	opts    map[string]withOpts // Options for paths added with Add()
+	closed  bool                // Set to true when Close() is first called
 
-	mu      sync.Mutex // Protects access to watches, closed
-	watches watchMap   // Map of watches (key: i-number)
-	closed  bool       // Set to true when Close() is first called
+	// Time ReadDirectoryChanges last returned, for Event.Time. Only accessed
+	// from the I/O thread.
+	readTime time.Time
 }
 
-// NewWatcher creates a new Watcher.
-func NewWatcher() (*Watcher, error) {
+func newBackend(ev chan Event, errs chan error, pipe *pipeline) (backend, error) {
 	port, err := windows.CreateIoCompletionPort(windows.InvalidHandle, 0, 0, 0)
 	if err != nil {
 		return nil, os.NewSyscallError("CreateIoCompletionPort", err)
 	}
-	w := &Watcher{
+	w := &readDirChangesW{
 		port:    port,
 		watches: make(watchMap),
+		opts:    make(map[string]withOpts),
 		input:   make(chan *input, 1),
-		Events:  make(chan Event, 50),
-		Errors:  make(chan error),
+		Events:  ev,
+		Errors:  errs,
+		pipe:    pipe,
 		quit:    make(chan chan<- error, 1),
+		abort:   make(chan struct{}),
+		exit:    make(chan struct{}),
 	}
+	w.auto.b = w
 	go w.readEvents()
 	return w, nil
 }
 
-func (w *Watcher) isClosed() bool {
+func (w *readDirChangesW) isClosed() bool {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 	return w.closed
 }
 
-func (w *Watcher) sendEvent(name string, mask uint64) bool {
+func (w *readDirChangesW) sendEvent(name, renamedFrom string, mask uint64) bool {
+	return w.sendRawEvent(name, renamedFrom, mask, nil)
+}
+
+// sendRawEvent is like sendEvent, but sets Event.Raw to raw if
+// WithRawEvents() was used.
+func (w *readDirChangesW) sendRawEvent(name, renamedFrom string, mask uint64, raw *RawWindowsEvent) bool {
 	if mask == 0 {
 		return false
 	}
 
 	event := w.newEvent(name, uint32(mask))
-	select {
-	case ch := <-w.quit:
-		w.quit <- ch
-	case w.Events <- event:
+	event.RenamedFrom, event.Moved = renamedFrom, renamedFrom != ""
+	event.Time = w.readTime
+	if raw != nil && w.rawFor(name) {
+		event.Raw = *raw
+	}
+	return w.send(event)
+}
+
+// send is like sendEvent, but for an Event rather than a mask.
+func (w *readDirChangesW) send(e Event) bool {
+	e.Seq = w.pipe.nextSeq()
+	if w.pipe.match(e.Name) {
+		return true
+	}
+	if w.pipe.dropExt(e) || w.pipe.dropPaused() {
+		return true
 	}
+	w.scans.wait()
+	w.pipe.send(w.Events, e, w.abort, &w.stats)
 	return true
 }
 
 // Returns true if the error was sent, or false if watcher is closed.
-func (w *Watcher) sendError(err error) bool {
+func (w *readDirChangesW) sendError(err error) bool {
 	select {
 	case w.Errors <- err:
+		w.sentError(err)
 		return true
-	case <-w.quit:
+	case <-w.abort:
 	}
 	return false
 }
 
-// Close removes all watches and closes the events channel.
-func (w *Watcher) Close() error {
-	if w.isClosed() {
-		return nil
+// rawFor reports if WithRawEvents() was used for the path or a directory it's
+// in.
+func (w *readDirChangesW) rawFor(name string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for {
+		if with, ok := w.opts[name]; ok {
+			return with.raw
+		}
+		parent := filepath.Dir(name)
+		if parent == name {
+			return false
+		}
+		name = parent
 	}
+}
 
+// waitOnly reports if the directory of watch is only watched for the
+// rewatcher, in which case nothing is sent for it (see rewatcher.hold()). The
+// files in it that were added with Add() are still sent.
+func (w *readDirChangesW) waitOnly(watch *watch) bool {
 	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.opts[watch.path].internal
+}
+
+// tooDeep reports if name is in a directory below a recursive watch that's
+// deeper than the WithMaxDepth() limit.
+func (w *readDirChangesW) tooDeep(watch *watch, name string) bool {
+	w.mu.Lock()
+	with, ok := w.opts[watch.path]
+	w.mu.Unlock()
+	return ok && with.maxDepth >= 0 && depth(watch.path, name) > with.maxDepth+1
+}
+
+func (w *readDirChangesW) Close() error {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return nil
+	}
 	w.closed = true
 	w.mu.Unlock()
+	close(w.abort)
 
 	// Send "quit" message to the reader goroutine
 	ch := make(chan error)
@@ -198,85 +172,136 @@ func (w *Watcher) Close() error {
 	return <-ch
 }
 
-// Add starts monitoring the path for changes.
-//
-// A path can only be watched once; attempting to watch it more than once will
-// return an error. Paths that do not yet exist on the filesystem cannot be
-// added.
-//
-// A watch will be automatically removed if the watched path is deleted or
-// renamed. The exception is the Windows backend, which doesn't remove the
-// watcher on renames.
-//
-// Notifications on network filesystems (NFS, SMB, FUSE, etc.) or special
-// filesystems (/proc, /sys, etc.) generally don't work.
-//
-// Returns [ErrClosed] if [Watcher.Close] was called.
-//
-// # Watching directories
-//
-// All files in a directory are monitored, including new files that are created
-// after the watcher is started. Subdirectories are not watched (i.e. it's
-// non-recursive).
-//
-// # Watching files
-//
-// Watching individual files (rather than directories) is generally not
-// recommended as many tools update files atomically. Instead of "just" writing
-// to the file a temporary file will be written to first, and if successful the
-// temporary file is moved to to destination removing the original, or some
-// variant thereof. The watcher on the original file is now lost, as it no
-// longer exists.
-//
-// Instead, watch the parent directory and use Event.Name to filter out files
-// you're not interested in. There is an example of this in [cmd/fsnotify/file.go].
-func (w *Watcher) Add(name string) error {
+func (w *readDirChangesW) CloseWait(ctx context.Context) error {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return nil
+	}
+	w.closed = true
+	w.mu.Unlock()
+
+	// The reader goroutine only processes the "quit" message once it's done
+	// with the current buffer.
+	ch := make(chan error)
+	w.quit <- ch
+	if err := w.wakeupReader(); err != nil {
+		return err
+	}
+
+	select {
+	case err := <-ch:
+		return err
+	case <-ctx.Done():
+		close(w.abort)
+		<-ch
+		return ctx.Err()
+	}
+}
+
+func (w *readDirChangesW) AddWith(name string, opts ...addOpt) error {
 	if w.isClosed() {
 		return ErrClosed
 	}
+	with, err := getOptions(opts...)
+	if err != nil {
+		return err
+	}
+	if with.trackInode {
+		return ErrInodeUnsupported
+	}
+	if with.createWatch {
+		if waiting, err := w.auto.create(filepath.Clean(name), with, w.send, w.sendError); waiting || err != nil {
+			return err
+		}
+	}
+	if with.bufsize < 4096 {
+		return fmt.Errorf("fsnotify.WithBufferSize: buffer size cannot be smaller than 4096 bytes")
+	}
+	if with.ops&^Chmod == 0 {
+		return fmt.Errorf("fsnotify.WithOps: Chmod events are never sent on Windows")
+	}
+	if with.initialScan {
+		w.scans.begin()
+		defer w.scans.end()
+	}
 
+	name, recurse := recursivePath(filepath.Clean(name))
+	flags := w.toSysFlags(with.ops)
+	w.mu.Lock()
+	prev, watched := w.opts[name]
+	w.mu.Unlock()
+	shared := with.internal && watched && !prev.internal
+	switch {
+	case shared:
+		// Directory that's waited in by the rewatcher; see rewatcher.hold().
+		// Add it again with the same flags, to update the filter.
+		flags = w.toSysFlags(prev.ops)
+	case !with.internal:
+		w.auto.claim(name)
+	}
 	in := &input{
-		op:    opAddWatch,
-		path:  filepath.Clean(name),
-		flags: sysFSALLEVENTS,
-		reply: make(chan error),
+		op:      opAddWatch,
+		path:    name,
+		flags:   flags,
+		recurse: recurse,
+		bufsize: with.bufsize,
+		reply:   make(chan error),
 	}
 	w.input <- in
 	if err := w.wakeupReader(); err != nil {
 		return err
 	}
-	return <-in.reply
+	if err := <-in.reply; err != nil {
+		return err
+	}
+	if shared {
+		return errAlreadyWatched
+	}
+
+	w.mu.Lock()
+	w.opts[name] = with
+	w.mu.Unlock()
+	w.scans.run(name, recurse, with, w.pipe, w.Events, w.abort, &w.stats)
+	return nil
 }
 
-// Remove stops monitoring the path for changes.
-//
-// Directories are always removed non-recursively. For example, if you added
-// /tmp/dir and /tmp/dir/subdir then you will need to remove both.
-//
-// Removing a path that has not yet been added returns [ErrNonExistentWatch].
-func (w *Watcher) Remove(name string) error {
+func (w *readDirChangesW) Remove(name string) error {
 	if w.isClosed() {
-		return nil
+		return ErrClosed
 	}
 
+	name, recurse := recursivePath(filepath.Clean(name))
+	if w.auto.stop(name) {
+		return nil
+	}
+	if w.auto.owns(name) {
+		return fmt.Errorf("%w: %s", ErrNonExistentWatch, name)
+	}
+	defer w.auto.rehold(name, recurse)
 	in := &input{
-		op:    opRemoveWatch,
-		path:  filepath.Clean(name),
-		reply: make(chan error),
+		op:      opRemoveWatch,
+		path:    name,
+		recurse: recurse,
+		reply:   make(chan error),
 	}
 	w.input <- in
 	if err := w.wakeupReader(); err != nil {
 		return err
 	}
-	return <-in.reply
+	if err := <-in.reply; err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	delete(w.opts, name)
+	w.mu.Unlock()
+	return nil
 }
 
-// WatchList returns all paths added with [Add] (and are not yet removed).
-//
-// Returns nil if [Watcher.Close] was called.
-func (w *Watcher) WatchList() []string {
+func (w *readDirChangesW) WatchList() []string {
 	if w.isClosed() {
-		return nil
+		return []string{}
 	}
 
 	w.mu.Lock()
@@ -285,13 +310,85 @@ func (w *Watcher) WatchList() []string {
 	entries := make([]string, 0, len(w.watches))
 	for _, entry := range w.watches {
 		for _, watchEntry := range entry {
-			entries = append(entries, watchEntry.path)
+			switch {
+			case watchEntry.mask != 0 && watchEntry.recurse:
+				entries = append(entries, filepath.Join(watchEntry.path, "..."))
+			case watchEntry.mask != 0:
+				entries = append(entries, watchEntry.path)
+			}
+			for name := range watchEntry.names {
+				entries = append(entries, filepath.Join(watchEntry.path, name))
+			}
+		}
+	}
+
+	return w.auto.hide(entries)
+}
+
+func (w *readDirChangesW) IsWatched(name string) bool {
+	if w.isClosed() {
+		return false
+	}
+
+	name, recurse := recursivePath(filepath.Clean(name))
+	if w.auto.owns(name) {
+		return false
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, entry := range w.watches {
+		for _, watchEntry := range entry {
+			if watchEntry.path == name && watchEntry.mask != 0 && (!recurse || watchEntry.recurse) {
+				return true
+			}
+			if _, ok := watchEntry.names[filepath.Base(name)]; ok && !recurse && watchEntry.path == filepath.Dir(name) {
+				return true
+			}
 		}
 	}
+	return false
+}
+
+// Sync can't see if the completion port has anything queued, so this only
+// waits until the reader goroutine is done with what it already read.
+func (w *readDirChangesW) Sync(ctx context.Context) error {
+	return w.reads.sync(ctx, nil, func() bool { return false })
+}
+
+func (w *readDirChangesW) Fd() (uintptr, bool) { return 0, false }
+
+func (w *readDirChangesW) Heartbeat(d time.Duration) <-chan time.Time {
+	return w.reads.heartbeat(d, w.exit)
+}
+
+func (w *readDirChangesW) rescan(events []Event) {
+	w.scans.send(events, w.pipe, w.Events, w.abort, &w.stats)
+}
+
+func (w *readDirChangesW) reset() error { return ErrResetUnsupported }
 
-	return entries
+// DryRunAdd always needs one handle, for the directory; files are watched
+// through the directory they're in, and recursive watches don't need anything
+// extra.
+func (w *readDirChangesW) DryRunAdd(name string, opts ...addOpt) (int, error) {
+	if _, err := getOptions(opts...); err != nil {
+		return 0, err
+	}
+	name, recurse := recursivePath(filepath.Clean(name))
+	fi, err := os.Stat(name)
+	if err != nil {
+		return 0, err
+	}
+	if recurse && !fi.IsDir() {
+		return 0, errRecursiveFile(name)
+	}
+	return 1, nil
 }
 
+func (w *readDirChangesW) SupportsRecursion() bool { return true }
+
+func (w *readDirChangesW) setMaxWatches(int) {}
+
 // These options are from the old golang.org/x/exp/winfsnotify, where you could
 // add various options to the watch. This has long since been removed.
 //
@@ -311,7 +408,7 @@ const (
 	sysFSIGNORED    = 0x8000
 )
 
-func (w *Watcher) newEvent(name string, mask uint32) Event {
+func (w *readDirChangesW) newEvent(name string, mask uint32) Event {
 	e := Event{Name: name}
 	if mask&sysFSCREATE == sysFSCREATE || mask&sysFSMOVEDTO == sysFSMOVEDTO {
 		e.Op |= Create
@@ -338,10 +435,12 @@ const (
 )
 
 type input struct {
-	op    int
-	path  string
-	flags uint32
-	reply chan error
+	op      int
+	path    string
+	flags   uint32
+	recurse bool
+	bufsize int
+	reply   chan error
 }
 
 type inode struct {
@@ -351,13 +450,14 @@ type inode struct {
 }
 
 type watch struct {
-	ov     windows.Overlapped
-	ino    *inode            // i-number
-	path   string            // Directory path
-	mask   uint64            // Directory itself is being watched with these notify flags
-	names  map[string]uint64 // Map of names being watched and their notify flags
-	rename string            // Remembers the old name while renaming a file
-	buf    [65536]byte       // 64K buffer
+	ov      windows.Overlapped
+	ino     *inode            // i-number
+	path    string            // Directory path
+	recurse bool              // Recursive watch (Add("dir\\..."))
+	mask    uint64            // Directory itself is being watched with these notify flags
+	names   map[string]uint64 // Map of names being watched and their notify flags
+	rename  string            // Remembers the old name while renaming a file
+	buf     []byte            // Buffer for ReadDirectoryChanges (WithBufferSize())
 }
 
 type (
@@ -365,7 +465,7 @@ type (
 	watchMap map[uint32]indexMap
 )
 
-func (w *Watcher) wakeupReader() error {
+func (w *readDirChangesW) wakeupReader() error {
 	err := windows.PostQueuedCompletionStatus(w.port, 0, 0, nil)
 	if err != nil {
 		return os.NewSyscallError("PostQueuedCompletionStatus", err)
@@ -373,8 +473,8 @@ func (w *Watcher) wakeupReader() error {
 	return nil
 }
 
-func (w *Watcher) getDir(pathname string) (dir string, err error) {
-	attr, err := windows.GetFileAttributes(windows.StringToUTF16Ptr(pathname))
+func (w *readDirChangesW) getDir(pathname string) (dir string, err error) {
+	attr, err := windows.GetFileAttributes(windows.StringToUTF16Ptr(longPath(pathname)))
 	if err != nil {
 		return "", os.NewSyscallError("GetFileAttributes", err)
 	}
@@ -387,8 +487,61 @@ func (w *Watcher) getDir(pathname string) (dir string, err error) {
 	return
 }
 
-func (w *Watcher) getIno(path string) (ino *inode, err error) {
-	h, err := windows.CreateFile(windows.StringToUTF16Ptr(path),
+// longPath converts path to an extended-length path (\\?\C:\dir or
+// \\?\UNC\server\share\dir) for the syscalls, so that paths longer than
+// MAX_PATH can be watched. The watches (and Event.Name) keep the path as it was
+// passed to Add.
+func longPath(path string) string {
+	if strings.HasPrefix(path, `\\?\`) || strings.HasPrefix(path, `\\.\`) {
+		return path
+	}
+	if !filepath.IsAbs(path) {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return path
+		}
+		path = abs
+	}
+	if strings.HasPrefix(path, `\\`) {
+		return `\\?\UNC\` + path[2:]
+	}
+	return `\\?\` + path
+}
+
+// longName resolves 8.3 short names (PROGRA~1) in name, relative to dir, to the
+// long names. ReadDirectoryChangesW uses the name the file was accessed with,
+// which may be the short name. The name is returned as-is if it can't be
+// resolved, for example because the file was already removed.
+func longName(dir, name string) string {
+	if !strings.Contains(name, "~") {
+		return name
+	}
+	p, err := windows.UTF16PtrFromString(longPath(filepath.Join(dir, name)))
+	if err != nil {
+		return name
+	}
+	buf := make([]uint16, windows.MAX_PATH)
+	n, err := windows.GetLongPathName(p, &buf[0], uint32(len(buf)))
+	if err == nil && n > uint32(len(buf)) { // Returns the required size.
+		buf = make([]uint16, n)
+		n, err = windows.GetLongPathName(p, &buf[0], uint32(len(buf)))
+	}
+	if err != nil || n == 0 || n > uint32(len(buf)) {
+		return name
+	}
+
+	// Only the last components are from name; keep dir as it was passed to
+	// Add.
+	long := strings.Split(windows.UTF16ToString(buf[:n]), `\`)
+	k := strings.Count(name, `\`) + 1
+	if len(long) < k {
+		return name
+	}
+	return strings.Join(long[len(long)-k:], `\`)
+}
+
+func (w *readDirChangesW) getIno(path string) (ino *inode, err error) {
+	h, err := windows.CreateFile(windows.StringToUTF16Ptr(longPath(path)),
 		windows.FILE_LIST_DIRECTORY,
 		windows.FILE_SHARE_READ|windows.FILE_SHARE_WRITE|windows.FILE_SHARE_DELETE,
 		nil, windows.OPEN_EXISTING,
@@ -430,11 +583,14 @@ func (m watchMap) set(ino *inode, watch *watch) {
 }
 
 // Must run within the I/O thread.
-func (w *Watcher) addWatch(pathname string, flags uint64) error {
+func (w *readDirChangesW) addWatch(pathname string, flags uint64, recurse bool, bufsize int) error {
 	dir, err := w.getDir(pathname)
 	if err != nil {
 		return err
 	}
+	if recurse && dir != pathname {
+		return errRecursiveFile(pathname)
+	}
 
 	ino, err := w.getIno(dir)
 	if err != nil {
@@ -453,6 +609,7 @@ func (w *Watcher) addWatch(pathname string, flags uint64) error {
 			ino:   ino,
 			path:  dir,
 			names: make(map[string]uint64),
+			buf:   make([]byte, bufsize),
 		}
 		w.mu.Lock()
 		w.watches.set(ino, watchEntry)
@@ -461,27 +618,32 @@ func (w *Watcher) addWatch(pathname string, flags uint64) error {
 	} else {
 		windows.CloseHandle(ino.handle)
 	}
+	w.mu.Lock()
 	if pathname == dir {
-		watchEntry.mask |= flags
+		watchEntry.mask = flags
+		watchEntry.recurse = watchEntry.recurse || recurse
 	} else {
-		watchEntry.names[filepath.Base(pathname)] |= flags
+		watchEntry.names[filepath.Base(pathname)] = flags
 	}
+	w.mu.Unlock()
 
 	err = w.startRead(watchEntry)
 	if err != nil {
 		return err
 	}
 
+	w.mu.Lock()
 	if pathname == dir {
 		watchEntry.mask &= ^provisional
 	} else {
 		watchEntry.names[filepath.Base(pathname)] &= ^provisional
 	}
+	w.mu.Unlock()
 	return nil
 }
 
 // Must run within the I/O thread.
-func (w *Watcher) remWatch(pathname string) error {
+func (w *readDirChangesW) remWatch(pathname string, recurse bool) error {
 	dir, err := w.getDir(pathname)
 	if err != nil {
 		return err
@@ -497,50 +659,77 @@ func (w *Watcher) remWatch(pathname string) error {
 
 	err = windows.CloseHandle(ino.handle)
 	if err != nil {
-		w.sendError(os.NewSyscallError("CloseHandle", err))
+		w.sendError(&WatchError{Path: pathname, Op: "remove", Err: os.NewSyscallError("CloseHandle", err)})
 	}
-	if watch == nil {
+	if watch == nil || (recurse && (pathname != dir || !watch.recurse)) {
 		return fmt.Errorf("%w: %s", ErrNonExistentWatch, pathname)
 	}
 	if pathname == dir {
-		w.sendEvent(watch.path, watch.mask&sysFSIGNORED)
+		w.sendEvent(watch.path, "", watch.mask&sysFSIGNORED)
+		w.mu.Lock()
 		watch.mask = 0
+		watch.recurse = false
+		w.mu.Unlock()
 	} else {
 		name := filepath.Base(pathname)
-		w.sendEvent(filepath.Join(watch.path, name), watch.names[name]&sysFSIGNORED)
+		w.sendEvent(filepath.Join(watch.path, name), "", watch.names[name]&sysFSIGNORED)
+		w.mu.Lock()
 		delete(watch.names, name)
+		w.mu.Unlock()
 	}
 
 	return w.startRead(watch)
 }
 
+// orphans gets the files in the directory of watch that were added with Add(),
+// for when the directory is removed; the removal of the files isn't always
+// reported.
+func (w *readDirChangesW) orphans(watch *watch) []orphan {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var found []orphan
+	for name, mask := range watch.names {
+		if mask&provisional != 0 || mask&sysFSDELETESELF == 0 {
+			continue
+		}
+		path := filepath.Join(watch.path, name)
+		with, ok := w.opts[path]
+		if !ok {
+			with = defaultOpts
+		}
+		found = append(found, orphan{name: path, with: with})
+	}
+	return found
+}
+
 // Must run within the I/O thread.
-func (w *Watcher) deleteWatch(watch *watch) {
+func (w *readDirChangesW) deleteWatch(watch *watch) {
 	for name, mask := range watch.names {
 		if mask&provisional == 0 {
-			w.sendEvent(filepath.Join(watch.path, name), mask&sysFSIGNORED)
+			w.sendEvent(filepath.Join(watch.path, name), "", mask&sysFSIGNORED)
 		}
+		w.mu.Lock()
 		delete(watch.names, name)
+		w.mu.Unlock()
 	}
 	if watch.mask != 0 {
 		if watch.mask&provisional == 0 {
-			w.sendEvent(watch.path, watch.mask&sysFSIGNORED)
+			w.sendEvent(watch.path, "", watch.mask&sysFSIGNORED)
 		}
+		w.mu.Lock()
 		watch.mask = 0
+		w.mu.Unlock()
 	}
 }
 
 // Must run within the I/O thread.
-func (w *Watcher) startRead(watch *watch) error {
+func (w *readDirChangesW) startRead(watch *watch) error {
 	err := windows.CancelIo(watch.ino.handle)
 	if err != nil {
-		w.sendError(os.NewSyscallError("CancelIo", err))
+		w.sendError(&WatchError{Path: watch.path, Op: "read", Err: os.NewSyscallError("CancelIo", err)})
 		w.deleteWatch(watch)
 	}
-	mask := w.toWindowsFlags(watch.mask)
-	for _, m := range watch.names {
-		mask |= w.toWindowsFlags(m)
-	}
+	mask := w.notifyFilter(watch)
 	if mask == 0 {
 		err := windows.CloseHandle(watch.ino.handle)
 		if err != nil {
@@ -553,12 +742,16 @@ func (w *Watcher) startRead(watch *watch) error {
 	}
 
 	rdErr := windows.ReadDirectoryChanges(watch.ino.handle, &watch.buf[0],
-		uint32(unsafe.Sizeof(watch.buf)), false, mask, nil, &watch.ov, 0)
+		uint32(len(watch.buf)), watch.recurse, mask, nil, &watch.ov, 0)
 	if rdErr != nil {
 		err := os.NewSyscallError("ReadDirectoryChanges", rdErr)
 		if rdErr == windows.ERROR_ACCESS_DENIED && watch.mask&provisional == 0 {
 			// Watched directory was probably removed
-			w.sendEvent(watch.path, watch.mask&sysFSDELETESELF)
+			w.auto.notify(watch.path)
+			if !w.waitOnly(watch) {
+				w.sendEvent(watch.path, "", watch.mask&sysFSDELETESELF)
+			}
+			sendOrphans(w.orphans(watch), w.readTime, &w.auto, &w.stats, w.send, w.sendError)
 			err = nil
 		}
 		w.deleteWatch(watch)
@@ -568,10 +761,31 @@ func (w *Watcher) startRead(watch *watch) error {
 	return nil
 }
 
+// notifyFilter gets the ReadDirectoryChanges filter for the directory and the
+// files in it that are watched.
+//
+// bWatchSubtree is set from watch.recurse, which is only true if the directory
+// itself was added recursively: a file that's watched without its directory
+// never watches the subtree, but it shares the ReadDirectoryChanges call (and
+// the subtree) if its directory is also watched recursively.
+//
+// Directories that the rewatcher waits in always need the name changes, even if
+// the user's watch for it doesn't.
+func (w *readDirChangesW) notifyFilter(watch *watch) uint32 {
+	mask := w.toWindowsFlags(watch.mask)
+	for _, m := range watch.names {
+		mask |= w.toWindowsFileFlags(m)
+	}
+	if mask != 0 && w.auto.holds(watch.path) {
+		mask |= windows.FILE_NOTIFY_CHANGE_FILE_NAME | windows.FILE_NOTIFY_CHANGE_DIR_NAME
+	}
+	return mask
+}
+
 // readEvents reads from the I/O completion port, converts the
 // received events into Event objects and sends them via the Events channel.
 // Entry point to the I/O thread.
-func (w *Watcher) readEvents() {
+func (w *readDirChangesW) readEvents() {
 	var (
 		n   uint32
 		key uintptr
@@ -580,7 +794,10 @@ func (w *Watcher) readEvents() {
 	runtime.LockOSThread()
 
 	for {
+		w.reads.idle()
 		qErr := windows.GetQueuedCompletionStatus(w.port, &n, &key, &ov, windows.INFINITE)
+		w.reads.start()
+		w.readTime = time.Now()
 		// This error is handled after the watch == nil check below. NOTE: this
 		// seems odd, note sure if it's correct.
 
@@ -588,6 +805,24 @@ func (w *Watcher) readEvents() {
 		if watch == nil {
 			select {
 			case ch := <-w.quit:
+				// Files that are waited on for WithAutoRewatch() may be
+				// adding a watch, which needs this goroutine.
+				done := make(chan struct{})
+				go func() {
+					w.auto.close()
+					close(done)
+				}()
+				for waiting := true; waiting; {
+					select {
+					case <-done:
+						waiting = false
+					case in := <-w.input:
+						in.reply <- ErrClosed
+					}
+				}
+				w.scans.close()
+				w.pipe.closeHeld()
+
 				w.mu.Lock()
 				var indexes []indexMap
 				for _, index := range w.watches {
@@ -607,14 +842,16 @@ func (w *Watcher) readEvents() {
 				}
 				close(w.Events)
 				close(w.Errors)
+				close(w.exit)
+				w.reads.idle()
 				ch <- err
 				return
 			case in := <-w.input:
 				switch in.op {
 				case opAddWatch:
-					in.reply <- w.addWatch(in.path, uint64(in.flags))
+					in.reply <- w.addWatch(in.path, uint64(in.flags), in.recurse, in.bufsize)
 				case opRemoveWatch:
-					in.reply <- w.remWatch(in.path)
+					in.reply <- w.remWatch(in.path, in.recurse)
 				}
 			default:
 			}
@@ -629,11 +866,19 @@ func (w *Watcher) readEvents() {
 				// The i/o succeeded but the buffer is full.
 				// In theory we should be building up a full packet.
 				// In practice we can get away with just carrying on.
-				n = uint32(unsafe.Sizeof(watch.buf))
+				n = uint32(len(watch.buf))
 			}
-		case windows.ERROR_ACCESS_DENIED:
-			// Watched directory was probably removed
-			w.sendEvent(watch.path, watch.mask&sysFSDELETESELF)
+		case windows.ERROR_ACCESS_DENIED, windows.ERROR_NETNAME_DELETED:
+			// Watched directory was probably removed, or the network share it's
+			// on is gone.
+			w.auto.notify(watch.path)
+			if !w.waitOnly(watch) {
+				w.sendEvent(watch.path, "", watch.mask&sysFSDELETESELF)
+				if qErr == windows.ERROR_NETNAME_DELETED {
+					w.sendError(&WatchError{Path: watch.path, Op: "read", Err: ErrUnmounted})
+				}
+			}
+			sendOrphans(w.orphans(watch), w.readTime, &w.auto, &w.stats, w.send, w.sendError)
 			w.deleteWatch(watch)
 			w.startRead(watch)
 			continue
@@ -649,7 +894,7 @@ func (w *Watcher) readEvents() {
 		var offset uint32
 		for {
 			if n == 0 {
-				w.sendError(ErrEventOverflow)
+				w.sendError(&OverflowError{Dropped: -1})
 				break
 			}
 
@@ -664,8 +909,10 @@ func (w *Watcher) readEvents() {
 			sh.Data = uintptr(unsafe.Pointer(&raw.FileName))
 			sh.Len = size
 			sh.Cap = size
-			name := windows.UTF16ToString(buf)
+			rawEvent := &RawWindowsEvent{Action: raw.Action, Name: windows.UTF16ToString(buf)}
+			name := longName(watch.path, rawEvent.Name)
 			fullname := filepath.Join(watch.path, name)
+			w.auto.notify(fullname)
 
 			var mask uint64
 			switch raw.Action {
@@ -687,29 +934,33 @@ func (w *Watcher) readEvents() {
 					}
 				}
 				w.mu.Unlock()
-
-				if watch.names[watch.rename] != 0 {
-					watch.names[name] |= watch.names[watch.rename]
-					delete(watch.names, watch.rename)
-					mask = sysFSMOVESELF
-				}
 			}
 
-			sendNameEvent := func() {
-				w.sendEvent(fullname, watch.names[name]&mask)
-			}
-			if raw.Action != windows.FILE_ACTION_RENAMED_NEW_NAME {
-				sendNameEvent()
-			}
+			w.sendRawEvent(fullname, "", watch.names[name]&mask, rawEvent)
 			if raw.Action == windows.FILE_ACTION_REMOVED {
-				w.sendEvent(fullname, watch.names[name]&sysFSIGNORED)
-				delete(watch.names, name)
+				w.unwatchName(watch, name, rawEvent)
 			}
 
-			w.sendEvent(fullname, watch.mask&w.toFSnotifyFlags(raw.Action))
+			var renamedFrom string
 			if raw.Action == windows.FILE_ACTION_RENAMED_NEW_NAME {
-				fullname = filepath.Join(watch.path, watch.rename)
-				sendNameEvent()
+				renamedFrom = filepath.Join(watch.path, watch.rename)
+			}
+			// Also need to check the subdirectories for recursive watches, as
+			// these are never watched separately. Directories that are only
+			// watched for the rewatcher only send the events for the files
+			// in it that were added with Add().
+			if !w.waitOnly(watch) && (!watch.recurse || (!w.pipe.matchBelow(watch.path, fullname) && !w.tooDeep(watch, fullname))) {
+				w.sendRawEvent(fullname, renamedFrom, watch.mask&w.toFSnotifyFlags(raw.Action), rawEvent)
+			}
+			if raw.Action == windows.FILE_ACTION_RENAMED_NEW_NAME {
+				// A file added with Add() that's renamed is gone, as on the
+				// other platforms. If the directory is also watched it already
+				// sent a Rename.
+				if watch.mask == 0 {
+					old := filepath.Join(watch.path, watch.rename)
+					w.sendRawEvent(old, "", watch.names[watch.rename]&sysFSDELETESELF, rawEvent)
+				}
+				w.unwatchName(watch, watch.rename, rawEvent)
 			}
 
 			// Move to the next event in the buffer
@@ -727,12 +978,47 @@ func (w *Watcher) readEvents() {
 		}
 
 		if err := w.startRead(watch); err != nil {
-			w.sendError(err)
+			w.sendError(&WatchError{Path: watch.path, Op: "read", Err: err})
 		}
 	}
 }
 
-func (w *Watcher) toWindowsFlags(mask uint64) uint32 {
+// unwatchName stops watching the file name in the directory of watch after
+// it's removed or renamed, and starts WithAutoRewatch() if it was set.
+//
+// Must run within the I/O thread.
+func (w *readDirChangesW) unwatchName(watch *watch, name string, raw *RawWindowsEvent) {
+	fullname := filepath.Join(watch.path, name)
+	w.sendRawEvent(fullname, "", watch.names[name]&sysFSIGNORED, raw)
+	w.mu.Lock()
+	with, ok := w.opts[fullname]
+	rewatch := watch.names[name] != 0 && ok && with.autoRewatch
+	delete(watch.names, name)
+	w.mu.Unlock()
+	if rewatch {
+		w.auto.start(fullname, with, &w.stats, w.send, w.sendError)
+	}
+}
+
+// toSysFlags gets the notify flags to only send the given ops.
+func (w *readDirChangesW) toSysFlags(ops Op) uint32 {
+	var flags uint32 = sysFSALLEVENTS
+	if !ops.Has(Create) {
+		flags &^= sysFSCREATE | sysFSMOVEDTO
+	}
+	if !ops.Has(Write) {
+		flags &^= sysFSMODIFY
+	}
+	if !ops.Has(Remove) {
+		flags &^= sysFSDELETE | sysFSDELETESELF
+	}
+	if !ops.Has(Rename) {
+		flags &^= sysFSMOVEDFROM | sysFSMOVESELF
+	}
+	return flags
+}
+
+func (w *readDirChangesW) toWindowsFlags(mask uint64) uint32 {
 	var m uint32
 	if mask&sysFSMODIFY != 0 {
 		m |= windows.FILE_NOTIFY_CHANGE_LAST_WRITE
@@ -743,7 +1029,23 @@ func (w *Watcher) toWindowsFlags(mask uint64) uint32 {
 	return m
 }
 
-func (w *Watcher) toFSnotifyFlags(action uint32) uint64 {
+// toWindowsFileFlags is like toWindowsFlags, but for a file that's watched
+// without its directory. Only changes to the file itself are needed: creates
+// and changes to directories are never reported for it, so the
+// ReadDirectoryChanges filter can be narrower, which matters for files in busy
+// directories.
+func (w *readDirChangesW) toWindowsFileFlags(mask uint64) uint32 {
+	var m uint32
+	if mask&sysFSMODIFY != 0 {
+		m |= windows.FILE_NOTIFY_CHANGE_LAST_WRITE
+	}
+	if mask&(sysFSDELETESELF|sysFSMOVESELF) != 0 {
+		m |= windows.FILE_NOTIFY_CHANGE_FILE_NAME
+	}
+	return m
+}
+
+func (w *readDirChangesW) toFSnotifyFlags(action uint32) uint64 {
 	switch action {
 	case windows.FILE_ACTION_ADDED:
 		return sysFSCREATE
@@ -7,6 +7,8 @@ import (
 	"fmt"
 	"strings"
 	"testing"
+
+	"golang.org/x/sys/windows"
 )
 
 func TestRemoveState(t *testing.T) {
@@ -22,18 +24,19 @@ func TestRemoveState(t *testing.T) {
 	touch(t, file)
 
 	w := newWatcher(t, tmp)
+	b := w.b.(*readDirChangesW)
 	addWatch(t, w, tmp)
 	addWatch(t, w, file)
 
 	check := func(want int) {
 		t.Helper()
-		if len(w.watches) != want {
+		if len(b.watches) != want {
 			var d []string
-			for k, v := range w.watches {
+			for k, v := range b.watches {
 				d = append(d, fmt.Sprintf("%#v = %#v", k, v))
 			}
 			t.Errorf("unexpected number of entries in w.watches (have %d, want %d):\n%v",
-				len(w.watches), want, strings.Join(d, "\n"))
+				len(b.watches), want, strings.Join(d, "\n"))
 		}
 	}
 
@@ -49,3 +52,129 @@ func TestRemoveState(t *testing.T) {
 	}
 	check(0)
 }
+
+func TestNotifyFilter(t *testing.T) {
+	const (
+		fileName = windows.FILE_NOTIFY_CHANGE_FILE_NAME
+		dirName  = windows.FILE_NOTIFY_CHANGE_DIR_NAME
+		lastMod  = windows.FILE_NOTIFY_CHANGE_LAST_WRITE
+	)
+	tests := []struct {
+		name        string
+		add         func(t *testing.T, w *Watcher, tmp string)
+		want        uint32
+		wantRecurse bool
+	}{
+		{"file", func(t *testing.T, w *Watcher, tmp string) {
+			addWatch(t, w, tmp, "file")
+		}, lastMod | fileName, false},
+
+		{"file with WithOps", func(t *testing.T, w *Watcher, tmp string) {
+			if err := w.AddWith(join(tmp, "file"), WithOps(Write)); err != nil {
+				t.Fatal(err)
+			}
+		}, lastMod, false},
+
+		{"dir", func(t *testing.T, w *Watcher, tmp string) {
+			addWatch(t, w, tmp)
+		}, lastMod | fileName | dirName, false},
+
+		{"file in recursive dir", func(t *testing.T, w *Watcher, tmp string) {
+			addWatch(t, w, tmp, "...")
+			addWatch(t, w, tmp, "file")
+		}, lastMod | fileName | dirName, true},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			tmp := t.TempDir()
+			touch(t, tmp, "file")
+			w := newWatcher(t)
+			defer w.Close()
+			tt.add(t, w, tmp)
+
+			b := w.b.(*readDirChangesW)
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			for _, m := range b.watches {
+				for _, watch := range m {
+					if watch.path != tmp {
+						continue
+					}
+					if have := b.notifyFilter(watch); have != tt.want {
+						t.Errorf("filter: have 0x%x, want 0x%x", have, tt.want)
+					}
+					if watch.recurse != tt.wantRecurse {
+						t.Errorf("bWatchSubtree: have %t, want %t", watch.recurse, tt.wantRecurse)
+					}
+					return
+				}
+			}
+			t.Fatalf("no watch for %q", tmp)
+		})
+	}
+}
+
+func TestLongPath(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{`C:\dir`, `\\?\C:\dir`},
+		{`C:\dir\file`, `\\?\C:\dir\file`},
+		{`\\server\share\logs`, `\\?\UNC\server\share\logs`},
+		{`\\?\C:\dir`, `\\?\C:\dir`},
+		{`\\?\UNC\server\share`, `\\?\UNC\server\share`},
+		{`\\.\pipe\x`, `\\.\pipe\x`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			if have := longPath(tt.in); have != tt.want {
+				t.Errorf("\nhave: %s\nwant: %s", have, tt.want)
+			}
+		})
+	}
+}
+
+func TestLongName(t *testing.T) {
+	tmp := t.TempDir()
+	mkdir(t, tmp, "long directory name")
+	touch(t, tmp, "long directory name", "long file name.txt")
+
+	short := func(name string) string {
+		t.Helper()
+		p := windows.StringToUTF16Ptr(longPath(join(tmp, name)))
+		buf := make([]uint16, windows.MAX_PATH)
+		n, err := windows.GetShortPathName(p, &buf[0], uint32(len(buf)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := windows.UTF16ToString(buf[:n])
+		return s[strings.LastIndex(s, `\`)+1:]
+	}
+	dir := short("long directory name")
+	if dir == "long directory name" {
+		t.Skip("8.3 short names are disabled on this volume")
+	}
+	file := short(join("long directory name", "long file name.txt"))
+
+	tests := []struct {
+		in, want string
+	}{
+		{dir, "long directory name"},
+		{dir + `\` + file, `long directory name\long file name.txt`},
+		{`long directory name\` + file, `long directory name\long file name.txt`},
+		{"file", "file"},
+		{"REMOVE~1", "REMOVE~1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			if have := longName(tmp, tt.in); have != tt.want {
+				t.Errorf("\nhave: %s\nwant: %s", have, tt.want)
+			}
+		})
+	}
+}
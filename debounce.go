@@ -0,0 +1,230 @@
+package fsnotify
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// debounced wraps a backend to merge Create, Write, and Chmod events for the
+// same path that are sent within d of each other.
+type debounced struct {
+	backend
+
+	Events chan Event
+	Errors chan error
+	pipe   *pipeline // For Watcher.Subscribe(); the backend uses it for everything else.
+
+	d        time.Duration
+	in       chan Event    // Events from the backend
+	inErrs   chan error    // Errors from the backend
+	mu       sync.Mutex    // Protects closed
+	closed   bool          // Set to true when Close() or CloseWait() is first called
+	doneResp chan struct{} // Closed when the debounce goroutine exits
+	abort    chan struct{} // Stop sending events; closed by Close, or by CloseWait if ctx is done
+	sent     stats         // Counts the merged events; the backend counts everything else
+}
+
+// pendingEvent is an event that hasn't been sent yet, and the time after
+// which it can be sent.
+type pendingEvent struct {
+	Event
+	deadline time.Time
+}
+
+func newDebounced(d time.Duration, ev chan Event, errs chan error, pipe *pipeline) (*debounced, error) {
+	in, inErrs := make(chan Event), make(chan error)
+	b, err := newBackend(in, inErrs, pipe)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &debounced{
+		backend:  b,
+		Events:   ev,
+		Errors:   errs,
+		pipe:     pipe,
+		d:        d,
+		in:       in,
+		inErrs:   inErrs,
+		doneResp: make(chan struct{}),
+		abort:    make(chan struct{}),
+	}
+	go w.debounce()
+	return w, nil
+}
+
+func (w *debounced) setClosed() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return false
+	}
+	w.closed = true
+	return true
+}
+
+func (w *debounced) Close() error {
+	if !w.setClosed() {
+		return nil
+	}
+
+	err := w.backend.Close()
+	close(w.abort)
+	<-w.doneResp
+	return err
+}
+
+func (w *debounced) CloseWait(ctx context.Context) error {
+	if !w.setClosed() {
+		return nil
+	}
+
+	// The backend waits until all its events are read, after which all
+	// pending events are sent without waiting.
+	err := w.backend.CloseWait(ctx)
+	if err != nil {
+		close(w.abort)
+		<-w.doneResp
+		return err
+	}
+
+	select {
+	case <-w.doneResp:
+		return nil
+	case <-ctx.Done():
+		close(w.abort)
+		<-w.doneResp
+		return ctx.Err()
+	}
+}
+
+// Stats gets the counters from the backend, but with the number of events
+// after merging them.
+func (w *debounced) Stats() WatcherStats {
+	s := w.backend.Stats()
+	s.EventsDelivered = w.sent.Stats().EventsDelivered
+	return s
+}
+
+// debounce reads events from the backend until its channels are closed.
+func (w *debounced) debounce() {
+	defer func() {
+		close(w.Errors)
+		close(w.Events)
+		close(w.doneResp)
+	}()
+
+	var (
+		pending = make(map[string]*pendingEvent)
+		order   []string // Pending paths, in the order they were first seen.
+		timer   = time.NewTimer(w.d)
+	)
+	defer timer.Stop()
+
+	send := func(e Event) bool {
+		select {
+		case w.Events <- e:
+			w.sent.sentEvent()
+			w.pipe.publish(e)
+			return true
+		case <-w.abort:
+			return false
+		}
+	}
+	// Send all pending events with a deadline before t, and reset the timer
+	// for the next one.
+	flush := func(t time.Time) bool {
+		var next time.Time
+		keep := order[:0]
+		for _, name := range order {
+			p := pending[name]
+			if p.deadline.After(t) {
+				if next.IsZero() || p.deadline.Before(next) {
+					next = p.deadline
+				}
+				keep = append(keep, name)
+				continue
+			}
+			delete(pending, name)
+			if !send(p.Event) {
+				return false
+			}
+		}
+		order = keep
+		if !next.IsZero() {
+			timer.Reset(time.Until(next))
+		}
+		return true
+	}
+	// Send a pending event for name right away.
+	flushName := func(name string) bool {
+		p, ok := pending[name]
+		if !ok {
+			return true
+		}
+		delete(pending, name)
+		for i := range order {
+			if order[i] == name {
+				order = append(order[:i], order[i+1:]...)
+				break
+			}
+		}
+		return send(p.Event)
+	}
+
+	if !timer.Stop() {
+		<-timer.C
+	}
+	errs := w.inErrs
+	for {
+		select {
+		case <-w.abort:
+			return
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			select {
+			case w.Errors <- err:
+			case <-w.abort:
+				return
+			}
+		case <-timer.C:
+			if !flush(time.Now()) {
+				return
+			}
+		case e, ok := <-w.in:
+			if !ok {
+				flush(time.Now().Add(w.d))
+				return
+			}
+
+			// Remove and Rename are sent right away, after anything that was
+			// pending for the path.
+			if e.Has(Remove) || e.Has(Rename) {
+				if !flushName(e.Name) || !send(e) {
+					return
+				}
+				continue
+			}
+
+			deadline := time.Now().Add(w.d)
+			if p, ok := pending[e.Name]; ok {
+				p.Op |= e.Op
+				p.Time, p.Seq, p.isDir, p.Moved = e.Time, e.Seq, e.isDir, p.Moved || e.Moved
+				if e.RenamedFrom != "" {
+					p.RenamedFrom = e.RenamedFrom
+				}
+				p.deadline = deadline
+				continue
+			}
+			pending[e.Name] = &pendingEvent{Event: e, deadline: deadline}
+			order = append(order, e.Name)
+			if len(order) == 1 {
+				timer.Reset(w.d)
+			}
+		}
+	}
+}
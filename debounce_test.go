@@ -0,0 +1,151 @@
+package fsnotify
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func newDebouncedCollector(t *testing.T, d time.Duration, add ...string) *eventCollector {
+	t.Helper()
+	w, err := NewDebouncedWatcher(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range add {
+		if err := w.Add(a); err != nil {
+			t.Fatalf("add %q: %s", a, err)
+		}
+	}
+	return &eventCollector{w: w, done: make(chan struct{}), e: make(Events, 0, 8)}
+}
+
+func TestDebounce(t *testing.T) {
+	tests := []struct {
+		name string
+		ops  func(t *testing.T, tmp string)
+		want string
+	}{
+		{"create write", func(t *testing.T, tmp string) {
+			touch(t, tmp, "file")
+			cat(t, "data", tmp, "file")
+			cat(t, "data", tmp, "file")
+			cat(t, "data", tmp, "file")
+		}, `
+			create|write  /file
+		`},
+
+		{"remove sends pending", func(t *testing.T, tmp string) {
+			touch(t, tmp, "file")
+			cat(t, "data", tmp, "file")
+			rm(t, tmp, "file")
+		}, `
+			create|write  /file
+			remove        /file
+		`},
+
+		{"multiple paths", func(t *testing.T, tmp string) {
+			touch(t, tmp, "one")
+			touch(t, tmp, "two")
+			cat(t, "data", tmp, "one")
+		}, `
+			create|write  /one
+			create        /two
+		`},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			tmp := t.TempDir()
+			w := newDebouncedCollector(t, 200*time.Millisecond, tmp)
+			w.collect(t)
+			tt.ops(t, tmp)
+			cmpEvents(t, tmp, w.stop(t), newEvents(t, tt.want))
+		})
+	}
+}
+
+func TestDebouncedWatcher(t *testing.T) {
+	t.Run("duration", func(t *testing.T) {
+		t.Parallel()
+
+		if _, err := NewDebouncedWatcher(0); err == nil {
+			t.Fatal("no error for duration of 0")
+		}
+	})
+
+	t.Run("close wait", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		w, err := NewDebouncedWatcher(time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		addWatch(t, w, tmp)
+		touch(t, tmp, "file")
+		waitForEvents()
+
+		errC := make(chan error)
+		go func() { errC <- w.CloseWait(context.Background()) }()
+
+		var have Events
+		for e := range w.Events {
+			have = append(have, e)
+		}
+		if err := <-errC; err != nil {
+			t.Fatal(err)
+		}
+		cmpEvents(t, tmp, have, newEvents(t, `create /file`))
+	})
+
+	t.Run("flush after duration", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		w := newDebouncedCollector(t, 50*time.Millisecond, tmp)
+		defer w.w.Close()
+		touch(t, tmp, "file")
+
+		select {
+		case e := <-w.w.Events:
+			if e.Name != join(tmp, "file") || !e.Has(Create) {
+				t.Errorf("wrong event: %s", e)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("no event")
+		}
+	})
+
+	t.Run("seq", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		w := newDebouncedCollector(t, 500*time.Millisecond, tmp)
+		w.collect(t)
+		for i := 0; i < 5; i++ {
+			cat(t, "data", tmp, fmt.Sprintf("file%d", i))
+			cat(t, "data", tmp, fmt.Sprintf("file%d", i))
+		}
+		time.Sleep(time.Second)
+
+		// The Writes are merged with the Create, which has the Seq of the last
+		// Write.
+		have := w.stop(t)
+		if len(have) == 0 || len(have) >= 10 {
+			t.Fatalf("events not merged:\n%s", have)
+		}
+		for i := 1; i < len(have); i++ {
+			if have[i].Seq <= have[i-1].Seq {
+				t.Errorf("Seq for event %d not increasing: %d after %d (%s)", i, have[i].Seq, have[i-1].Seq, have[i])
+			}
+		}
+		if last := have[len(have)-1].Seq; last <= uint64(len(have)) {
+			t.Errorf("no gaps for the merged events: last Seq is %d for %d events", last, len(have))
+		}
+	})
+}
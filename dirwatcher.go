@@ -0,0 +1,234 @@
+package fsnotify
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// DirWatcher keeps a snapshot of everything in a directory in sync with the
+// filesystem, by applying the events from a [Watcher].
+//
+// For example, to print the files in a directory whenever something changes:
+//
+//	d, err := fsnotify.NewDirWatcher("/tmp/dir")
+//	if err != nil {
+//	    log.Fatal(err)
+//	}
+//	defer d.Close()
+//
+//	for range d.Changes {
+//	    for path := range d.Snapshot() {
+//	        fmt.Println(path)
+//	    }
+//	}
+type DirWatcher struct {
+	// Changes sends every event from the Watcher once it's applied to the
+	// snapshot. This channel must be read, as no further events are applied
+	// until the event is received.
+	//
+	// Changes and Errors are closed after Close is called.
+	Changes chan Event
+
+	// Errors sends the errors from the Watcher. The snapshot is scanned again
+	// after an [OverflowError], as events may have been lost; every difference
+	// that's found is sent on Changes after the error, as with
+	// [Watcher.Rescan].
+	Errors chan error
+
+	w        *Watcher
+	root     string
+	recurse  bool
+	manual   bool      // Recursive, but the Watcher doesn't support it: every directory is added separately.
+	snap     *snapshot // Everything in the directory.
+	once     sync.Once
+	done     chan struct{} // Closed by Close
+	doneResp chan struct{} // Closed when the run() goroutine exits
+}
+
+// NewDirWatcher starts watching the directory path, and scans everything in it.
+//
+// As with [Watcher.Add], everything below path is watched if it ends with
+// "/..." (or "\..." on Windows). This works on all platforms: on platforms
+// where recursive watches aren't supported every directory is watched
+// separately. Symlinks are never followed.
+func NewDirWatcher(path string) (*DirWatcher, error) {
+	root, recurse := recursivePath(cleanPath(path))
+	fi, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("%w: %s", ErrNotDirectory, root)
+	}
+
+	w, err := NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	d := &DirWatcher{
+		Changes:  make(chan Event),
+		Errors:   make(chan error),
+		w:        w,
+		root:     root,
+		recurse:  recurse,
+		manual:   recurse && !w.SupportsRecursion(),
+		done:     make(chan struct{}),
+		doneResp: make(chan struct{}),
+	}
+
+	// Watch first, so that nothing is missed between scanning and watching;
+	// events for paths that were already scanned don't change anything.
+	if recurse && !d.manual {
+		err = w.Add(filepath.Join(root, "..."))
+	} else {
+		err = w.Add(root)
+	}
+	var files map[string]fs.FileInfo
+	if err == nil {
+		files, err = d.scan(root)
+	}
+	if err != nil {
+		w.Close()
+		return nil, err
+	}
+	d.snap = &snapshot{root: root, recurse: recurse, dir: true, files: files}
+
+	go d.run()
+	return d, nil
+}
+
+// Snapshot gets a copy of everything in the directory (key: path), with the
+// paths in the same format as Event.Name. The directory itself isn't included.
+func (d *DirWatcher) Snapshot() map[string]fs.FileInfo {
+	return d.snap.copy()
+}
+
+// Close stops watching the directory, and closes the Changes and Errors
+// channels.
+//
+// It's safe to call Close more than once; later calls do nothing and return
+// nil.
+func (d *DirWatcher) Close() error {
+	var err error
+	d.once.Do(func() {
+		close(d.done)
+		err = d.w.Close()
+		<-d.doneResp
+	})
+	return err
+}
+
+func (d *DirWatcher) run() {
+	defer func() {
+		close(d.Errors)
+		close(d.Changes)
+		close(d.doneResp)
+	}()
+
+	for {
+		select {
+		case <-d.done:
+			return
+		case e, ok := <-d.w.Events:
+			if !ok {
+				return
+			}
+			if err := d.apply(e); err != nil && !d.sendError(err) {
+				return
+			}
+			select {
+			case d.Changes <- e:
+			case <-d.done:
+				return
+			}
+		case err, ok := <-d.w.Errors:
+			if !ok {
+				return
+			}
+			var (
+				overflow *OverflowError
+				diff     []Event
+			)
+			if errors.As(err, &overflow) {
+				files, scanErr := d.scan(d.root)
+				if scanErr == nil {
+					diff = d.snap.replace(files, time.Now())
+				}
+			}
+			if !d.sendError(err) {
+				return
+			}
+			for _, e := range diff {
+				select {
+				case d.Changes <- e:
+				case <-d.done:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (d *DirWatcher) sendError(err error) bool {
+	select {
+	case d.Errors <- err:
+		return true
+	case <-d.done:
+		return false
+	}
+}
+
+// apply an event to the snapshot.
+func (d *DirWatcher) apply(e Event) error {
+	fi := d.snap.apply(e)
+
+	// Directories that are created or moved in may already have something in
+	// them.
+	if d.recurse && fi != nil && fi.IsDir() && e.Has(Create) {
+		files, err := d.scan(e.Name)
+		if err != nil {
+			return err
+		}
+		d.snap.add(files)
+	}
+	return nil
+}
+
+// scan everything in dir, and everything below it if it's a recursive watch.
+// Directories are added to the Watcher if it doesn't support recursive
+// watches.
+func (d *DirWatcher) scan(dir string) (map[string]fs.FileInfo, error) {
+	files := make(map[string]fs.FileInfo)
+	err := filepath.WalkDir(dir, func(path string, e fs.DirEntry, err error) error {
+		// Removed while scanning, or can't be read.
+		if err != nil {
+			return nil
+		}
+		if path == d.root {
+			return nil
+		}
+		fi, err := e.Info()
+		if err != nil {
+			return nil
+		}
+		files[path] = fi
+		if !e.IsDir() {
+			return nil
+		}
+		if !d.recurse {
+			return filepath.SkipDir
+		}
+		if d.manual {
+			if err := d.w.Add(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+		}
+		return nil
+	})
+	return files, err
+}
@@ -0,0 +1,168 @@
+package fsnotify
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDirWatcher(t *testing.T) {
+	tests := []struct {
+		name    string
+		recurse bool
+		before  func(t *testing.T, tmp string)
+		ops     func(t *testing.T, tmp string)
+		want    []string
+	}{
+		{"initial scan", false, func(t *testing.T, tmp string) {
+			touch(t, tmp, "file")
+			mkdirAll(t, tmp, "dir", "sub")
+			touch(t, tmp, "dir", "file")
+		}, func(t *testing.T, tmp string) {}, []string{
+			"/dir",
+			"/file",
+		}},
+
+		{"create and remove", false, func(t *testing.T, tmp string) {
+			touch(t, tmp, "file")
+		}, func(t *testing.T, tmp string) {
+			touch(t, tmp, "new")
+			mkdir(t, tmp, "dir")
+			rm(t, tmp, "file")
+		}, []string{
+			"/dir",
+			"/new",
+		}},
+
+		{"rename", false, func(t *testing.T, tmp string) {
+			touch(t, tmp, "file")
+		}, func(t *testing.T, tmp string) {
+			mv(t, join(tmp, "file"), tmp, "renamed")
+		}, []string{
+			"/renamed",
+		}},
+
+		{"recursive", true, func(t *testing.T, tmp string) {
+			mkdirAll(t, tmp, "dir", "sub")
+			touch(t, tmp, "dir", "sub", "file")
+		}, func(t *testing.T, tmp string) {
+			mkdirAll(t, tmp, "new", "a", "b")
+			touch(t, tmp, "new", "a", "b", "file")
+			touch(t, tmp, "dir", "file")
+		}, []string{
+			"/dir",
+			"/dir/file",
+			"/dir/sub",
+			"/dir/sub/file",
+			"/new",
+			"/new/a",
+			"/new/a/b",
+			"/new/a/b/file",
+		}},
+
+		{"recursive remove", true, func(t *testing.T, tmp string) {
+			mkdirAll(t, tmp, "dir", "sub")
+			touch(t, tmp, "dir", "sub", "file")
+			touch(t, tmp, "file")
+		}, func(t *testing.T, tmp string) {
+			rmAll(t, tmp, "dir")
+		}, []string{
+			"/file",
+		}},
+
+		{"recursive rename", true, func(t *testing.T, tmp string) {
+			mkdirAll(t, tmp, "dir", "sub")
+			touch(t, tmp, "dir", "sub", "file")
+		}, func(t *testing.T, tmp string) {
+			mv(t, join(tmp, "dir"), tmp, "renamed")
+		}, []string{
+			"/renamed",
+			"/renamed/sub",
+			"/renamed/sub/file",
+		}},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			tmp := t.TempDir()
+			tt.before(t, tmp)
+
+			path := tmp
+			if tt.recurse {
+				path = join(tmp, "...")
+			}
+			d, err := NewDirWatcher(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer d.Close()
+			go func() {
+				for range d.Changes {
+				}
+			}()
+			go func() {
+				for err := range d.Errors {
+					t.Error(err)
+				}
+			}()
+
+			tt.ops(t, tmp)
+
+			want := make([]string, 0, len(tt.want))
+			for _, p := range tt.want {
+				want = append(want, filepath.FromSlash(p))
+			}
+			var have []string
+			for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(50 * time.Millisecond) {
+				have = have[:0]
+				for p := range d.Snapshot() {
+					have = append(have, strings.TrimPrefix(p, tmp))
+				}
+				sort.Strings(have)
+				if reflect.DeepEqual(have, want) {
+					return
+				}
+			}
+			t.Errorf("wrong snapshot\nhave: %q\nwant: %q", have, want)
+		})
+	}
+
+	t.Run("not a directory", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		touch(t, tmp, "file")
+		_, err := NewDirWatcher(join(tmp, "file"))
+		if !errors.Is(err, ErrNotDirectory) {
+			t.Errorf("wrong error: %v", err)
+		}
+	})
+
+	t.Run("close", func(t *testing.T) {
+		t.Parallel()
+
+		d, err := NewDirWatcher(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := <-d.Changes; ok {
+			t.Error("Changes not closed")
+		}
+		if _, ok := <-d.Errors; ok {
+			t.Error("Errors not closed")
+		}
+	})
+}
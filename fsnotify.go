@@ -3,84 +3,2806 @@
 //
 // Currently supported systems:
 //
-//    Linux 2.6.32+    via inotify
-//    BSD, macOS       via kqueue
-//    Windows          via ReadDirectoryChangesW
-//    illumos          via FEN
+//	Linux 2.6.32+    via inotify
+//	BSD, macOS       via kqueue
+//	Windows          via ReadDirectoryChangesW
+//	illumos          via FEN
 package fsnotify
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
+// Watcher watches a set of paths, delivering events on a channel.
+//
+// A watcher should not be copied (e.g. pass it by pointer, rather than by
+// value).
+//
+// # Linux notes
+//
+// When a file in a watched directory is removed a Remove event is emitted
+// right away. Files added with [Watcher.Add] are watched through their parent
+// directory, so the same applies to them: a Remove is sent when the file is
+// unlinked, even if there are still open file descriptors. Symlinks to files
+// are still watched directly; for those a Remove won't be emitted until all
+// file descriptors are closed, and deletes will always emit a Chmod.
+//
+// The fs.inotify.max_user_watches sysctl variable specifies the upper limit
+// for the number of watches per user, and fs.inotify.max_user_instances
+// specifies the maximum number of inotify instances per user. Every Watcher you
+// create is an "instance", and every path you add is a "watch".
+//
+// These are also exposed in /proc as /proc/sys/fs/inotify/max_user_watches and
+// /proc/sys/fs/inotify/max_user_instances
+//
+// To increase them you can use sysctl or write the value to the /proc file:
+//
+//	# Default values on Linux 5.18
+//	sysctl fs.inotify.max_user_watches=124983
+//	sysctl fs.inotify.max_user_instances=128
+//
+// To make the changes persist on reboot edit /etc/sysctl.conf or
+// /usr/lib/sysctl.d/50-default.conf (details differ per Linux distro; check
+// your distro's documentation):
+//
+//	fs.inotify.max_user_watches=124983
+//	fs.inotify.max_user_instances=128
+//
+// Reaching the max_user_watches limit will result in Add returning an error
+// wrapping [ErrWatchLimitReached], and reaching the max_user_instances limit
+// in NewWatcher returning a "too many open files" error.
+//
+// # kqueue notes (macOS, BSD)
+//
+// kqueue requires opening a file descriptor for every file that's being watched;
+// so if you're watching a directory with five files then that's six file
+// descriptors. You will run in to your system's "max open files" limit faster on
+// these platforms.
+//
+// Files created in a watched directory are opened and watched automatically, so
+// that writes to them are sent like on other platforms, and their file
+// descriptor is closed again once they're removed or renamed.
+//
+// The sysctl variables kern.maxfiles and kern.maxfilesperproc can be used to
+// control the maximum number of open files, as well as /etc/login.conf on BSD
+// systems.
+//
+// Use [Watcher.SetMaxWatches] to get [ErrWatchLimitReached] from AddWith before
+// that limit is reached.
+//
+// # macOS notes
+//
+// Spotlight indexing on macOS can result in multiple events (see [#15]). A
+// temporary workaround is to add your folder(s) to the "Spotlight Privacy
+// Settings" until we have a native FSEvents implementation (see [#11]).
+//
+// [#11]: https://github.com/fsnotify/fsnotify/issues/11
+// [#15]: https://github.com/fsnotify/fsnotify/issues/15
+type Watcher struct {
+	b      backend
+	pipe   *pipeline
+	closed int32                    // Set to 1 (with sync/atomic) when Close or CloseWait is called
+	drain  int32                    // Set to 1 (with sync/atomic) with SetDrainOnClose().
+	newFn  func() (*Watcher, error) // Create a new Watcher of the same kind, for Clone().
+
+	mu    sync.Mutex           // Protects refs, ttls, canon, opts
+	refs  map[string]int       // Number of times a path was added with WithRefCount(), if it was.
+	ttls  map[string]*watchTTL // Timers to remove a watch for WithTTL() and WithOneShot() (key: path).
+	canon map[string]string    // Path a directory or file was first added with (key: absolute path, with symlinks resolved).
+	opts  map[string]withOpts  // Options a path was last added with, for SetOps() (key: path).
+
+	// Events sends the filesystem change events.
+	//
+	// fsnotify can send the following events; a "path" here can refer to a
+	// file, directory, symbolic link, or special file like a FIFO.
+	//
+	//   fsnotify.Create    A new path was created; this may be followed by one
+	//                      or more Write events if data also gets written to a
+	//                      file.
+	//
+	//   fsnotify.Remove    A path was removed.
+	//
+	//   fsnotify.Rename    A path was renamed. A rename is always sent with the
+	//                      old path as Event.Name, and a Create event will be
+	//                      sent with the new name. Renames are only sent for
+	//                      paths that are currently watched; e.g. moving an
+	//                      unmonitored file into a monitored directory will
+	//                      show up as just a Create. Similarly, renaming a file
+	//                      to outside a monitored directory will show up as
+	//                      only a Rename.
+	//
+	//   fsnotify.Write     A file or named pipe was written to. A Truncate will
+	//                      also trigger a Write. A single "write action"
+	//                      initiated by the user may show up as one or multiple
+	//                      writes, depending on when the system syncs things to
+	//                      disk. For example when compiling a large Go program
+	//                      you may get hundreds of Write events, so you
+	//                      probably want to wait until you've stopped receiving
+	//                      them (see the dedup example in cmd/fsnotify).
+	//
+	//   fsnotify.Chmod     Attributes were changed. On Linux this is also sent
+	//                      when a file is removed (or more accurately, when a
+	//                      link to an inode is removed). On kqueue it's sent
+	//                      and on kqueue when a file is truncated. On Windows
+	//                      it's never sent.
+	//
+	// Sending an event blocks until it's received: fsnotify never drops events
+	// if this channel isn't read fast enough, but stops reading new events from
+	// the OS until it is. The OS keeps queueing events in the meantime, and an
+	// [OverflowError] is sent on the Errors channel if that queue fills up (see
+	// below). Use [NewBufferedWatcher] to smooth out bursts of events.
+	Events chan Event
+
+	// Errors sends any errors.
+	//
+	// An [OverflowError], which wraps [ErrEventOverflow], is used to indicate
+	// ther are too many events:
+	//
+	//  - inotify: there are too many queued events (fs.inotify.max_queued_events sysctl)
+	//  - windows: The buffer size is too small.
+	//  - kqueue, fen: not used.
+	//
+	// A [DiedError], which wraps [ErrWatcherDied], is sent if the watcher
+	// stopped without Close being called. On Linux the channels stay open so
+	// that [Watcher.Reset] can start it again; on other platforms they're
+	// closed after it.
+	Errors chan error
+}
+
+// backend is implemented by all the platform-specific watchers.
+type backend interface {
+	AddWith(name string, opts ...addOpt) error
+	Remove(name string) error
+	WatchList() []string
+	IsWatched(name string) bool
+	Stats() WatcherStats
+	Fd() (uintptr, bool)
+	SupportsRecursion() bool
+	Close() error
+	CloseWait(ctx context.Context) error
+	Sync(ctx context.Context) error
+	DryRunAdd(name string, opts ...addOpt) (int, error)
+	Heartbeat(d time.Duration) <-chan time.Time
+
+	// rescan sends the events from Watcher.Rescan(), in the same way as
+	// WithInitialScan().
+	rescan(events []Event)
+
+	// reset opens the OS handle again for Watcher.Reset(), and forgets all
+	// watches; the caller adds them again.
+	reset() error
+
+	// setMaxWatches sets the limit from Watcher.SetMaxWatches(); 0 for no
+	// limit.
+	setMaxWatches(n int)
+}
+
+// NewWatcher creates a new Watcher.
+func NewWatcher() (*Watcher, error) {
+	// The Windows backend has always used a small buffer.
+	if runtime.GOOS == "windows" {
+		return NewBufferedWatcher(50)
+	}
+	return NewBufferedWatcher(0)
+}
+
+// NewBufferedWatcher creates a new Watcher with a buffered Watcher.Events
+// channel that can hold sz events.
+//
+// A larger buffer uses more memory, but makes it less likely that events are
+// lost with a burst of filesystem activity: the kernel queue overflows (and
+// [ErrEventOverflow] is sent) if events aren't read fast enough. It's usually
+// better to read events faster, or increase the kernel limits if possible.
+//
+// [NewWatcher] is the same as NewBufferedWatcher(0), except on Windows where
+// it's NewBufferedWatcher(50).
+func NewBufferedWatcher(sz int) (*Watcher, error) {
+	if sz < 0 {
+		return nil, fmt.Errorf("fsnotify.NewBufferedWatcher: negative buffer size: %d", sz)
+	}
+
+	ev, errs := make(chan Event, sz), make(chan error)
+	pipe := &pipeline{events: ev}
+	b, err := newBackend(ev, errs, pipe)
+	if err != nil {
+		return nil, err
+	}
+	newFn := func() (*Watcher, error) { return NewBufferedWatcher(sz) }
+	return &Watcher{b: b, pipe: pipe, newFn: newFn, Events: ev, Errors: errs}, nil
+}
+
+// NewDebouncedWatcher creates a new Watcher that merges Create, Write, and
+// Chmod events for the same path, and sends them once no new events for that
+// path were seen for d. This is useful for editors and compilers that write
+// to a file many times in a row.
+//
+// The merged event has all the operations that were seen; for example a
+// Create followed by a few Writes is sent as one event with Create|Write. A
+// Remove or Rename is always sent right away, after anything that was still
+// pending for that path.
+//
+// Because events are held back, events for different paths may arrive in a
+// different order than they happened. Closing the watcher with
+// [Watcher.CloseWait] sends all pending events without waiting for d.
+func NewDebouncedWatcher(d time.Duration) (*Watcher, error) {
+	if d <= 0 {
+		return nil, fmt.Errorf("fsnotify.NewDebouncedWatcher: duration must be positive: %s", d)
+	}
+
+	ev, errs := make(chan Event), make(chan error)
+	pipe := &pipeline{events: ev}
+	b, err := newDebounced(d, ev, errs, pipe)
+	if err != nil {
+		return nil, err
+	}
+	newFn := func() (*Watcher, error) { return NewDebouncedWatcher(d) }
+	return &Watcher{b: b, pipe: pipe, newFn: newFn, Events: ev, Errors: errs}, nil
+}
+
+// NewPollingWatcher creates a new Watcher that stats all watched paths every
+// interval, instead of relying on the OS to send notifications. This is useful
+// for filesystems that don't support notifications (reliably), such as NFS,
+// SMB, and some FUSE filesystems.
+//
+// Changes are detected by comparing the modification time, size, and mode of
+// every path, and whether it's still the same file (inode on Unix). This means
+// that:
+//
+//   - Create, Remove, Write, and Chmod are sent as usual. Renames are sent as a
+//     Rename for the old path and a Create for the new path (with
+//     Event.RenamedFrom set), if both paths are watched.
+//   - Anything that happens between two polls is only seen as the difference;
+//     a file that's created and removed again between polls won't send any
+//     events, and multiple writes are sent as one Write.
+//   - All events are sent after the poll, and Event.Time is the time of the
+//     poll rather than the time of the change.
+//
+// Every poll reads all watched directories, so this can be expensive for large
+// directory trees or short intervals.
+func NewPollingWatcher(interval time.Duration) (*Watcher, error) {
+	if interval <= 0 {
+		return nil, fmt.Errorf("fsnotify.NewPollingWatcher: interval must be positive: %s", interval)
+	}
+
+	ev, errs := make(chan Event), make(chan error)
+	pipe := &pipeline{events: ev}
+	newFn := func() (*Watcher, error) { return NewPollingWatcher(interval) }
+	return &Watcher{b: newPolling(interval, ev, errs, pipe), pipe: pipe, newFn: newFn, Events: ev, Errors: errs}, nil
+}
+
+// NewAccumulatingWatcher creates a new Watcher that collects events until they
+// are read with [Watcher.Changes], for callers that periodically want to know
+// what changed rather than reading every event as it happens. Nothing is sent
+// on the Events channel, and events are read from the OS as fast as they come
+// in, so a slow caller doesn't cause an [OverflowError].
+//
+// Errors are still sent on the Errors channel, but only if something is
+// reading from it when they happen; otherwise they're dropped.
+func NewAccumulatingWatcher() (*Watcher, error) {
+	ev, errs := make(chan Event), make(chan error)
+	pipe := &pipeline{events: ev}
+	b, err := newAccumulated(ev, errs, pipe)
+	if err != nil {
+		return nil, err
+	}
+	return &Watcher{b: b, pipe: pipe, newFn: NewAccumulatingWatcher, Events: ev, Errors: errs}, nil
+}
+
+// Add starts monitoring the path for changes.
+//
+// A path can only be watched once; attempting to watch it more than once will
+// return an error. Paths that do not yet exist on the filesystem cannot be
+// added.
+//
+// The path is cleaned with [filepath.Clean], so "dir/", "./dir", and
+// "dir/sub/.." are all the same watch, and Event.Name uses the cleaned path:
+// Add("dir//sub/") sends "dir/sub/file". On Windows forward slashes are
+// replaced with backslashes. [Watcher.Remove] and [Watcher.IsWatched] clean
+// the path in the same way.
+//
+// Adding a path that's already watched under a different name, such as "dir"
+// and "/home/me/dir", or through a symlink, uses the existing watch: Event.Name
+// keeps using the name it was first added with, and the options for it are
+// replaced. Remove and IsWatched also work with either name. Symlinks aren't
+// resolved for paths added with [WithNoFollow].
+//
+// Changes to the watched path itself are sent with the path as Event.Name: a
+// Chmod if the permissions change (except for directories on Windows), and a
+// Remove or Rename if it's removed or renamed. The polling backend sends a
+// Remove for both, and unmounting the filesystem is also sent as a Remove.
+//
+// A watch will be automatically removed if the watched path is deleted or
+// renamed. The exception is the Windows backend, which doesn't remove the
+// watcher on renames, and the inotify backend, which keeps watching a
+// directory under the new name if it's renamed to a directory that's also
+// watched.
+//
+// The same happens if a directory the path is in is removed or renamed, in
+// which case a Remove is sent for the path even if the OS doesn't report it.
+// This requires that the event for the directory is seen: it's watched, its
+// parent directory is watched, or on Linux the path is a file and the directory
+// is the one it's in. Renaming a directory further up isn't detected.
+//
+// Notifications on network filesystems (NFS, SMB, FUSE, etc.) or special
+// filesystems (/proc, /sys, etc.) generally don't work. The exception is SMB
+// shares on Windows: UNC paths such as \\server\share\dir can be watched, as
+// can paths longer than MAX_PATH. Event.Name uses the path as it was passed to
+// Add, without a \\?\ prefix. Names of files in the directory always use the
+// long name, also when the file was accessed with an 8.3 short name such as
+// PROGRA~1, except when the file no longer exists.
+//
+// Returns [ErrClosed] if [Watcher.Close] was called. Errors for the path are
+// the same on all platforms: [ErrNotExist] if it doesn't exist, [ErrPermission]
+// if it can't be read, and [ErrNotDirectory] if a recursive watch is added for
+// a file or part of the path isn't a directory. These still wrap the error
+// from the OS.
+//
+// # Watching directories
+//
+// All files in a directory are monitored, including new files that are created
+// after the watcher is started. Subdirectories are not watched (i.e. it's
+// non-recursive), unless the path ends with "/..." (or "\..." on Windows).
+//
+// Add("dir/...") watches dir and every directory below it, including
+// directories created after the watch was added. Symlinks to directories are
+// not followed. Recursive watches are supported on Linux, Windows, and illumos;
+// other platforms return [ErrRecursionUnsupported]. Use
+// [Watcher.SupportsRecursion] to check before adding one.
+//
+// # Watching files
+//
+// A watched file sends Write and Chmod events. When the file is deleted,
+// renamed, or replaced by another file a Remove is sent and the watch is
+// removed. On Linux the file is watched through its parent directory, which
+// isn't reported in [Watcher.WatchList]. If the parent directory is itself
+// watched its events are sent as usual.
+//
+// A write through another hard link to a watched file sends a Write for the
+// watched name. On Linux this is only detected for files that already had more
+// than one link when they were added, and adding or removing a link sends a
+// Chmod. On Windows it may not be sent if the other link is in a directory
+// that isn't watched. A Remove is only sent when the watched name itself is
+// removed.
+//
+// Many tools update files atomically: a temporary file is written first, and if
+// successful it's moved to the destination, replacing the original. The watch
+// is lost after this, as the original file no longer exists. On Linux
+// [WithAtomicSaveDetection] sends a Write instead and keeps watching the file.
+// Otherwise, watch the parent directory and use Event.Name to filter out files
+// you're not interested in. There is an example of this in [cmd/fsnotify/file.go].
+// For files that are deleted and recreated, such as logs that are rotated, use
+// [WithAutoRewatch].
+//
+// Named pipes (FIFOs), sockets, and device files can be watched like files on
+// Linux, illumos, and with [NewPollingWatcher]: Chmod and Remove are sent as
+// for files, and Write is sent when something is written to a named pipe or
+// device (but not for sockets, as nothing is written to the file). kqueue can't
+// watch sockets or named pipes, and Add returns [ErrSpecialFileUnsupported] for
+// them; in a watched directory they're still sent as Create and Remove. Windows
+// has no such files.
+func (w *Watcher) Add(name string) error { return w.AddWith(name) }
+
+// AddWith is like [Watcher.Add], but allows adding options. When using Add()
+// the defaults described below are used.
+//
+// Possible options are:
+//
+//   - [WithBufferSize] sets the buffer size for the Windows backend; no-op on
+//     other platforms. The default is 64K (65536 bytes).
+//   - [WithOps] only sends the given operations for this watch. The default is
+//     to send all operations.
+//   - [WithNoFollow] watches a symlink itself, rather than the path it points
+//     to.
+//   - [WithAtomicSaveDetection] sends a Write when a file is renamed over
+//     another file.
+//   - [WithFollowSymlinks] follows symlinks to directories in recursive
+//     watches.
+//   - [WithDedup] drops events that are the same as the previous event.
+//   - [WithAutoRewatch] watches a file again if it's recreated after it was
+//     removed or renamed.
+//   - [WithMaxDepth] limits how many levels of directories below the root a
+//     recursive watch watches.
+//   - [WithInitialScan] sends a Create for the paths that already exist.
+//   - [WithCreateWatch] waits for the path to be created if it doesn't exist
+//     yet.
+//   - [WithBasePath] sends Event.Name relative to a directory.
+//   - [WithChmodAsWrite] also sets Write for Chmod events.
+//   - [WithRefCount] counts how often the path was added, for [Watcher.Remove].
+//   - [WithoutHidden] drops events for hidden files and directories.
+//   - [WithSkipErrors] skips directories that can't be read in recursive
+//     watches, rather than failing.
+//   - [WithSizeTracking] reports if a Write truncated a file, with
+//     [Event.IsTruncated].
+//   - [WithTTL] removes the watch after a duration, and
+//     [WithTTLResetOnEvent] restarts it on every event.
+//   - [WithSlashPaths] sends paths with forward slashes on Windows.
+//   - [WithCloseWriteOnly] sends a Write once a file is closed on Linux.
+//   - [WithResolveTargets] also watches the files that symlinks point to on
+//     Linux.
+//   - [WithMergeCreateWrite] sends a Create and a Write right after it as one
+//     event.
+//   - [WithRawEvents] sets Event.Raw to the event the OS sent.
+//   - [WithRateLimit] limits the number of events for every path.
+//   - [WithSnapshot] keeps the state of the watch for [Watcher.Rescan].
+//   - [WithTrackInode] keeps watching a file when it's renamed on Linux and
+//     kqueue.
+//   - [WithPartialRecursion] keeps the directories of a recursive watch that
+//     could be watched if some can't be.
+//   - [WithOneShot] removes the watch after the first event.
+//   - [WithRealPath] sends events under the path with symlinks resolved.
+//
+// Adding a path that is already watched replaces the options for that path.
+func (w *Watcher) AddWith(name string, opts ...addOpt) error {
+	if w.isClosed() {
+		return ErrClosed
+	}
+	with, err := getOptions(opts...)
+	if err != nil {
+		return err
+	}
+
+	name = cleanPath(name)
+	if with.realPath {
+		real, err := realPath(name)
+		if err != nil {
+			return err
+		}
+		// Sending events as another path would defeat the point.
+		if name, _ = w.canonical(real, false); name != real {
+			return fmt.Errorf("fsnotify.WithRealPath: %s is already watched as %s", real, name)
+		}
+	}
+	// Set before adding the watch, as WithInitialScan() starts sending events
+	// right away.
+	name, key := w.canonical(name, with.noFollow)
+	path, recurse := recursivePath(name)
+	var ttl *watchTTL
+	if with.ttl > 0 || with.oneShot {
+		ttl = &watchTTL{d: with.ttl, once: with.oneShot}
+	}
+	if err := w.pipe.setRewrite(path, with, ttl); err != nil {
+		return err
+	}
+	if with.snapshot {
+		w.pipe.takeSnapshot(path, recurse, with)
+	}
+	// Chmod needs to be sent by the backend to send it as a Write.
+	if with.chmodAsWrite && with.ops.Has(Write) && !with.ops.Has(Chmod) {
+		opts = append(opts[:len(opts):len(opts)], WithOps(with.ops|Chmod))
+	}
+	watched := w.b.IsWatched(path)
+	err = w.b.AddWith(name, opts...)
+	var skipped *SkippedError
+	if err != nil && !errors.As(err, &skipped) {
+		if !w.b.IsWatched(path) {
+			w.pipe.forgetRewrite(path)
+		}
+		return classifyError(path, err)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.canon == nil {
+		w.canon = make(map[string]string)
+	}
+	w.canon[key] = path
+	if w.opts == nil {
+		w.opts = make(map[string]withOpts)
+	}
+	w.opts[path] = with
+	w.stopTTL(path)
+	if ttl != nil {
+		if w.ttls == nil {
+			w.ttls = make(map[string]*watchTTL)
+		}
+		w.ttls[path] = ttl
+		ttl.start(func() { w.expire(path, name, ttl) })
+	}
+	switch n := w.refs[path]; {
+	case !watched && with.refCount:
+		if w.refs == nil {
+			w.refs = make(map[string]int)
+		}
+		w.refs[path] = 1
+	case !watched:
+		// Was removed by the OS since it was last added.
+		delete(w.refs, path)
+	case with.refCount:
+		// A path that was added without WithRefCount() counts once.
+		if n == 0 {
+			n = 1
+		}
+		if w.refs == nil {
+			w.refs = make(map[string]int)
+		}
+		w.refs[path] = n + 1
+	}
+	return err
+}
+
+// AddOps is like [Watcher.Add], but only sends the operations in ops for the
+// watch. It's the same as AddWith(name, WithOps(ops)); start from [AllOps] and
+// mask out what you don't need:
+//
+//	w.AddOps("/tmp", fsnotify.AllOps&^fsnotify.Chmod)
+func (w *Watcher) AddOps(name string, ops Op) error { return w.AddWith(name, WithOps(ops)) }
+
+// AddFS watches name in the directory root, and sends Event.Name (and
+// Event.RenamedFrom) as an [io/fs] path relative to root: with slashes as the
+// separator on all platforms, and "." for root itself. For example:
+//
+//	w.AddFS("/srv/site", "static/css")
+//
+// watches /srv/site/static/css and sends "static/css/main.css" for
+// /srv/site/static/css/main.css. This is the same as using [Watcher.AddWith]
+// with [WithBasePath] and [WithSlashPaths].
+//
+// The name must be valid for [fs.ValidPath], and can end with "/..." for a
+// recursive watch. Paths in errors and [Watcher.WatchList] are the OS paths,
+// and the watch is removed with Remove(filepath.Join(root, name)).
+func (w *Watcher) AddFS(root, name string) error {
+	if !fs.ValidPath(name) {
+		return fmt.Errorf("fsnotify.AddFS: invalid path: %q", name)
+	}
+	return w.AddWith(filepath.Join(root, filepath.FromSlash(name)), WithBasePath(root), WithSlashPaths())
+}
+
+// AddGlob watches the directory of pattern, and only sends events for the paths
+// in it with a base name that matches the last element of pattern, as with
+// [filepath.Match]. For example:
+//
+//	w.AddGlob("/incoming/upload-*.dat")
+//
+// sends events for /incoming/upload-1.dat, but not for /incoming/upload-1.tmp.
+// Events for the directory itself are always sent. Only the base name can be a
+// pattern; the directory is used as-is, and isn't watched recursively.
+//
+// Every event is matched on its own name, so renaming a file in the directory
+// sends the Rename if the old name matches and the Create if the new name
+// matches: renaming upload-1.tmp to upload-1.dat only sends a Create for
+// upload-1.dat.
+//
+// Returns an error wrapping [filepath.ErrBadPattern] if the pattern is
+// malformed. The watch is removed with Remove on the directory. Unlike
+// [Watcher.Ignore] this applies to this watch only.
+func (w *Watcher) AddGlob(pattern string) error {
+	dir, base := filepath.Split(cleanPath(pattern))
+	if _, err := filepath.Match(base, ""); err != nil {
+		return fmt.Errorf("fsnotify.AddGlob: %w: %q", err, pattern)
+	}
+	if dir == "" {
+		dir = "."
+	}
+	return w.AddWith(dir, func(opt *withOpts) { opt.glob = base })
+}
+
+// Remove stops monitoring the path for changes.
+//
+// Directories are always removed non-recursively. For example, if you added
+// /tmp/dir and /tmp/dir/subdir then you will need to remove both.
+//
+// A recursive watch added with "/tmp/dir/..." can be removed with either
+// "/tmp/dir/..." or "/tmp/dir", which removes the watches for all the
+// subdirectories too. Using "/..." for a path that wasn't added recursively
+// returns [ErrNonExistentWatch].
+//
+// Removing a path that has not yet been added returns [ErrNonExistentWatch].
+//
+// If the path was added more than once with [WithRefCount] the watch is only
+// removed once Remove was called as many times; the other calls only return
+// nil.
+//
+// Returns [ErrClosed] if [Watcher.Close] was called.
+func (w *Watcher) Remove(name string) error {
+	if w.isClosed() {
+		return ErrClosed
+	}
+	name = cleanPath(name)
+	if !w.b.IsWatched(name) {
+		name, _ = w.canonical(name, false)
+	}
+	path, _ := recursivePath(name)
+	w.mu.Lock()
+	if n := w.refs[path]; n > 1 && w.b.IsWatched(name) {
+		w.refs[path] = n - 1
+		w.mu.Unlock()
+		return nil
+	}
+	w.mu.Unlock()
+
+	err := w.b.Remove(name)
+	if err == nil {
+		w.pipe.forgetRewrite(path)
+		w.mu.Lock()
+		delete(w.refs, path)
+		w.stopTTL(path)
+		w.forgetCanonical(path)
+		delete(w.opts, path)
+		w.mu.Unlock()
+	}
+	return err
+}
+
+// realPath gets the absolute path of name with all symlinks resolved, for
+// WithRealPath(). A "/..." suffix is kept.
+func realPath(name string) (string, error) {
+	path, recurse := recursivePath(name)
+	path, err := filepath.Abs(path)
+	if err == nil {
+		path, err = filepath.EvalSymlinks(path)
+	}
+	if err != nil {
+		return "", fmt.Errorf("fsnotify.WithRealPath: %w", err)
+	}
+	if recurse {
+		path = filepath.Join(path, "...")
+	}
+	return path, nil
+}
+
+// canonical gets the name that the path in name was first added with, if it's
+// still watched, so that the same path isn't watched twice under a different
+// name. Also returns the key for Watcher.canon.
+func (w *Watcher) canonical(name string, noFollow bool) (string, string) {
+	path, recurse := recursivePath(name)
+	key, err := filepath.Abs(path)
+	if err != nil {
+		return name, path
+	}
+	if !noFollow {
+		if real, err := filepath.EvalSymlinks(key); err == nil {
+			key = real
+		}
+	}
+
+	w.mu.Lock()
+	prev, ok := w.canon[key]
+	if !ok && w.pipe.foldCase() {
+		for k, p := range w.canon {
+			if strings.EqualFold(k, key) {
+				prev, ok = p, true
+				break
+			}
+		}
+	}
+	w.mu.Unlock()
+	if !ok || prev == path || !w.b.IsWatched(prev) {
+		return name, key
+	}
+	if recurse {
+		return filepath.Join(prev, "..."), key
+	}
+	return prev, key
+}
+
+// forgetCanonical forgets the name path was added with once it's removed.
+//
+// Unlocked!
+func (w *Watcher) forgetCanonical(path string) {
+	for k, p := range w.canon {
+		if p == path {
+			delete(w.canon, k)
+		}
+	}
+}
+
+// RemoveAll removes all paths in [Watcher.WatchList], ignoring [WithRefCount].
+// The watcher can still be used to add new paths afterwards.
+//
+// Paths that were already removed (for example because the OS removed the
+// watch) are skipped. All other paths are removed even if removing one of them
+// fails; a [*MultiError] is returned with the errors in that case.
+//
+// Returns [ErrClosed] if [Watcher.Close] was called.
+func (w *Watcher) RemoveAll() error {
+	if w.isClosed() {
+		return ErrClosed
+	}
+	_, err := w.removeMatching("RemoveAll", func(string) bool { return true })
+	return err
+}
+
+// RemoveMatching is like [Watcher.RemoveAll], but only removes the paths in
+// [Watcher.WatchList] for which match returns true. Everything is done while
+// holding the lock, so paths that are added or removed at the same time are
+// either seen or not, rather than racing with every Remove. match must not call
+// any Watcher methods.
+//
+// Returns the paths that were removed, and a [*MultiError] with the errors
+// for the paths that couldn't be removed. Returns [ErrClosed] if
+// [Watcher.Close] was called.
+func (w *Watcher) RemoveMatching(match func(path string) bool) ([]string, error) {
+	if w.isClosed() {
+		return nil, ErrClosed
+	}
+	return w.removeMatching("RemoveMatching", match)
+}
+
+func (w *Watcher) removeMatching(op string, match func(string) bool) ([]string, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	// Remove files before the directories they're in.
+	paths := w.b.WatchList()
+	sort.Sort(sort.Reverse(sort.StringSlice(paths)))
+	var (
+		removed []string
+		rErr    = MultiError{op: op}
+	)
+	for _, p := range paths {
+		if !match(p) {
+			continue
+		}
+		err := w.b.Remove(p)
+		if err != nil && !errors.Is(err, ErrNonExistentWatch) {
+			rErr.Errs = append(rErr.Errs, err)
+			continue
+		}
+		if err == nil {
+			removed = append(removed, p)
+		}
+		path, _ := recursivePath(p)
+		w.pipe.forgetRewrite(path)
+		delete(w.refs, path)
+		w.stopTTL(path)
+		w.forgetCanonical(path)
+		delete(w.opts, path)
+	}
+	if len(rErr.Errs) > 0 {
+		return removed, &rErr
+	}
+	return removed, nil
+}
+
+// SetOps changes the operations to send for a path that's already watched,
+// without removing it first. It's like calling [Watcher.AddWith] again with
+// the same options and [WithOps], except that [WithInitialScan] isn't done
+// again and the [WithRefCount] count doesn't change.
+//
+// On Linux the inotify flags of the existing watch are updated, so no events
+// are lost in between.
+//
+// Returns [ErrNonExistentWatch] if the path isn't watched, or [ErrClosed] if
+// [Watcher.Close] was called.
+func (w *Watcher) SetOps(name string, ops Op) error {
+	if w.isClosed() {
+		return ErrClosed
+	}
+	name = cleanPath(name)
+	if !w.b.IsWatched(name) {
+		name, _ = w.canonical(name, false)
+	}
+	path, recurse := recursivePath(name)
+	w.mu.Lock()
+	prev, ok := w.opts[path]
+	ttl := w.ttls[path]
+	w.mu.Unlock()
+	if !ok || !w.b.IsWatched(name) {
+		return fmt.Errorf("%w: %s", ErrNonExistentWatch, name)
+	}
+	if rname := filepath.Join(path, "..."); !recurse && w.b.IsWatched(rname) {
+		name = rname
+	}
+
+	with := prev
+	with.ops, with.initialScan, with.createWatch = ops, false, false
+	if _, err := getOptions(func(o *withOpts) { *o = with }); err != nil {
+		return err
+	}
+	if err := w.pipe.setRewrite(path, with, ttl); err != nil {
+		return err
+	}
+	send := with
+	if send.chmodAsWrite && send.ops.Has(Write) {
+		send.ops |= Chmod
+	}
+	if err := w.b.AddWith(name, func(o *withOpts) { *o = send }); err != nil {
+		w.pipe.setRewrite(path, prev, ttl)
+		return err
+	}
+
+	w.mu.Lock()
+	if _, ok := w.opts[path]; ok {
+		w.opts[path] = with
+	}
+	w.mu.Unlock()
+	return nil
+}
+
+// Close removes all watches and closes the events channel.
+//
+// Add, AddWith, and Remove return [ErrClosed] after this, and WatchList returns
+// an empty slice.
+//
+// It's safe to call Close more than once, and from multiple goroutines; only
+// the first call closes the watcher and the channels, and all later calls (of
+// either Close or CloseWait) do nothing and return nil. A later call doesn't
+// wait for the first to finish.
+//
+// With [Watcher.SetDrainOnClose] this is the same as CloseWait, with a
+// timeout.
+func (w *Watcher) Close() error {
+	if atomic.LoadInt32(&w.drain) == 1 {
+		ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+		defer cancel()
+		if err := w.CloseWait(ctx); err != context.DeadlineExceeded {
+			return err
+		}
+		return nil
+	}
+	atomic.StoreInt32(&w.closed, 1)
+	w.stopTTLs()
+	err := w.b.Close()
+	w.pipe.closeSubs()
+	return err
+}
+
+// CloseWait is like [Watcher.Close], but first sends all events that were
+// already read from the OS on the Events channel, and waits for the Events and
+// Errors channels to be closed.
+//
+// No new watches can be added once CloseWait is called. Events are sent as
+// usual while draining, so something needs to keep reading from the Events and
+// Errors channels.
+//
+// Returns ctx.Err() if ctx is done before everything was drained; the remaining
+// events are dropped, and the channels are closed before it returns.
+//
+// Calling Close or CloseWait after CloseWait was called is a no-op, and
+// returns nil.
+func (w *Watcher) CloseWait(ctx context.Context) error {
+	atomic.StoreInt32(&w.closed, 1)
+	w.stopTTLs()
+	err := w.b.CloseWait(ctx)
+	w.pipe.closeSubs()
+	return err
+}
+
+func (w *Watcher) isClosed() bool { return atomic.LoadInt32(&w.closed) == 1 }
+
+// drainTimeout is how long Close waits for the events to be sent with
+// Watcher.SetDrainOnClose().
+var drainTimeout = time.Second
+
+// Sync reads everything that's queued in the OS, and waits until all of it is
+// sent on the Events and Errors channels. This is useful in tests, or to know
+// that the events for a change that was just made were received.
+//
+// Something needs to keep reading from the Events and Errors channels while
+// Sync is running, as it waits for every event to be received.
+//
+// This is a best effort: changes made while Sync is running may or may not be
+// included, and some filesystems send events with a delay. On Windows there is
+// no way to see if anything is still queued, so Sync only waits until the
+// events that were already read are sent. With [NewPollingWatcher] all watches
+// are polled right away, and with [NewDebouncedWatcher] the merged events are
+// still sent after the debounce duration (as are Creates held for
+// [WithMergeCreateWrite], and events over the [WithRateLimit] limit).
+//
+// Returns ctx.Err() if ctx is done before everything was sent, or [ErrClosed]
+// if the watcher was closed.
+func (w *Watcher) Sync(ctx context.Context) error {
+	if w.isClosed() {
+		return ErrClosed
+	}
+	return w.b.Sync(ctx)
+}
+
+// Rescan reads a path that was added with [WithSnapshot] again, and sends an
+// event for everything that's different from the snapshot: a Create for new
+// paths, a Remove for paths that are gone, a Write for files with a different
+// size or modification time, and a Chmod for different permissions. The
+// snapshot is then replaced with what was read. Use [Event.IsRescanned] to
+// tell these events apart.
+//
+// This is a way to recover after an [OverflowError], or after [Watcher.Pause],
+// when events may have been lost. The snapshot is kept up to date with the
+// events that are sent, so only what was missed is sent again. The events are
+// sent in the background, in the same way as [WithInitialScan]; events from
+// the OS are sent after them.
+//
+// Returns [ErrNonExistentWatch] if the path isn't watched, and an error if it
+// wasn't added with WithSnapshot.
+func (w *Watcher) Rescan(name string) error {
+	if w.isClosed() {
+		return ErrClosed
+	}
+	name = cleanPath(name)
+	if !w.b.IsWatched(name) {
+		name, _ = w.canonical(name, false)
+	}
+	if !w.b.IsWatched(name) {
+		return fmt.Errorf("%w: %s", ErrNonExistentWatch, name)
+	}
+	path, _ := recursivePath(name)
+	events, err := w.pipe.rescan(path)
+	if err != nil {
+		return err
+	}
+	w.b.rescan(events)
+	return nil
+}
+
+// DryRunAdd gets the number of watches that [Watcher.AddWith] would need for
+// name with these options, without adding anything. The same directories are
+// scanned, so [WithMaxDepth], [WithFollowSymlinks], [WithSkipErrors], and
+// [Watcher.Ignore] patterns all change the result. Paths that are already
+// watched aren't counted on Linux, as they don't need a new watch.
+//
+// What's counted depends on the platform: inotify and fen need a watch for
+// every directory (fen also for every file in it), kqueue needs a file
+// descriptor for the path and every file in a directory, Windows needs one
+// handle, and [NewPollingWatcher] doesn't use any (but still scans everything,
+// so errors are still reported).
+//
+// On Linux an error wrapping [ErrWatchLimitReached] is returned with the count
+// if there aren't enough watches left in the fs.inotify.max_user_watches
+// limit. Watches used by other Watchers and programs aren't known, so this
+// may still fail once added. With kqueue this is checked against
+// [Watcher.SetMaxWatches], if it's set.
+//
+// Returns [ErrClosed] if [Watcher.Close] was called.
+func (w *Watcher) DryRunAdd(name string, opts ...addOpt) (int, error) {
+	if w.isClosed() {
+		return 0, ErrClosed
+	}
+	n, err := w.b.DryRunAdd(cleanPath(name), opts...)
+	return n, classifyError(cleanPath(name), err)
+}
+
+// Heartbeat gets a channel that's sent the current time every d for as long as
+// the goroutine reading from the OS is working: it's either waiting for the OS,
+// or finished something since the last heartbeat. No heartbeats are sent while
+// it's stuck (for example because nothing reads from the Events channel), so
+// this can tell a hung watcher apart from a filesystem where nothing happens.
+//
+// As with [time.Ticker], heartbeats are dropped if the channel isn't read in
+// time. The channel is closed once the watcher is closed. Heartbeats are never
+// sent on the Events channel, and aren't counted in [Watcher.Stats].
+//
+// Every call starts a new heartbeat with its own channel. Returns an error if d
+// isn't positive, or [ErrClosed] if [Watcher.Close] was called.
+func (w *Watcher) Heartbeat(d time.Duration) (<-chan time.Time, error) {
+	if d <= 0 {
+		return nil, fmt.Errorf("fsnotify.Heartbeat: interval must be positive: %s", d)
+	}
+	if w.isClosed() {
+		return nil, ErrClosed
+	}
+	return w.b.Heartbeat(d), nil
+}
+
+// Subscribe gets a new channel that's sent a copy of every event that's sent on
+// the Events channel, for when more than one goroutine needs to see every
+// event. The returned function unsubscribes and closes the channel; it's safe
+// to call more than once. All subscriber channels are closed when the watcher
+// is closed.
+//
+// Events are still sent on the Events channel as usual, so something still
+// needs to read it; subscribers only get an event once it was sent on Events.
+//
+// Every subscriber has a buffer of 64 events, and a subscriber that doesn't
+// keep up never blocks the others: if the buffer is full the event is dropped
+// for that subscriber only. Compare [Event.Seq] with the events on the Events
+// channel to see if events were dropped.
+func (w *Watcher) Subscribe() (<-chan Event, func()) { return w.pipe.subscribe() }
+
+// Clone creates a new Watcher of the same kind (with the same buffer size,
+// debounce duration, or poll interval), and adds all paths from
+// [Watcher.WatchList] to it; recursive watches are added recursively.
+//
+// Only the paths are copied: options from [Watcher.AddWith], ignore patterns,
+// extensions from [Watcher.WatchExtensions], and settings such as
+// [Watcher.SetCaseInsensitive] aren't. The two watchers are independent, and
+// need to be closed separately.
+//
+// Paths that can't be added (for example because they were removed) are
+// skipped; the new watcher is returned with a [*MultiError] for those paths.
+// Returns [ErrClosed] if [Watcher.Close] was called.
+func (w *Watcher) Clone() (*Watcher, error) {
+	if w.isClosed() {
+		return nil, ErrClosed
+	}
+	newFn := w.newFn
+	if newFn == nil {
+		newFn = NewWatcher
+	}
+	c, err := newFn()
+	if err != nil {
+		return nil, err
+	}
+
+	paths := w.WatchList()
+	sort.Strings(paths)
+	cErr := MultiError{op: "Clone"}
+	for _, p := range paths {
+		if err := c.Add(p); err != nil {
+			cErr.Errs = append(cErr.Errs, err)
+		}
+	}
+	if len(cErr.Errs) > 0 {
+		return c, &cErr
+	}
+	return c, nil
+}
+
+// Reset opens the inotify file descriptor again and adds all paths from
+// [Watcher.WatchList] again, with the options they were added with. This is
+// mostly useful to recover after a [DiedError], but it can be called at any
+// time. The Events and Errors channels stay the same, and so do everything set
+// on the Watcher itself, such as ignore patterns and subscribers.
+//
+// Only paths are added again, so [WithInitialScan] isn't sent again and
+// [WithCreateWatch] doesn't wait for paths that don't exist. Events for
+// changes while the watcher was dead (or while Reset is running) are lost; use
+// [WithSnapshot] and [Watcher.Rescan] to find those.
+//
+// Paths that can't be added again (for example because they were removed) are
+// no longer watched, and a [*MultiError] is returned for those paths.
+//
+// This is only supported on Linux; it returns [ErrResetUnsupported] on other
+// platforms and with [NewPollingWatcher]. Returns [ErrClosed] if
+// [Watcher.Close] was called.
+func (w *Watcher) Reset() error {
+	if w.isClosed() {
+		return ErrClosed
+	}
+	paths := w.b.WatchList()
+	sort.Strings(paths)
+	if err := w.b.reset(); err != nil {
+		return err
+	}
+
+	rErr := MultiError{op: "Reset"}
+	for _, p := range paths {
+		path, _ := recursivePath(p)
+		w.mu.Lock()
+		with, ok := w.opts[path]
+		w.mu.Unlock()
+		if !ok {
+			with = defaultOpts
+		}
+		with.initialScan, with.createWatch = false, false
+		if with.chmodAsWrite && with.ops.Has(Write) {
+			with.ops |= Chmod
+		}
+		err := w.b.AddWith(p, func(o *withOpts) { *o = with })
+		var skipped *SkippedError
+		if err == nil || errors.As(err, &skipped) {
+			continue
+		}
+		rErr.Errs = append(rErr.Errs, classifyError(path, err))
+		w.pipe.forgetRewrite(path)
+		w.mu.Lock()
+		delete(w.refs, path)
+		w.stopTTL(path)
+		w.forgetCanonical(path)
+		delete(w.opts, path)
+		w.mu.Unlock()
+	}
+	if len(rErr.Errs) > 0 {
+		return &rErr
+	}
+	return nil
+}
+
+// WatchList returns all paths explicitly added with [Watcher.Add] (and are not
+// yet removed).
+//
+// The returned slice is a snapshot; it's safe to call this concurrently with
+// Add and Remove. Returns an empty slice if [Watcher.Close] was called.
+func (w *Watcher) WatchList() []string {
+	if w.isClosed() {
+		return []string{}
+	}
+	return w.b.WatchList()
+}
+
+// IsWatched reports if the path was added with [Watcher.Add] or
+// [Watcher.AddWith], and hasn't been removed since.
+//
+// Paths that are watched under a different name (see [Watcher.Add]) also
+// return true.
+//
+// For recursive watches both "dir" and "dir/..." return true, but
+// subdirectories of the watch return false as they weren't explicitly added.
+// Using "/..." for a path that wasn't added recursively returns false.
+//
+// Returns false if the Watcher is closed.
+func (w *Watcher) IsWatched(name string) bool {
+	if w.isClosed() {
+		return false
+	}
+	name = cleanPath(name)
+	if w.b.IsWatched(name) {
+		return true
+	}
+	name, _ = w.canonical(name, false)
+	return w.b.IsWatched(name)
+}
+
+// Fd returns the file descriptor of the inotify or kqueue instance, for
+// integrating the Watcher in an existing event loop; for example to add it to
+// an epoll set to know when there is activity.
+//
+// The Watcher keeps reading from the file descriptor in its own goroutine: don't
+// read from it, change it, or close it yourself, as that will lose events or
+// break the Watcher. Using it as anything other than a readiness notification
+// alongside the Events channel is unsupported. [Watcher.Reset] replaces it with
+// a new one.
+//
+// Returns false if the backend doesn't have a file descriptor (Windows, illumos,
+// and the polling watcher), or if the Watcher is closed.
+func (w *Watcher) Fd() (uintptr, bool) {
+	if w.isClosed() {
+		return 0, false
+	}
+	return w.b.Fd()
+}
+
+// SupportsRecursion reports if recursive watches can be added with
+// Add("dir/..."). This is true on Linux, Windows, and illumos, and for the
+// polling watcher; adding a recursive watch returns [ErrRecursionUnsupported]
+// if it's false.
+func (w *Watcher) SupportsRecursion() bool { return w.b.SupportsRecursion() }
+
+// Stats returns the counters for this Watcher. It's cheap to call and safe to
+// call concurrently, e.g. to export metrics periodically.
+func (w *Watcher) Stats() WatcherStats {
+	s := w.b.Stats()
+	s.ActiveWatches = len(w.b.WatchList())
+	return s
+}
+
+// Buffered gets the number of events in the buffer of the Events channel, and
+// the size of the buffer, for [NewBufferedWatcher]; for example to see how
+// close the buffer is to being full. This is 0, 0 for an unbuffered channel.
+// Like Stats it's cheap to call and safe to call concurrently.
+//
+// Events that aren't sent yet aren't counted: those held back by
+// [NewDebouncedWatcher], [WithMergeCreateWrite], or [WithRateLimit], the
+// changes for [NewAccumulatingWatcher], and events the OS queued that weren't
+// read yet.
+func (w *Watcher) Buffered() (used, size int) { return len(w.Events), cap(w.Events) }
+
+// RecentEvents gets the last events that were sent on the Events channel, with
+// [Watcher.SetEventLog], oldest first. This is a debugging aid, e.g. to see
+// what was sent before the program that reads the events got stuck. It's safe
+// to call concurrently with anything else, and still works after the Watcher is
+// closed.
+//
+// Returns nil if SetEventLog wasn't used.
+func (w *Watcher) RecentEvents() []Event { return w.pipe.recentEvents() }
+
+// SetEventLog keeps the last n events that were sent on the Events channel in
+// memory, for [Watcher.RecentEvents]. The default of 0 keeps nothing.
+//
+// Calling it again changes the size, and keeps as many of the events that were
+// already logged as fit; SetEventLog(0) drops the log. Returns an error if n is
+// negative.
+func (w *Watcher) SetEventLog(n int) error {
+	if n < 0 {
+		return fmt.Errorf("fsnotify.SetEventLog: negative number: %d", n)
+	}
+	w.pipe.setEventLog(n)
+	return nil
+}
+
+// SetMaxWatches limits the number of file descriptors the kqueue backend
+// opens; this is a no-op for other backends. The default of 0 is no limit.
+//
+// kqueue needs a file descriptor for every watched path, including every file
+// in a watched directory. Once the limit is reached AddWith returns
+// [ErrWatchLimitReached] rather than failing with "too many open files"
+// (EMFILE), and nothing is added. New files in watched directories aren't
+// watched when the limit is reached: the Create is still sent, but nothing
+// else, and a [WatchError] wrapping ErrWatchLimitReached is sent on the Errors
+// channel.
+//
+// Lowering the limit below the number of file descriptors that are already
+// open doesn't close any of them; only nothing new is opened. Returns an error
+// if n is negative.
+func (w *Watcher) SetMaxWatches(n int) error {
+	if n < 0 {
+		return fmt.Errorf("fsnotify.SetMaxWatches: negative number: %d", n)
+	}
+	w.b.setMaxWatches(n)
+	return nil
+}
+
+// SetCaseInsensitive matches paths without regard to case if fold is true, for
+// case-insensitive (but case-preserving) filesystems such as the defaults on
+// macOS and Windows. This applies to the patterns from [Watcher.Ignore] and
+// [Watcher.AddGlob], and to finding a path that's already watched under a
+// different case for [Watcher.IsWatched], [Watcher.Remove], and AddWith. That
+// includes paths that were added before it was called. Event.Name is still sent
+// as the OS reports it. The extensions from [Watcher.WatchExtensions] are always
+// matched without regard to case.
+//
+// Don't use this for case-sensitive filesystems (the default on Linux), where
+// "File" and "file" are different paths: an ignore pattern for one also drops
+// events for the other, and IsWatched and Remove may find the wrong path.
+func (w *Watcher) SetCaseInsensitive(fold bool) { w.pipe.setFold(fold) }
+
+// SetDrainOnClose makes [Watcher.Close] send the events that were already read
+// from the OS (and those held back by e.g. [WithRateLimit]) before it closes
+// the channels, like [Watcher.CloseWait], rather than dropping them, if drain
+// is true.
+//
+// This only waits a second for the events to be read: if nothing reads from
+// the Events channel any more, the events that weren't sent by then are
+// dropped and Close returns as usual. Use CloseWait to wait longer.
+func (w *Watcher) SetDrainOnClose(drain bool) { atomic.StoreInt32(&w.drain, boolInt(drain)) }
+
+// Ignore drops all events for paths that match pattern, using the syntax of
+// [filepath.Match].
+//
+// A pattern without a path separator is matched against the base name of the
+// path (e.g. "*.tmp" or "node_modules"), and a pattern with a path separator
+// against the full path as it would be in Event.Name (e.g. "/tmp/dir/*.tmp").
+//
+// Directories that match are not watched for recursive watches, so with
+// Ignore("node_modules") nothing in a node_modules directory is sent. On kqueue
+// files that match are not opened. This only applies to watches that are
+// added after calling Ignore; directories and files that are already watched
+// stay watched, although any events for paths that match are still dropped.
+//
+// Returns [filepath.ErrBadPattern] if the pattern is malformed.
+func (w *Watcher) Ignore(pattern string) error { return w.pipe.add(pattern) }
+
+// ClearIgnores removes all patterns added with [Watcher.Ignore].
+func (w *Watcher) ClearIgnores() { w.pipe.clear() }
+
+// WatchExtensions drops all events for files that don't have one of the
+// extensions, replacing the extensions from an earlier call. Calling it without
+// any extensions sends events for all files again.
+//
+// The extensions can be given with or without a dot (".go" or "go"), and are
+// compared with the last extension of Event.Name case-insensitively: "file.GO"
+// and "file.tar.go" both match ".go", but "file.go.bak" doesn't.
+//
+// Events for directories, and for paths without an extension, are always sent.
+// It's not always possible to tell if a path that no longer exists was a
+// directory, so a Remove or Rename for a directory with an extension may still
+// be dropped.
+//
+// This is applied after [WithOps] and [Watcher.Ignore]: events for paths that
+// match an ignore pattern are dropped even if they have one of the extensions.
+func (w *Watcher) WatchExtensions(exts ...string) { w.pipe.setExts(exts) }
+
+// SetFilter drops all events for which fn returns false. It's called after
+// everything else: events that are dropped by [Watcher.Ignore],
+// [Watcher.WatchExtensions], [WithOps], etc. are never passed to it, and the
+// event is passed as it would be sent (for example with the Name relative to
+// [WithBasePath]). The [Event.Seq] is already set, so events that fn drops
+// leave a gap.
+//
+// fn is called from the goroutine that reads events from the OS, and no events
+// are read until it returns; it should be fast, and must not block or call
+// methods on the Watcher. It's called from more than one goroutine with some
+// options, such as [WithAutoRewatch] and [WithInitialScan].
+//
+// Only one filter can be set; calling SetFilter again replaces it, and
+// SetFilter(nil) removes it.
+func (w *Watcher) SetFilter(fn func(Event) bool) { w.pipe.setFilter(fn) }
+
+// Pause drops all events until [Watcher.Resume] is called. The watches are
+// kept, so this is cheaper than removing and adding them again, for example
+// while making a lot of changes you're not interested in. Errors are still sent,
+// and events that are already in the Events channel's buffer are still read.
+//
+// Pausing doesn't guarantee that nothing is missed: scan the watched paths
+// again after Resume if you need to know the current state. Calling Pause on a
+// Watcher that's already paused does nothing.
+func (w *Watcher) Pause() { w.pipe.pause() }
+
+// Resume starts sending events again after [Watcher.Pause]. It returns the
+// number of events that were dropped while paused; if it's not 0 you'll want to
+// rescan the watched paths. Returns 0 if the Watcher wasn't paused.
+//
+// The events that are sent right after Resume may be for changes from before
+// it was called, as the OS may not have sent them yet.
+func (w *Watcher) Resume() int { return w.pipe.resume() }
+
+// ReadBatch reads up to max events from the Events channel at once. It waits
+// up to timeout for the first event (or forever if timeout is negative), and
+// then reads the events that are already buffered without waiting for more.
+// This works best with a buffered watcher from [NewBufferedWatcher].
+//
+// Errors are read from the Errors channel while waiting for the first event;
+// an error is returned together with no events. It returns no events and a nil
+// error if the timeout expires, and [ErrClosed] if the watcher was closed and
+// all events have been read.
+//
+// ReadBatch reads from the same channels, so it can be mixed with reading from
+// Events and Errors, but every event is only received once: events read by
+// ReadBatch aren't sent on the Events channel.
+func (w *Watcher) ReadBatch(max int, timeout time.Duration) ([]Event, error) {
+	if max < 1 {
+		return nil, fmt.Errorf("fsnotify.ReadBatch: max must be positive: %d", max)
+	}
+
+	var expired <-chan time.Time
+	if timeout >= 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		expired = t.C
+	}
+
+	batch := make([]Event, 0, max)
+	select {
+	case e, ok := <-w.Events:
+		if !ok {
+			return nil, ErrClosed
+		}
+		batch = append(batch, e)
+	case err, ok := <-w.Errors:
+		if !ok {
+			return nil, ErrClosed
+		}
+		return nil, err
+	case <-expired:
+		return nil, nil
+	}
+
+	for len(batch) < max {
+		select {
+		case e, ok := <-w.Events:
+			if !ok {
+				return batch, nil
+			}
+			batch = append(batch, e)
+		default:
+			return batch, nil
+		}
+	}
+	return batch, nil
+}
+
+// Next waits for the next event or error, whichever comes first, so that a
+// single loop can read both without a select:
+//
+//	for {
+//	    e, err := w.Next()
+//	    if errors.Is(err, fsnotify.ErrClosed) {
+//	        break
+//	    }
+//	    if err != nil {
+//	        log.Println("error:", err)
+//	        continue
+//	    }
+//	    log.Println("event:", e)
+//	}
+//
+// It returns [ErrClosed] once the watcher was closed and all events and errors
+// have been read.
+//
+// Like [Watcher.ReadBatch], events and errors read by Next aren't sent on the
+// Events and Errors channels.
+func (w *Watcher) Next() (Event, error) {
+	events, errs := w.Events, w.Errors
+	for events != nil || errs != nil {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			return e, nil
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			return Event{}, err
+		}
+	}
+	return Event{}, ErrClosed
+}
+
+// Changes gets everything that changed since the last call to Changes, for a
+// watcher created with [NewAccumulatingWatcher]; it always returns nil for
+// other watchers.
+//
+// There is one event for every path, ordered by [Event.Seq] of the last event
+// for it. Events for the same path are merged as follows:
+//
+//   - The last event wins: a Write followed by a Chmod is returned as a Chmod,
+//     and a Remove followed by a Create as a Create.
+//   - A Create stays a Create if it's followed by a Write or Chmod, as the
+//     path is still new.
+//   - A Create followed by a Remove or Rename cancels out: nothing is returned
+//     for a path that didn't exist at the last call and is gone again.
+//
+// Events that were already accumulated can still be read after the watcher is
+// closed. Use [Watcher.Sync] first to make sure everything that's queued in the
+// OS is included.
+func (w *Watcher) Changes() []Event {
+	a, ok := w.b.(*accumulated)
+	if !ok {
+		return nil
+	}
+	return a.changes()
+}
+
 // Event represents a file system notification.
 type Event struct {
 	// Path to the file or directory.
 	//
 	// Paths are relative to the input; for example with Add("dir") the Name
 	// will be set to "dir/file" if you create that file, but if you use
-	// Add("/path/to/dir") it will be "/path/to/dir/file".
+	// Add("/path/to/dir") it will be "/path/to/dir/file". Use [WithRealPath]
+	// to get the absolute path with symlinks resolved.
 	Name string
 
-	// File operation that triggered the event.
-	//
-	// This is a bitmask and some systems may send multiple operations at once.
-	// Use the Event.Has() method instead of comparing with ==.
-	Op Op
+	// File operation that triggered the event.
+	//
+	// This is a bitmask and some systems may send multiple operations at once.
+	// Use the Event.Has() method instead of comparing with ==.
+	Op Op
+
+	// Old path of a file or directory that was renamed.
+	//
+	// This is set on the Create event for the new path if both the old and
+	// new path are watched, so that the Rename and Create can be paired. It's
+	// empty if the old path wasn't watched (e.g. a file got moved in to a
+	// watched directory) or if the backend couldn't find the old path.
+	//
+	// This is always empty with the FEN backend (illumos, Solaris).
+	RenamedFrom string
+
+	// Set on a Create if the path was moved here rather than created. On
+	// Linux this is also set if the old path wasn't watched (e.g. a file got
+	// moved in to a watched directory from somewhere else); other backends
+	// can't tell that apart from a new file, and only set it if RenamedFrom is
+	// set.
+	//
+	// This is always false with the FEN backend (illumos, Solaris).
+	Moved bool
+
+	// Time the event was read from the OS. All events that were read at once
+	// (e.g. a burst of changes) have the same time.
+	Time time.Time
+
+	// Sequence number of the event: 1 for the first event the watcher reads
+	// from the OS, and one more for every event after that. It's set as soon
+	// as the event is read, so it's the order in which the OS reported the
+	// events; this can be used to see if events were reordered after that.
+	//
+	// Events are usually sent in this order, but an event that's held for a
+	// while (with [WithRateLimit], [WithMergeCreateWrite], or
+	// [NewDebouncedWatcher]) is sent after events with a higher Seq. An event
+	// that was merged from several has the Seq of the last one.
+	//
+	// Events that are read but never sent leave a gap: for example those
+	// dropped with [Watcher.Ignore], [Watcher.SetFilter], or [WithOps], while
+	// paused, or merged into another event. Events that were lost because the
+	// OS queue overflowed were never read, so they don't get a number (an
+	// [OverflowError] is sent for those).
+	Seq uint64
+
+	// Event the OS sent, with [WithRawEvents]; nil otherwise. This is a
+	// [RawInotifyEvent], [RawKqueueEvent], [RawWindowsEvent], or
+	// [RawFENEvent], depending on the backend.
+	//
+	// It's also nil for events that fsnotify makes up itself, rather than
+	// translating them from an OS event: for example those from
+	// [WithInitialScan], for files that are found when a directory is read,
+	// and everything from the polling backend. If several OS events are
+	// merged in to one Event this is the first one.
+	//
+	// This isn't included in the JSON encoding.
+	Raw interface{}
+
+	isDir     bool
+	initial   bool
+	scanned   bool
+	truncated bool
+	rescanned bool
+}
+
+// RawInotifyEvent is the inotify event an Event was made from, for
+// [WithRawEvents]. See inotify(7) for the meaning of the fields.
+type RawInotifyEvent struct {
+	Wd     int32  // Watch descriptor.
+	Mask   uint32 // IN_* flags.
+	Cookie uint32 // Pairs IN_MOVED_FROM with IN_MOVED_TO.
+	Name   string // Name in the watched directory; empty for the watch itself.
+}
+
+// RawKqueueEvent is the kevent an Event was made from, for [WithRawEvents].
+// See kqueue(2) for the meaning of the fields; they're wide enough for the
+// types that every BSD uses.
+type RawKqueueEvent struct {
+	Ident  uint64 // File descriptor.
+	Filter int32  // EVFILT_VNODE.
+	Flags  uint32 // EV_* flags.
+	Fflags uint32 // NOTE_* flags.
+	Data   int64
+}
+
+// RawWindowsEvent is the FILE_NOTIFY_INFORMATION an Event was made from, for
+// [WithRawEvents].
+type RawWindowsEvent struct {
+	Action uint32 // FILE_ACTION_* value.
+	Name   string // Name relative to the watched directory, as sent by Windows.
+}
+
+// RawFENEvent is the port event an Event was made from, for [WithRawEvents].
+type RawFENEvent struct {
+	Events int32 // FILE_* flags; see port_associate(3C).
+}
+
+// Op describes a set of file operations.
+type Op uint32
+
+// The operations fsnotify can trigger; see the documentation on [Watcher] for a
+// full description, and check them with [Event.Has].
+const (
+	Create Op = 1 << iota
+	Write
+	Remove
+	Rename
+	Chmod
+)
+
+// AllOps is all the operations, and is the default for [WithOps]. Use it to
+// start from everything and mask out what isn't needed:
+//
+//	w.AddWith("/tmp", fsnotify.WithOps(fsnotify.AllOps&^fsnotify.Chmod))
+//
+// New operations may be added to this in the future.
+const AllOps = Create | Write | Remove | Rename | Chmod
+
+// Common errors that can be reported.
+var (
+	ErrNonExistentWatch = errors.New("fsnotify: can't remove non-existent watcher")
+	ErrEventOverflow    = errors.New("fsnotify: queue or buffer overflow")
+	ErrClosed           = errors.New("fsnotify: watcher already closed")
+
+	ErrRecursionUnsupported = errors.New("fsnotify: recursive watches are not supported by this backend")
+	ErrInodeUnsupported     = errors.New("fsnotify: tracking inodes is not supported by this backend")
+	ErrResetUnsupported     = errors.New("fsnotify: resetting is not supported by this backend")
+	ErrNotDirectory         = errors.New("fsnotify: not a directory")
+
+	// ErrSpecialFileUnsupported is returned by Add for sockets and named pipes
+	// with kqueue, which can't watch them.
+	ErrSpecialFileUnsupported = errors.New("fsnotify: sockets and named pipes can't be watched by this backend")
+
+	// ErrNotExist is returned by Add if the path doesn't exist; it wraps
+	// [fs.ErrNotExist].
+	ErrNotExist error = &wrappedError{msg: "fsnotify: no such file or directory", err: fs.ErrNotExist}
+
+	// ErrPermission is returned by Add if the path can't be read; it wraps
+	// [fs.ErrPermission].
+	ErrPermission error = &wrappedError{msg: "fsnotify: permission denied", err: fs.ErrPermission}
+
+	// ErrWatchLimitReached is returned by Add when the maximum number of
+	// watches is reached; this is set by the fs.inotify.max_user_watches
+	// sysctl on Linux, and by [Watcher.SetMaxWatches] with kqueue. It's never
+	// returned on other platforms.
+	//
+	// With kqueue a [WatchError] wrapping it is also sent on the Errors
+	// channel for new files in a watched directory that can't be watched.
+	ErrWatchLimitReached = errors.New("fsnotify: watch limit reached")
+
+	// ErrWatcherDied is wrapped by a [DiedError].
+	ErrWatcherDied = errors.New("fsnotify: watcher stopped unexpectedly")
+
+	// ErrUnmounted is wrapped by the [WatchError] that's sent on the Errors
+	// channel when the filesystem a watched path is on was unmounted, after
+	// the Remove event for the path. This is not sent for normal removes.
+	//
+	// It's detected on Linux, kqueue, and illumos for unmounts, and on Windows
+	// for network shares that went away.
+	ErrUnmounted = errors.New("fsnotify: filesystem unmounted")
+)
+
+// WatchError is sent on the Errors channel for errors that happened while
+// updating the watch for a path in the background, for example when watching a
+// new directory inside a recursive watch fails.
+//
+// Use errors.Is and errors.As to check the underlying error.
+type WatchError struct {
+	Path string // Path that caused the error.
+	Op   string // What fsnotify was doing: "add", "remove", or "read".
+	Err  error  // Underlying error.
+}
+
+func (e *WatchError) Error() string { return "fsnotify: " + e.Op + " " + e.Path + ": " + e.Err.Error() }
+func (e *WatchError) Unwrap() error { return e.Err }
+
+// OverflowError is sent on the Errors channel when events were lost because a
+// queue or buffer overflowed. It wraps [ErrEventOverflow], so
+// errors.Is(err, ErrEventOverflow) works.
+type OverflowError struct {
+	// Number of events that were lost, or -1 if it's not known. Neither inotify
+	// nor Windows report this, so it's currently always -1.
+	Dropped int
+}
+
+func (e *OverflowError) Error() string {
+	if e.Dropped < 0 {
+		return ErrEventOverflow.Error()
+	}
+	return fmt.Sprintf("%s: %d events dropped", ErrEventOverflow, e.Dropped)
+}
+
+func (e *OverflowError) Unwrap() error { return ErrEventOverflow }
+
+// DiedError is sent on the Errors channel if the watcher stopped because the
+// inotify, kqueue, or event port file descriptor can no longer be read, rather
+// than because [Watcher.Close] was called. The watcher doesn't send any more
+// events after it, until [Watcher.Reset] is called.
+//
+// On Linux the Events and Errors channels stay open, and [Watcher.Reset] starts
+// the watcher again; they're closed once [Watcher.Close] is called. On other
+// platforms it's the last error sent before the channels are closed, and a new
+// watcher needs to be created.
+//
+// It matches [ErrWatcherDied] with [errors.Is], and unwraps to the error from
+// the OS.
+type DiedError struct {
+	Err error
+}
+
+func (e *DiedError) Error() string        { return ErrWatcherDied.Error() + ": " + e.Err.Error() }
+func (e *DiedError) Unwrap() error        { return e.Err }
+func (e *DiedError) Is(target error) bool { return target == ErrWatcherDied }
+
+// SkippedError is returned by [Watcher.AddWith] with [WithSkipErrors] or
+// [WithPartialRecursion] if some directories of a recursive watch were skipped,
+// and sent on the Errors channel for directories that are skipped later.
+// Everything else is watched.
+type SkippedError struct {
+	// The errors for the skipped directories.
+	Errs []error
+
+	all bool // Skip all errors, for WithPartialRecursion().
+}
+
+func (e *SkippedError) Error() string { return joinErrors("fsnotify: skipped directories: ", e.Errs) }
+
+// Is reports if any of the errors match target.
+func (e *SkippedError) Is(target error) bool {
+	for _, err := range e.Errs {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// Paths gets the paths of the skipped directories, in the same order as Errs.
+// With [WithSkipErrors] these may have been skipped while reading a directory,
+// in which case everything below them isn't watched either.
+func (e *SkippedError) Paths() []string {
+	paths := make([]string, 0, len(e.Errs))
+	for _, err := range e.Errs {
+		var (
+			werr *WatchError
+			perr *fs.PathError
+		)
+		switch {
+		case errors.As(err, &werr):
+			paths = append(paths, werr.Path)
+		case errors.As(err, &perr):
+			paths = append(paths, perr.Path)
+		}
+	}
+	return paths
+}
+
+// skip adds err if it's for a directory that can't be read or was removed, or
+// for any error with WithPartialRecursion(). Returns false if it should fail
+// the watch instead, or if e is nil (without either option).
+func (e *SkippedError) skip(err error) bool {
+	if e == nil || !(e.all || errors.Is(err, fs.ErrPermission) || errors.Is(err, fs.ErrNotExist)) {
+		return false
+	}
+	e.Errs = append(e.Errs, err)
+	return true
+}
+
+// err gets e as an error, or nil if nothing was skipped.
+func (e *SkippedError) err() error {
+	if e == nil || len(e.Errs) == 0 {
+		return nil
+	}
+	return e
+}
+
+// newSkippedError gets a SkippedError to collect errors in for
+// WithSkipErrors() and WithPartialRecursion(), or nil to fail on the first
+// error.
+func newSkippedError(with withOpts) *SkippedError {
+	if !with.skipErrors && !with.partial {
+		return nil
+	}
+	return &SkippedError{all: with.partial}
+}
+
+// MultiError is returned by the methods that act on more than one path if some
+// of them failed: [Watcher.RemoveAll], [Watcher.RemoveMatching],
+// [Watcher.Clone], and [Watcher.Reset]. The other paths are still handled.
+type MultiError struct {
+	// The errors, one for every path that failed.
+	Errs []error
+
+	op string // Method that returned it, for the message.
 }
 
-// Op describes a set of file operations.
-type Op uint32
+func (e *MultiError) Error() string { return joinErrors("fsnotify."+e.op+": ", e.Errs) }
 
-// The operations fsnotify can trigger; see the documentation on [Watcher] for a
-// full description, and check them with [Event.Has].
-const (
-	Create Op = 1 << iota
-	Write
-	Remove
-	Rename
-	Chmod
-)
+// Is reports if any of the errors match target.
+func (e *MultiError) Is(target error) bool {
+	for _, err := range e.Errs {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
 
-// Common errors that can be reported.
-var (
-	ErrNonExistentWatch = errors.New("fsnotify: can't remove non-existent watcher")
-	ErrEventOverflow    = errors.New("fsnotify: queue or buffer overflow")
-	ErrClosed           = errors.New("fsnotify: watcher already closed")
-)
+// joinErrors joins the messages of errs with "; ", after prefix.
+func joinErrors(prefix string, errs []error) string {
+	var b strings.Builder
+	b.WriteString(prefix)
+	for i, err := range errs {
+		if i > 0 {
+			b.WriteString("; ")
+		}
+		b.WriteString(err.Error())
+	}
+	return b.String()
+}
+
+// Names of the operations, in the order they're shown in Op.String().
+var opNames = []struct {
+	op   Op
+	name string
+}{
+	{Create, "CREATE"},
+	{Remove, "REMOVE"},
+	{Write, "WRITE"},
+	{Rename, "RENAME"},
+	{Chmod, "CHMOD"},
+}
 
 func (o Op) String() string {
 	var b strings.Builder
-	if o.Has(Create) {
-		b.WriteString("|CREATE")
-	}
-	if o.Has(Remove) {
-		b.WriteString("|REMOVE")
+	for _, n := range opNames {
+		if o.Has(n.op) {
+			b.WriteString("|" + n.name)
+		}
 	}
-	if o.Has(Write) {
-		b.WriteString("|WRITE")
+	if b.Len() == 0 {
+		return "[no events]"
 	}
-	if o.Has(Rename) {
-		b.WriteString("|RENAME")
+	return b.String()[1:]
+}
+
+// GoString returns the operations as Go syntax, for %#v; for example
+// "fsnotify.Create|fsnotify.Write". Unknown operations are shown as
+// fsnotify.Op(0x400), and 0 as fsnotify.Op(0).
+func (o Op) GoString() string {
+	if o == 0 {
+		return "fsnotify.Op(0)"
 	}
-	if o.Has(Chmod) {
-		b.WriteString("|CHMOD")
+	var b strings.Builder
+	for _, n := range opNames {
+		if o.Has(n.op) {
+			b.WriteString("|fsnotify." + n.name[:1] + strings.ToLower(n.name[1:]))
+		}
 	}
-	if b.Len() == 0 {
-		return "[no events]"
+	if unknown := o &^ AllOps; unknown != 0 {
+		fmt.Fprintf(&b, "|fsnotify.Op(%#x)", uint32(unknown))
 	}
 	return b.String()[1:]
 }
 
+// MarshalJSON encodes the operations as a list of strings, in the same order
+// as [Op.String]; for example Create|Write is encoded as ["CREATE","WRITE"],
+// and 0 as an empty list.
+func (o Op) MarshalJSON() ([]byte, error) {
+	if o&^AllOps != 0 {
+		return nil, fmt.Errorf("fsnotify.Op.MarshalJSON: unknown operation: %#x", uint32(o&^AllOps))
+	}
+	names := make([]string, 0, 5)
+	for _, n := range opNames {
+		if o.Has(n.op) {
+			names = append(names, n.name)
+		}
+	}
+	return json.Marshal(names)
+}
+
+// UnmarshalJSON decodes the operations from a list of strings, as encoded by
+// [Op.MarshalJSON]. The names are case-insensitive. Unknown names are an error.
+func (o *Op) UnmarshalJSON(b []byte) error {
+	var names []string
+	if err := json.Unmarshal(b, &names); err != nil {
+		return fmt.Errorf("fsnotify.Op.UnmarshalJSON: %w", err)
+	}
+	if names == nil { // null
+		return nil
+	}
+	var op Op
+	for _, name := range names {
+		n, ok := opFromName(name)
+		if !ok {
+			return fmt.Errorf("fsnotify.Op.UnmarshalJSON: unknown operation: %q", name)
+		}
+		op |= n
+	}
+	*o = op
+	return nil
+}
+
+// ParseOp parses the operations from the form used by [Op.String], such as
+// "CREATE|WRITE" or "CHMOD". The names are case-insensitive, and "[no events]"
+// is parsed as 0. Unknown names are an error.
+func ParseOp(s string) (Op, error) {
+	if s == "[no events]" {
+		return 0, nil
+	}
+	var op Op
+	for _, name := range strings.Split(s, "|") {
+		n, ok := opFromName(strings.TrimSpace(name))
+		if !ok {
+			return 0, fmt.Errorf("fsnotify.ParseOp: unknown operation: %q", name)
+		}
+		op |= n
+	}
+	return op, nil
+}
+
+// opFromName gets the operation for a name as used by Op.String(), ignoring
+// case.
+func opFromName(name string) (Op, bool) {
+	for _, n := range opNames {
+		if strings.EqualFold(n.name, name) {
+			return n.op, true
+		}
+	}
+	return 0, false
+}
+
 // Has reports if this operation has the given operation.
 func (o Op) Has(h Op) bool { return o&h == h }
 
+// Primary gets the single most significant operation, so that a switch on the
+// result works for events with more than one operation, such as Create|Write.
+//
+// The precedence is Remove, Rename, Create, Write, Chmod: an operation that
+// makes the path go away or appear says more about its current state than a
+// change to the contents, and a change to the contents says more than a change
+// to the metadata. Returns 0 if o has none of the operations.
+func (o Op) Primary() Op {
+	for _, op := range []Op{Remove, Rename, Create, Write, Chmod} {
+		if o.Has(op) {
+			return op
+		}
+	}
+	return 0
+}
+
 // Has reports if this event has the given operation.
 func (e Event) Has(op Op) bool { return e.Op.Has(op) }
 
+// IsDir reports if the path was a directory when the event happened, without
+// having to stat it (which may fail if it's already removed again).
+//
+// This is only as accurate as the information the OS sends: it's always false
+// on Windows (except for events from [WithInitialScan]). Use os.Lstat if you
+// need to be sure.
+func (e Event) IsDir() bool { return e.isDir }
+
+// IsInitial reports if this is a Create for a path that already existed when
+// the watch was added, from [WithInitialScan], rather than a path that was
+// created.
+func (e Event) IsInitial() bool { return e.initial }
+
+// IsScanned reports if this is a Create for a path inside a directory that was
+// created in a recursive watch on Linux, which was found by reading the new
+// directory rather than sent by the OS. Paths that are created in the
+// directory before it's watched don't send an event, so it's read once it's
+// watched; paths created right after that may get a Create twice.
+func (e Event) IsScanned() bool { return e.scanned }
+
+// IsTruncated reports if this is a Write that made the file smaller than it
+// was on the previous event for it, with [WithSizeTracking].
+func (e Event) IsTruncated() bool { return e.truncated }
+
+// IsRescanned reports if this event is for a difference that [Watcher.Rescan]
+// found, rather than an event the OS sent.
+func (e Event) IsRescanned() bool { return e.rescanned }
+
 // String returns a string representation of the event with their path.
 func (e Event) String() string {
+	if e.RenamedFrom != "" {
+		return fmt.Sprintf("%-13s %q ← %q", e.Op.String(), e.Name, e.RenamedFrom)
+	}
 	return fmt.Sprintf("%-13s %q", e.Op.String(), e.Name)
 }
+
+// jsonEvent is the JSON encoding of Event; this is needed to include the
+// unexported fields.
+type jsonEvent struct {
+	Name        string    `json:"name"`
+	Op          Op        `json:"op"`
+	RenamedFrom string    `json:"renamedFrom,omitempty"`
+	Moved       bool      `json:"moved,omitempty"`
+	Time        time.Time `json:"time"`
+	Seq         uint64    `json:"seq,omitempty"`
+	IsDir       bool      `json:"isDir,omitempty"`
+	Initial     bool      `json:"initial,omitempty"`
+	Scanned     bool      `json:"scanned,omitempty"`
+	Truncated   bool      `json:"truncated,omitempty"`
+	Rescanned   bool      `json:"rescanned,omitempty"`
+}
+
+// MarshalJSON encodes the event as a JSON object, with the operations encoded
+// as a list of strings:
+//
+//	{"name":"/tmp/file","op":["CREATE","WRITE"],"time":"2024-01-02T15:04:05.123Z"}
+//
+// "renamedFrom", "moved", "seq", "isDir", "initial", "scanned", "truncated",
+// and "rescanned" are only included if they're set. The result can be decoded
+// back with [Event.UnmarshalJSON] without losing anything, except for Raw and
+// the monotonic clock reading of Time (see [time.Time.MarshalJSON]).
+func (e Event) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonEvent{
+		Name:        e.Name,
+		Op:          e.Op,
+		RenamedFrom: e.RenamedFrom,
+		Moved:       e.Moved,
+		Time:        e.Time,
+		Seq:         e.Seq,
+		IsDir:       e.isDir,
+		Initial:     e.initial,
+		Scanned:     e.scanned,
+		Truncated:   e.truncated,
+		Rescanned:   e.rescanned,
+	})
+}
+
+// UnmarshalJSON decodes an event as encoded by [Event.MarshalJSON].
+func (e *Event) UnmarshalJSON(b []byte) error {
+	var j jsonEvent
+	if err := json.Unmarshal(b, &j); err != nil {
+		return err
+	}
+	*e = Event{
+		Name:        j.Name,
+		Op:          j.Op,
+		RenamedFrom: j.RenamedFrom,
+		Moved:       j.Moved,
+		Time:        j.Time,
+		Seq:         j.Seq,
+		isDir:       j.IsDir,
+		initial:     j.Initial,
+		scanned:     j.Scanned,
+		truncated:   j.Truncated,
+		rescanned:   j.Rescanned,
+	}
+	return nil
+}
+
+// wrappedError is a sentinel error that wraps another one.
+type wrappedError struct {
+	msg string
+	err error
+}
+
+func (e *wrappedError) Error() string { return e.msg }
+func (e *wrappedError) Unwrap() error { return e.err }
+
+// addError is an error from the OS for adding a path, classified as one of the
+// fsnotify errors with classifyError().
+type addError struct {
+	kind error
+	path string
+	err  error
+}
+
+func (e *addError) Error() string        { return e.kind.Error() + ": " + e.path + ": " + e.err.Error() }
+func (e *addError) Unwrap() error        { return e.err }
+func (e *addError) Is(target error) bool { return target == e.kind }
+
+// classifyError wraps errors from the OS for adding path in [ErrNotExist],
+// [ErrPermission], or [ErrNotDirectory], as every backend (and OS) reports
+// these differently. Other errors are returned as-is.
+func classifyError(path string, err error) error {
+	var kind error
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, ErrNotExist), errors.Is(err, ErrPermission), errors.Is(err, ErrNotDirectory):
+		return err
+	case errors.Is(err, fs.ErrNotExist):
+		kind = ErrNotExist
+	case errors.Is(err, fs.ErrPermission):
+		kind = ErrPermission
+	case errors.Is(err, syscall.ENOTDIR):
+		kind = ErrNotDirectory
+	default:
+		return err
+	}
+	return &addError{kind: kind, path: path, err: err}
+}
+
+// errRecursiveFile is the error for a recursive watch on path, if path isn't a
+// directory.
+func errRecursiveFile(path string) error {
+	return fmt.Errorf(`%w: %s: recursive watches ("/...") can only be added for directories`, ErrNotDirectory, path)
+}
+
+// Check if this path is recursive (ends with "/..." or "\..."), and return the
+// path with the /... stripped.
+func recursivePath(path string) (string, bool) {
+	if filepath.Base(path) == "..." {
+		return filepath.Dir(path), true
+	}
+	return path, false
+}
+
+// findDirs returns path and all directories below it, except those ignored
+// by pipe and those more than maxDepth levels below path (if maxDepth isn't
+// negative).
+//
+// Symlinks to directories are not followed, unless follow is set. Returns
+// errRecursiveFile() if path itself isn't a directory.
+func findDirs(path string, pipe *pipeline, follow bool, maxDepth int, skipped *SkippedError) ([]string, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, errRecursiveFile(path)
+	}
+	if follow {
+		var dirs []string
+		return dirs, findDirsFollow(path, fi, pipe, &dirs, nil, maxDepth, skipped)
+	}
+
+	dirs := []string{path}
+	err = filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if p == path || !skipped.skip(err) {
+				return err
+			}
+			// The directory was added before it failed to read.
+			if dirs[len(dirs)-1] == p {
+				dirs = dirs[:len(dirs)-1]
+			}
+			return nil
+		}
+		if d.IsDir() && p != path {
+			if pipe.match(p) || (maxDepth >= 0 && depth(path, p) > maxDepth) {
+				return filepath.SkipDir
+			}
+			dirs = append(dirs, p)
+		}
+		return nil
+	})
+	return dirs, err
+}
+
+// dryRunDirs gets the paths AddWith would watch for name, for DryRunAdd(): all
+// the directories for a recursive watch, or just name.
+func dryRunDirs(name string, with withOpts, pipe *pipeline) ([]string, error) {
+	name, recurse := recursivePath(name)
+	if recurse {
+		skipped := newSkippedError(with)
+		dirs, err := findDirs(name, pipe, with.follow, with.maxDepth, skipped)
+		if err != nil {
+			return nil, err
+		}
+		return dirs, skipped.err()
+	}
+
+	stat := os.Stat
+	if with.noFollow {
+		stat = os.Lstat
+	}
+	if _, err := stat(name); err != nil {
+		return nil, err
+	}
+	return []string{name}, nil
+}
+
+// findDirsFollow adds path and all directories below it to dirs, following
+// symlinks to directories. seen has all the parent directories; symlinks to
+// any of those are skipped, so that cyclic symlinks don't loop forever.
+//
+// Directories more than maxDepth levels below path are skipped, if maxDepth
+// isn't negative.
+func findDirsFollow(path string, fi fs.FileInfo, pipe *pipeline, dirs *[]string, seen []fs.FileInfo, maxDepth int, skipped *SkippedError) error {
+	*dirs = append(*dirs, path)
+	seen = append(seen, fi)
+	if maxDepth == 0 {
+		return nil
+	}
+
+	ls, err := os.ReadDir(path)
+	if err != nil {
+		if len(seen) > 1 && skipped.skip(err) {
+			*dirs = (*dirs)[:len(*dirs)-1]
+			return nil
+		}
+		return err
+	}
+outer:
+	for _, d := range ls {
+		isLink := d.Type()&fs.ModeSymlink != 0
+		if !d.IsDir() && !isLink {
+			continue
+		}
+		p := filepath.Join(path, d.Name())
+		if pipe.match(p) {
+			continue
+		}
+
+		fi, err := os.Stat(p)
+		if err != nil {
+			if isLink || errors.Is(err, fs.ErrNotExist) {
+				continue // Broken symlink, or removed since the ReadDir()
+			}
+			if skipped.skip(err) {
+				continue
+			}
+			return err
+		}
+		if !fi.IsDir() {
+			continue
+		}
+		for _, s := range seen {
+			if os.SameFile(s, fi) {
+				continue outer
+			}
+		}
+		if err := findDirsFollow(p, fi, pipe, dirs, seen, maxDepth-1, skipped); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cleanPath cleans a path passed to Add, Remove, or IsWatched, so that e.g.
+// "dir/", "./dir", and "dir//sub/.." are the same watch. An empty path is kept
+// as it is, rather than becoming ".".
+func cleanPath(name string) string {
+	if name == "" {
+		return name
+	}
+	return filepath.Clean(name)
+}
+
+// depth gets the number of levels path is below root: 0 for root itself, 1 for
+// root/a, 2 for root/a/b, etc.
+func depth(root, path string) int {
+	rel, err := filepath.Rel(root, path)
+	if err != nil || rel == "." {
+		return 0
+	}
+	return strings.Count(rel, string(filepath.Separator)) + 1
+}
+
+// findSameFile finds the path in dir that is the same file as fi, for
+// WithTrackInode(). Returns an empty string if there isn't one, other than
+// skip.
+func findSameFile(dir, skip string, fi os.FileInfo) string {
+	ls, _ := os.ReadDir(dir)
+	for _, d := range ls {
+		path := filepath.Join(dir, d.Name())
+		if path == skip {
+			continue
+		}
+		if other, err := os.Lstat(path); err == nil && os.SameFile(fi, other) {
+			return path
+		}
+	}
+	return ""
+}
+
+// WatcherStats are counters for a Watcher, from [Watcher.Stats]. All counters
+// start at 0 when the Watcher is created.
+type WatcherStats struct {
+	// Number of events sent on the Events channel.
+	EventsDelivered uint64
+
+	// Number of errors sent on the Errors channel, including overflows.
+	ErrorsEmitted uint64
+
+	// Number of times an [OverflowError] was sent: the kernel queue or buffer
+	// overflowed and events were dropped. The OS doesn't say how many events
+	// were dropped, so this counts the overflows rather than the events.
+	Overflows uint64
+
+	// Number of watches the Watcher added or updated by itself, rather than
+	// with Add: new directories inside a recursive watch, watched directories
+	// that were renamed, and files that were watched again with
+	// [WithAutoRewatch]. Renamed directories are only counted on Linux, and
+	// new directories only on Linux and illumos.
+	Rewatches uint64
+
+	// Number of paths in [Watcher.WatchList].
+	ActiveWatches int
+}
+
+// reader tracks if the goroutine that reads from the OS is busy with something
+// it read, for Watcher.Sync() and Watcher.Heartbeat().
+type reader struct {
+	busy  int32
+	reads uint32 // Number of times start was called.
+}
+
+// start is called after reading from the OS, and idle before reading again.
+func (r *reader) start() {
+	atomic.AddUint32(&r.reads, 1)
+	atomic.StoreInt32(&r.busy, 1)
+}
+func (r *reader) idle() { atomic.StoreInt32(&r.busy, 0) }
+
+// heartbeat sends the time every d, unless the reader is still busy with the
+// same thing as for the last heartbeat. The channel is closed once done is
+// closed.
+func (r *reader) heartbeat(d time.Duration, done <-chan struct{}) <-chan time.Time {
+	ch := make(chan time.Time, 1)
+	go func() {
+		defer close(ch)
+		t := time.NewTicker(d)
+		defer t.Stop()
+		last := atomic.LoadUint32(&r.reads)
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-t.C:
+				n := atomic.LoadUint32(&r.reads)
+				if n == last && atomic.LoadInt32(&r.busy) == 1 {
+					continue
+				}
+				last = n
+				select {
+				case ch <- now:
+				default:
+				}
+			}
+		}
+	}()
+	return ch
+}
+
+// sync waits until the reader is idle and pending reports nothing is queued in
+// the OS. It has to be seen twice in a row, as there's a small window between
+// reading from the OS and calling start.
+func (r *reader) sync(ctx context.Context, done <-chan struct{}, pending func() bool) error {
+	t := time.NewTicker(time.Millisecond)
+	defer t.Stop()
+	for seen := 0; ; {
+		if !pending() && atomic.LoadInt32(&r.busy) == 0 {
+			seen++
+		} else {
+			seen = 0
+		}
+		if seen == 2 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-done:
+			return ErrClosed
+		case <-t.C:
+		}
+	}
+}
+
+type (
+	addOpt   func(opt *withOpts)
+	withOpts struct {
+		bufsize       int
+		ops           Op
+		noFollow      bool
+		atomicSave    bool
+		follow        bool
+		dedup         time.Duration
+		autoRewatch   bool
+		maxDepth      int // -1 for no limit
+		initialScan   bool
+		createWatch   bool
+		basePath      string
+		chmodAsWrite  bool
+		refCount      bool
+		withoutHidden bool
+		skipErrors    bool
+		sizeTracking  bool
+		ttl           time.Duration // 0 for no limit
+		ttlReset      bool
+		slashPaths    bool
+		closeWrite    bool
+		targets       bool
+		mergeCreate   bool
+		raw           bool
+		rateN         int
+		rateWindow    time.Duration
+		snapshot      bool
+		trackInode    bool
+		partial       bool
+		oneShot       bool
+		glob          string // Base name pattern from AddGlob(); empty for everything.
+		realPath      bool
+		internal      bool // Directory that's waited in by the rewatcher; see rewatcher.hold().
+	}
+)
+
+var defaultOpts = withOpts{
+	bufsize:  65536, // 64K
+	ops:      AllOps,
+	maxDepth: -1,
+}
+
+func getOptions(opts ...addOpt) (withOpts, error) {
+	with := defaultOpts
+	for _, o := range opts {
+		o(&with)
+	}
+	if with.ops == 0 || with.ops&^AllOps != 0 {
+		return with, fmt.Errorf("fsnotify.WithOps: invalid operations: %d", with.ops)
+	}
+	if with.dedup < 0 {
+		return with, fmt.Errorf("fsnotify.WithDedup: negative duration: %s", with.dedup)
+	}
+	if with.ttl < 0 {
+		return with, fmt.Errorf("fsnotify.WithTTL: negative duration: %s", with.ttl)
+	}
+	if with.realPath && with.noFollow {
+		return with, errors.New("fsnotify.WithRealPath: can't be used with WithNoFollow")
+	}
+	if (with.rateN != 0 || with.rateWindow != 0) && (with.rateN < 1 || with.rateWindow <= 0) {
+		return with, fmt.Errorf("fsnotify.WithRateLimit: invalid limit: %d per %s", with.rateN, with.rateWindow)
+	}
+	return with, nil
+}
+
+// WithBufferSize sets the buffer size for the Windows backend. This is a no-op
+// for other backends.
+//
+// The default value is 64K (65536 bytes) which is the highest value that works
+// on all filesystems and should be enough for most applications, but if you
+// have a large burst of events it may not be enough. You can increase it if
+// you're hitting "queue or buffer overflow" errors ([ErrEventOverflow]).
+//
+// The minimum is 4096 bytes; AddWith will return an error if it's smaller.
+func WithBufferSize(bytes int) addOpt {
+	return func(opt *withOpts) { opt.bufsize = bytes }
+}
+
+// WithOps sets which operations to send for this watch; other operations are
+// dropped before they're sent on the Events channel. The default is to send all
+// operations.
+//
+// On Linux the inotify flags are set so that the kernel won't send events that
+// aren't needed in the first place; the other backends drop them after reading
+// them.
+//
+// For example, to only get events for new and modified files:
+//
+//	w.AddWith("dir", fsnotify.WithOps(fsnotify.Create|fsnotify.Write))
+func WithOps(op Op) addOpt {
+	return func(opt *withOpts) { opt.ops = op }
+}
+
+// WithNoFollow watches a symlink itself, rather than the path it points to.
+//
+// This is not supported with kqueue on BSD systems (it does work on macOS), as
+// symlinks can't be opened without following them; AddWith will return an error
+// if the path is a symlink. It's a no-op on Windows.
+func WithNoFollow() addOpt {
+	return func(opt *withOpts) { opt.noFollow = true }
+}
+
+// WithRealPath watches the absolute path of name with all symlinks resolved, as
+// with [filepath.EvalSymlinks], and sends Event.Name under that path rather than
+// the path as it was given. For example with a symlink "/srv/current" to
+// "/srv/releases/v2":
+//
+//	w.AddWith("/srv/current/../current/conf", WithRealPath())
+//
+// sends "/srv/releases/v2/conf/app.ini" for a change to app.ini, and
+// [Watcher.WatchList] has "/srv/releases/v2/conf". The watch can be removed with
+// either path.
+//
+// Only the watched path is resolved when it's added: symlinks inside a
+// recursive watch are handled as usual (see [WithFollowSymlinks]), and the
+// watch isn't changed if a symlink in the path is changed to point somewhere
+// else later.
+//
+// Returns an error if the path can't be resolved, for example for a dangling
+// symlink, or if the resolved path is already watched as another path. This
+// can't be used with [WithNoFollow].
+func WithRealPath() addOpt {
+	return func(opt *withOpts) { opt.realPath = true }
+}
+
+// WithFollowSymlinks follows symlinks to directories in recursive watches,
+// which are skipped by default. The directories are watched with the path of
+// the symlink, so for a symlink "dir/current" to "/releases/v2" events are
+// sent as "dir/current/file".
+//
+// Cyclic symlinks are detected and not followed. If a directory can be reached
+// through more than one path inside the watch it's only watched once, and
+// events are sent for only one of the paths.
+//
+// This is only supported by inotify; it's a no-op on other platforms.
+func WithFollowSymlinks() addOpt {
+	return func(opt *withOpts) { opt.follow = true }
+}
+
+// WithAtomicSaveDetection sends an extra Write event when a file is renamed
+// over another file, which is how many editors save files: they write to a
+// temporary file first, and then rename it to the original.
+//
+// Without this, only a Rename for the temporary file and a Create for the
+// original are sent. The Write is sent after the Create:
+//
+//   - inotify: for every rename to a path in the watched directory from a path
+//     in any watched directory, because it's not possible to tell if the
+//     destination already existed.
+//   - kqueue: when a file in the watched directory is replaced by another file,
+//     regardless of where that file came from.
+//   - polling: when a file is replaced by another file, as kqueue.
+//   - windows, fen: not supported; no events are added.
+func WithAtomicSaveDetection() addOpt {
+	return func(opt *withOpts) { opt.atomicSave = true }
+}
+
+// WithDedup drops an event if it has the same Name and Op as the event that was
+// sent right before it, and it's within d of that event.
+//
+// Unlike [NewDebouncedWatcher] events are never delayed; only exact repeats are
+// dropped. For example several Write events in a row for a file are sent as
+// one Write, but a Remove and Create for the same file are both sent. Events
+// dropped by [WithOps], [Watcher.Ignore], [Watcher.WatchExtensions], or
+// [Watcher.SetFilter] don't count as sent. Removing the watch with
+// [Watcher.Remove] forgets the last event.
+func WithDedup(d time.Duration) addOpt {
+	return func(opt *withOpts) { opt.dedup = d }
+}
+
+// WithAutoRewatch watches a file again if a file with the same name appears
+// after it was removed or renamed, which is what happens when log files are
+// rotated. A Create is sent once the new file is watched.
+//
+// The Remove is sent as usual. The parent directory is then watched until the
+// new file shows up, the same way as for [WithCreateWatch]; it gives up if the
+// parent directory is removed. While it's waiting the path isn't in
+// [Watcher.WatchList], but [Watcher.Remove] stops the wait. Events for the new
+// file that happened before the watch was added again are not sent.
+//
+// This is a no-op for directories.
+func WithAutoRewatch() addOpt {
+	return func(opt *withOpts) { opt.autoRewatch = true }
+}
+
+// WithMaxDepth limits a recursive watch to the directories at most n levels
+// below the root; 0 only watches the root (like a non-recursive watch), and 1
+// the root and the directories in it. A negative n means no limit, which is the
+// default.
+//
+// Directories that are created deeper than the limit are not watched, but the
+// Create for the directory itself is still sent if its parent is watched. This
+// is useful to limit the number of watches for very large trees, which may
+// otherwise hit the inotify watch limit.
+//
+// inotify and the polling backend don't watch or scan the directories beyond
+// the limit, and on Windows events for them are dropped. This is a no-op for
+// non-recursive watches.
+func WithMaxDepth(n int) addOpt {
+	return func(opt *withOpts) { opt.maxDepth = n }
+}
+
+// WithInitialScan sends a Create for every path that already exists in the
+// directory when it's added (or below it, for a recursive watch), so that the
+// state is complete without having to read the directory separately. Use
+// [Event.IsInitial] to tell these apart from paths that were created.
+//
+// The directory is read after the watch is added, so nothing is missed, and
+// all of these events are sent before any other events that happen after
+// AddWith returns. A path that's created while the directory is read may be
+// sent twice: once from the scan and once as a regular Create.
+//
+// Events for other watches are held until the scan is sent, so a large scan
+// may cause the kernel queue to overflow if events aren't read fast enough.
+// [Watcher.Ignore] and [WithMaxDepth] apply to the scan, and nothing is sent
+// if [WithOps] doesn't include Create. This is a no-op for files.
+func WithInitialScan() addOpt {
+	return func(opt *withOpts) { opt.initialScan = true }
+}
+
+// WithCreateWatch waits for the path to be created if it doesn't exist yet,
+// rather than returning an error. For example, to watch a socket that's only
+// created once some service starts:
+//
+//	w.AddWith("/run/app/app.sock", fsnotify.WithCreateWatch())
+//
+// The nearest parent directory that exists is watched until the path is
+// created, at which point the path is watched with the other options, as if
+// AddWith was called again, and a Create is sent for it. Directories that are
+// created in between are followed, so this works if /run/app doesn't exist
+// either.
+//
+// The path isn't in [Watcher.WatchList] until it's created. [Watcher.Remove]
+// stops waiting for it. The parent directory is watched with the same watcher,
+// and all paths that are waited for in the same directory share that watch. It
+// doesn't show up in [Watcher.WatchList] and nothing is sent for it, unless the
+// directory was also added with [Watcher.Add].
+func WithCreateWatch() addOpt {
+	return func(opt *withOpts) { opt.createWatch = true }
+}
+
+// WithBasePath sends Event.Name (and Event.RenamedFrom) relative to root,
+// rather than relative to the path passed to AddWith. For example:
+//
+//	w.AddWith("/home/me/project/src", fsnotify.WithBasePath("/home/me/project"))
+//
+// sends "src/main.go" for /home/me/project/src/main.go. Paths outside root
+// start with "..", and if the path can't be made relative to root (e.g. it's on
+// a different volume on Windows) the absolute path is sent.
+//
+// Relative paths are resolved against the working directory at the time
+// AddWith is called. The names for [Watcher.Ignore] patterns and the paths in
+// errors and [Watcher.WatchList] are not changed.
+func WithBasePath(root string) addOpt {
+	return func(opt *withOpts) { opt.basePath = root }
+}
+
+// WithChmodAsWrite sends Chmod events with Write set too, for programs that
+// save files by only changing the metadata, for example by setting the mtime.
+// With [WithOps] the Chmod is sent as only a Write if Write was given but Chmod
+// wasn't.
+//
+// There is no way to tell what changed: changing the permissions with e.g.
+// "chmod +x" sends the same event as changing the mtime.
+func WithChmodAsWrite() addOpt {
+	return func(opt *withOpts) { opt.chmodAsWrite = true }
+}
+
+// WithRefCount counts how many times the path was added, so that independent
+// parts of a program can add and remove the same path: the watch is only
+// removed once [Watcher.Remove] was called as many times as AddWith. For
+// example:
+//
+//	w.AddWith("/tmp/dir", fsnotify.WithRefCount())
+//	w.AddWith("/tmp/dir", fsnotify.WithRefCount())
+//	w.Remove("/tmp/dir")  // Still watched.
+//	w.Remove("/tmp/dir")  // Removed.
+//
+// If the path was already added without this option that counts as one. Every
+// AddWith still replaces the options for the path, and it's listed once in
+// [Watcher.WatchList]. The count is reset if the watch is removed because the
+// path was removed or renamed.
+func WithRefCount() addOpt {
+	return func(opt *withOpts) { opt.refCount = true }
+}
+
+// WithoutHidden drops all events for hidden files and directories (with a name
+// that starts with a dot, such as ".git"), and for everything in hidden
+// directories. Hidden directories aren't watched for recursive watches.
+//
+// Only the paths below the watched path are checked, so the watched path
+// itself can be hidden or be in a hidden directory, as in
+// AddWith(".config/app", WithoutHidden()).
+//
+// This doesn't use the "hidden" attribute on Windows.
+func WithoutHidden() addOpt {
+	return func(opt *withOpts) { opt.withoutHidden = true }
+}
+
+// WithSkipErrors skips directories that can't be read (for example because of
+// permissions) or that are removed while adding a recursive watch, rather than
+// failing the entire watch. Everything else is watched, and AddWith returns a
+// [*SkippedError] with the errors for the skipped directories.
+//
+// Directories that can't be read when they're created or moved in later are
+// also skipped, and a *SkippedError is sent on the Errors channel for them
+// (except with [NewPollingWatcher], which skips them without an error).
+//
+// This is a no-op on Windows, as the OS watches the entire tree, and for
+// non-recursive watches.
+func WithSkipErrors() addOpt {
+	return func(opt *withOpts) { opt.skipErrors = true }
+}
+
+// WithSizeTracking stats files on every Create and Write to remember their
+// size, and sets [Event.IsTruncated] if a Write made a file smaller; for
+// example when a log file is truncated to rotate it in place, rather than
+// appended to.
+//
+// This is a best effort: the size is read when the event is sent rather than
+// when the file was changed, so a truncate that's directly followed by more
+// writes may not be seen. The first Write for files that didn't exist yet when
+// the watch was added (or are in subdirectories of a recursive watch) can't be
+// compared to anything, unless there was a Create for them.
+func WithSizeTracking() addOpt {
+	return func(opt *withOpts) { opt.sizeTracking = true }
+}
+
+// WithTTL removes the watch d after it was added, as if [Watcher.Remove] was
+// called (ignoring [WithRefCount]). Nothing is sent when the watch expires.
+//
+// Adding the path again starts a new timer (or stops it, if WithTTL isn't
+// used), and removing the path or closing the watcher stops it.
+func WithTTL(d time.Duration) addOpt {
+	return func(opt *withOpts) { opt.ttl = d }
+}
+
+// WithOneShot removes the watch right after the first event for it was sent, as
+// if [Watcher.Remove] was called (ignoring [WithRefCount]). Nothing is sent for
+// the watch after that, even for events that were already read from the OS.
+//
+// This is the first event that's actually sent: events that are dropped (for
+// example by [WithOps], [Watcher.Ignore], or [Watcher.SetFilter]) don't count,
+// and with [WithInitialScan] it's the first Create for an existing path. It
+// can be combined with [WithTTL] to stop waiting after a while.
+//
+// This is done by fsnotify on all platforms, rather than with inotify's
+// IN_ONESHOT: the kernel would also remove the watch for events that fsnotify
+// then drops, and files are watched through their directory. The watch is
+// removed from a different goroutine right after the event is sent, so
+// [Watcher.IsWatched] may still report it as watched for a short while.
+func WithOneShot() addOpt {
+	return func(opt *withOpts) { opt.oneShot = true }
+}
+
+// WithTTLResetOnEvent restarts the [WithTTL] timer on every event for the
+// watch, so that it's only removed once nothing happened for the duration.
+// Events that are dropped (for example with [Watcher.Ignore] or when paused)
+// don't reset it.
+func WithTTLResetOnEvent() addOpt {
+	return func(opt *withOpts) { opt.ttlReset = true }
+}
+
+// WithSlashPaths sends Event.Name and Event.RenamedFrom with forward slashes
+// as the separator on all platforms, rather than a backslash on Windows. This
+// is a no-op on other platforms.
+//
+// Paths are still added and removed with the native separator (or forward
+// slashes, which also work on Windows), so the path this watch was added with
+// can be passed to [Watcher.Remove] as usual.
+func WithSlashPaths() addOpt {
+	return func(opt *withOpts) { opt.slashPaths = true }
+}
+
+// WithCloseWriteOnly sends a Write once a file that was opened for writing is
+// closed, rather than for every write to it. A program saving a file usually
+// writes it in a few parts, so this sends one Write rather than several, once
+// the file is complete. Writes through memory maps and files that are kept open
+// aren't sent at all.
+//
+// This uses IN_CLOSE_WRITE on Linux, and is a no-op on other platforms.
+func WithCloseWriteOnly() addOpt {
+	return func(opt *withOpts) { opt.closeWrite = true }
+}
+
+// WithResolveTargets also watches the files that symlinks in the directory
+// point to, and sends a Write or Chmod with the path of the symlink when the
+// target changes; for example a Write for "conf.d/app.conf" if it's a symlink
+// to "/opt/app/app.conf" and that file is written to. Without this only changes
+// to the symlink itself are sent.
+//
+// Symlinks that are created or replaced (as "ln -sf" does) are watched again,
+// and a Write is sent if a target is replaced by another file. Several symlinks
+// to the same file all get the event, and symlinks that loop are skipped, as
+// are symlinks to directories (use [WithFollowSymlinks] for those in recursive
+// watches). Every target uses an inotify watch, which counts towards the
+// fs.inotify.max_user_watches limit.
+//
+// This is only supported by inotify; it's a no-op on other platforms.
+func WithResolveTargets() addOpt {
+	return func(opt *withOpts) { opt.targets = true }
+}
+
+// WithMergeCreateWrite sends a Create for a new file together with the first
+// Write to it as one event with Create|Write, if the Write follows within a few
+// milliseconds; this is what a program that creates a file and writes to it
+// right away usually looks like. Otherwise they're sent separately, as usual.
+//
+// The Create is held back until the Write is seen or the time is up, or until
+// any other event for the same file is sent (which is sent after it). Events
+// for other paths aren't held up, so they may be sent before the Create. Only
+// the first Write is merged; later ones are sent as usual.
+func WithMergeCreateWrite() addOpt {
+	return func(opt *withOpts) { opt.mergeCreate = true }
+}
+
+// WithRawEvents sets [Event.Raw] to the event the OS sent, for the events for
+// this path: a [RawInotifyEvent], [RawKqueueEvent], [RawWindowsEvent], or
+// [RawFENEvent], depending on the backend. This is useful for anything that
+// fsnotify doesn't translate to an [Op], but relying on it isn't portable.
+//
+// This is a no-op for the polling backend, which doesn't get events from the
+// OS.
+func WithRawEvents() addOpt {
+	return func(opt *withOpts) { opt.raw = true }
+}
+
+// WithRateLimit sends at most perPath events for every path in window, as a
+// safety valve for a program that changes a file in a loop. The window starts
+// with the first event for a path; everything over the limit is merged in to
+// one event that's sent once the window ends, with the operations of all of
+// them (and the Name and Time of the last one). Unlike [NewDebouncedWatcher]
+// events up to the limit are sent right away.
+//
+// This can hide a real burst of changes: a Create and Remove over the limit are
+// sent as one event with both, for example. Read the directory again (for
+// example with [WithInitialScan]) if the exact state matters.
+//
+// What was over the limit is dropped if the path is removed with
+// [Watcher.Remove] or the watcher is closed with [Watcher.Close], and sent
+// right away by [Watcher.CloseWait].
+func WithRateLimit(perPath int, window time.Duration) addOpt {
+	return func(opt *withOpts) { opt.rateN, opt.rateWindow = perPath, window }
+}
+
+// WithSnapshot keeps a snapshot of everything in the watch, for
+// [Watcher.Rescan]: the name, type, size, modification time, and permissions
+// of every path, as read when the path is added and updated on every event.
+//
+// This reads the whole directory when it's added (and everything below it for
+// recursive watches), and every path again when an event is sent for it.
+func WithSnapshot() addOpt {
+	return func(opt *withOpts) { opt.snapshot = true }
+}
+
+// WithTrackInode keeps watching a file that was added with Add() when it's
+// renamed, rather than sending a Remove and no longer watching it. The rename
+// is sent as a Rename with the new path as Name and the old path as
+// RenamedFrom, and all later events have the new path; use the new path for
+// [Watcher.Remove] too.
+//
+// This is a best effort: the new path is found by looking for the same inode
+// in the directory the file was in, so a file that's moved to another
+// directory is still removed, and a file that's deleted (or replaced by
+// another file) is gone as usual. It's a no-op for directories.
+//
+// This is only supported by inotify and kqueue; AddWith returns
+// [ErrInodeUnsupported] on other platforms.
+func WithTrackInode() addOpt {
+	return func(opt *withOpts) { opt.trackInode = true }
+}
+
+// WithPartialRecursion keeps the directories of a recursive watch that could
+// be watched if one of them can't be, for any reason. AddWith returns a
+// [*SkippedError] with the errors for the directories that aren't watched, and
+// [SkippedError.Paths] lists them. Like with [WithSkipErrors] (which only skips
+// directories that can't be read or were removed) directories that are created
+// or moved in later and can't be watched are skipped, and a *SkippedError is
+// sent on the Errors channel for them.
+//
+// Without this, adding a recursive watch is all-or-nothing: if one of the
+// directories can't be watched (for example because the inotify watch limit is
+// reached) the directories that were already watched for this call are removed
+// again, and AddWith returns the error. Directories that were already watched
+// before are left as they are.
+//
+// This is a no-op on Windows, where the OS watches the entire tree, and for
+// non-recursive watches.
+func WithPartialRecursion() addOpt {
+	return func(opt *withOpts) { opt.partial = true }
+}
@@ -1,14 +1,18 @@
 package fsnotify
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
 	"os"
 	"path/filepath"
 	"reflect"
 	"runtime"
 	"sort"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -158,6 +162,27 @@ func TestWatch(t *testing.T) {
 			write    /file
 		`},
 
+		{"watch file in busy dir", func(t *testing.T, w *Watcher, tmp string) {
+			file := join(tmp, "file")
+			touch(t, file)
+			addWatch(t, w, file)
+
+			for i := 0; i < 10; i++ {
+				sib := join(tmp, fmt.Sprintf("sibling-%d", i))
+				touch(t, sib)
+				cat(t, "hello", sib)
+				mv(t, sib, sib+"-renamed")
+				rm(t, sib+"-renamed")
+			}
+			mkdir(t, tmp, "dir")
+			touch(t, tmp, "dir", "file")
+			rmAll(t, tmp, "dir")
+
+			cat(t, "hello", file)
+		}, `
+			write    /file
+		`},
+
 		{"watch a symlink to a file", func(t *testing.T, w *Watcher, tmp string) {
 			if runtime.GOOS == "darwin" {
 				// TODO
@@ -465,12 +490,7 @@ func TestWatchRename(t *testing.T) {
 			mv(t, file, rename)
 			mv(t, rename, tmp, "rename-two")
 		}, `
-			rename     /file
-
-			# TODO(v2): Windows should behave the same by default. See #518
-			windows:
-				rename   /file
-				rename   /rename-one
+			remove     /file
 		`},
 
 		{"re-add renamed file", func(t *testing.T, w *Watcher, tmp string) {
@@ -486,15 +506,9 @@ func TestWatchRename(t *testing.T) {
 			cat(t, "hello", rename)
 			cat(t, "hello", file)
 		}, `
-			rename /file    # mv file rename
+			remove /file    # mv file rename
 			                # Watcher gets removed on rename, so no write for /rename
 			write  /file    # cat hello >file
-
-			# TODO(v2): Windows should behave the same by default. See #518
-			windows:
-				rename    /file
-				write     /rename
-				write     /file
 		`},
 	}
 
@@ -504,6 +518,166 @@ func TestWatchRename(t *testing.T) {
 	}
 }
 
+func TestWatchRenamedFrom(t *testing.T) {
+	if isSolaris() {
+		t.Skip("FEN doesn't report the new name")
+	}
+
+	t.Run("inside watched dir", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		w := newCollector(t, tmp)
+		w.collect(t)
+
+		// Make sure the watcher has seen the file before it's renamed.
+		touch(t, tmp, "file")
+		waitForEvents()
+		mv(t, join(tmp, "file"), tmp, "renamed")
+
+		var found bool
+		for _, e := range w.stop(t) {
+			if e.Has(Create) && e.Name == join(tmp, "renamed") {
+				found = true
+				if e.RenamedFrom != join(tmp, "file") {
+					t.Errorf("wrong RenamedFrom: %q", e.RenamedFrom)
+				}
+			} else if e.RenamedFrom != "" {
+				t.Errorf("RenamedFrom set on %s", e)
+			}
+		}
+		if !found {
+			t.Error("no create event for renamed")
+		}
+	})
+
+	t.Run("from outside watched dir", func(t *testing.T) {
+		t.Parallel()
+
+		tmp, src := t.TempDir(), t.TempDir()
+		touch(t, src, "file")
+
+		w := newCollector(t, tmp)
+		w.collect(t)
+		mv(t, join(src, "file"), tmp, "file")
+
+		for _, e := range w.stop(t) {
+			if e.RenamedFrom != "" {
+				t.Errorf("RenamedFrom set on %s", e)
+			}
+		}
+	})
+}
+
+func TestWatchTime(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	w := newCollector(t, tmp)
+	w.collect(t)
+
+	start := time.Now()
+	touch(t, tmp, "file")
+	eventSeparator()
+	cat(t, "data", tmp, "file")
+	end := time.Now()
+
+	have := w.stop(t)
+	if len(have) == 0 {
+		t.Fatal("no events")
+	}
+	for i, e := range have {
+		if e.Time.Before(start) || e.Time.After(end) {
+			t.Errorf("time of %s not between %s and %s: %s", e, start, end, e.Time)
+		}
+		if i > 0 && e.Time.Before(have[i-1].Time) {
+			t.Errorf("time of %s before previous event", e)
+		}
+	}
+}
+
+func TestWatchIsDir(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Windows doesn't report the file type")
+	}
+	t.Parallel()
+
+	tmp := t.TempDir()
+	w := newCollector(t, tmp)
+	w.collect(t)
+
+	mkdir(t, tmp, "dir")
+	touch(t, tmp, "file")
+	eventSeparator()
+	rmAll(t, tmp, "dir")
+	rm(t, tmp, "file")
+	chmod(t, 0o755, tmp)
+
+	have := w.stop(t)
+	if len(have) == 0 {
+		t.Fatal("no events")
+	}
+	for _, e := range have {
+		if want := e.Name == join(tmp, "dir") || e.Name == tmp; e.IsDir() != want {
+			t.Errorf("IsDir() for %s is %t", e, e.IsDir())
+		}
+	}
+}
+
+func TestWatchInitialScan(t *testing.T) {
+	tests := []struct {
+		name    string
+		recurse bool
+		want    string
+	}{
+		{"dir", false, `
+			create  /file
+			create  /one
+			create  /new
+		`},
+		{"recursive", true, `
+			create  /file
+			create  /one
+			create  /one/file
+			create  /new
+		`},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.recurse {
+				supportsRecurse(t)
+			}
+			t.Parallel()
+
+			tmp := t.TempDir()
+			mkdir(t, tmp, "one")
+			touch(t, tmp, "file")
+			touch(t, tmp, "one", "file")
+
+			w := newCollector(t)
+			path := tmp
+			if tt.recurse {
+				path = join(tmp, "...")
+			}
+			if err := w.w.AddWith(path, WithInitialScan()); err != nil {
+				t.Fatal(err)
+			}
+			w.collect(t)
+			touch(t, tmp, "new")
+
+			have := w.stop(t)
+			for _, e := range have {
+				if want := e.Name != join(tmp, "new"); e.IsInitial() != want {
+					t.Errorf("IsInitial() for %s is %t", e, e.IsInitial())
+				}
+			}
+			cmpEvents(t, tmp, have, newEvents(t, tt.want))
+		})
+	}
+}
+
 func TestWatchSymlink(t *testing.T) {
 	tests := []testCase{
 		{"create unresolvable symlink", func(t *testing.T, w *Watcher, tmp string) {
@@ -586,6 +760,77 @@ func TestWatchSymlink(t *testing.T) {
 	}
 }
 
+func TestWatchSpecialFiles(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no named pipes or sockets on Windows")
+	}
+
+	tests := []struct {
+		name   string
+		create func(t *testing.T, path string)
+		write  bool
+		want   string
+	}{
+		{"named pipe", func(t *testing.T, path string) { mkfifo(t, path) }, true, `
+			write   /special
+			chmod   /special
+			remove  /special
+		`},
+		{"socket", func(t *testing.T, path string) {
+			l, err := net.Listen("unix", path)
+			if err != nil {
+				t.Skip(err)
+			}
+			t.Cleanup(func() { l.Close() })
+		}, false, `
+			chmod   /special
+			remove  /special
+		`},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			tmp := t.TempDir()
+			path := join(tmp, "special")
+			tt.create(t, path)
+
+			w := newCollector(t)
+			err := w.w.Add(path)
+			if isKqueue() {
+				if !errors.Is(err, ErrSpecialFileUnsupported) {
+					t.Errorf("wrong error: %v", err)
+				}
+				w.w.Close()
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.collect(t)
+
+			if tt.write {
+				// Opening a named pipe for reading and writing doesn't block
+				// on Linux, BSD, and illumos.
+				fp, err := os.OpenFile(path, os.O_RDWR, 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err := fp.Write([]byte("data")); err != nil {
+					t.Fatal(err)
+				}
+				fp.Close()
+				eventSeparator()
+			}
+			chmod(t, 0o600, path)
+			rm(t, path)
+			cmpEvents(t, tmp, w.stop(t), newEvents(t, tt.want))
+		})
+	}
+}
+
 func TestWatchAttrib(t *testing.T) {
 	tests := []testCase{
 		{"chmod", func(t *testing.T, w *Watcher, tmp string) {
@@ -632,12 +877,160 @@ func TestWatchAttrib(t *testing.T) {
 			windows:
 				write /file
 		`},
+
+		{"chmod watched directory", func(t *testing.T, w *Watcher, tmp string) {
+			dir := join(tmp, "dir")
+			mkdir(t, dir)
+			addWatch(t, w, dir)
+			chmod(t, 0o700, dir)
+		}, `
+			CHMOD   "/dir"
+
+			windows:
+				empty
+		`},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		tt.run(t)
+	}
+}
+
+func TestWatchRecursive(t *testing.T) {
+	supportsRecurse(t)
+
+	tests := []testCase{
+		{"add recursive", func(t *testing.T, w *Watcher, tmp string) {
+			mkdirAll(t, tmp, "/one/two")
+			addWatch(t, w, tmp, "...")
+
+			touch(t, tmp, "/file")
+			touch(t, tmp, "/one/file")
+			touch(t, tmp, "/one/two/file")
+			rm(t, tmp, "/one/two/file")
+		}, `
+			create    /file
+			create    /one/file
+			create    /one/two/file
+			remove    /one/two/file
+
+			windows:
+				create    /file
+				create    /one/file
+				write     /one
+				create    /one/two/file
+				write     /one/two
+				remove    /one/two/file
+				write     /one/two
+		`},
+
+		{"new directory", func(t *testing.T, w *Watcher, tmp string) {
+			addWatch(t, w, tmp, "...")
+
+			mkdir(t, tmp, "/new")
+			touch(t, tmp, "/new/file")
+			mkdir(t, tmp, "/new/sub")
+			touch(t, tmp, "/new/sub/file")
+		}, `
+			create    /new
+			create    /new/file
+			create    /new/sub
+			create    /new/sub/file
+
+			windows:
+				create    /new
+				create    /new/file
+				write     /new
+				create    /new/sub
+				write     /new
+				create    /new/sub/file
+				write     /new/sub
+		`},
+
+		{"max depth", func(t *testing.T, w *Watcher, tmp string) {
+			mkdirAll(t, tmp, "/one/two")
+			if err := w.AddWith(join(tmp, "..."), WithMaxDepth(1)); err != nil {
+				t.Fatal(err)
+			}
+
+			touch(t, tmp, "/file")
+			touch(t, tmp, "/one/file")
+			touch(t, tmp, "/one/two/file") // Too deep.
+			mkdir(t, tmp, "/new")
+			mkdir(t, tmp, "/new/sub")
+			touch(t, tmp, "/new/sub/file") // Too deep.
+		}, `
+			create    /file
+			create    /one/file
+			create    /new
+			create    /new/sub
+
+			# Directories that are too deep are watched as files in the
+			# directory, as with non-recursive watches.
+			fen:
+				create    /file
+				create    /one/file
+				write     /one/two
+				create    /new
+				create    /new/sub
+				write     /new/sub
+			windows:
+				create    /file
+				create    /one/file
+				write     /one
+				write     /one/two
+				create    /new
+				create    /new/sub
+				write     /new
+				write     /new/sub
+		`},
+
+		{"remove directory", func(t *testing.T, w *Watcher, tmp string) {
+			mkdirAll(t, tmp, "/one/two")
+			addWatch(t, w, tmp, "...")
+
+			rm(t, tmp, "/one/two")
+			touch(t, tmp, "/one/file")
+		}, `
+			remove    /one/two
+			create    /one/file
+
+			windows:
+				remove    /one/two
+				write     /one
+				create    /one/file
+				write     /one
+		`},
 	}
 
 	for _, tt := range tests {
 		tt := tt
 		tt.run(t)
 	}
+
+	// Directories created in quick succession may be created before the watch
+	// for the parent is added; make sure we still watch them.
+	t.Run("mkdir -p", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		w := newCollector(t, join(tmp, "..."))
+		w.collect(t)
+
+		mkdirAll(t, tmp, "/a/b/c/d")
+		touch(t, tmp, "/a/b/c/d/file")
+
+		var found bool
+		for _, e := range w.stop(t) {
+			if e.Name == join(tmp, "/a/b/c/d/file") && e.Has(Create) {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("no create event for /a/b/c/d/file")
+		}
+	})
 }
 
 func TestWatchRm(t *testing.T) {
@@ -650,11 +1043,6 @@ func TestWatchRm(t *testing.T) {
 			rm(t, file)
 		}, `
 			REMOVE   "/file"
-
-			# unlink always emits a CHMOD on Linux.
-			linux:
-				CHMOD    "/file"
-				REMOVE   "/file"
 		`},
 
 		{"remove watched file with open fd", func(t *testing.T, w *Watcher, tmp string) {
@@ -675,12 +1063,15 @@ func TestWatchRm(t *testing.T) {
 			rm(t, file)
 		}, `
 			REMOVE   "/file"
+		`},
 
-			# inotify will just emit a CHMOD for the unlink, but won't actually
-			# emit a REMOVE until the descriptor is closed. Bit odd, but not much
-			# we can do about it. The REMOVE is tested in TestInotifyDeleteOpenFile()
-			linux:
-				CHMOD    "/file"
+		{"remove empty watched directory", func(t *testing.T, w *Watcher, tmp string) {
+			dir := join(tmp, "dir")
+			mkdir(t, dir)
+			addWatch(t, w, dir)
+			rm(t, dir)
+		}, `
+			REMOVE   "/dir"
 		`},
 
 		{"remove watched directory", func(t *testing.T, w *Watcher, tmp string) {
@@ -743,6 +1134,48 @@ func TestWatchRm(t *testing.T) {
 				WRITE                "/j"
 				WRITE                "/j"
 		`},
+
+		{"rename parent of watched file", func(t *testing.T, w *Watcher, tmp string) {
+			if runtime.GOOS == "windows" {
+				t.Skip("Windows doesn't allow renaming directories with open handles inside")
+			}
+
+			mkdir(t, tmp, "dir")
+			touch(t, tmp, "dir", "file")
+			addWatch(t, w, tmp, "dir", "file")
+
+			mv(t, join(tmp, "dir"), tmp, "renamed")
+		}, `
+			remove    /dir/file
+
+			# The file is watched directly, and nothing is sent for renaming a
+			# directory that isn't watched.
+			kqueue:
+				empty
+			fen:
+				empty
+		`},
+
+		{"rename directory with watched paths", func(t *testing.T, w *Watcher, tmp string) {
+			if runtime.GOOS == "windows" {
+				t.Skip("Windows doesn't allow renaming directories with open handles inside")
+			}
+
+			mkdirAll(t, tmp, "dir", "sub")
+			touch(t, tmp, "dir", "sub", "file")
+			addWatch(t, w, tmp)
+			addWatch(t, w, tmp, "dir", "sub")
+			addWatch(t, w, tmp, "dir", "sub", "file")
+
+			mv(t, join(tmp, "dir"), tmp, "renamed")
+			eventSeparator()
+			touch(t, tmp, "renamed", "sub", "file")
+		}, `
+			rename    /dir
+			remove    /dir/sub/file
+			remove    /dir/sub
+			create    /renamed
+		`},
 	}
 
 	for _, tt := range tests {
@@ -895,6 +1328,50 @@ func TestClose(t *testing.T) {
 		}
 	})
 
+	t.Run("close and closewait concurrently", func(t *testing.T) {
+		t.Parallel()
+
+		for _, poll := range []bool{false, true} {
+			var (
+				w   *Watcher
+				err error
+			)
+			if poll {
+				w, err = NewPollingWatcher(10 * time.Millisecond)
+			} else {
+				w, err = NewWatcher()
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var wg sync.WaitGroup
+			errs := make(chan error, 6)
+			for i := 0; i < 3; i++ {
+				wg.Add(2)
+				go func() { defer wg.Done(); errs <- w.Close() }()
+				go func() { defer wg.Done(); errs <- w.CloseWait(context.Background()) }()
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				if err != nil {
+					t.Errorf("poll=%t: %s", poll, err)
+				}
+			}
+
+			// Closing a channel twice would have panicked; make sure they're
+			// closed exactly once.
+			for range w.Events {
+			}
+			for range w.Errors {
+			}
+			if err := w.Close(); err != nil {
+				t.Errorf("poll=%t: close after close: %s", poll, err)
+			}
+		}
+	})
+
 	t.Run("closes channels after read", func(t *testing.T) {
 		if runtime.GOOS == "netbsd" {
 			t.Skip("flaky")
@@ -919,159 +1396,3420 @@ func TestClose(t *testing.T) {
 	t.Run("error after closed", func(t *testing.T) {
 		t.Parallel()
 
-		tmp := t.TempDir()
-		w := newWatcher(t, tmp)
-		if err := w.Close(); err != nil {
-			t.Fatal(err)
-		}
+		for _, closeWait := range []bool{false, true} {
+			tmp := t.TempDir()
+			w := newWatcher(t, tmp)
+			if closeWait {
+				if err := w.CloseWait(context.Background()); err != nil {
+					t.Fatal(err)
+				}
+			} else if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
 
-		file := join(tmp, "file")
-		touch(t, file)
-		if err := w.Add(file); !errors.Is(err, ErrClosed) {
-			t.Fatalf("wrong error for Add: %#v", err)
-		}
-		if err := w.Remove(file); err != nil {
-			t.Fatalf("wrong error for Remove: %#v", err)
-		}
-		if l := w.WatchList(); l != nil { // Should return an error, but meh :-/
-			t.Fatalf("WatchList not nil: %#v", l)
+			file := join(tmp, "file")
+			touch(t, file)
+			if err := w.Add(file); !errors.Is(err, ErrClosed) {
+				t.Errorf("wrong error for Add: %#v", err)
+			}
+			if err := w.AddWith(file, WithOps(Write)); !errors.Is(err, ErrClosed) {
+				t.Errorf("wrong error for AddWith: %#v", err)
+			}
+			if err := w.Remove(tmp); !errors.Is(err, ErrClosed) {
+				t.Errorf("wrong error for Remove: %#v", err)
+			}
+			if err := w.Remove(file); !errors.Is(err, ErrClosed) {
+				t.Errorf("wrong error for Remove: %#v", err)
+			}
+			if l := w.WatchList(); l == nil || len(l) != 0 {
+				t.Errorf("WatchList not empty: %#v", l)
+			}
+			if w.IsWatched(tmp) {
+				t.Error("IsWatched is true")
+			}
+			if s := w.Stats(); s.ActiveWatches != 0 {
+				t.Errorf("ActiveWatches = %d", s.ActiveWatches)
+			}
+			if _, err := w.ReadBatch(1, -1); !errors.Is(err, ErrClosed) {
+				t.Errorf("wrong error for ReadBatch: %#v", err)
+			}
+			if _, err := w.Next(); !errors.Is(err, ErrClosed) {
+				t.Errorf("wrong error for Next: %#v", err)
+			}
+			if err := w.Close(); err != nil {
+				t.Errorf("wrong error for Close: %#v", err)
+			}
+			if err := w.CloseWait(context.Background()); err != nil {
+				t.Errorf("wrong error for CloseWait: %#v", err)
+			}
 		}
 	})
 }
 
-func TestAdd(t *testing.T) {
+func TestIgnore(t *testing.T) {
+	tests := []testCase{
+		{"base name", func(t *testing.T, w *Watcher, tmp string) {
+			if err := w.Ignore("*.tmp"); err != nil {
+				t.Fatal(err)
+			}
+			addWatch(t, w, tmp)
+
+			touch(t, tmp, "file.tmp")
+			touch(t, tmp, "file")
+		}, `
+			create  /file
+		`},
+
+		{"full path", func(t *testing.T, w *Watcher, tmp string) {
+			if err := w.Ignore(join(tmp, "a*")); err != nil {
+				t.Fatal(err)
+			}
+			addWatch(t, w, tmp)
+
+			touch(t, tmp, "abc")
+			touch(t, tmp, "b")
+			touch(t, tmp, "bac")
+		}, `
+			create  /b
+			create  /bac
+		`},
+
+		{"recursive", func(t *testing.T, w *Watcher, tmp string) {
+			supportsRecurse(t)
+			if err := w.Ignore("node_modules"); err != nil {
+				t.Fatal(err)
+			}
+			mkdirAll(t, tmp, "node_modules", "pkg")
+			addWatch(t, w, tmp, "...")
+
+			touch(t, tmp, "node_modules", "file")
+			touch(t, tmp, "node_modules", "pkg", "file")
+			mkdir(t, tmp, "dir")
+			touch(t, tmp, "dir", "file")
+		}, `
+			create  /dir
+			create  /dir/file
+		`},
+
+		{"clear", func(t *testing.T, w *Watcher, tmp string) {
+			if err := w.Ignore("*"); err != nil {
+				t.Fatal(err)
+			}
+			w.ClearIgnores()
+			addWatch(t, w, tmp)
+
+			touch(t, tmp, "file")
+		}, `
+			create  /file
+		`},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		tt.run(t)
+	}
+
+	t.Run("bad pattern", func(t *testing.T) {
+		t.Parallel()
+
+		w := newWatcher(t)
+		defer w.Close()
+
+		if err := w.Ignore("[x"); !errors.Is(err, filepath.ErrBadPattern) {
+			t.Fatalf("wrong error: %v", err)
+		}
+	})
+}
+
+func TestWatchExtensions(t *testing.T) {
+	tests := []testCase{
+		{"extensions", func(t *testing.T, w *Watcher, tmp string) {
+			w.WatchExtensions(".go", "js")
+			addWatch(t, w, tmp)
+
+			touch(t, tmp, "file.go")
+			touch(t, tmp, "file.JS")
+			touch(t, tmp, "file.css")
+			touch(t, tmp, "file.go.bak")
+			touch(t, tmp, "file")
+			mkdir(t, tmp, "dir.d")
+		}, `
+			create  /file.go
+			create  /file.JS
+			create  /file
+			create  /dir.d
+		`},
+
+		{"ignore wins", func(t *testing.T, w *Watcher, tmp string) {
+			w.WatchExtensions("go")
+			if err := w.Ignore("*_test.go"); err != nil {
+				t.Fatal(err)
+			}
+			addWatch(t, w, tmp)
+
+			touch(t, tmp, "file.go")
+			touch(t, tmp, "file_test.go")
+		}, `
+			create  /file.go
+		`},
+
+		{"reset", func(t *testing.T, w *Watcher, tmp string) {
+			w.WatchExtensions("go")
+			w.WatchExtensions()
+			addWatch(t, w, tmp)
+
+			touch(t, tmp, "file.css")
+		}, `
+			create  /file.css
+		`},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		tt.run(t)
+	}
+}
+
+func TestSetFilter(t *testing.T) {
+	tests := []testCase{
+		{"filter", func(t *testing.T, w *Watcher, tmp string) {
+			w.SetFilter(func(e Event) bool { return !strings.HasPrefix(filepath.Base(e.Name), "skip") })
+			addWatch(t, w, tmp)
+
+			touch(t, tmp, "file")
+			touch(t, tmp, "skip-file")
+			mkdir(t, tmp, "skip-dir")
+		}, `
+			create  /file
+		`},
+
+		{"after extensions", func(t *testing.T, w *Watcher, tmp string) {
+			w.WatchExtensions("go")
+			w.SetFilter(func(e Event) bool {
+				if filepath.Ext(e.Name) == ".css" {
+					t.Errorf("filter called for %s", e)
+				}
+				return true
+			})
+			addWatch(t, w, tmp)
+
+			touch(t, tmp, "file.go")
+			touch(t, tmp, "file.css")
+		}, `
+			create  /file.go
+		`},
+
+		{"remove", func(t *testing.T, w *Watcher, tmp string) {
+			w.SetFilter(func(e Event) bool { return false })
+			w.SetFilter(nil)
+			addWatch(t, w, tmp)
+
+			touch(t, tmp, "file")
+		}, `
+			create  /file
+		`},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		tt.run(t)
+	}
+
+	t.Run("stats", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		w := newCollector(t, tmp)
+		w.w.SetFilter(func(e Event) bool { return filepath.Base(e.Name) == "keep" })
+		w.collect(t)
+
+		touch(t, tmp, "drop")
+		touch(t, tmp, "keep")
+		have := w.stop(t)
+		if len(have) != 1 || have[0].Seq == 1 {
+			t.Errorf("wrong events (the dropped events should leave a gap in Seq):\n%s", have)
+		}
+		if n := w.w.Stats().EventsDelivered; n != 1 {
+			t.Errorf("EventsDelivered is %d", n)
+		}
+	})
+}
+
+func TestSubscribe(t *testing.T) {
+	// Read n events from ch, or fail after a timeout.
+	read := func(t *testing.T, ch <-chan Event, n int) Events {
+		t.Helper()
+		var have Events
+		for len(have) < n {
+			select {
+			case e, ok := <-ch:
+				if !ok {
+					t.Fatalf("channel closed after %d events", len(have))
+				}
+				have = append(have, e)
+			case <-time.After(5 * time.Second):
+				t.Fatalf("timeout after %d events:\n%s", len(have), have)
+			}
+		}
+		return have
+	}
+
+	t.Run("fan out", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		w := newCollector(t, tmp)
+		a, unsubA := w.w.Subscribe()
+		defer unsubA()
+		b, unsubB := w.w.Subscribe()
+		defer unsubB()
+		w.collect(t)
+
+		touch(t, tmp, "file1")
+		touch(t, tmp, "file2")
+		haveA, haveB := read(t, a, 2), read(t, b, 2)
+		have := w.stop(t)
+		for i, e := range have[:2] {
+			if haveA[i] != e || haveB[i] != e {
+				t.Errorf("wrong event %d\nEvents: %s\na:      %s\nb:      %s", i, e, haveA[i], haveB[i])
+			}
+		}
+	})
+
+	t.Run("slow subscriber", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		w := newCollector(t, tmp)
+		slow, unsubSlow := w.w.Subscribe()
+		defer unsubSlow()
+		fast, unsubFast := w.w.Subscribe()
+		defer unsubFast()
+		w.collect(t)
+
+		n := subscribeBuffer + 10
+		haveC := make(chan Events)
+		go func() {
+			var have Events
+			for e := range fast {
+				if have = append(have, e); len(have) == n {
+					break
+				}
+			}
+			haveC <- have
+		}()
+		for i := 0; i < n; i++ {
+			touch(t, tmp, fmt.Sprintf("file%d", i))
+		}
+
+		var have Events
+		select {
+		case have = <-haveC:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout")
+		}
+		for i, e := range have {
+			if e.Seq != have[0].Seq+uint64(i) {
+				t.Fatalf("gap in Seq at %d:\n%s", i, have)
+			}
+		}
+		if l := len(slow); l != subscribeBuffer {
+			t.Errorf("slow subscriber has %d events buffered; want %d", l, subscribeBuffer)
+		}
+	})
+
+	t.Run("unsubscribe", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		w := newCollector(t, tmp)
+		ch, unsub := w.w.Subscribe()
+		w.collect(t)
+
+		unsub()
+		unsub()
+		touch(t, tmp, "file")
+		w.stop(t)
+		if e, ok := <-ch; ok {
+			t.Errorf("event after unsubscribing: %s", e)
+		}
+	})
+
+	t.Run("close", func(t *testing.T) {
+		t.Parallel()
+
+		w := newWatcher(t)
+		ch, unsub := w.Subscribe()
+		w.Close()
+		if _, ok := <-ch; ok {
+			t.Error("channel not closed after Close")
+		}
+		unsub()
+
+		ch, unsub = w.Subscribe()
+		if _, ok := <-ch; ok {
+			t.Error("channel not closed after Close")
+		}
+		unsub()
+	})
+
+	t.Run("debounced", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		w, err := NewDebouncedWatcher(50 * time.Millisecond)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer w.Close()
+		addWatch(t, w, tmp)
+		ch, unsub := w.Subscribe()
+		defer unsub()
+
+		touch(t, tmp, "file")
+		cat(t, "data", tmp, "file")
+		e := <-w.Events
+		if have := read(t, ch, 1); have[0] != e {
+			t.Errorf("wrong event\nEvents:     %s\nsubscriber: %s", e, have[0])
+		}
+	})
+}
+
+func TestCloseWait(t *testing.T) {
+	t.Run("drain", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		w := newWatcher(t, tmp)
+
+		// Don't read the event yet, so it's stuck in the reader goroutine.
+		touch(t, tmp, "file")
+		waitForEvents()
+
+		errC := make(chan error)
+		go func() { errC <- w.CloseWait(context.Background()) }()
+
+		var have Events
+		for e := range w.Events {
+			have = append(have, e)
+		}
+		if err := <-errC; err != nil {
+			t.Fatal(err)
+		}
+		if len(have) == 0 || !have[0].Has(Create) || have[0].Name != join(tmp, "file") {
+			t.Fatalf("wrong events:\n%s", have)
+		}
+
+		if err := w.Add(t.TempDir()); err == nil {
+			t.Fatal("expected error on Add() after CloseWait(), got nil")
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("context done", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		w := newWatcher(t, tmp)
+
+		// Windows has a buffered Events channel; make sure it's full.
+		for i := 0; i < 60; i++ {
+			touch(t, tmp, fmt.Sprintf("file-%d", i), noWait)
+		}
+		waitForEvents()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		err := w.CloseWait(ctx)
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("wrong error: %v", err)
+		}
+
+		// Channel should be closed after draining the buffer.
+		for range w.Events {
+		}
+	})
+
+	t.Run("after close", func(t *testing.T) {
+		t.Parallel()
+
+		w := newWatcher(t)
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.CloseWait(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestNewBufferedWatcher(t *testing.T) {
+	t.Run("buffered", func(t *testing.T) {
+		t.Parallel()
+
+		w, err := NewBufferedWatcher(100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer w.Close()
+		if c := cap(w.Events); c != 100 {
+			t.Fatalf("cap = %d", c)
+		}
+
+		// Events are put in the buffer without anyone reading them.
+		tmp := t.TempDir()
+		addWatch(t, w, tmp)
+		for i := 0; i < 10; i++ {
+			touch(t, tmp, fmt.Sprintf("file-%d", i), noWait)
+		}
+		waitForEvents()
+		if l := len(w.Events); l < 10 {
+			t.Fatalf("len = %d", l)
+		}
+	})
+
+	t.Run("negative", func(t *testing.T) {
+		t.Parallel()
+
+		if _, err := NewBufferedWatcher(-1); err == nil {
+			t.Fatal("error is nil")
+		}
+	})
+}
+
+func TestReadBatch(t *testing.T) {
+	t.Run("read", func(t *testing.T) {
+		t.Parallel()
+
+		w, err := NewBufferedWatcher(100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer w.Close()
+		tmp := t.TempDir()
+		addWatch(t, w, tmp)
+
+		if b, err := w.ReadBatch(10, 10*time.Millisecond); err != nil || b != nil {
+			t.Fatalf("not empty after timeout: %v, %v", b, err)
+		}
+
+		for i := 0; i < 10; i++ {
+			touch(t, tmp, fmt.Sprintf("file-%d", i), noWait)
+		}
+		waitForEvents()
+
+		b, err := w.ReadBatch(5, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(b) != 5 {
+			t.Fatalf("len = %d: %v", len(b), b)
+		}
+		b, err = w.ReadBatch(100, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(b) < 5 {
+			t.Fatalf("len = %d: %v", len(b), b)
+		}
+	})
+
+	t.Run("closed", func(t *testing.T) {
+		t.Parallel()
+
+		w := newWatcher(t)
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.ReadBatch(10, -1); !errors.Is(err, ErrClosed) {
+			t.Errorf("wrong error: %v", err)
+		}
+	})
+
+	t.Run("max", func(t *testing.T) {
+		t.Parallel()
+
+		w := newWatcher(t)
+		defer w.Close()
+		if _, err := w.ReadBatch(0, time.Second); err == nil {
+			t.Fatal("no error for max of 0")
+		}
+	})
+}
+
+func TestNext(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	w := newWatcher(t, tmp)
+	defer w.Close()
+
+	touch(t, tmp, "file")
+	e, err := w.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := join(tmp, "file"); e.Name != want || !e.Has(Create) {
+		t.Errorf("wrong event: %s", e)
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		if _, err := w.Next(); err != nil {
+			if !errors.Is(err, ErrClosed) {
+				t.Errorf("wrong error: %v", err)
+			}
+			break
+		}
+	}
+}
+
+func TestEventSeq(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	touch(t, tmp, "existing")
+	w := newCollector(t)
+	if err := w.w.AddWith(tmp, WithInitialScan()); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.w.Ignore("*.tmp"); err != nil {
+		t.Fatal(err)
+	}
+	w.collect(t)
+
+	for i := 0; i < 10; i++ {
+		touch(t, tmp, fmt.Sprintf("file%d", i))
+		touch(t, tmp, fmt.Sprintf("file%d.tmp", i))
+	}
+	have := w.stop(t)
+	if len(have) < 11 {
+		t.Fatalf("not enough events:\n%s", have)
+	}
+	if have[0].Seq != 1 {
+		t.Errorf("wrong Seq for the first event: %d (%s)", have[0].Seq, have[0])
+	}
+	for i := 1; i < len(have); i++ {
+		if have[i].Seq <= have[i-1].Seq {
+			t.Errorf("Seq for event %d not increasing: %d after %d (%s)", i, have[i].Seq, have[i-1].Seq, have[i])
+		}
+	}
+	// The ignored events were read, and leave a gap.
+	if last := have[len(have)-1].Seq; last <= uint64(len(have)) {
+		t.Errorf("no gaps for the ignored events: last Seq is %d for %d events", last, len(have))
+	}
+}
+
+func TestSync(t *testing.T) {
+	t.Run("sync", func(t *testing.T) {
+		if runtime.GOOS == "windows" {
+			t.Skip("Sync can't see if anything is queued on Windows")
+		}
+		t.Parallel()
+
+		tmp := t.TempDir()
+		w := newCollector(t, tmp)
+		w.collect(t)
+		defer w.stop(t)
+
+		names := []string{"a", "b", "c"}
+		for _, n := range names {
+			touch(t, tmp, n)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := w.w.Sync(ctx); err != nil {
+			t.Fatal(err)
+		}
+
+		have := make(map[string]bool)
+		for _, e := range w.events(t) {
+			if e.Has(Create) {
+				have[filepath.Base(e.Name)] = true
+			}
+		}
+		for _, n := range names {
+			if !have[n] {
+				t.Errorf("no Create for %q after Sync", n)
+			}
+		}
+	})
+
+	t.Run("closed", func(t *testing.T) {
+		t.Parallel()
+
+		w := newWatcher(t)
+		w.Close()
+		if err := w.Sync(context.Background()); !errors.Is(err, ErrClosed) {
+			t.Errorf("wrong error: %v", err)
+		}
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		if runtime.GOOS == "windows" {
+			t.Skip("Sync can't see if anything is queued on Windows")
+		}
+		t.Parallel()
+
+		tmp := t.TempDir()
+		w := newWatcher(t, tmp)
+		defer w.Close()
+
+		// Nothing reads the Events channel, so the Create is never sent.
+		touch(t, tmp, "file")
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		if err := w.Sync(ctx); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("wrong error: %v", err)
+		}
+	})
+}
+
+func TestHeartbeat(t *testing.T) {
+	t.Run("idle", func(t *testing.T) {
+		t.Parallel()
+
+		w := newWatcher(t, t.TempDir())
+		defer w.Close()
+		hb, err := w.Heartbeat(10 * time.Millisecond)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 3; i++ {
+			select {
+			case <-hb:
+			case <-time.After(time.Second):
+				t.Fatalf("no heartbeat %d", i)
+			}
+		}
+	})
+
+	t.Run("stuck", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		w, err := NewBufferedWatcher(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer w.Close()
+		addWatch(t, w, tmp)
+		hb, err := w.Heartbeat(10 * time.Millisecond)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Nothing reads the Events channel, so sending the Create blocks.
+		touch(t, tmp, "file")
+		time.Sleep(100 * time.Millisecond)
+		select {
+		case <-hb:
+		default:
+		}
+		select {
+		case <-hb:
+			t.Fatal("heartbeat while stuck")
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		go func() {
+			for range w.Events {
+			}
+		}()
+		select {
+		case <-hb:
+		case <-time.After(time.Second):
+			t.Fatal("no heartbeat after reading the events")
+		}
+	})
+
+	t.Run("closed", func(t *testing.T) {
+		t.Parallel()
+
+		w := newWatcher(t)
+		if _, err := w.Heartbeat(0); err == nil {
+			t.Error("no error for zero interval")
+		}
+		hb, err := w.Heartbeat(time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Close()
+		select {
+		case _, ok := <-hb:
+			if ok {
+				t.Error("heartbeat after Close")
+			}
+		case <-time.After(time.Second):
+			t.Error("channel not closed after Close")
+		}
+		if _, err := w.Heartbeat(time.Second); !errors.Is(err, ErrClosed) {
+			t.Errorf("wrong error: %v", err)
+		}
+	})
+}
+
+func TestAdd(t *testing.T) {
 	t.Run("permission denied", func(t *testing.T) {
 		if runtime.GOOS == "windows" {
-			t.Skip("chmod doesn't work on Windows") // See if we can make a file unreadable
+			t.Skip("chmod doesn't work on Windows") // See if we can make a file unreadable
+		}
+
+		t.Parallel()
+
+		tmp := t.TempDir()
+		dir := join(tmp, "dir-unreadable")
+		mkdir(t, dir)
+		touch(t, dir, "/file")
+		chmod(t, 0, dir)
+
+		w := newWatcher(t)
+		defer func() {
+			w.Close()
+			chmod(t, 0o755, dir) // Make TempDir() cleanup work
+		}()
+		err := w.Add(dir)
+		if err == nil {
+			t.Fatal("error is nil")
+		}
+		if !errors.Is(err, internal.UnixEACCES) {
+			t.Errorf("not unix.EACCESS: %T %#[1]v", err)
+		}
+		if !errors.Is(err, internal.SyscallEACCES) {
+			t.Errorf("not syscall.EACCESS: %T %#[1]v", err)
+		}
+		if !errors.Is(err, ErrPermission) || !errors.Is(err, os.ErrPermission) {
+			t.Errorf("not ErrPermission: %T %#[1]v", err)
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		touch(t, tmp, "file")
+		w := newWatcher(t)
+		defer w.Close()
+
+		err := w.Add(join(tmp, "nonexistent"))
+		if !errors.Is(err, ErrNotExist) || !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("not ErrNotExist: %T %#[1]v", err)
+		}
+		err = w.Add(join(tmp, "file", "sub"))
+		if !errors.Is(err, ErrNotDirectory) || errors.Is(err, ErrNotExist) {
+			t.Errorf("not ErrNotDirectory: %T %#[1]v", err)
+		}
+		if w.SupportsRecursion() {
+			if err := w.Add(join(tmp, "file", "...")); !errors.Is(err, ErrNotDirectory) {
+				t.Errorf("not ErrNotDirectory: %T %#[1]v", err)
+			}
+		}
+		if _, err := w.DryRunAdd(join(tmp, "nonexistent")); !errors.Is(err, ErrNotExist) {
+			t.Errorf("not ErrNotExist: %T %#[1]v", err)
+		}
+	})
+
+	t.Run("unclean paths", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		sub := join(tmp, "sub")
+		mkdir(t, sub)
+
+		paths := []string{
+			tmp + "/sub/",
+			tmp + "//sub",
+			tmp + "/./sub",
+			tmp + "/sub/../sub",
+			tmp + "/sub/.",
+		}
+		for i, p := range paths {
+			w := newCollector(t)
+			if err := w.w.Add(p); err != nil {
+				t.Fatalf("%q: %s", p, err)
+			}
+			if l := w.w.WatchList(); len(l) != 1 || l[0] != sub {
+				t.Errorf("%q: wrong WatchList: %#v", p, l)
+			}
+			other := paths[(i+1)%len(paths)]
+			if !w.w.IsWatched(other) {
+				t.Errorf("%q: IsWatched(%q) is false", p, other)
+			}
+			w.collect(t)
+
+			file := join(sub, fmt.Sprintf("file%d", i))
+			touch(t, file)
+			eventSeparator()
+			if err := w.w.Remove(other); err != nil {
+				t.Errorf("%q: Remove(%q): %s", p, other, err)
+			}
+			if l := w.w.WatchList(); len(l) != 0 {
+				t.Errorf("%q: WatchList not empty: %#v", p, l)
+			}
+
+			for _, e := range w.stop(t) {
+				if e.Name != file {
+					t.Errorf("%q: wrong name: %s", p, e)
+				}
+			}
+		}
+	})
+
+	t.Run("different names", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		sub := join(tmp, "sub")
+		mkdir(t, sub)
+		cwd, err := os.Getwd()
+		if err != nil {
+			t.Fatal(err)
+		}
+		rel, err := filepath.Rel(cwd, sub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names := []string{sub, rel}
+		if runtime.GOOS != "windows" {
+			symlink(t, sub, tmp, "link")
+			names = append(names, join(tmp, "link"))
+		}
+
+		for i, first := range names {
+			second := names[(i+1)%len(names)]
+			w := newCollector(t)
+			addWatch(t, w.w, first)
+			addWatch(t, w.w, second)
+			if l := w.w.WatchList(); len(l) != 1 || l[0] != first {
+				t.Errorf("%q, %q: wrong WatchList: %#v", first, second, l)
+			}
+			if !w.w.IsWatched(second) {
+				t.Errorf("%q: IsWatched(%q) is false", first, second)
+			}
+			w.collect(t)
+
+			name := fmt.Sprintf("file%d", i)
+			touch(t, sub, name)
+			eventSeparator()
+			if err := w.w.Remove(second); err != nil {
+				t.Errorf("%q: Remove(%q): %s", first, second, err)
+			}
+			if l := w.w.WatchList(); len(l) != 0 {
+				t.Errorf("%q: WatchList not empty: %#v", first, l)
+			}
+
+			have := w.stop(t)
+			if len(have) == 0 {
+				t.Errorf("%q, %q: no events", first, second)
+			}
+			for _, e := range have {
+				if e.Name != join(first, name) {
+					t.Errorf("%q, %q: wrong name: %s", first, second, e)
+				}
+			}
+		}
+	})
+
+	t.Run("recursive", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		touch(t, tmp, "file")
+
+		w := newWatcher(t)
+		defer w.Close()
+
+		want := ErrNotDirectory
+		switch runtime.GOOS {
+		case "linux", "windows", "illumos", "solaris":
+		default:
+			want = ErrRecursionUnsupported
+		}
+
+		err := w.Add(join(tmp, "file", "..."))
+		if !errors.Is(err, want) {
+			t.Fatalf("wrong error: %v", err)
+		}
+		if want == ErrNotDirectory && !strings.Contains(err.Error(), "recursive watches") {
+			t.Errorf("error doesn't mention recursion: %v", err)
+		}
+		if l := w.WatchList(); len(l) != 0 {
+			t.Fatalf("WatchList not empty: %#v", l)
+		}
+	})
+}
+
+func TestAddWith(t *testing.T) {
+	tests := []testCase{
+		{"WithOps create", func(t *testing.T, w *Watcher, tmp string) {
+			file := join(tmp, "file")
+			if err := w.AddWith(tmp, WithOps(Create)); err != nil {
+				t.Fatal(err)
+			}
+
+			cat(t, "data", file)
+			rm(t, file)
+			touch(t, file)
+		}, `
+			create  /file
+			create  /file
+		`},
+
+		{"AddOps", func(t *testing.T, w *Watcher, tmp string) {
+			file := join(tmp, "file")
+			if err := w.AddOps(tmp, AllOps&^Write); err != nil {
+				t.Fatal(err)
+			}
+
+			cat(t, "data", file)
+			rm(t, file)
+		}, `
+			create  /file
+			remove  /file
+		`},
+
+		{"WithOps remove and rename", func(t *testing.T, w *Watcher, tmp string) {
+			file := join(tmp, "file")
+			touch(t, file)
+			if err := w.AddWith(tmp, WithOps(Remove|Rename)); err != nil {
+				t.Fatal(err)
+			}
+
+			cat(t, "data", file)
+			mv(t, file, tmp, "rename")
+			rm(t, tmp, "rename")
+		}, `
+			rename  /file
+			remove  /rename
+		`},
+
+		{"WithOps no chmod", func(t *testing.T, w *Watcher, tmp string) {
+			file := join(tmp, "file")
+			touch(t, file)
+			if err := w.AddWith(tmp, WithOps(Create|Write)); err != nil {
+				t.Fatal(err)
+			}
+
+			chmod(t, 0o700, file)
+			cat(t, "data", file)
+			chmod(t, 0o600, file)
+		}, `
+			write   /file
+		`},
+
+		{"WithAtomicSaveDetection", func(t *testing.T, w *Watcher, tmp string) {
+			if runtime.GOOS == "windows" || isSolaris() {
+				t.Skip("WithAtomicSaveDetection not supported on " + runtime.GOOS)
+			}
+			touch(t, tmp, "file")
+			cat(t, "data", tmp, "file.tmp")
+			if err := w.AddWith(tmp, WithAtomicSaveDetection()); err != nil {
+				t.Fatal(err)
+			}
+
+			mv(t, join(tmp, "file.tmp"), tmp, "file")
+		}, `
+			rename  /file.tmp
+			create  /file
+			write   /file
+
+			kqueue:
+				rename  /file.tmp
+				remove  /file
+				create  /file
+				write   /file
+		`},
+
+		{"WithDedup", func(t *testing.T, w *Watcher, tmp string) {
+			file := join(tmp, "file")
+			if err := w.AddWith(tmp, WithDedup(time.Minute)); err != nil {
+				t.Fatal(err)
+			}
+
+			cat(t, "data", file)
+			cat(t, "data", file)
+			cat(t, "data", file)
+			rm(t, file)
+			touch(t, file)
+		}, `
+			create  /file
+			write   /file
+			remove  /file
+			create  /file
+		`},
+
+		{"WithDedup after Ignore", func(t *testing.T, w *Watcher, tmp string) {
+			file := join(tmp, "file")
+			if err := w.Ignore("*.tmp"); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.AddWith(tmp, WithDedup(time.Minute)); err != nil {
+				t.Fatal(err)
+			}
+
+			cat(t, "data", file)
+			cat(t, "data", tmp, "file.tmp")
+			cat(t, "data", file)
+		}, `
+			create  /file
+			write   /file
+		`},
+
+		{"WithAutoRewatch", func(t *testing.T, w *Watcher, tmp string) {
+			file := join(tmp, "file")
+			touch(t, file)
+			if err := w.AddWith(file, WithAutoRewatch()); err != nil {
+				t.Fatal(err)
+			}
+
+			rm(t, file)
+			touch(t, file)
+			waitForEvents()
+			cat(t, "data", file)
+		}, `
+			remove  /file
+			create  /file
+			write   /file
+		`},
+
+		{"WithCreateWatch", func(t *testing.T, w *Watcher, tmp string) {
+			file := join(tmp, "a", "b", "file")
+			if err := w.AddWith(file, WithCreateWatch()); err != nil {
+				t.Fatal(err)
+			}
+
+			mkdir(t, tmp, "a")
+			eventSeparator()
+			mkdir(t, tmp, "a", "b")
+			touch(t, tmp, "a", "other")
+			touch(t, file)
+			waitForEvents()
+			cat(t, "data", file)
+		}, `
+			create  /a/b/file
+			write   /a/b/file
+		`},
+
+		{"WithChmodAsWrite", func(t *testing.T, w *Watcher, tmp string) {
+			file := join(tmp, "file")
+			cat(t, "data", file)
+			if err := w.AddWith(file, WithChmodAsWrite()); err != nil {
+				t.Fatal(err)
+			}
+
+			chmod(t, 0o700, file)
+			cat(t, "more data", file)
+		}, `
+			chmod|write  /file
+			write        /file
+
+			windows:
+				write        /file
+		`},
+
+		{"WithChmodAsWrite only write", func(t *testing.T, w *Watcher, tmp string) {
+			file := join(tmp, "file")
+			cat(t, "data", file)
+			if err := w.AddWith(file, WithChmodAsWrite(), WithOps(Write)); err != nil {
+				t.Fatal(err)
+			}
+
+			chmod(t, 0o700, file)
+			eventSeparator()
+			chmod(t, 0o600, file)
+		}, `
+			write  /file
+			write  /file
+
+			windows:
+				empty
+		`},
+
+		{"WithoutHidden", func(t *testing.T, w *Watcher, tmp string) {
+			root := join(tmp, ".config")
+			mkdir(t, root)
+			if err := w.AddWith(root, WithoutHidden()); err != nil {
+				t.Fatal(err)
+			}
+
+			touch(t, root, ".hidden")
+			touch(t, root, "file")
+			mkdir(t, root, ".dir")
+		}, `
+			create  /.config/file
+		`},
+
+		{"WithoutHidden recursive", func(t *testing.T, w *Watcher, tmp string) {
+			supportsRecurse(t)
+			mkdirAll(t, tmp, ".git", "objects")
+			if err := w.AddWith(join(tmp, "..."), WithoutHidden()); err != nil {
+				t.Fatal(err)
+			}
+
+			touch(t, tmp, ".git", "objects", "file")
+			touch(t, tmp, ".git", "file")
+			mkdirAll(t, tmp, "dir", ".cache")
+			touch(t, tmp, "dir", ".cache", "file")
+			touch(t, tmp, "dir", "file")
+		}, `
+			create  /dir
+			create  /dir/file
+
+			# Everything in a directory is watched on Windows.
+			windows:
+				create  /dir
+				write   /dir
+				create  /dir/file
+				write   /dir
+		`},
+
+		{"replace options", func(t *testing.T, w *Watcher, tmp string) {
+			file := join(tmp, "file")
+			if err := w.AddWith(tmp, WithOps(Remove)); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.AddWith(tmp, WithOps(Create)); err != nil {
+				t.Fatal(err)
+			}
+
+			touch(t, file)
+			rm(t, file)
+		}, `
+			create  /file
+		`},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		tt.run(t)
+	}
+
+	t.Run("invalid ops", func(t *testing.T) {
+		t.Parallel()
+
+		w := newWatcher(t)
+		defer w.Close()
+
+		for _, op := range []Op{0, Op(1 << 10)} {
+			if err := w.AddWith(t.TempDir(), WithOps(op)); err == nil {
+				t.Errorf("no error for %d", op)
+			}
+		}
+		if err := w.AddWith(t.TempDir(), WithDedup(-1)); err == nil {
+			t.Error("no error for negative WithDedup")
+		}
+		if err := w.SetMaxWatches(-1); err == nil {
+			t.Error("no error for negative SetMaxWatches")
+		}
+		if err := w.AddWith(t.TempDir(), WithTTL(-1)); err == nil {
+			t.Error("no error for negative WithTTL")
+		}
+		if l := w.WatchList(); len(l) != 0 {
+			t.Fatalf("WatchList not empty: %#v", l)
+		}
+	})
+
+	t.Run("WithSkipErrors", func(t *testing.T) {
+		if runtime.GOOS == "windows" {
+			t.Skip("chmod doesn't work on Windows") // See if we can make a file unreadable
+		}
+		if os.Geteuid() == 0 {
+			t.Skip("root can read everything")
+		}
+		supportsRecurse(t)
+		t.Parallel()
+
+		tmp := t.TempDir()
+		mkdirAll(t, tmp, "dir", "sub")
+		mkdirAll(t, tmp, "locked", "sub")
+		chmod(t, 0, tmp, "locked")
+		defer chmod(t, 0o755, tmp, "locked") // Make TempDir() cleanup work
+
+		w := newWatcher(t)
+		defer w.Close()
+
+		path := join(tmp, "...")
+		if err := w.Add(path); !errors.Is(err, os.ErrPermission) {
+			t.Fatalf("wrong error without WithSkipErrors: %v", err)
+		}
+
+		err := w.AddWith(path, WithSkipErrors())
+		var skipped *SkippedError
+		if !errors.As(err, &skipped) {
+			t.Fatalf("wrong error: %v", err)
+		}
+		if len(skipped.Errs) != 1 || !errors.Is(err, os.ErrPermission) {
+			t.Errorf("wrong errors: %v", skipped.Errs)
+		}
+		if !w.IsWatched(path) {
+			t.Errorf("%q not watched", path)
+		}
+	})
+
+	t.Run("WithPartialRecursion", func(t *testing.T) {
+		if runtime.GOOS == "windows" {
+			t.Skip("chmod doesn't work on Windows") // See if we can make a file unreadable
+		}
+		if os.Geteuid() == 0 {
+			t.Skip("root can read everything")
+		}
+		supportsRecurse(t)
+		t.Parallel()
+
+		tmp := t.TempDir()
+		mkdirAll(t, tmp, "dir", "sub")
+		mkdirAll(t, tmp, "locked", "sub")
+		chmod(t, 0, tmp, "locked")
+		defer chmod(t, 0o755, tmp, "locked") // Make TempDir() cleanup work
+
+		w := newWatcher(t)
+		defer w.Close()
+
+		path := join(tmp, "...")
+		if err := w.Add(path); !errors.Is(err, os.ErrPermission) {
+			t.Fatalf("wrong error without WithPartialRecursion: %v", err)
+		}
+		if l := w.WatchList(); len(l) != 0 {
+			t.Fatalf("WatchList not empty: %#v", l)
+		}
+
+		err := w.AddWith(path, WithPartialRecursion())
+		var skipped *SkippedError
+		if !errors.As(err, &skipped) {
+			t.Fatalf("wrong error: %v", err)
+		}
+		if have, want := skipped.Paths(), []string{join(tmp, "locked")}; !reflect.DeepEqual(have, want) {
+			t.Errorf("\nhave: %q\nwant: %q", have, want)
+		}
+		if !w.IsWatched(path) {
+			t.Errorf("%q not watched", path)
+		}
+	})
+
+	t.Run("WithSizeTracking", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		file := join(tmp, "file")
+		cat(t, "data", file)
+
+		w := newCollector(t)
+		if err := w.w.AddWith(tmp, WithSizeTracking()); err != nil {
+			t.Fatal(err)
+		}
+		w.collect(t)
+
+		cat(t, "more data", file)
+		if err := os.Truncate(file, 0); err != nil {
+			t.Fatal(err)
+		}
+		eventSeparator()
+		cat(t, "data", file)
+
+		var truncated []bool
+		for _, e := range w.stop(t) {
+			if e.Name == file && e.Has(Write) {
+				truncated = append(truncated, e.IsTruncated())
+			}
+		}
+		// There may be more than one Write for a single write, but only the
+		// truncate makes it smaller.
+		var n int
+		for i, tr := range truncated {
+			if tr {
+				n++
+				if i == 0 || i == len(truncated)-1 {
+					t.Errorf("wrong Write truncated: %v", truncated)
+				}
+			}
+		}
+		if n != 1 {
+			t.Errorf("want one truncated Write: %v", truncated)
+		}
+	})
+
+	t.Run("WithTTL", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		w := newWatcher(t)
+		defer w.Close()
+		if err := w.AddWith(tmp, WithTTL(100*time.Millisecond)); err != nil {
+			t.Fatal(err)
+		}
+		if !w.IsWatched(tmp) {
+			t.Fatalf("%q not watched", tmp)
+		}
+		waitUnwatched(t, w, tmp)
+
+		// Adding it again without WithTTL stops the timer.
+		if err := w.AddWith(tmp, WithTTL(100*time.Millisecond)); err != nil {
+			t.Fatal(err)
+		}
+		addWatch(t, w, tmp)
+		time.Sleep(300 * time.Millisecond)
+		if !w.IsWatched(tmp) {
+			t.Errorf("%q removed after adding it without WithTTL", tmp)
+		}
+	})
+
+	t.Run("WithTTLResetOnEvent", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		w := newCollector(t)
+		if err := w.w.AddWith(tmp, WithTTL(500*time.Millisecond), WithTTLResetOnEvent()); err != nil {
+			t.Fatal(err)
+		}
+		w.collect(t)
+		defer w.stop(t)
+
+		for i := 0; i < 10; i++ {
+			touch(t, tmp, fmt.Sprintf("file%d", i))
+			time.Sleep(100 * time.Millisecond)
+		}
+		if !w.w.IsWatched(tmp) {
+			t.Fatalf("%q removed while there were events", tmp)
+		}
+		waitUnwatched(t, w.w, tmp)
+	})
+
+	t.Run("WithOneShot", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		w := newCollector(t)
+		w.w.Ignore("*.tmp")
+		if err := w.w.AddWith(tmp, WithOneShot()); err != nil {
+			t.Fatal(err)
+		}
+		w.collect(t)
+
+		// Ignored events don't count.
+		touch(t, tmp, "file.tmp")
+		touch(t, tmp, "file")
+		waitUnwatched(t, w.w, tmp)
+		touch(t, tmp, "other")
+		cmpEvents(t, tmp, w.stop(t), newEvents(t, `create /file`))
+	})
+
+	t.Run("WithRealPath", func(t *testing.T) {
+		t.Parallel()
+
+		// TempDir may be below a symlink, as on macOS.
+		tmp, err := filepath.EvalSymlinks(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		mkdir(t, tmp, "dir")
+		symlink(t, join(tmp, "dir"), tmp, "link")
+		w := newCollector(t)
+		if err := w.w.AddWith(join(tmp, "link", "..", "link"), WithRealPath()); err != nil {
+			t.Fatal(err)
+		}
+		if l := w.w.WatchList(); len(l) != 1 || l[0] != join(tmp, "dir") {
+			t.Errorf("wrong WatchList: %q", l)
+		}
+		w.collect(t)
+
+		touch(t, tmp, "dir", "file")
+		cmpEvents(t, tmp, w.stop(t), newEvents(t, `create /dir/file`))
+	})
+
+	t.Run("WithRealPath remove and errors", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		mkdir(t, tmp, "dir")
+		symlink(t, join(tmp, "dir"), tmp, "link")
+		symlink(t, join(tmp, "missing"), tmp, "dangling")
+		w := newWatcher(t)
+		defer w.Close()
+
+		// Can be removed with the symlink.
+		if err := w.AddWith(join(tmp, "link"), WithRealPath()); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Remove(join(tmp, "link")); err != nil {
+			t.Fatal(err)
+		}
+		if l := w.WatchList(); len(l) != 0 {
+			t.Errorf("still watched after removing the symlink: %q", l)
+		}
+
+		err := w.AddWith(join(tmp, "dangling"), WithRealPath())
+		if !errors.Is(err, os.ErrNotExist) || !strings.Contains(err.Error(), "fsnotify.WithRealPath") {
+			t.Errorf("dangling symlink: wrong error: %v", err)
+		}
+
+		addWatch(t, w, tmp, "link")
+		err = w.AddWith(join(tmp, "dir"), WithRealPath())
+		if err == nil || !strings.Contains(err.Error(), "already watched") {
+			t.Errorf("already watched: wrong error: %v", err)
+		}
+
+		err = w.AddWith(join(tmp, "dir"), WithRealPath(), WithNoFollow())
+		if err == nil || !strings.Contains(err.Error(), "can't be used with WithNoFollow") {
+			t.Errorf("WithNoFollow: wrong error: %v", err)
+		}
+	})
+
+	t.Run("WithAutoRewatch stop", func(t *testing.T) {
+		t.Parallel()
+
+		w := newCollector(t)
+		tmp := t.TempDir()
+		dir, file := join(tmp, "dir"), join(tmp, "dir", "file")
+		mkdir(t, dir)
+		touch(t, file)
+		other := join(tmp, "other")
+		touch(t, other)
+		if err := w.w.AddWith(file, WithAutoRewatch()); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.w.AddWith(other, WithAutoRewatch()); err != nil {
+			t.Fatal(err)
+		}
+		w.collect(t)
+
+		// Removing the parent directory gives up, and Remove() stops the wait.
+		rmAll(t, dir)
+		rm(t, other)
+		eventSeparator()
+		if err := w.w.Remove(other); err != nil {
+			t.Fatal(err)
+		}
+		mkdir(t, dir)
+		touch(t, file)
+		touch(t, other)
+		waitForEvents()
+
+		if l := w.w.WatchList(); len(l) != 0 {
+			t.Errorf("WatchList not empty: %#v", l)
+		}
+		for _, e := range w.stop(t) {
+			if e.Has(Create) {
+				t.Errorf("unexpected event: %s", e)
+			}
+		}
+	})
+
+	t.Run("WithBasePath", func(t *testing.T) {
+		t.Parallel()
+
+		w := newCollector(t)
+		tmp := t.TempDir()
+		dir, sub := join(tmp, "dir"), join(tmp, "dir", "sub")
+		mkdirAll(t, sub)
+		if err := w.w.AddWith(dir, WithBasePath(tmp)); err != nil {
+			t.Fatal(err)
+		}
+		// Watches without the option are unchanged, even inside another one.
+		if err := w.w.AddWith(sub); err != nil {
+			t.Fatal(err)
+		}
+		w.collect(t)
+
+		touch(t, dir, "file")
+		mv(t, join(dir, "file"), dir, "renamed")
+		touch(t, sub, "file")
+
+		var found bool
+		for _, e := range w.stop(t) {
+			if e.Name == filepath.Join("dir", "renamed") && e.Has(Create) {
+				found = true
+			}
+			if e.Name == sub || strings.HasPrefix(e.Name, sub+string(filepath.Separator)) {
+				continue
+			}
+			if !strings.HasPrefix(e.Name, "dir"+string(filepath.Separator)) {
+				t.Errorf("name not relative: %s", e)
+			}
+			if e.RenamedFrom != "" && e.RenamedFrom != filepath.Join("dir", "file") {
+				t.Errorf("RenamedFrom not relative: %s", e)
+			}
+		}
+		if !found {
+			t.Errorf("no create event for dir/renamed")
+		}
+	})
+
+	t.Run("WithSlashPaths", func(t *testing.T) {
+		t.Parallel()
+
+		w := newCollector(t)
+		tmp := t.TempDir()
+		if err := w.w.AddWith(tmp, WithSlashPaths()); err != nil {
+			t.Fatal(err)
+		}
+		w.collect(t)
+
+		touch(t, tmp, "file")
+		mv(t, join(tmp, "file"), tmp, "renamed")
+		waitForEvents()
+		have := w.events(t)
+		if len(have) == 0 {
+			t.Fatal("no events")
+		}
+		for _, e := range have {
+			if !strings.HasPrefix(e.Name, filepath.ToSlash(tmp)+"/") || strings.Contains(e.Name, `\`) {
+				t.Errorf("wrong name: %s", e)
+			}
+			if e.RenamedFrom != "" && e.RenamedFrom != filepath.ToSlash(join(tmp, "file")) {
+				t.Errorf("wrong RenamedFrom: %s", e)
+			}
+		}
+
+		// The native path still works.
+		if err := w.w.Remove(tmp); err != nil {
+			t.Fatal(err)
+		}
+		w.stop(t)
+	})
+
+	t.Run("WithCreateWatch stop", func(t *testing.T) {
+		t.Parallel()
+
+		w := newCollector(t)
+		tmp := t.TempDir()
+		file, other := join(tmp, "dir", "file"), join(tmp, "other")
+		if err := w.w.AddWith(file, WithCreateWatch()); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.w.AddWith(other, WithCreateWatch()); err != nil {
+			t.Fatal(err)
+		}
+		if l := w.w.WatchList(); len(l) != 0 {
+			t.Errorf("WatchList not empty: %#v", l)
+		}
+		w.collect(t)
+
+		if err := w.w.Remove(file); err != nil {
+			t.Fatal(err)
+		}
+		mkdir(t, tmp, "dir")
+		touch(t, file)
+		touch(t, other)
+		waitForEvents()
+
+		if l := w.w.WatchList(); len(l) != 1 || l[0] != other {
+			t.Errorf("wrong WatchList: %#v", l)
+		}
+		cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+			create /other
+		`))
+	})
+
+	t.Run("WithCreateWatch parent", func(t *testing.T) {
+		t.Parallel()
+
+		// All waits in a directory share one watch for it, which doesn't send
+		// anything and isn't reported.
+		w := newCollector(t)
+		tmp := t.TempDir()
+		for i := 0; i < 200; i++ {
+			if err := w.w.AddWith(join(tmp, "dir", fmt.Sprintf("file%d", i)), WithCreateWatch()); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if l := w.w.WatchList(); len(l) != 0 {
+			t.Errorf("WatchList not empty: %#v", l)
+		}
+		if w.w.IsWatched(tmp) {
+			t.Errorf("IsWatched(%q) = true", tmp)
+		}
+		if err := w.w.Remove(tmp); !errors.Is(err, ErrNonExistentWatch) {
+			t.Errorf("wrong error for Remove: %v", err)
+		}
+		w.collect(t)
+
+		touch(t, tmp, "other")
+		mkdir(t, tmp, "dir")
+		touch(t, tmp, "dir", "other")
+		touch(t, tmp, "dir", "file1")
+		waitForEvents()
+		cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+			create /dir/file1
+		`))
+	})
+
+	t.Run("WithCreateWatch watched parent", func(t *testing.T) {
+		t.Parallel()
+
+		// The user's watch for the directory is used, and the wait continues
+		// once it's removed.
+		w := newCollector(t)
+		tmp := t.TempDir()
+		if err := w.w.Add(tmp); err != nil {
+			t.Fatal(err)
+		}
+		file := join(tmp, "file")
+		if err := w.w.AddWith(file, WithCreateWatch()); err != nil {
+			t.Fatal(err)
+		}
+		w.collect(t)
+
+		touch(t, tmp, "other")
+		eventSeparator()
+		if err := w.w.Remove(tmp); err != nil {
+			t.Fatal(err)
+		}
+		touch(t, tmp, "other2")
+		eventSeparator()
+		touch(t, file)
+		waitForEvents()
+
+		if l := w.w.WatchList(); len(l) != 1 || l[0] != file {
+			t.Errorf("wrong WatchList: %#v", l)
+		}
+		cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+			create /other
+			create /file
+		`))
+	})
+
+	t.Run("WithAutoRewatch keeps waiting", func(t *testing.T) {
+		t.Parallel()
+
+		w := newCollector(t)
+		tmp := t.TempDir()
+		file := join(tmp, "file")
+		touch(t, file)
+		if err := w.w.AddWith(file, WithAutoRewatch()); err != nil {
+			t.Fatal(err)
+		}
+		w.collect(t)
+
+		rm(t, file)
+		for i := 0; i < 20; i++ {
+			touch(t, tmp, fmt.Sprintf("other%d", i))
+		}
+		eventSeparator()
+		touch(t, file)
+		waitForEvents()
+
+		cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+			remove  /file
+			create  /file
+		`))
+	})
+
+	t.Run("buffer size", func(t *testing.T) {
+		t.Parallel()
+
+		w := newWatcher(t)
+		defer w.Close()
+
+		err := w.AddWith(t.TempDir(), WithBufferSize(1024))
+		if runtime.GOOS == "windows" && err == nil {
+			t.Fatal("no error for small buffer")
+		}
+		if runtime.GOOS != "windows" && err != nil {
+			t.Fatal(err)
+		}
+		if err := w.AddWith(t.TempDir(), WithBufferSize(65536*4)); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("no follow", func(t *testing.T) {
+		if runtime.GOOS == "windows" {
+			t.Skip("symlinks don't work on Windows")
+		}
+		t.Parallel()
+
+		tmp, target := t.TempDir(), t.TempDir()
+		touch(t, target, "file")
+		symlink(t, join(target, "file"), tmp, "link")
+
+		w := newCollector(t)
+		err := w.w.AddWith(join(tmp, "link"), WithNoFollow())
+		if isKqueue() && runtime.GOOS != "darwin" {
+			if err == nil {
+				t.Fatal("no error for symlink on BSD")
+			}
+			return
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.collect(t)
+
+		// Writing to the target shouldn't send anything, as only the link
+		// itself is watched.
+		cat(t, "data", target, "file")
+		if have := w.stop(t); len(have) != 0 {
+			t.Errorf("unexpected events:\n%s", have)
+		}
+	})
+}
+
+func TestAddFS(t *testing.T) {
+	t.Run("names", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		mkdir(t, tmp, "dir")
+		w := newCollector(t)
+		if err := w.w.AddFS(tmp, "dir"); err != nil {
+			t.Fatal(err)
+		}
+		w.collect(t)
+
+		touch(t, tmp, "dir", "file")
+		mkdir(t, tmp, "dir", "sub")
+		have := w.stop(t)
+
+		want := []string{"dir/file", "dir/sub"}
+		if len(have) != len(want) {
+			t.Fatalf("wrong events:\n%s", indent(have))
+		}
+		for i := range want {
+			if have[i].Name != want[i] {
+				t.Errorf("wrong name for event %d: %q; want %q\n%s", i, have[i].Name, want[i], indent(have))
+			}
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		t.Parallel()
+
+		w := newWatcher(t)
+		defer w.Close()
+		for _, name := range []string{"", "/dir", "../dir", "dir/"} {
+			err := w.AddFS(t.TempDir(), name)
+			if err == nil || !strings.Contains(err.Error(), "fsnotify.AddFS: invalid path") {
+				t.Errorf("AddFS(%q): wrong error: %v", name, err)
+			}
+		}
+	})
+}
+
+func TestAddGlob(t *testing.T) {
+	t.Run("matches", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		w := newCollector(t)
+		if err := w.w.AddGlob(join(tmp, "upload-*.dat")); err != nil {
+			t.Fatal(err)
+		}
+		if !w.w.IsWatched(tmp) {
+			t.Fatalf("%q not watched", tmp)
+		}
+		w.collect(t)
+
+		touch(t, tmp, "upload-1.dat")
+		touch(t, tmp, "upload-2.tmp")
+		touch(t, tmp, "other.dat")
+		mv(t, join(tmp, "upload-2.tmp"), tmp, "upload-2.dat")
+		mv(t, join(tmp, "upload-1.dat"), tmp, "done-1.dat")
+		have := w.stop(t)
+		for i := range have {
+			have[i].RenamedFrom = ""
+		}
+		cmpEvents(t, tmp, have, newEvents(t, `
+			create  /upload-1.dat
+			create  /upload-2.dat
+			rename  /upload-1.dat
+		`))
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		t.Parallel()
+
+		w := newWatcher(t)
+		defer w.Close()
+		err := w.AddGlob(join(t.TempDir(), "upload-[.dat"))
+		if !errors.Is(err, filepath.ErrBadPattern) {
+			t.Errorf("wrong error: %v", err)
+		}
+		if l := w.WatchList(); len(l) != 0 {
+			t.Errorf("added: %q", l)
+		}
+	})
+}
+
+func TestMergeCreateWrite(t *testing.T) {
+	// Create and write right away, as a program saving a new file would.
+	write := func(t *testing.T, path ...string) {
+		t.Helper()
+		if err := os.WriteFile(join(path...), []byte("data"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name string
+		opts []addOpt
+		ops  func(t *testing.T, tmp string)
+		want string
+	}{
+		{"merged", []addOpt{WithMergeCreateWrite()}, func(t *testing.T, tmp string) {
+			write(t, tmp, "file")
+		}, `
+			create|write  /file
+		`},
+
+		{"without", nil, func(t *testing.T, tmp string) {
+			write(t, tmp, "file")
+		}, `
+			create  /file
+			write   /file
+		`},
+
+		{"write later", []addOpt{WithMergeCreateWrite()}, func(t *testing.T, tmp string) {
+			touch(t, tmp, "file")
+			cat(t, "data", tmp, "file")
+		}, `
+			create  /file
+			write   /file
+		`},
+
+		{"only first write", []addOpt{WithMergeCreateWrite()}, func(t *testing.T, tmp string) {
+			write(t, tmp, "file")
+			eventSeparator()
+			cat(t, "data", tmp, "file")
+		}, `
+			create|write  /file
+			write         /file
+		`},
+
+		{"remove", []addOpt{WithMergeCreateWrite()}, func(t *testing.T, tmp string) {
+			fp, err := os.Create(join(tmp, "file"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			fp.Close()
+			rm(t, tmp, "file")
+		}, `
+			create  /file
+			remove  /file
+		`},
+
+		{"dir", []addOpt{WithMergeCreateWrite()}, func(t *testing.T, tmp string) {
+			mkdir(t, tmp, "dir")
+		}, `
+			create  /dir
+		`},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			tmp := t.TempDir()
+			w := newCollector(t)
+			if err := w.w.AddWith(tmp, tt.opts...); err != nil {
+				t.Fatal(err)
+			}
+			w.collect(t)
+			tt.ops(t, tmp)
+			cmpEvents(t, tmp, w.stop(t), newEvents(t, tt.want))
+		})
+	}
+
+	t.Run("close", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		w := newCollector(t)
+		if err := w.w.AddWith(tmp, WithMergeCreateWrite()); err != nil {
+			t.Fatal(err)
+		}
+		w.collect(t)
+		fp, err := os.Create(join(tmp, "file"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fp.Close()
+		// The Create is still held; CloseWait sends it.
+		if err := w.w.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.w.CloseWait(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		cmpEvents(t, tmp, w.events(t), newEvents(t, `create /file`))
+	})
+}
+
+func TestRateLimit(t *testing.T) {
+	// Wait until n events were sent, which includes the events over the limit
+	// that are sent once the window ends.
+	waitSent := func(t *testing.T, w *Watcher, n int) {
+		t.Helper()
+		for start := time.Now(); w.Stats().EventsDelivered < uint64(n); time.Sleep(10 * time.Millisecond) {
+			if time.Since(start) > 5*time.Second {
+				t.Fatalf("timeout: %d events sent; want %d", w.Stats().EventsDelivered, n)
+			}
+		}
+	}
+
+	tests := []struct {
+		name string
+		opts []addOpt
+		ops  func(t *testing.T, tmp string)
+		want string
+	}{
+		{"limited", []addOpt{WithRateLimit(2, time.Second)}, func(t *testing.T, tmp string) {
+			for i := 0; i < 4; i++ {
+				cat(t, "data", tmp, "file")
+			}
+		}, `
+			write  /file
+			write  /file
+			write  /file
+		`},
+
+		{"merged ops", []addOpt{WithRateLimit(1, time.Second)}, func(t *testing.T, tmp string) {
+			cat(t, "data", tmp, "file")
+			cat(t, "data", tmp, "file")
+			rm(t, tmp, "file")
+		}, `
+			write         /file
+			write|remove  /file
+		`},
+
+		{"per path", []addOpt{WithRateLimit(1, time.Second)}, func(t *testing.T, tmp string) {
+			touch(t, tmp, "other")
+			cat(t, "data", tmp, "file")
+		}, `
+			create  /other
+			write   /file
+		`},
+
+		{"after window", []addOpt{WithRateLimit(1, 50*time.Millisecond)}, func(t *testing.T, tmp string) {
+			cat(t, "data", tmp, "file")
+			time.Sleep(200 * time.Millisecond)
+			cat(t, "data", tmp, "file")
+		}, `
+			write  /file
+			write  /file
+		`},
+
+		{"without", nil, func(t *testing.T, tmp string) {
+			cat(t, "data", tmp, "file")
+			cat(t, "data", tmp, "file")
+		}, `
+			write  /file
+			write  /file
+		`},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			tmp := t.TempDir()
+			touch(t, tmp, "file")
+			w := newCollector(t)
+			if err := w.w.AddWith(tmp, tt.opts...); err != nil {
+				t.Fatal(err)
+			}
+			w.collect(t)
+			tt.ops(t, tmp)
+			want := newEvents(t, tt.want)
+			waitSent(t, w.w, len(want))
+			cmpEvents(t, tmp, w.stop(t), want)
+		})
+	}
+
+	t.Run("window", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		touch(t, tmp, "file")
+		w := newCollector(t)
+		if err := w.w.AddWith(tmp, WithRateLimit(1, 300*time.Millisecond)); err != nil {
+			t.Fatal(err)
+		}
+		w.collect(t)
+		cat(t, "data", tmp, "file")
+		cat(t, "data", tmp, "file")
+		waitSent(t, w.w, 2)
+		cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+			write  /file
+			write  /file
+		`))
+	})
+
+	t.Run("remove", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		touch(t, tmp, "file")
+		w := newCollector(t)
+		if err := w.w.AddWith(tmp, WithRateLimit(1, time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+		w.collect(t)
+		cat(t, "data", tmp, "file")
+		cat(t, "data", tmp, "file")
+		waitForEvents()
+		if err := w.w.Remove(tmp); err != nil {
+			t.Fatal(err)
+		}
+		cmpEvents(t, tmp, w.stop(t), newEvents(t, `write /file`))
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		w := newWatcher(t)
+		for _, o := range []addOpt{WithRateLimit(0, time.Second), WithRateLimit(1, 0), WithRateLimit(-1, time.Second)} {
+			if err := w.AddWith(tmp, o); err == nil || !strings.Contains(err.Error(), "fsnotify.WithRateLimit") {
+				t.Errorf("wrong error: %v", err)
+			}
+		}
+	})
+}
+
+func TestRescan(t *testing.T) {
+	tests := []struct {
+		name    string
+		recurse bool
+		ops     func(t *testing.T, tmp string)
+		want    string
+	}{
+		{"dir", false, func(t *testing.T, tmp string) {
+			touch(t, tmp, "new")
+			cat(t, "data", tmp, "file")
+			rm(t, tmp, "gone")
+			mkdir(t, tmp, "dir")
+		}, `
+			remove  /gone
+			create  /dir
+			write   /file
+			create  /new
+		`},
+
+		{"replaced", false, func(t *testing.T, tmp string) {
+			rm(t, tmp, "gone")
+			mkdir(t, tmp, "gone")
+		}, `
+			remove  /gone
+			create  /gone
+		`},
+
+		{"recursive", true, func(t *testing.T, tmp string) {
+			mkdir(t, tmp, "sub")
+			touch(t, tmp, "sub", "file")
+		}, `
+			create  /sub
+			create  /sub/file
+		`},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			tmp := t.TempDir()
+			touch(t, tmp, "file")
+			touch(t, tmp, "gone")
+			w := newCollector(t)
+			path := tmp
+			if tt.recurse {
+				if !w.w.SupportsRecursion() {
+					t.Skip("no recursion")
+				}
+				path = join(tmp, "...")
+			}
+			if err := w.w.AddWith(path, WithSnapshot()); err != nil {
+				t.Fatal(err)
+			}
+			w.collect(t)
+
+			// Everything that's dropped while paused is missed.
+			w.w.Pause()
+			tt.ops(t, tmp)
+			waitForEvents()
+			w.w.Resume()
+
+			if err := w.w.Rescan(path); err != nil {
+				t.Fatal(err)
+			}
+			have := w.stop(t)
+			for _, e := range have {
+				if !e.IsRescanned() {
+					t.Errorf("not rescanned: %s", e)
+				}
+			}
+			cmpEvents(t, tmp, have, newEvents(t, tt.want))
+		})
+	}
+
+	t.Run("nothing missed", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		touch(t, tmp, "file")
+		w := newCollector(t)
+		if err := w.w.AddWith(tmp, WithSnapshot()); err != nil {
+			t.Fatal(err)
+		}
+		w.collect(t)
+		touch(t, tmp, "new")
+		cat(t, "data", tmp, "file")
+		rm(t, tmp, "new")
+		waitForEvents()
+		if err := w.w.Rescan(tmp); err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range w.stop(t) {
+			if e.IsRescanned() {
+				t.Errorf("rescanned: %s", e)
+			}
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		w := newWatcher(t)
+		if err := w.Rescan(tmp); !errors.Is(err, ErrNonExistentWatch) {
+			t.Errorf("wrong error for unwatched path: %v", err)
+		}
+		addWatch(t, w, tmp)
+		if err := w.Rescan(tmp); err == nil || !strings.Contains(err.Error(), "WithSnapshot") {
+			t.Errorf("wrong error without WithSnapshot: %v", err)
+		}
+		w.Close()
+		if err := w.Rescan(tmp); !errors.Is(err, ErrClosed) {
+			t.Errorf("wrong error after Close: %v", err)
+		}
+	})
+}
+
+func TestTrackInode(t *testing.T) {
+	add := func(t *testing.T, w *Watcher, path ...string) {
+		t.Helper()
+		err := w.AddWith(join(path...), WithTrackInode())
+		if errors.Is(err, ErrInodeUnsupported) {
+			t.Skip(err)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("rename", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		touch(t, tmp, "wal")
+		w := newCollector(t)
+		add(t, w.w, tmp, "wal")
+		w.collect(t)
+
+		mv(t, join(tmp, "wal"), tmp, "wal.old")
+		cat(t, "data", tmp, "wal.old")
+		if l := w.w.WatchList(); len(l) != 1 || l[0] != join(tmp, "wal.old") {
+			t.Errorf("wrong WatchList: %q", l)
+		}
+		if err := w.w.Remove(join(tmp, "wal.old")); err != nil {
+			t.Fatal(err)
+		}
+		cat(t, "data", tmp, "wal.old")
+
+		have := w.stop(t)
+		cmpEvents(t, tmp, have, newEvents(t, `
+			rename  /wal.old
+			write   /wal.old
+		`))
+		if len(have) > 0 && have[0].RenamedFrom != join(tmp, "wal") {
+			t.Errorf("wrong RenamedFrom: %q", have[0].RenamedFrom)
+		}
+	})
+
+	t.Run("other dir", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		touch(t, tmp, "wal")
+		mkdir(t, tmp, "dir")
+		w := newCollector(t)
+		add(t, w.w, tmp, "wal")
+		w.collect(t)
+
+		mv(t, join(tmp, "wal"), tmp, "dir", "wal")
+		cat(t, "data", tmp, "dir", "wal")
+		cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+			remove  /wal
+		`))
+	})
+
+	t.Run("without", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		touch(t, tmp, "wal")
+		w := newCollector(t, join(tmp, "wal"))
+		w.collect(t)
+
+		mv(t, join(tmp, "wal"), tmp, "wal.old")
+		cat(t, "data", tmp, "wal.old")
+		cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+			remove  /wal
+		`))
+	})
+}
+
+func TestEventLog(t *testing.T) {
+	t.Run("last events", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		w := newCollector(t, tmp)
+		if err := w.w.SetEventLog(2); err != nil {
+			t.Fatal(err)
+		}
+		w.collect(t)
+
+		touch(t, tmp, "one")
+		touch(t, tmp, "two")
+		touch(t, tmp, "three")
+		w.stop(t)
+
+		cmpEvents(t, tmp, Events(w.w.RecentEvents()), newEvents(t, `
+			create  /two
+			create  /three
+		`))
+	})
+
+	t.Run("resize", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		w := newCollector(t, tmp)
+		if err := w.w.SetEventLog(3); err != nil {
+			t.Fatal(err)
+		}
+		w.collect(t)
+
+		touch(t, tmp, "one")
+		touch(t, tmp, "two")
+		touch(t, tmp, "three")
+		waitForEvents()
+		if err := w.w.SetEventLog(2); err != nil {
+			t.Fatal(err)
+		}
+		cmpEvents(t, tmp, Events(w.w.RecentEvents()), newEvents(t, `
+			create  /two
+			create  /three
+		`))
+
+		if err := w.w.SetEventLog(4); err != nil {
+			t.Fatal(err)
+		}
+		touch(t, tmp, "four")
+		w.stop(t)
+		cmpEvents(t, tmp, Events(w.w.RecentEvents()), newEvents(t, `
+			create  /two
+			create  /three
+			create  /four
+		`))
+	})
+
+	t.Run("not used", func(t *testing.T) {
+		t.Parallel()
+
+		w := newWatcher(t, t.TempDir())
+		defer w.Close()
+		if e := w.RecentEvents(); e != nil {
+			t.Errorf("RecentEvents() = %s; want nil", Events(e))
+		}
+	})
+
+	t.Run("off", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		w := newCollector(t, tmp)
+		if err := w.w.SetEventLog(2); err != nil {
+			t.Fatal(err)
+		}
+		w.collect(t)
+		touch(t, tmp, "one")
+		waitForEvents()
+		if err := w.w.SetEventLog(0); err != nil {
+			t.Fatal(err)
+		}
+		touch(t, tmp, "two")
+		w.stop(t)
+		if e := w.w.RecentEvents(); e != nil {
+			t.Errorf("RecentEvents() = %s; want nil", Events(e))
+		}
+	})
+
+	t.Run("negative", func(t *testing.T) {
+		t.Parallel()
+
+		w := newWatcher(t)
+		defer w.Close()
+		if err := w.SetEventLog(-1); err == nil {
+			t.Error("no error")
+		}
+	})
+}
+
+func TestCaseInsensitive(t *testing.T) {
+	t.Run("ignore", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		w := newCollector(t)
+		if err := w.w.Ignore("*.TMP"); err != nil {
+			t.Fatal(err)
+		}
+		w.w.SetCaseInsensitive(true)
+		if err := w.w.Add(tmp); err != nil {
+			t.Fatal(err)
+		}
+		w.collect(t)
+
+		touch(t, tmp, "a.tmp")
+		touch(t, tmp, "B.Tmp")
+		touch(t, tmp, "File.TXT")
+		cmpEvents(t, tmp, w.stop(t), newEvents(t, `create /File.TXT`))
+	})
+
+	t.Run("without", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		w := newCollector(t, tmp)
+		if err := w.w.Ignore("*.TMP"); err != nil {
+			t.Fatal(err)
+		}
+		w.collect(t)
+
+		touch(t, tmp, "a.tmp")
+		touch(t, tmp, "B.TMP")
+		cmpEvents(t, tmp, w.stop(t), newEvents(t, `create /a.tmp`))
+	})
+
+	t.Run("watched", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		mkdir(t, tmp, "Dir")
+		w := newWatcher(t)
+		defer w.Close()
+		// Also for paths that were added before.
+		addWatch(t, w, tmp, "Dir")
+		if w.IsWatched(join(tmp, "dir")) {
+			t.Errorf("%q watched before SetCaseInsensitive", join(tmp, "dir"))
+		}
+		w.SetCaseInsensitive(true)
+
+		if !w.IsWatched(join(tmp, "dir")) {
+			t.Errorf("%q not watched", join(tmp, "dir"))
+		}
+		if err := w.Remove(join(tmp, "DIR")); err != nil {
+			t.Fatal(err)
+		}
+		if w.IsWatched(join(tmp, "Dir")) {
+			t.Errorf("%q still watched", join(tmp, "Dir"))
+		}
+	})
+
+	t.Run("off", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		mkdir(t, tmp, "Dir")
+		w := newWatcher(t)
+		defer w.Close()
+		w.SetCaseInsensitive(true)
+		addWatch(t, w, tmp, "Dir")
+		w.SetCaseInsensitive(false)
+		if w.IsWatched(join(tmp, "dir")) {
+			t.Errorf("%q watched after SetCaseInsensitive(false)", join(tmp, "dir"))
+		}
+	})
+}
+
+func TestDrainOnClose(t *testing.T) {
+	tests := []struct {
+		name  string
+		drain bool
+		want  string
+	}{
+		{"drain", true, `
+			write  /file
+			write  /file
+		`},
+		// Everything over the limit is dropped by Close.
+		{"without", false, `
+			write  /file
+		`},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			tmp := t.TempDir()
+			touch(t, tmp, "file")
+			w := newCollector(t)
+			w.w.SetDrainOnClose(tt.drain)
+			if err := w.w.AddWith(tmp, WithRateLimit(1, time.Minute)); err != nil {
+				t.Fatal(err)
+			}
+			w.collect(t)
+			cat(t, "data", tmp, "file")
+			cat(t, "data", tmp, "file")
+			if err := w.w.Sync(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			cmpEvents(t, tmp, w.events(t), newEvents(t, tt.want))
+		})
+	}
+
+	t.Run("not read", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		w := newWatcher(t, tmp)
+		w.SetDrainOnClose(true)
+		touch(t, tmp, "one")
+		touch(t, tmp, "two")
+		waitForEvents()
+
+		start := time.Now()
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if d := time.Since(start); d > drainTimeout+time.Second {
+			t.Errorf("Close took %s", d)
+		}
+	})
+}
+
+// TODO: should also check internal state is correct/cleaned up; e.g. no
+//       left-over file descriptors or whatnot.
+func TestRemove(t *testing.T) {
+	t.Run("works", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		touch(t, tmp, "file")
+
+		w := newCollector(t)
+		w.collect(t)
+		addWatch(t, w.w, tmp)
+		if err := w.w.Remove(tmp); err != nil {
+			t.Fatal(err)
+		}
+
+		time.Sleep(200 * time.Millisecond)
+		cat(t, "data", tmp, "file")
+		chmod(t, 0o700, tmp, "file")
+
+		have := w.stop(t)
+		if len(have) > 0 {
+			t.Errorf("received events; expected none:\n%s", have)
+		}
+	})
+
+	t.Run("remove same dir twice", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+
+		touch(t, tmp, "file")
+
+		w := newWatcher(t)
+		defer w.Close()
+
+		addWatch(t, w, tmp)
+
+		if err := w.Remove(tmp); err != nil {
+			t.Fatal(err)
+		}
+		err := w.Remove(tmp)
+		if err == nil {
+			t.Fatal("no error")
+		}
+		if !errors.Is(err, ErrNonExistentWatch) {
+			t.Fatalf("wrong error: %T", err)
+		}
+	})
+
+	t.Run("WithRefCount", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		w := newWatcher(t)
+		defer w.Close()
+
+		// Added without WithRefCount() counts once.
+		addWatch(t, w, tmp)
+		for i := 0; i < 2; i++ {
+			if err := w.AddWith(tmp, WithRefCount()); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if l := w.WatchList(); !reflect.DeepEqual(l, []string{tmp}) {
+			t.Errorf("wrong WatchList: %s", l)
+		}
+		for i := 0; i < 3; i++ {
+			if !w.IsWatched(tmp) {
+				t.Fatalf("not watched after %d removes", i)
+			}
+			if err := w.Remove(tmp); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if w.IsWatched(tmp) {
+			t.Error("still watched")
+		}
+		if err := w.Remove(tmp); !errors.Is(err, ErrNonExistentWatch) {
+			t.Fatalf("wrong error: %v", err)
+		}
+
+		// Count starts again after the watch is removed.
+		addWatch(t, w, tmp)
+		if err := w.Remove(tmp); err != nil {
+			t.Fatal(err)
+		}
+		if w.IsWatched(tmp) {
+			t.Error("still watched")
+		}
+	})
+
+	t.Run("recursive", func(t *testing.T) {
+		supportsRecurse(t)
+		t.Parallel()
+
+		for _, rm := range []string{"...", ""} {
+			tmp := t.TempDir()
+			mkdirAll(t, tmp, "sub", "subsub")
+
+			w := newCollector(t)
+			w.collect(t)
+			addWatch(t, w.w, tmp, "...")
+			if err := w.w.Remove(join(tmp, rm)); err != nil {
+				t.Fatal(err)
+			}
+			if l := w.w.WatchList(); len(l) != 0 {
+				t.Errorf("wrong WatchList: %s", l)
+			}
+
+			time.Sleep(200 * time.Millisecond)
+			touch(t, tmp, "sub", "file")
+			touch(t, tmp, "sub", "subsub", "file")
+
+			have := w.stop(t)
+			if len(have) > 0 {
+				t.Errorf("received events; expected none:\n%s", have)
+			}
+		}
+	})
+
+	t.Run("recursive on non-recursive watch", func(t *testing.T) {
+		supportsRecurse(t)
+		t.Parallel()
+
+		tmp := t.TempDir()
+		w := newWatcher(t, tmp)
+		defer w.Close()
+
+		if err := w.Remove(join(tmp, "...")); !errors.Is(err, ErrNonExistentWatch) {
+			t.Fatalf("wrong error: %v", err)
+		}
+		if l := w.WatchList(); !reflect.DeepEqual(l, []string{tmp}) {
+			t.Errorf("wrong WatchList: %s", l)
+		}
+	})
+
+	// Make sure that concurrent calls to Remove() don't race.
+	t.Run("no race", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		touch(t, tmp, "file")
+
+		for i := 0; i < 10; i++ {
+			w := newWatcher(t)
+			defer w.Close()
+			addWatch(t, w, tmp)
+
+			done := make(chan struct{})
+			go func() {
+				defer func() { done <- struct{}{} }()
+				w.Remove(tmp)
+			}()
+			go func() {
+				defer func() { done <- struct{}{} }()
+				w.Remove(tmp)
+			}()
+			<-done
+			<-done
+			w.Close()
+		}
+	})
+}
+
+func TestRemoveAll(t *testing.T) {
+	t.Run("works", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		mkdirAll(t, tmp, "dir", "sub")
+		touch(t, tmp, "file")
+
+		w := newCollector(t)
+		addWatch(t, w.w, tmp)
+		addWatch(t, w.w, tmp, "file")
+		if w.w.SupportsRecursion() {
+			addWatch(t, w.w, tmp, "dir", "...")
+		} else {
+			addWatch(t, w.w, tmp, "dir")
+		}
+		if err := w.w.AddWith(join(tmp, "dir", "sub"), WithRefCount()); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.w.AddWith(join(tmp, "dir", "sub"), WithRefCount()); err != nil {
+			t.Fatal(err)
+		}
+		w.collect(t)
+
+		if err := w.w.RemoveAll(); err != nil {
+			t.Fatal(err)
+		}
+		if l := w.w.WatchList(); len(l) != 0 {
+			t.Errorf("WatchList not empty: %q", l)
+		}
+
+		time.Sleep(200 * time.Millisecond)
+		cat(t, "data", tmp, "file")
+		touch(t, tmp, "dir", "sub", "file")
+		if have := w.events(t); len(have) > 0 {
+			t.Errorf("received events; expected none:\n%s", have)
+		}
+
+		// Can still add new watches.
+		addWatch(t, w.w, tmp)
+		touch(t, tmp, "new")
+		cmpEvents(t, tmp, w.stop(t), newEvents(t, `create /new`))
+	})
+
+	t.Run("closed", func(t *testing.T) {
+		t.Parallel()
+
+		w := newWatcher(t)
+		w.Close()
+		if err := w.RemoveAll(); !errors.Is(err, ErrClosed) {
+			t.Errorf("wrong error: %v", err)
+		}
+	})
+}
+
+func TestRemoveMatching(t *testing.T) {
+	t.Run("works", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		mkdirAll(t, tmp, "a", "sub")
+		mkdir(t, tmp, "b")
+		touch(t, tmp, "a", "file")
+
+		w := newCollector(t)
+		addWatch(t, w.w, tmp, "a")
+		addWatch(t, w.w, tmp, "a", "sub")
+		addWatch(t, w.w, tmp, "a", "file")
+		addWatch(t, w.w, tmp, "b")
+		w.collect(t)
+
+		removed, err := w.w.RemoveMatching(func(path string) bool {
+			return strings.HasPrefix(path, join(tmp, "a"))
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(removed)
+		want := []string{join(tmp, "a"), join(tmp, "a", "file"), join(tmp, "a", "sub")}
+		if !reflect.DeepEqual(removed, want) {
+			t.Errorf("wrong paths removed\nhave: %q\nwant: %q", removed, want)
+		}
+		if l := w.w.WatchList(); !reflect.DeepEqual(l, []string{join(tmp, "b")}) {
+			t.Errorf("wrong WatchList: %q", l)
+		}
+
+		time.Sleep(200 * time.Millisecond)
+		touch(t, tmp, "a", "new")
+		touch(t, tmp, "b", "new")
+		cmpEvents(t, tmp, w.stop(t), newEvents(t, `create /b/new`))
+	})
+
+	t.Run("nothing", func(t *testing.T) {
+		t.Parallel()
+
+		w := newWatcher(t, t.TempDir())
+		removed, err := w.RemoveMatching(func(string) bool { return false })
+		if err != nil || len(removed) != 0 {
+			t.Errorf("removed %q (error %v); want nothing", removed, err)
+		}
+		if l := w.WatchList(); len(l) != 1 {
+			t.Errorf("wrong WatchList: %q", l)
+		}
+	})
+
+	t.Run("closed", func(t *testing.T) {
+		t.Parallel()
+
+		w := newWatcher(t)
+		w.Close()
+		if _, err := w.RemoveMatching(func(string) bool { return true }); !errors.Is(err, ErrClosed) {
+			t.Errorf("wrong error: %v", err)
+		}
+	})
+}
+
+func TestSetOps(t *testing.T) {
+	tests := []testCase{
+		{"widen", func(t *testing.T, w *Watcher, tmp string) {
+			if err := w.AddWith(tmp, WithOps(Create)); err != nil {
+				t.Fatal(err)
+			}
+			touch(t, tmp, "file")
+			cat(t, "data", tmp, "file")
+			eventSeparator()
+
+			if err := w.SetOps(tmp, Create|Write); err != nil {
+				t.Fatal(err)
+			}
+			cat(t, "data", tmp, "file")
+		}, `
+			create   /file
+			write    /file
+		`},
+
+		{"narrow", func(t *testing.T, w *Watcher, tmp string) {
+			addWatch(t, w, tmp)
+			touch(t, tmp, "file")
+			eventSeparator()
+
+			if err := w.SetOps(tmp, Remove); err != nil {
+				t.Fatal(err)
+			}
+			touch(t, tmp, "new")
+			cat(t, "data", tmp, "file")
+			rm(t, tmp, "file")
+		}, `
+			create   /file
+			remove   /file
+		`},
+
+		{"keeps options", func(t *testing.T, w *Watcher, tmp string) {
+			touch(t, tmp, "file")
+			if err := w.AddWith(tmp, WithInitialScan(), WithoutHidden()); err != nil {
+				t.Fatal(err)
+			}
+			eventSeparator()
+
+			if err := w.SetOps(tmp, Create); err != nil {
+				t.Fatal(err)
+			}
+			touch(t, tmp, ".hidden")
+			touch(t, tmp, "new")
+		}, `
+			create   /file
+			create   /new
+		`},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		tt.run(t)
+	}
+
+	t.Run("errors", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		w := newWatcher(t)
+		if err := w.SetOps(tmp, Create); !errors.Is(err, ErrNonExistentWatch) {
+			t.Errorf("wrong error for unwatched path: %v", err)
+		}
+		addWatch(t, w, tmp)
+		if err := w.SetOps(tmp, 0); err == nil {
+			t.Error("no error for invalid ops")
+		}
+		if err := w.Remove(tmp); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.SetOps(tmp, Create); !errors.Is(err, ErrNonExistentWatch) {
+			t.Errorf("wrong error for removed path: %v", err)
+		}
+		w.Close()
+		if err := w.SetOps(tmp, Create); !errors.Is(err, ErrClosed) {
+			t.Errorf("wrong error after Close: %v", err)
+		}
+	})
+}
+
+func TestDryRunAdd(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	mkdirAll(t, tmp, "dir", "sub")
+	touch(t, tmp, "file")
+	touch(t, tmp, "dir", "file")
+
+	w := newWatcher(t)
+	n, err := w.DryRunAdd(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n < 1 {
+		t.Errorf("count is %d", n)
+	}
+	if _, err := w.DryRunAdd(join(tmp, "file")); err != nil {
+		t.Fatal(err)
+	}
+	if w.SupportsRecursion() {
+		if _, err := w.DryRunAdd(join(tmp, "...")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.DryRunAdd(join(tmp, "file", "...")); err == nil {
+			t.Error("no error for recursive watch on a file")
+		}
+	}
+	if l := w.WatchList(); len(l) != 0 {
+		t.Errorf("WatchList not empty: %q", l)
+	}
+
+	if _, err := w.DryRunAdd(join(tmp, "nonexistent")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("wrong error for nonexistent path: %v", err)
+	}
+	if _, err := w.DryRunAdd(tmp, WithOps(0)); err == nil {
+		t.Error("no error for invalid ops")
+	}
+	w.Close()
+	if _, err := w.DryRunAdd(tmp); !errors.Is(err, ErrClosed) {
+		t.Errorf("wrong error after Close: %v", err)
+	}
+}
+
+func TestIsWatched(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	mkdirAll(t, tmp, "dir", "sub")
+	touch(t, tmp, "file")
+
+	w := newWatcher(t)
+	defer w.Close()
+	addWatch(t, w, tmp, "dir")
+	addWatch(t, w, tmp, "file")
+
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{join(tmp, "dir"), true},
+		{join(tmp, "dir") + string(filepath.Separator), true},
+		{join(tmp, "file"), true},
+		{join(tmp, "dir", "sub"), false},
+		{join(tmp, "dir", "..."), false},
+		{join(tmp, "nonexistent"), false},
+	}
+	for _, tt := range tests {
+		if have := w.IsWatched(tt.path); have != tt.want {
+			t.Errorf("IsWatched(%q) = %t; want %t", tt.path, have, tt.want)
+		}
+	}
+
+	if err := w.Remove(join(tmp, "file")); err != nil {
+		t.Fatal(err)
+	}
+	if w.IsWatched(join(tmp, "file")) {
+		t.Error("still watched after Remove")
+	}
+
+	t.Run("recursive", func(t *testing.T) {
+		supportsRecurse(t)
+		t.Parallel()
+
+		tmp := t.TempDir()
+		mkdirAll(t, tmp, "sub")
+		w := newWatcher(t)
+		defer w.Close()
+		addWatch(t, w, tmp, "...")
+
+		if !w.IsWatched(tmp) || !w.IsWatched(join(tmp, "...")) {
+			t.Error("recursive root not watched")
+		}
+		if w.IsWatched(join(tmp, "sub")) {
+			t.Error("subdirectory of recursive watch is watched")
+		}
+	})
+
+	t.Run("closed", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		w := newWatcher(t, tmp)
+		w.Close()
+		if w.IsWatched(tmp) {
+			t.Error("watched after Close")
+		}
+	})
+}
+
+func TestStats(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	w := newCollector(t, tmp)
+	if s := w.w.Stats(); s != (WatcherStats{ActiveWatches: 1}) {
+		t.Errorf("wrong Stats: %+v", s)
+	}
+	w.collect(t)
+
+	touch(t, tmp, "file")
+	rm(t, tmp, "file")
+	have := w.stop(t)
+
+	s := w.w.Stats()
+	if s.EventsDelivered != uint64(len(have)) {
+		t.Errorf("EventsDelivered is %d, but %d events were read", s.EventsDelivered, len(have))
+	}
+	if s.ErrorsEmitted != 0 || s.Overflows != 0 || s.ActiveWatches != 0 {
+		t.Errorf("wrong Stats: %+v", s)
+	}
+}
+
+func TestBuffered(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	w, err := NewBufferedWatcher(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	addWatch(t, w, tmp)
+	if used, size := w.Buffered(); used != 0 || size != 4 {
+		t.Errorf("Buffered() = %d, %d; want 0, 4", used, size)
+	}
+
+	touch(t, tmp, "one")
+	touch(t, tmp, "two")
+	waitForEvents()
+	if used, size := w.Buffered(); used != 2 || size != 4 {
+		t.Errorf("Buffered() = %d, %d; want 2, 4", used, size)
+	}
+
+	unbuffered := newWatcher(t)
+	defer unbuffered.Close()
+	if used, size := unbuffered.Buffered(); runtime.GOOS != "windows" && (used != 0 || size != 0) {
+		t.Errorf("Buffered() = %d, %d for NewWatcher; want 0, 0", used, size)
+	}
+}
+
+func TestPause(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	w := newCollector(t, tmp)
+	w.collect(t)
+
+	if n := w.w.Resume(); n != 0 {
+		t.Errorf("Resume returned %d when not paused", n)
+	}
+
+	touch(t, tmp, "a")
+	eventSeparator()
+	w.w.Pause()
+	w.w.Pause()
+	touch(t, tmp, "b")
+	touch(t, tmp, "c")
+	waitForEvents()
+	if n := w.w.Resume(); n < 2 {
+		t.Errorf("Resume returned %d; want at least 2", n)
+	}
+	if n := w.w.Resume(); n != 0 {
+		t.Errorf("second Resume returned %d", n)
+	}
+	touch(t, tmp, "d")
+
+	cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+		create /a
+		create /d
+	`))
+}
+
+func TestFd(t *testing.T) {
+	t.Parallel()
+
+	var want bool
+	switch runtime.GOOS {
+	case "linux", "darwin", "freebsd", "openbsd", "netbsd", "dragonfly":
+		want = true
+	}
+
+	w := newWatcher(t)
+	fd, ok := w.Fd()
+	if ok != want {
+		t.Fatalf("ok is %t; want %t", ok, want)
+	}
+	if ok && fd == 0 {
+		t.Error("fd is 0")
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := w.Fd(); ok {
+		t.Error("ok is true after Close")
+	}
+
+	p, err := NewPollingWatcher(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	if _, ok := p.Fd(); ok {
+		t.Error("ok is true for polling watcher")
+	}
+}
+
+func TestSupportsRecursion(t *testing.T) {
+	t.Parallel()
+
+	p, err := NewPollingWatcher(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	for _, w := range []*Watcher{newWatcher(t), p} {
+		err := w.Add(join(t.TempDir(), "..."))
+		if w.SupportsRecursion() {
+			if err != nil {
+				t.Errorf("SupportsRecursion is true, but Add failed: %s", err)
+			}
+		} else if !errors.Is(err, ErrRecursionUnsupported) {
+			t.Errorf("SupportsRecursion is false, but Add returned %v", err)
 		}
+		w.Close()
+	}
+
+	var want bool
+	switch runtime.GOOS {
+	case "linux", "windows", "illumos", "solaris":
+		want = true
+	}
+	w := newWatcher(t)
+	defer w.Close()
+	if have := w.SupportsRecursion(); have != want {
+		t.Errorf("SupportsRecursion is %t on %s", have, runtime.GOOS)
+	}
+	if !p.SupportsRecursion() {
+		t.Error("SupportsRecursion is false for polling watcher")
+	}
+}
+
+func TestWatchError(t *testing.T) {
+	var err error = &WatchError{Path: "/dir", Op: "add", Err: fmt.Errorf("%w: /dir", ErrWatchLimitReached)}
+
+	if have, want := err.Error(), "fsnotify: add /dir: fsnotify: watch limit reached: /dir"; have != want {
+		t.Errorf("\nhave: %s\nwant: %s", have, want)
+	}
+	if !errors.Is(err, ErrWatchLimitReached) {
+		t.Error("errors.Is failed")
+	}
+	var wErr *WatchError
+	if !errors.As(fmt.Errorf("wrap: %w", err), &wErr) || wErr.Path != "/dir" {
+		t.Errorf("errors.As failed: %#v", wErr)
+	}
+}
 
-		t.Parallel()
+func TestOverflowError(t *testing.T) {
+	tests := []struct {
+		in   *OverflowError
+		want string
+	}{
+		{&OverflowError{Dropped: -1}, "fsnotify: queue or buffer overflow"},
+		{&OverflowError{Dropped: 42}, "fsnotify: queue or buffer overflow: 42 events dropped"},
+	}
 
-		tmp := t.TempDir()
-		dir := join(tmp, "dir-unreadable")
-		mkdir(t, dir)
-		touch(t, dir, "/file")
-		chmod(t, 0, dir)
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			if have := tt.in.Error(); have != tt.want {
+				t.Errorf("\nhave: %q\nwant: %q", have, tt.want)
+			}
+			if !errors.Is(tt.in, ErrEventOverflow) {
+				t.Error("errors.Is failed")
+			}
+		})
+	}
+}
 
-		w := newWatcher(t)
-		defer func() {
-			w.Close()
-			chmod(t, 0o755, dir) // Make TempDir() cleanup work
-		}()
-		err := w.Add(dir)
-		if err == nil {
-			t.Fatal("error is nil")
-		}
-		if !errors.Is(err, internal.UnixEACCES) {
-			t.Errorf("not unix.EACCESS: %T %#[1]v", err)
-		}
-		if !errors.Is(err, internal.SyscallEACCES) {
-			t.Errorf("not syscall.EACCESS: %T %#[1]v", err)
-		}
-	})
+func TestEventString(t *testing.T) {
+	tests := []struct {
+		in   Event
+		want string
+	}{
+		{Event{}, `[no events]   ""`},
+		{Event{Name: "/file", Op: 0}, `[no events]   "/file"`},
+
+		{Event{Name: "/file", Op: Chmod | Create},
+			`CREATE|CHMOD  "/file"`},
+		{Event{Name: "/file", Op: Rename},
+			`RENAME        "/file"`},
+		{Event{Name: "/file", Op: Remove},
+			`REMOVE        "/file"`},
+		{Event{Name: "/file", Op: Write | Chmod},
+			`WRITE|CHMOD   "/file"`},
+		{Event{Name: "/new", Op: Create, RenamedFrom: "/old"},
+			`CREATE        "/new" ← "/old"`},
+	}
+
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			have := tt.in.String()
+			if have != tt.want {
+				t.Errorf("\nhave: %q\nwant: %q", have, tt.want)
+			}
+		})
+	}
 }
 
-// TODO: should also check internal state is correct/cleaned up; e.g. no
-//       left-over file descriptors or whatnot.
-func TestRemove(t *testing.T) {
-	t.Run("works", func(t *testing.T) {
-		t.Parallel()
+func TestParseOp(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Op
+		wantErr string
+	}{
+		{"[no events]", 0, ""},
+		{"CREATE", Create, ""},
+		{"CREATE|WRITE", Create | Write, ""},
+		{"write|Create", Create | Write, ""},
+		{"CHMOD | RENAME", Chmod | Rename, ""},
+		{"CREATE|REMOVE|WRITE|RENAME|CHMOD", AllOps, ""},
+
+		{"", 0, `unknown operation: ""`},
+		{"CREATE|", 0, `unknown operation: ""`},
+		{"CREATE|DELETE", 0, `unknown operation: "DELETE"`},
+		{"[NO EVENTS]", 0, `unknown operation: "[NO EVENTS]"`},
+	}
 
-		tmp := t.TempDir()
-		touch(t, tmp, "file")
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			have, err := ParseOp(tt.in)
+			if !errorContains(err, tt.wantErr) {
+				t.Fatalf("wrong error\nhave: %v\nwant: %s", err, tt.wantErr)
+			}
+			if have != tt.want {
+				t.Errorf("\nhave: %s\nwant: %s", have, tt.want)
+			}
+		})
+	}
 
-		w := newCollector(t)
-		w.collect(t)
-		addWatch(t, w.w, tmp)
-		if err := w.w.Remove(tmp); err != nil {
+	// Every Op round-trips through String().
+	for o := Op(0); o <= AllOps; o++ {
+		have, err := ParseOp(o.String())
+		if err != nil {
 			t.Fatal(err)
 		}
-
-		time.Sleep(200 * time.Millisecond)
-		cat(t, "data", tmp, "file")
-		chmod(t, 0o700, tmp, "file")
-
-		have := w.stop(t)
-		if len(have) > 0 {
-			t.Errorf("received events; expected none:\n%s", have)
+		if have != o {
+			t.Errorf("\nhave: %s\nwant: %s", have, o)
 		}
-	})
-
-	t.Run("remove same dir twice", func(t *testing.T) {
-		t.Parallel()
-
-		tmp := t.TempDir()
+	}
+}
 
-		touch(t, tmp, "file")
+func TestAllOps(t *testing.T) {
+	for _, o := range []Op{Create, Write, Remove, Rename, Chmod} {
+		if !AllOps.Has(o) {
+			t.Errorf("AllOps doesn't have %s", o)
+		}
+	}
+	if have, want := AllOps.String(), "CREATE|REMOVE|WRITE|RENAME|CHMOD"; have != want {
+		t.Errorf("\nhave: %s\nwant: %s", have, want)
+	}
+}
 
-		w := newWatcher(t)
-		defer w.Close()
+func TestOpJSON(t *testing.T) {
+	tests := []struct {
+		in   Op
+		want string
+	}{
+		{0, `[]`},
+		{Create, `["CREATE"]`},
+		{Write | Create, `["CREATE","WRITE"]`},
+		{AllOps, `["CREATE","REMOVE","WRITE","RENAME","CHMOD"]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in.String(), func(t *testing.T) {
+			have, err := json.Marshal(tt.in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(have) != tt.want {
+				t.Errorf("\nhave: %s\nwant: %s", have, tt.want)
+			}
 
-		addWatch(t, w, tmp)
+			var o Op
+			if err := json.Unmarshal(have, &o); err != nil {
+				t.Fatal(err)
+			}
+			if o != tt.in {
+				t.Errorf("\nhave: %s\nwant: %s", o, tt.in)
+			}
+		})
+	}
 
-		if err := w.Remove(tmp); err != nil {
+	t.Run("case-insensitive", func(t *testing.T) {
+		var o Op
+		if err := json.Unmarshal([]byte(`["create","Write"]`), &o); err != nil {
 			t.Fatal(err)
 		}
-		err := w.Remove(tmp)
-		if err == nil {
-			t.Fatal("no error")
+		if o != Create|Write {
+			t.Errorf("wrong op: %s", o)
 		}
-		if !errors.Is(err, ErrNonExistentWatch) {
-			t.Fatalf("wrong error: %T", err)
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		if _, err := json.Marshal(Op(1 << 10)); err == nil || !strings.Contains(err.Error(), "unknown operation: 0x400") {
+			t.Errorf("wrong error: %v", err)
+		}
+		for _, in := range []string{`["CREATE","DELETE"]`, `"CREATE"`, `[1]`} {
+			var o Op
+			if err := json.Unmarshal([]byte(in), &o); err == nil {
+				t.Errorf("no error for %s", in)
+			}
+		}
+
+		var o Op
+		err := json.Unmarshal([]byte(`["DELETE"]`), &o)
+		if err == nil || !strings.Contains(err.Error(), `unknown operation: "DELETE"`) {
+			t.Errorf("wrong error: %v", err)
 		}
 	})
+}
 
-	// Make sure that concurrent calls to Remove() don't race.
-	t.Run("no race", func(t *testing.T) {
-		t.Parallel()
+func TestEventJSON(t *testing.T) {
+	tm := time.Date(2024, 1, 2, 15, 4, 5, 123456789, time.UTC)
+	tests := []struct {
+		in   Event
+		want string
+	}{
+		{Event{}, `{"name":"","op":[],"time":"0001-01-01T00:00:00Z"}`},
+		{Event{Name: "/file", Op: Create | Write, Time: tm},
+			`{"name":"/file","op":["CREATE","WRITE"],"time":"2024-01-02T15:04:05.123456789Z"}`},
+		{Event{Name: "/new", Op: Create, RenamedFrom: "/old", Time: tm},
+			`{"name":"/new","op":["CREATE"],"renamedFrom":"/old","time":"2024-01-02T15:04:05.123456789Z"}`},
+		{Event{Name: "/new", Op: Create, Moved: true, Time: tm},
+			`{"name":"/new","op":["CREATE"],"moved":true,"time":"2024-01-02T15:04:05.123456789Z"}`},
+		{Event{Name: "/dir", Op: Create, Time: tm, isDir: true, initial: true},
+			`{"name":"/dir","op":["CREATE"],"time":"2024-01-02T15:04:05.123456789Z","isDir":true,"initial":true}`},
+		{Event{Name: "/file", Op: Create, Time: tm, scanned: true},
+			`{"name":"/file","op":["CREATE"],"time":"2024-01-02T15:04:05.123456789Z","scanned":true}`},
+		{Event{Name: "/file", Op: Write, Time: tm, truncated: true},
+			`{"name":"/file","op":["WRITE"],"time":"2024-01-02T15:04:05.123456789Z","truncated":true}`},
+		{Event{Name: "/file", Op: Write, Time: tm, Seq: 42},
+			`{"name":"/file","op":["WRITE"],"time":"2024-01-02T15:04:05.123456789Z","seq":42}`},
+	}
 
-		tmp := t.TempDir()
-		touch(t, tmp, "file")
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			have, err := json.Marshal(tt.in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(have) != tt.want {
+				t.Errorf("\nhave: %s\nwant: %s", have, tt.want)
+			}
 
-		for i := 0; i < 10; i++ {
-			w := newWatcher(t)
-			defer w.Close()
-			addWatch(t, w, tmp)
+			var e Event
+			if err := json.Unmarshal(have, &e); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(e, tt.in) {
+				t.Errorf("\nhave: %#v\nwant: %#v", e, tt.in)
+			}
+		})
+	}
 
-			done := make(chan struct{})
-			go func() {
-				defer func() { done <- struct{}{} }()
-				w.Remove(tmp)
-			}()
-			go func() {
-				defer func() { done <- struct{}{} }()
-				w.Remove(tmp)
-			}()
-			<-done
-			<-done
-			w.Close()
+	t.Run("unknown op", func(t *testing.T) {
+		var e Event
+		err := json.Unmarshal([]byte(`{"name":"/file","op":["TRUNCATE"]}`), &e)
+		if err == nil || !strings.Contains(err.Error(), `unknown operation: "TRUNCATE"`) {
+			t.Errorf("wrong error: %v", err)
 		}
 	})
 }
 
-func TestEventString(t *testing.T) {
+func TestOpGoString(t *testing.T) {
 	tests := []struct {
-		in   Event
+		in   Op
 		want string
 	}{
-		{Event{}, `[no events]   ""`},
-		{Event{"/file", 0}, `[no events]   "/file"`},
+		{0, `fsnotify.Op(0)`},
+		{Create, `fsnotify.Create`},
+		{Write | Create, `fsnotify.Create|fsnotify.Write`},
+		{AllOps, `fsnotify.Create|fsnotify.Remove|fsnotify.Write|fsnotify.Rename|fsnotify.Chmod`},
+		{Write | 1<<10, `fsnotify.Write|fsnotify.Op(0x400)`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in.String(), func(t *testing.T) {
+			if have := fmt.Sprintf("%#v", tt.in); have != tt.want {
+				t.Errorf("\nhave: %s\nwant: %s", have, tt.want)
+			}
+			// Not changed by GoString.
+			if have := fmt.Sprintf("%v", tt.in); have != tt.in.String() {
+				t.Errorf("%%v changed: %s", have)
+			}
+		})
+	}
+}
 
-		{Event{"/file", Chmod | Create},
-			`CREATE|CHMOD  "/file"`},
-		{Event{"/file", Rename},
-			`RENAME        "/file"`},
-		{Event{"/file", Remove},
-			`REMOVE        "/file"`},
-		{Event{"/file", Write | Chmod},
-			`WRITE|CHMOD   "/file"`},
+func TestOpPrimary(t *testing.T) {
+	// Build the want for all combinations of the operations from the
+	// precedence, rather than listing all 31 of them.
+	precedence := []Op{Remove, Rename, Create, Write, Chmod}
+	tests := []struct {
+		in, want Op
+	}{
+		{0, 0},
+		{1 << 10, 0},
+		{Write | 1<<10, Write},
+	}
+	for o := Op(1); o <= AllOps; o++ {
+		for _, p := range precedence {
+			if o&p != 0 {
+				tests = append(tests, struct{ in, want Op }{o, p})
+				break
+			}
+		}
+	}
+	if len(tests) != 3+31 {
+		t.Fatalf("%d tests", len(tests))
 	}
 
 	for _, tt := range tests {
-		t.Run("", func(t *testing.T) {
-			have := tt.in.String()
+		t.Run(tt.in.String(), func(t *testing.T) {
+			have := tt.in.Primary()
 			if have != tt.want {
-				t.Errorf("\nhave: %q\nwant: %q", have, tt.want)
+				t.Errorf("\nhave: %s\nwant: %s", have, tt.want)
 			}
 		})
 	}
@@ -1202,6 +4940,7 @@ func TestWatchStress(t *testing.T) {
 	var extra Events
 	for _, h := range have {
 		h.Name = filepath.ToSlash(strings.TrimPrefix(h.Name, tmp))
+		h.Time, h.Seq = time.Time{}, 0
 		_, ok := want[h]
 		if ok {
 			delete(want, h)
@@ -1233,11 +4972,6 @@ func TestWatchStress(t *testing.T) {
 }
 
 func TestWatchList(t *testing.T) {
-	if runtime.GOOS == "windows" {
-		// TODO: probably should I guess...
-		t.Skip("WatchList has always been broken on Windows and I don't feel like fixing it")
-	}
-
 	t.Parallel()
 
 	tmp := t.TempDir()
@@ -1256,4 +4990,114 @@ func TestWatchList(t *testing.T) {
 	if !reflect.DeepEqual(have, want) {
 		t.Errorf("\nhave: %s\nwant: %s", have, want)
 	}
+
+	t.Run("empty", func(t *testing.T) {
+		t.Parallel()
+
+		w := newWatcher(t)
+		defer w.Close()
+
+		if l := w.WatchList(); l == nil || len(l) != 0 {
+			t.Fatalf("WatchList not empty: %#v", l)
+		}
+	})
+
+	t.Run("cleaned", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		w := newWatcher(t, tmp+"/./")
+		defer w.Close()
+
+		have := w.WatchList()
+		want := []string{tmp}
+		if !reflect.DeepEqual(have, want) {
+			t.Errorf("\nhave: %s\nwant: %s", have, want)
+		}
+	})
+
+	t.Run("concurrent", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		w := newWatcher(t)
+		defer w.Close()
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := 0; i < 100; i++ {
+				w.WatchList()
+			}
+		}()
+		for i := 0; i < 100; i++ {
+			addWatch(t, w, tmp)
+			if err := w.Remove(tmp); err != nil {
+				t.Fatal(err)
+			}
+		}
+		<-done
+	})
+}
+
+func TestClone(t *testing.T) {
+	t.Run("works", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		mkdirAll(t, tmp, "dir", "sub")
+		touch(t, tmp, "file")
+
+		w := newWatcher(t, tmp, join(tmp, "file"))
+		defer w.Close()
+		if w.SupportsRecursion() {
+			addWatch(t, w, tmp, "dir", "...")
+		}
+
+		c, err := w.Clone()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+
+		have, want := c.WatchList(), w.WatchList()
+		sort.Strings(have)
+		sort.Strings(want)
+		if !reflect.DeepEqual(have, want) {
+			t.Errorf("\nhave: %s\nwant: %s", have, want)
+		}
+
+		// Independent from the original.
+		if err := c.Remove(tmp); err != nil {
+			t.Fatal(err)
+		}
+		if !w.IsWatched(tmp) {
+			t.Error("removed from the original")
+		}
+	})
+
+	t.Run("closed", func(t *testing.T) {
+		t.Parallel()
+
+		w := newWatcher(t)
+		w.Close()
+		if _, err := w.Clone(); !errors.Is(err, ErrClosed) {
+			t.Errorf("wrong error: %v", err)
+		}
+	})
+
+	t.Run("error", func(t *testing.T) {
+		t.Parallel()
+
+		err := error(&MultiError{op: "Clone", Errs: []error{
+			fmt.Errorf("%w: /a", ErrNotDirectory),
+			fmt.Errorf("open /b: %w", os.ErrNotExist),
+		}})
+		if !errors.Is(err, os.ErrNotExist) || !errors.Is(err, ErrNotDirectory) || errors.Is(err, ErrClosed) {
+			t.Errorf("wrong errors.Is() for %v", err)
+		}
+		if have, want := err.Error(), "fsnotify.Clone: fsnotify: not a directory: /a; open /b: file does not exist"; have != want {
+			t.Errorf("\nhave: %s\nwant: %s", have, want)
+		}
+	})
 }
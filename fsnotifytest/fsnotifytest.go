@@ -0,0 +1,199 @@
+// Package fsnotifytest provides a fake fsnotify watcher for testing code that
+// uses fsnotify, without touching the filesystem.
+//
+// Events and errors are sent with [Watcher.Inject] and [Watcher.InjectError],
+// so tests don't need to wait for the OS:
+//
+//	w := fsnotifytest.NewWatcher()
+//	go reload(w.Events, w.Errors)
+//	w.Inject(fsnotify.Event{Name: "/etc/app.conf", Op: fsnotify.Write})
+package fsnotifytest
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Watcher is a fake watcher with the same methods and channels as
+// [fsnotify.Watcher]. Paths are never looked at: Add and Remove only keep
+// track of the list of watched paths.
+type Watcher struct {
+	// Events sends the events from Inject.
+	Events chan fsnotify.Event
+
+	// Errors sends the errors from InjectError.
+	Errors chan error
+
+	mu      sync.Mutex            // Protects access to watches, closed, stats
+	watches map[string]struct{}   // Paths added with Add()
+	closed  bool                  // Set to true when Close() is first called
+	stats   fsnotify.WatcherStats // Events and errors that were sent
+	done    chan struct{}         // Closed on Close, to stop sending
+	sending sync.WaitGroup        // Inject and InjectError calls that are sending
+}
+
+// NewWatcher creates a new fake Watcher with unbuffered channels; Inject
+// blocks until the event is read.
+func NewWatcher() *Watcher {
+	return NewBufferedWatcher(0)
+}
+
+// NewBufferedWatcher creates a new fake Watcher with a buffered Events channel
+// that can hold sz events, so that events can be injected before reading them.
+func NewBufferedWatcher(sz int) *Watcher {
+	return &Watcher{
+		Events:  make(chan fsnotify.Event, sz),
+		Errors:  make(chan error),
+		watches: make(map[string]struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// Add adds the path to the list of watched paths.
+//
+// Returns [fsnotify.ErrClosed] if the watcher was closed.
+func (w *Watcher) Add(name string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return fsnotify.ErrClosed
+	}
+	w.watches[filepath.Clean(name)] = struct{}{}
+	return nil
+}
+
+// Remove removes the path from the list of watched paths.
+//
+// Returns [fsnotify.ErrNonExistentWatch] if the path wasn't added, and
+// [fsnotify.ErrClosed] if the watcher was closed.
+func (w *Watcher) Remove(name string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return fsnotify.ErrClosed
+	}
+
+	name = filepath.Clean(name)
+	if _, ok := w.watches[name]; !ok {
+		return fmt.Errorf("%w: %s", fsnotify.ErrNonExistentWatch, name)
+	}
+	delete(w.watches, name)
+	return nil
+}
+
+// WatchList returns all paths that were added with Add, sorted.
+func (w *Watcher) WatchList() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return []string{}
+	}
+
+	entries := make([]string, 0, len(w.watches))
+	for p := range w.watches {
+		entries = append(entries, p)
+	}
+	sort.Strings(entries)
+	return entries
+}
+
+// IsWatched reports if the path was added with Add, and hasn't been removed
+// since.
+func (w *Watcher) IsWatched(name string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, ok := w.watches[filepath.Clean(name)]
+	return ok && !w.closed
+}
+
+// Stats returns the number of events and errors that were sent by Inject and
+// InjectError, and the number of watched paths. Rewatches is always 0.
+func (w *Watcher) Stats() fsnotify.WatcherStats {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	s := w.stats
+	if !w.closed {
+		s.ActiveWatches = len(w.watches)
+	}
+	return s
+}
+
+// Close removes all watches and closes the Events and Errors channels. Any
+// Inject or InjectError calls that are blocked will return
+// [fsnotify.ErrClosed].
+func (w *Watcher) Close() error {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return nil
+	}
+	w.closed = true
+	close(w.done)
+	w.mu.Unlock()
+
+	w.sending.Wait()
+	close(w.Events)
+	close(w.Errors)
+	return nil
+}
+
+// Inject sends the event on the Events channel, regardless of whether
+// Event.Name was added. It blocks until the event is read, or until there is
+// space in the buffer.
+//
+// Returns [fsnotify.ErrClosed] if the watcher was closed.
+func (w *Watcher) Inject(e fsnotify.Event) error {
+	if !w.startSend() {
+		return fsnotify.ErrClosed
+	}
+	defer w.sending.Done()
+
+	select {
+	case w.Events <- e:
+		w.mu.Lock()
+		w.stats.EventsDelivered++
+		w.mu.Unlock()
+		return nil
+	case <-w.done:
+		return fsnotify.ErrClosed
+	}
+}
+
+// InjectError sends the error on the Errors channel. It blocks until the error
+// is read.
+//
+// Returns [fsnotify.ErrClosed] if the watcher was closed.
+func (w *Watcher) InjectError(err error) error {
+	if !w.startSend() {
+		return fsnotify.ErrClosed
+	}
+	defer w.sending.Done()
+
+	select {
+	case w.Errors <- err:
+		w.mu.Lock()
+		w.stats.ErrorsEmitted++
+		if errors.Is(err, fsnotify.ErrEventOverflow) {
+			w.stats.Overflows++
+		}
+		w.mu.Unlock()
+		return nil
+	case <-w.done:
+		return fsnotify.ErrClosed
+	}
+}
+
+func (w *Watcher) startSend() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return false
+	}
+	w.sending.Add(1)
+	return true
+}
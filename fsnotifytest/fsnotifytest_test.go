@@ -0,0 +1,104 @@
+package fsnotifytest
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+func TestWatcher(t *testing.T) {
+	t.Run("add remove", func(t *testing.T) {
+		w := NewWatcher()
+		defer w.Close()
+
+		if err := w.Add("/b"); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Add("/a/"); err != nil {
+			t.Fatal(err)
+		}
+		if l := w.WatchList(); !reflect.DeepEqual(l, []string{"/a", "/b"}) {
+			t.Errorf("wrong WatchList: %s", l)
+		}
+		if !w.IsWatched("/a") || w.IsWatched("/c") {
+			t.Error("wrong IsWatched")
+		}
+
+		if err := w.Remove("/a"); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Remove("/a"); !errors.Is(err, fsnotify.ErrNonExistentWatch) {
+			t.Errorf("wrong error: %v", err)
+		}
+		if l := w.WatchList(); !reflect.DeepEqual(l, []string{"/b"}) {
+			t.Errorf("wrong WatchList: %s", l)
+		}
+	})
+
+	t.Run("inject", func(t *testing.T) {
+		w := NewBufferedWatcher(2)
+		defer w.Close()
+
+		want := []fsnotify.Event{
+			{Name: "/file", Op: fsnotify.Create},
+			{Name: "/file", Op: fsnotify.Write},
+		}
+		for _, e := range want {
+			if err := w.Inject(e); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, e := range want {
+			if have := <-w.Events; have != e {
+				t.Errorf("\nhave: %s\nwant: %s", have, e)
+			}
+		}
+
+		errC := make(chan error)
+		go func() { errC <- w.InjectError(fsnotify.ErrEventOverflow) }()
+		if err := <-w.Errors; !errors.Is(err, fsnotify.ErrEventOverflow) {
+			t.Errorf("wrong error: %v", err)
+		}
+		if err := <-errC; err != nil {
+			t.Fatal(err)
+		}
+
+		wantStats := fsnotify.WatcherStats{EventsDelivered: 2, ErrorsEmitted: 1, Overflows: 1}
+		if s := w.Stats(); s != wantStats {
+			t.Errorf("wrong Stats:\nhave: %+v\nwant: %+v", s, wantStats)
+		}
+	})
+
+	t.Run("close", func(t *testing.T) {
+		w := NewWatcher()
+
+		errC := make(chan error)
+		go func() { errC <- w.Inject(fsnotify.Event{Name: "/file", Op: fsnotify.Create}) }()
+		time.Sleep(50 * time.Millisecond)
+
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := <-errC; !errors.Is(err, fsnotify.ErrClosed) {
+			t.Errorf("wrong error: %v", err)
+		}
+		if _, ok := <-w.Events; ok {
+			t.Error("Events not closed")
+		}
+		if err := w.Add("/file"); !errors.Is(err, fsnotify.ErrClosed) {
+			t.Errorf("wrong error: %v", err)
+		}
+		if err := w.Remove("/file"); !errors.Is(err, fsnotify.ErrClosed) {
+			t.Errorf("wrong error: %v", err)
+		}
+		if err := w.Inject(fsnotify.Event{}); !errors.Is(err, fsnotify.ErrClosed) {
+			t.Errorf("wrong error: %v", err)
+		}
+	})
+}
@@ -70,6 +70,17 @@ func addWatch(t *testing.T, w *Watcher, path ...string) {
 	}
 }
 
+// waitUnwatched waits until path is no longer watched, for watches that are
+// removed in the background.
+func waitUnwatched(t *testing.T, w *Watcher, path string) {
+	t.Helper()
+	for start := time.Now(); w.IsWatched(path); time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("%q still watched", path)
+		}
+	}
+}
+
 const noWait = ""
 
 func shouldWait(path ...string) bool {
@@ -138,19 +149,19 @@ func mkdir(t *testing.T, path ...string) {
 }
 
 // mkdir -p
-// func mkdirAll(t *testing.T, path ...string) {
-// 	t.Helper()
-// 	if len(path) < 1 {
-// 		t.Fatalf("mkdirAll: path must have at least one element: %s", path)
-// 	}
-// 	err := os.MkdirAll(join(path...), 0o0755)
-// 	if err != nil {
-// 		t.Fatalf("mkdirAll(%q): %s", join(path...), err)
-// 	}
-// 	if shouldWait(path...) {
-// 		eventSeparator()
-// 	}
-// }
+func mkdirAll(t *testing.T, path ...string) {
+	t.Helper()
+	if len(path) < 1 {
+		t.Fatalf("mkdirAll: path must have at least one element: %s", path)
+	}
+	err := os.MkdirAll(join(path...), 0o0755)
+	if err != nil {
+		t.Fatalf("mkdirAll(%q): %s", join(path...), err)
+	}
+	if shouldWait(path...) {
+		eventSeparator()
+	}
+}
 
 // ln -s
 func symlink(t *testing.T, target string, link ...string) {
@@ -576,3 +587,22 @@ func isSolaris() bool {
 	}
 	return false
 }
+
+// Skip the test if recursive watches aren't supported on this platform.
+func supportsRecurse(t *testing.T) {
+	t.Helper()
+	switch runtime.GOOS {
+	case "linux", "windows", "illumos", "solaris":
+	default:
+		t.Skip("recursion not yet supported on " + runtime.GOOS)
+	}
+}
+
+// errorContains reports if err contains the string want, or if err is nil if
+// want is empty.
+func errorContains(err error, want string) bool {
+	if err == nil {
+		return want == ""
+	}
+	return want != "" && strings.Contains(err.Error(), want)
+}
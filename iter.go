@@ -0,0 +1,33 @@
+//go:build go1.23
+
+package fsnotify
+
+import "iter"
+
+// All returns an iterator over the events and errors, for use with range:
+//
+//	for e, err := range w.All() {
+//	    if err != nil {
+//	        log.Println("error:", err)
+//	        continue
+//	    }
+//	    log.Println("event:", e)
+//	}
+//
+// Every iteration has either an event or an error, as with [Watcher.Next]. The
+// loop ends once the watcher is closed and all events and errors have been
+// read; breaking out of the loop early doesn't close the watcher, and All can
+// be called again to continue reading.
+func (w *Watcher) All() iter.Seq2[Event, error] {
+	return func(yield func(Event, error) bool) {
+		for {
+			e, err := w.Next()
+			if err == ErrClosed {
+				return
+			}
+			if !yield(e, err) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,77 @@
+//go:build go1.23
+
+package fsnotify
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func ExampleWatcher_All() {
+	tmp, err := os.MkdirTemp("", "")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	w, err := NewWatcher()
+	if err != nil {
+		panic(err)
+	}
+	defer w.Close()
+	if err := w.Add(tmp); err != nil {
+		panic(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(tmp, "file"), nil, 0o644); err != nil {
+		panic(err)
+	}
+
+	// Stop after the first event; the watcher is still open.
+	for e, err := range w.All() {
+		if err != nil {
+			fmt.Println("error:", err)
+			continue
+		}
+		fmt.Println(e.Op, filepath.Base(e.Name))
+		break
+	}
+	// Output: CREATE file
+}
+
+func TestAll(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	w := newWatcher(t, tmp)
+	defer w.Close()
+
+	touch(t, tmp, "a")
+	for e, err := range w.All() {
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.Name != join(tmp, "a") {
+			t.Fatalf("wrong event: %s", e)
+		}
+		break
+	}
+
+	// Continues where the previous loop stopped, and ends once closed.
+	touch(t, tmp, "b")
+	n := 0
+	for e, err := range w.All() {
+		if err != nil {
+			t.Fatal(err)
+		}
+		n++
+		if e.Name == join(tmp, "b") {
+			w.Close()
+		}
+	}
+	if n == 0 {
+		t.Error("no events")
+	}
+}
@@ -0,0 +1,910 @@
+package fsnotify
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// pipeline is everything that's done to events between the backend and the
+// Events channel: the patterns added with Watcher.Ignore(), extensions from
+// Watcher.WatchExtensions(), and the filter from Watcher.SetFilter(), whether
+// events are paused with Watcher.Pause(), how events are changed with
+// WithBasePath(), WithChmodAsWrite(), WithoutHidden(), WithSizeTracking(), and
+// WithSnapshot(), the repeats dropped with WithDedup(), and the last Event.Seq.
+// It's shared between the Watcher and the backend.
+//
+// Events held back for WithMergeCreateWrite() and WithRateLimit(), the
+// SetEventLog() log, and the Watcher.Subscribe() channels each have their own
+// type and lock.
+//
+// match(), matchBelow(), dropExt(), dropPaused(), rewrite(), nextSeq(), and
+// send() can be used on a nil pipeline.
+type pipeline struct {
+	dropped  uint64 // Events dropped while paused; first for 64-bit alignment on 32-bit platforms.
+	seq      uint64 // Event.Seq of the last event that was read, with sync/atomic.
+	paused   int32
+	fold     int32 // Set to 1 (with sync/atomic) to match paths case-insensitively, for SetCaseInsensitive().
+	mu       sync.RWMutex
+	patterns []string
+	exts     map[string]struct{}     // Lower-cased extensions from Watcher.WatchExtensions(), with a dot; nil for all.
+	filter   func(Event) bool        // From Watcher.SetFilter(); nil to send everything.
+	rewrites map[string]watchRewrite // Watched paths (key: path as passed to Add), once an option for it was used.
+	active   int                     // Number of rewrites that change events.
+	last     lastEvent               // Last event that was sent, for WithDedup().
+
+	sizeMu sync.Mutex
+	sizes  map[string]int64 // Size of files on the last event, for WithSizeTracking() (key: path).
+
+	snapMu sync.Mutex
+	snaps  map[string]*snapshot // Last known state of watches, for WithSnapshot() (key: path as passed to Add).
+
+	sendMu sync.Mutex   // Held while sending an event, so that held events are sent before newer ones.
+	events chan<- Event // The Watcher's Events channel; only what's sent on it is sent to the subscribers.
+
+	heldEvents
+	eventLog
+	subscribers
+}
+
+// heldEvents are the events that aren't sent yet, for WithMergeCreateWrite()
+// and WithRateLimit().
+type heldEvents struct {
+	heldMu     sync.Mutex            // Protects held, rates, heldClosed; taken before sendMu.
+	held       map[string]*heldEvent // Creates waiting for a Write, for WithMergeCreateWrite() (key: Event.Name).
+	rates      map[string]*pathRate  // Paths with a WithRateLimit() window that didn't end yet (key: Event.Name before rewrite()).
+	heldClosed bool                  // Set by closeHeld(); nothing is held after this.
+	heldWg     sync.WaitGroup        // Timers for held events and rate windows that didn't run yet.
+}
+
+// eventLog is the last events sent on the Events channel, for SetEventLog().
+type eventLog struct {
+	logMu  sync.Mutex
+	log    []Event // A ring buffer once it's full.
+	logPos int     // Index of the oldest event in log once it's full.
+}
+
+// subscribers are the channels from Watcher.Subscribe().
+type subscribers struct {
+	subMu      sync.Mutex // Protects subs, subsClosed
+	subs       map[chan Event]struct{}
+	subsClosed bool // Set once the Watcher is closed; the subs are closed too.
+}
+
+// watchRewrite is how the events for a watch are changed before they're sent.
+type watchRewrite struct {
+	abs, root     string        // Absolute path of the watch, and the root from WithBasePath(); empty if it wasn't used.
+	chmodAsWrite  bool          // WithChmodAsWrite()
+	chmod         bool          // Chmod is in WithOps(), rather than only added for WithChmodAsWrite().
+	withoutHidden bool          // WithoutHidden()
+	sizes         bool          // WithSizeTracking()
+	slash         bool          // WithSlashPaths()
+	mergeCreate   bool          // WithMergeCreateWrite()
+	snapshot      bool          // WithSnapshot()
+	rateN         int           // WithRateLimit(); 0 for no limit.
+	rateWindow    time.Duration // Window for rateN.
+	ttl           *watchTTL     // Timer for WithTTLResetOnEvent() and WithOneShot().
+	ttlReset      bool          // Reset ttl on every event, for WithTTLResetOnEvent().
+	glob          string        // Watcher.AddGlob(); only paths in the directory that match are sent.
+	dedup         time.Duration // WithDedup(); 0 to send repeats.
+}
+
+func (r watchRewrite) changes() bool {
+	return r.root != "" || r.chmodAsWrite || r.withoutHidden || r.sizes || r.slash || r.mergeCreate || r.snapshot || r.rateN > 0 || r.ttl != nil || r.glob != "" || r.dedup > 0
+}
+
+// rel makes name relative to the WithBasePath() root; path is the watch it's
+// for.
+func (r watchRewrite) rel(path, name string) string {
+	if r.root == "" {
+		return name
+	}
+	abs := r.abs + name[len(path):]
+	if rel, err := filepath.Rel(r.root, abs); err == nil {
+		return rel
+	}
+	// On a different volume on Windows.
+	return abs
+}
+
+func (l *pipeline) pause() {
+	if atomic.CompareAndSwapInt32(&l.paused, 0, 1) {
+		atomic.StoreUint64(&l.dropped, 0)
+	}
+}
+
+func (l *pipeline) resume() int {
+	if !atomic.CompareAndSwapInt32(&l.paused, 1, 0) {
+		return 0
+	}
+	return int(atomic.SwapUint64(&l.dropped, 0))
+}
+
+// nextSeq gets the Event.Seq for an event that was just read from the OS.
+// Backends call this in their read loop when sending an event, before anything
+// can drop or hold it.
+func (l *pipeline) nextSeq() uint64 {
+	if l == nil {
+		return 0
+	}
+	return atomic.AddUint64(&l.seq, 1)
+}
+
+// dropPaused reports if events are paused, and counts the event as dropped if
+// they are. Backends call this right before sending an event.
+func (l *pipeline) dropPaused() bool {
+	if l == nil || atomic.LoadInt32(&l.paused) == 0 {
+		return false
+	}
+	atomic.AddUint64(&l.dropped, 1)
+	return true
+}
+
+func (l *pipeline) add(pattern string) error {
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return fmt.Errorf("fsnotify.Ignore: %w: %q", err, pattern)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.patterns = append(l.patterns, pattern)
+	return nil
+}
+
+func (l *pipeline) clear() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.patterns = nil
+}
+
+func (l *pipeline) setExts(exts []string) {
+	var m map[string]struct{}
+	if len(exts) > 0 {
+		m = make(map[string]struct{}, len(exts))
+		for _, e := range exts {
+			e = strings.ToLower(e)
+			if !strings.HasPrefix(e, ".") {
+				e = "." + e
+			}
+			m[e] = struct{}{}
+		}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.exts = m
+}
+
+// dropExt reports if the event is for a file that doesn't have one of the
+// extensions from Watcher.WatchExtensions(). Backends call this right before
+// dropPaused().
+func (l *pipeline) dropExt(e Event) bool {
+	if l == nil || e.isDir {
+		return false
+	}
+	ext := filepath.Ext(e.Name)
+	if ext == "" {
+		return false
+	}
+	l.mu.RLock()
+	_, ok := l.exts[strings.ToLower(ext)]
+	ok = ok || l.exts == nil
+	l.mu.RUnlock()
+	if ok {
+		return false
+	}
+
+	// Not all backends know if it's a directory.
+	fi, err := os.Lstat(e.Name)
+	return err != nil || !fi.IsDir()
+}
+
+// setRewrite sets how events for the watch on name are changed or dropped, from
+// WithBasePath(), WithChmodAsWrite(), WithoutHidden(), WithSizeTracking(),
+// WithSlashPaths(), WithMergeCreateWrite(), WithRateLimit(), WithSnapshot(),
+// and Watcher.AddGlob(). ttl is reset on every event with WithTTLResetOnEvent(),
+// and expired after the first event with WithOneShot().
+func (l *pipeline) setRewrite(name string, with withOpts, ttl *watchTTL) error {
+	r := watchRewrite{chmodAsWrite: with.chmodAsWrite, chmod: with.ops.Has(Chmod),
+		withoutHidden: with.withoutHidden, sizes: with.sizeTracking, slash: with.slashPaths,
+		mergeCreate: with.mergeCreate, rateN: with.rateN, rateWindow: with.rateWindow,
+		snapshot: with.snapshot, ttlReset: with.ttlReset, glob: with.glob, dedup: with.dedup}
+	if with.ttlReset || with.oneShot {
+		r.ttl = ttl
+	}
+	if with.basePath != "" {
+		var err error
+		if r.root, err = filepath.Abs(with.basePath); err != nil {
+			return fmt.Errorf("fsnotify.WithBasePath: %w", err)
+		}
+		if r.abs, err = filepath.Abs(name); err != nil {
+			return fmt.Errorf("fsnotify.WithBasePath: %w", err)
+		}
+	}
+
+	l.mu.Lock()
+	if l.rewrites == nil {
+		if !r.changes() {
+			l.mu.Unlock()
+			return nil
+		}
+		l.rewrites = make(map[string]watchRewrite)
+	}
+	l.forget(name)
+	l.rewrites[name] = r
+	if r.changes() {
+		l.active++
+	}
+	l.mu.Unlock()
+
+	if r.sizes {
+		l.readSizes(name)
+	}
+	return nil
+}
+
+// readSizes records the size of the file name, or of the files in the
+// directory name, so that the first Write can be compared to something.
+func (l *pipeline) readSizes(name string) {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return
+	}
+	sizes := map[string]int64{name: fi.Size()}
+	if fi.IsDir() {
+		sizes = make(map[string]int64)
+		ls, _ := os.ReadDir(name)
+		for _, f := range ls {
+			if fi, err := f.Info(); err == nil && fi.Mode().IsRegular() {
+				sizes[filepath.Join(name, f.Name())] = fi.Size()
+			}
+		}
+	} else if !fi.Mode().IsRegular() {
+		return
+	}
+
+	l.sizeMu.Lock()
+	defer l.sizeMu.Unlock()
+	if l.sizes == nil {
+		l.sizes = make(map[string]int64)
+	}
+	for path, sz := range sizes {
+		l.sizes[path] = sz
+	}
+}
+
+// truncated records the size of the file for the event, and reports if a
+// Write made it smaller.
+func (l *pipeline) truncated(e Event) bool {
+	if !e.Has(Create) && !e.Has(Write) && !e.Has(Remove) && !e.Has(Rename) {
+		return false
+	}
+	fi, err := os.Lstat(e.Name)
+
+	l.sizeMu.Lock()
+	defer l.sizeMu.Unlock()
+	prev, ok := l.sizes[e.Name]
+	if err != nil || !fi.Mode().IsRegular() || e.Has(Remove) || e.Has(Rename) {
+		delete(l.sizes, e.Name)
+		return false
+	}
+	if l.sizes == nil {
+		l.sizes = make(map[string]int64)
+	}
+	l.sizes[e.Name] = fi.Size()
+	return ok && e.Has(Write) && fi.Size() < prev
+}
+
+// forgetRewrite forgets the watch on name once it's removed.
+func (l *pipeline) forgetRewrite(name string) {
+	l.last.forget(name)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.forget(name)
+}
+
+// Unlocked!
+func (l *pipeline) forget(name string) {
+	if r, ok := l.rewrites[name]; ok {
+		delete(l.rewrites, name)
+		if r.changes() {
+			l.active--
+		}
+		if r.sizes {
+			prefix := name + string(filepath.Separator)
+			l.sizeMu.Lock()
+			for path := range l.sizes {
+				if path == name || strings.HasPrefix(path, prefix) {
+					delete(l.sizes, path)
+				}
+			}
+			l.sizeMu.Unlock()
+		}
+		if r.rateN > 0 {
+			l.forgetRates(name)
+		}
+		if r.snapshot {
+			l.forgetSnapshot(name)
+		}
+	}
+}
+
+// rewrite changes an event with the WithBasePath(), WithChmodAsWrite(),
+// WithSizeTracking(), and WithSlashPaths() options of the closest watch, applies
+// it to the WithSnapshot() snapshot, and resets the WithTTLResetOnEvent() timer.
+// Backends call this right before sending an event.
+func (l *pipeline) rewrite(e Event) Event {
+	if l == nil {
+		return e
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.active == 0 {
+		return e
+	}
+
+	r, path := l.closest(e.Name)
+	if r.ttl != nil && r.ttlReset {
+		r.ttl.reset()
+	}
+	if r.sizes && !e.isDir {
+		e.truncated = l.truncated(e)
+	}
+	if r.snapshot {
+		l.applySnapshot(path, e)
+	}
+	if r.chmodAsWrite && e.Has(Chmod) {
+		e.Op |= Write
+		if !r.chmod {
+			e.Op &^= Chmod
+		}
+	}
+	e.Name = r.rel(path, e.Name)
+	if e.RenamedFrom != "" {
+		r, path := l.closest(e.RenamedFrom)
+		e.RenamedFrom = r.rel(path, e.RenamedFrom)
+	}
+	if r.slash {
+		e.Name, e.RenamedFrom = filepath.ToSlash(e.Name), filepath.ToSlash(e.RenamedFrom)
+	}
+	return e
+}
+
+// send sends an event on ch after rewriting it, passing it to the filter from
+// Watcher.SetFilter(), and dropping it if it's a repeat for WithDedup(), and
+// counts it in st. Returns false if abort was closed first. Backends call this rather than sending on the
+// Events channel directly, as there may be more than one goroutine sending
+// events.
+func (l *pipeline) send(ch chan<- Event, e Event, abort <-chan struct{}, st *stats) bool {
+	if l == nil {
+		select {
+		case ch <- e:
+			st.sentEvent()
+			return true
+		case <-abort:
+			return false
+		}
+	}
+
+	merge := l.mergesCreate(e)
+	limit, window := l.rateFor(e)
+	once := l.oneShot(e)
+	dedup := l.dedupFor(e)
+	key := e.Name
+	e = l.rewrite(e)
+	l.mu.RLock()
+	filter := l.filter
+	l.mu.RUnlock()
+	if filter != nil && !filter(e) {
+		return true
+	}
+	if l.last.repeat(e, dedup) {
+		return true
+	}
+	if once != nil && !once.fire() {
+		return true
+	}
+
+	l.heldMu.Lock()
+	if limit > 0 && !l.heldClosed && l.overLimit(key, limit, window, &heldEvent{e: e, ch: ch, abort: abort, st: st}) {
+		l.heldMu.Unlock()
+		return true
+	}
+
+	// The held Create is taken over from the timer if it already expired, but
+	// sendHeld() is still waiting for heldMu.
+	if h, ok := l.held[e.Name]; ok {
+		delete(l.held, e.Name)
+		if h.timer.Stop() {
+			l.heldWg.Done()
+		}
+		l.heldMu.Unlock()
+		if e.Op == Write {
+			h.e.Op |= Write
+			h.e.Time, h.e.Seq = e.Time, e.Seq
+			return l.deliver(h.ch, h.e, h.abort, h.st)
+		}
+		return l.deliver(h.ch, h.e, h.abort, h.st) && l.deliver(ch, e, abort, st)
+	}
+	if merge && !l.heldClosed {
+		if l.held == nil {
+			l.held = make(map[string]*heldEvent)
+		}
+		h := &heldEvent{e: e, ch: ch, abort: abort, st: st}
+		l.held[e.Name] = h
+		l.heldWg.Add(1)
+		h.timer = time.AfterFunc(mergeCreateWindow, func() { l.sendHeld(h) })
+		l.heldMu.Unlock()
+		return true
+	}
+	l.heldMu.Unlock()
+	return l.deliver(ch, e, abort, st)
+}
+
+// lastEvent is the last event that was sent, to drop repeats of it for
+// WithDedup().
+type lastEvent struct {
+	mu   sync.Mutex
+	e    Event
+	sent time.Time
+}
+
+// repeat reports if e has the same Name and Op as the last event that was sent,
+// and is within d of it. If it's not a repeat e is stored as the last event.
+func (l *lastEvent) repeat(e Event, d time.Duration) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if d > 0 && e.Name == l.e.Name && e.Op == l.e.Op && now.Sub(l.sent) < d {
+		return true
+	}
+	l.e, l.sent = e, now
+	return false
+}
+
+// forget clears the last event if it's for name or a path below it, so that
+// the first event after the watch is removed and added again is never dropped.
+func (l *lastEvent) forget(name string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.e.Name == name || strings.HasPrefix(l.e.Name, name+string(filepath.Separator)) {
+		l.e = Event{}
+	}
+}
+
+// mergeCreateWindow is how long a Create is held for WithMergeCreateWrite().
+var mergeCreateWindow = 10 * time.Millisecond
+
+// heldEvent is a Create that's held for WithMergeCreateWrite() or the trailing
+// event for WithRateLimit(), and where to send it.
+type heldEvent struct {
+	e     Event
+	ch    chan<- Event
+	abort <-chan struct{}
+	st    *stats
+	timer *time.Timer
+}
+
+// oneShot gets the timer to expire on the first event for the watch e is for,
+// if it was added with WithOneShot().
+func (l *pipeline) oneShot(e Event) *watchTTL {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.active == 0 {
+		return nil
+	}
+	if r, _ := l.closest(e.Name); r.ttl != nil && r.ttl.once {
+		return r.ttl
+	}
+	return nil
+}
+
+// mergesCreate reports if e is a Create for a file that's held to merge a Write
+// into it, for WithMergeCreateWrite().
+func (l *pipeline) mergesCreate(e Event) bool {
+	if e.Op != Create || e.isDir {
+		return false
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.active == 0 {
+		return false
+	}
+	r, _ := l.closest(e.Name)
+	return r.mergeCreate
+}
+
+// pathRate is the WithRateLimit() window for a path.
+type pathRate struct {
+	n     int        // Events sent in this window.
+	over  *heldEvent // Everything over the limit, merged; nil if it wasn't reached.
+	timer *time.Timer
+}
+
+// dedupFor gets the WithDedup() duration for the path of e, from the closest
+// watch.
+func (l *pipeline) dedupFor(e Event) time.Duration {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.active == 0 {
+		return 0
+	}
+	r, _ := l.closest(e.Name)
+	return r.dedup
+}
+
+// rateFor gets the WithRateLimit() limit for the path of e, from the closest
+// watch.
+func (l *pipeline) rateFor(e Event) (int, time.Duration) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.active == 0 {
+		return 0, 0
+	}
+	r, _ := l.closest(e.Name)
+	return r.rateN, r.rateWindow
+}
+
+// overLimit counts h towards the rate limit for key, and reports if it's over
+// the limit; it's then merged in to the event that's sent once the window ends.
+//
+// Must be called with heldMu.
+func (l *pipeline) overLimit(key string, limit int, window time.Duration, h *heldEvent) bool {
+	r, ok := l.rates[key]
+	if !ok {
+		if l.rates == nil {
+			l.rates = make(map[string]*pathRate)
+		}
+		r = &pathRate{}
+		l.rates[key] = r
+		l.heldWg.Add(1)
+		r.timer = time.AfterFunc(window, func() { l.endWindow(key, r) })
+	}
+	if r.n < limit {
+		r.n++
+		return false
+	}
+	if r.over != nil {
+		h.e.Op |= r.over.e.Op
+	}
+	r.over = h
+	return true
+}
+
+// endWindow ends the rate limit window for key, and sends the merged event for
+// everything that was over the limit.
+func (l *pipeline) endWindow(key string, r *pathRate) {
+	defer l.heldWg.Done()
+	l.heldMu.Lock()
+	if l.rates[key] != r {
+		l.heldMu.Unlock()
+		return
+	}
+	delete(l.rates, key)
+	if r.over == nil {
+		l.heldMu.Unlock()
+		return
+	}
+	// A held Create for the path went through the limit before it.
+	send := make([]*heldEvent, 0, 2)
+	if h, ok := l.held[r.over.e.Name]; ok {
+		delete(l.held, r.over.e.Name)
+		if h.timer.Stop() {
+			l.heldWg.Done()
+		}
+		send = append(send, h)
+	}
+	send = append(send, r.over)
+
+	l.sendMu.Lock()
+	l.heldMu.Unlock()
+	for _, h := range send {
+		l.deliverLocked(h.ch, h.e, h.abort, h.st)
+	}
+	l.sendMu.Unlock()
+}
+
+// forgetRates drops the rate limit windows for name and everything below it,
+// without sending what was over the limit.
+func (h *heldEvents) forgetRates(name string) {
+	prefix := name + string(filepath.Separator)
+	h.heldMu.Lock()
+	defer h.heldMu.Unlock()
+	for key, r := range h.rates {
+		if key == name || strings.HasPrefix(key, prefix) {
+			delete(h.rates, key)
+			if r.timer.Stop() {
+				h.heldWg.Done()
+			}
+		}
+	}
+}
+
+// sendHeld sends a held Create once no Write was seen for it in time.
+func (l *pipeline) sendHeld(h *heldEvent) {
+	defer l.heldWg.Done()
+	l.heldMu.Lock()
+	if l.held[h.e.Name] != h {
+		l.heldMu.Unlock()
+		return
+	}
+	delete(l.held, h.e.Name)
+	// Take sendMu before releasing heldMu, so that an event for the same path
+	// that's sent right after this can't be sent before it.
+	l.sendMu.Lock()
+	l.heldMu.Unlock()
+	l.deliverLocked(h.ch, h.e, h.abort, h.st)
+	l.sendMu.Unlock()
+}
+
+// closeHeld sends all held creates and the events over the rate limit right
+// away, and waits until they're sent. Must be called before the Events channel
+// is closed.
+func (l *pipeline) closeHeld() {
+	if l == nil {
+		return
+	}
+	l.heldMu.Lock()
+	l.heldClosed = true
+	send := make([]*heldEvent, 0, len(l.held))
+	for name, h := range l.held {
+		delete(l.held, name)
+		if h.timer.Stop() {
+			l.heldWg.Done()
+		}
+		send = append(send, h)
+	}
+	for key, r := range l.rates {
+		delete(l.rates, key)
+		if r.timer.Stop() {
+			l.heldWg.Done()
+		}
+		if r.over != nil {
+			send = append(send, r.over)
+		}
+	}
+	l.heldMu.Unlock()
+
+	sort.Slice(send, func(i, j int) bool { return send[i].e.Time.Before(send[j].e.Time) })
+	for _, h := range send {
+		l.deliver(h.ch, h.e, h.abort, h.st)
+	}
+	// Timers that expired before this see that they were taken over.
+	l.heldWg.Wait()
+}
+
+// deliver sends an event that was already rewritten and filtered.
+func (l *pipeline) deliver(ch chan<- Event, e Event, abort <-chan struct{}, st *stats) bool {
+	l.sendMu.Lock()
+	defer l.sendMu.Unlock()
+	return l.deliverLocked(ch, e, abort, st)
+}
+
+// deliverLocked is deliver, for when sendMu is already held.
+func (l *pipeline) deliverLocked(ch chan<- Event, e Event, abort <-chan struct{}, st *stats) bool {
+	// select picks at random if there's room in ch as well.
+	select {
+	case <-abort:
+		return false
+	default:
+	}
+	select {
+	case ch <- e:
+		st.sentEvent()
+		if ch == l.events {
+			l.publish(e)
+		}
+		return true
+	case <-abort:
+		return false
+	}
+}
+
+// subscribeBuffer is the size of the channels from Watcher.Subscribe().
+const subscribeBuffer = 64
+
+// subscribe adds a channel that gets a copy of every event that's sent.
+func (s *subscribers) subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, subscribeBuffer)
+	s.subMu.Lock()
+	defer s.subMu.Unlock()
+	if s.subsClosed {
+		close(ch)
+		return ch, func() {}
+	}
+	if s.subs == nil {
+		s.subs = make(map[chan Event]struct{})
+	}
+	s.subs[ch] = struct{}{}
+	return ch, func() {
+		s.subMu.Lock()
+		defer s.subMu.Unlock()
+		if _, ok := s.subs[ch]; ok {
+			delete(s.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// publish sends e to all subscribers, dropping it for subscribers whose buffer
+// is full, and adds it to the SetEventLog() log.
+func (l *pipeline) publish(e Event) {
+	l.logEvent(e)
+	l.subMu.Lock()
+	defer l.subMu.Unlock()
+	for ch := range l.subs {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// setEventLog sets the number of events to keep for SetEventLog(), keeping
+// the most recent ones that were already logged.
+func (g *eventLog) setEventLog(n int) {
+	g.logMu.Lock()
+	defer g.logMu.Unlock()
+	if n == cap(g.log) {
+		return
+	}
+	keep := g.recentLocked()
+	if len(keep) > n {
+		keep = keep[len(keep)-n:]
+	}
+	g.log, g.logPos = make([]Event, len(keep), n), 0
+	copy(g.log, keep)
+}
+
+func (g *eventLog) logEvent(e Event) {
+	g.logMu.Lock()
+	defer g.logMu.Unlock()
+	switch {
+	case cap(g.log) == 0:
+	case len(g.log) < cap(g.log):
+		g.log = append(g.log, e)
+	default:
+		g.log[g.logPos] = e
+		g.logPos = (g.logPos + 1) % len(g.log)
+	}
+}
+
+// recentEvents gets a copy of the SetEventLog() log, oldest first; nil if
+// it's not used.
+func (g *eventLog) recentEvents() []Event {
+	g.logMu.Lock()
+	defer g.logMu.Unlock()
+	return g.recentLocked()
+}
+
+// Unlocked!
+func (g *eventLog) recentLocked() []Event {
+	if cap(g.log) == 0 {
+		return nil
+	}
+	events := make([]Event, 0, len(g.log))
+	return append(append(events, g.log[g.logPos:]...), g.log[:g.logPos]...)
+}
+
+// closeSubs closes the channels of all subscribers, for when the Watcher is
+// closed.
+func (s *subscribers) closeSubs() {
+	s.subMu.Lock()
+	defer s.subMu.Unlock()
+	for ch := range s.subs {
+		close(ch)
+	}
+	s.subs, s.subsClosed = nil, true
+}
+
+func (l *pipeline) setFilter(fn func(Event) bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.filter = fn
+}
+
+// closest gets the watch for name, or the closest directory above it that's
+// watched.
+//
+// Unlocked!
+func (l *pipeline) closest(name string) (watchRewrite, string) {
+	for path := name; ; {
+		if r, ok := l.rewrites[path]; ok {
+			return r, path
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return watchRewrite{}, name
+		}
+		path = parent
+	}
+}
+
+// match reports if path matches any of the patterns, if it's hidden and below
+// a watch added with WithoutHidden(), or if it's in a directory added with
+// Watcher.AddGlob() and doesn't match the glob.
+func (l *pipeline) match(path string) bool {
+	if l == nil {
+		return false
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	fold := l.foldCase()
+	if l.active > 0 {
+		r, root := l.closest(path)
+		if r.withoutHidden {
+			rel := path
+			if root != "." {
+				rel = path[len(root):]
+			}
+			if isHidden(rel) {
+				return true
+			}
+		}
+		if r.glob != "" && path != root && filepath.Dir(path) == root {
+			p, name := r.glob, filepath.Base(path)
+			if fold {
+				p, name = strings.ToLower(p), strings.ToLower(name)
+			}
+			if ok, _ := filepath.Match(p, name); !ok {
+				return true
+			}
+		}
+	}
+	for _, p := range l.patterns {
+		name := path
+		if !strings.ContainsRune(p, filepath.Separator) {
+			name = filepath.Base(path)
+		}
+		if fold {
+			p, name = strings.ToLower(p), strings.ToLower(name)
+		}
+		if ok, _ := filepath.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// foldCase reports if paths are matched case-insensitively, with
+// Watcher.SetCaseInsensitive().
+func (l *pipeline) foldCase() bool { return l != nil && atomic.LoadInt32(&l.fold) == 1 }
+
+func (l *pipeline) setFold(fold bool) { atomic.StoreInt32(&l.fold, boolInt(fold)) }
+
+// boolInt converts b to an int32 for sync/atomic.
+func boolInt(b bool) int32 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// isHidden reports if any of the elements of path start with a dot.
+func isHidden(path string) bool {
+	for _, p := range strings.Split(path, string(filepath.Separator)) {
+		if p != "." && p != ".." && strings.HasPrefix(p, ".") {
+			return true
+		}
+	}
+	return false
+}
+
+// matchBelow reports if path, or any of the directories between root and
+// path, match any of the patterns.
+func (l *pipeline) matchBelow(root, path string) bool {
+	for len(path) > len(root) && strings.HasPrefix(path, root) {
+		if l.match(path) {
+			return true
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			break
+		}
+		path = parent
+	}
+	return false
+}
@@ -0,0 +1,749 @@
+package fsnotify
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// orphan is a path that was added with Add() which is gone because a directory
+// it's in was removed or renamed.
+type orphan struct {
+	name  string
+	isDir bool
+	with  withOpts
+}
+
+// sendOrphans sends a Remove for paths that are gone because a directory they
+// were in was removed or renamed, which the OS doesn't always report, and
+// starts waiting for them with WithAutoRewatch(). Paths are sent deepest first;
+// directories that were only watched for the rewatcher are skipped. Returns
+// false if the watcher was closed.
+func sendOrphans(orphans []orphan, now time.Time, auto *rewatcher, st *stats, send func(Event) bool, sendErr func(error) bool) bool {
+	sort.Slice(orphans, func(i, j int) bool { return orphans[i].name > orphans[j].name })
+	for _, o := range orphans {
+		if o.with.internal {
+			continue
+		}
+		if o.with.ops.Has(Remove) && !send(Event{Name: o.name, Op: Remove, Time: now, isDir: o.isDir}) {
+			return false
+		}
+		if o.with.autoRewatch && !o.isDir {
+			auto.start(o.name, o.with, st, send, sendErr)
+		}
+	}
+	return true
+}
+
+// rewatcher waits for files added with WithAutoRewatch() to be recreated after
+// they were removed or renamed, and adds the watch for them again. It also
+// waits for paths added with WithCreateWatch() that don't exist yet.
+//
+// The directory that's waited in is watched with the backend itself; all waits
+// in the same directory share one watch (see hold()). Backends set b, and call:
+//
+//   - route() for every event, before anything can drop it; backends that know
+//     which watch an event is from call notify() instead, and drop the events
+//     from watches added with withOpts.internal themselves;
+//   - claim() when the user adds a path, and owns() and rehold() when the user
+//     removes one;
+//   - hide() and owns() to leave the directories out of WatchList() and
+//     IsWatched().
+type rewatcher struct {
+	b        backend                  // Backend to watch the parent directories with.
+	addMu    sync.Mutex               // Held while adding a watch, so that stop() waits for it.
+	parentMu sync.Mutex               // Held while adding or removing the watch for a parent directory.
+	mu       sync.Mutex               // Protects pending, parents, closed.
+	pending  map[string]chan struct{} // Files that are waited on (key: path); closed to stop waiting.
+	parents  map[string]*parentWatch  // Directories that are waited in (key: path).
+	closed   bool                     // Set by close(); no new waits are started after this.
+	wg       sync.WaitGroup
+}
+
+// parentWatch is a directory that's watched for the waits in it.
+type parentWatch struct {
+	refs  int                        // Number of waits in the directory.
+	owned bool                       // Only watched for the waits: its events aren't sent, and the watch is removed once refs is 0.
+	wake  map[chan struct{}]struct{} // Woken on every event in the directory.
+}
+
+// errAlreadyWatched is returned by AddWith() for a directory the rewatcher
+// waits in that's already watched; the rewatcher uses the existing watch.
+var errAlreadyWatched = errors.New("fsnotify: already watched")
+
+// parentOps are the operations a directory that's waited in is watched for.
+const parentOps = Create | Remove | Rename
+
+// start waiting for name to be recreated. Once it is, it's added with the
+// options in with to watch it again, it's counted in s, and a Create is sent
+// with send.
+//
+// stop() must not be called while holding any lock that AddWith() also takes.
+func (r *rewatcher) start(name string, with withOpts, s *stats, send func(Event) bool, sendErr func(error) bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return
+	}
+	if r.pending == nil {
+		r.pending = make(map[string]chan struct{})
+	}
+	if stop, ok := r.pending[name]; ok {
+		close(stop)
+	}
+	stop := make(chan struct{})
+	r.pending[name] = stop
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		defer r.forget(name, stop)
+		added, err := r.wait(name, stop, func() error {
+			return r.b.AddWith(name, func(opt *withOpts) { *opt = with })
+		})
+		switch {
+		case err != nil:
+			sendErr(&WatchError{Path: name, Op: "add", Err: err})
+		case added:
+			s.rewatch()
+			if with.ops.Has(Create) {
+				send(Event{Name: name, Op: Create, Time: time.Now()})
+			}
+		}
+	}()
+}
+
+// wait for name to be recreated, and call add once it is. The parent directory
+// is watched until then. Reports if it was added; it's not if the wait was
+// stopped, or if the parent directory was removed.
+func (r *rewatcher) wait(name string, stop chan struct{}, add func() error) (bool, error) {
+	dir, wake := filepath.Dir(name), make(chan struct{}, 1)
+	if err := r.hold(dir, wake); err != nil {
+		if errors.Is(err, fs.ErrNotExist) || errors.Is(err, ErrClosed) {
+			return false, nil
+		}
+		return false, err
+	}
+	defer r.unhold(dir, wake)
+
+	for {
+		if _, err := os.Lstat(dir); err != nil {
+			return false, nil
+		}
+		if _, err := os.Lstat(name); err == nil {
+			added, err := r.add(name, stop, add)
+			if !errors.Is(err, fs.ErrNotExist) {
+				return added, err
+			}
+			// Removed again since the Lstat(); there will be another event.
+		}
+
+		select {
+		case <-stop:
+			return false, nil
+		case <-wake:
+		}
+	}
+}
+
+// Wait this long before looking again if a directory that was just found was
+// removed before it could be watched, doubling it every time up to
+// rewatchMaxDelay.
+var (
+	rewatchDelay    = 10 * time.Millisecond
+	rewatchMaxDelay = time.Second
+)
+
+// create waits for name to be created, for WithCreateWatch(). Reports false if
+// name already exists, in which case it should be added as usual.
+//
+// The nearest directory that exists is watched, and the watch is moved down as
+// the directories in between are created. Once name exists it's added with the
+// options in with, and a Create is sent with send.
+func (r *rewatcher) create(name string, with withOpts, send func(Event) bool, sendErr func(error) bool) (bool, error) {
+	path, _ := recursivePath(name)
+	dir, err := nearestDir(path)
+	if err != nil || dir == path {
+		return false, err
+	}
+
+	// Watch the directory before returning, so that nothing created right after
+	// AddWith returns is missed.
+	wake := make(chan struct{}, 1)
+	if err := r.hold(dir, wake); err != nil {
+		return true, err
+	}
+
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		r.unhold(dir, wake)
+		return true, ErrClosed
+	}
+	if r.pending == nil {
+		r.pending = make(map[string]chan struct{})
+	}
+	if stop, ok := r.pending[path]; ok {
+		close(stop)
+	}
+	stop := make(chan struct{})
+	r.pending[path] = stop
+	r.wg.Add(1)
+	r.mu.Unlock()
+
+	with.createWatch = false
+	go func() {
+		watched := dir
+		defer r.wg.Done()
+		defer r.forget(path, stop)
+		defer func() { r.unhold(watched, wake) }()
+
+		// A directory was removed again right after it was found; wait a bit
+		// rather than trying again right away, as it may be a broken symlink.
+		delay := rewatchDelay
+		retry := func() bool {
+			t := time.NewTimer(delay)
+			defer t.Stop()
+			if delay *= 2; delay > rewatchMaxDelay {
+				delay = rewatchMaxDelay
+			}
+			select {
+			case <-stop:
+				return false
+			case <-t.C:
+				return true
+			}
+		}
+
+		for {
+			dir, err := nearestDir(path)
+			switch {
+			case err != nil:
+				sendErr(&WatchError{Path: path, Op: "add", Err: err})
+				return
+			case dir == path:
+				added, err := r.add(path, stop, func() error {
+					return r.b.AddWith(name, func(opt *withOpts) { *opt = with })
+				})
+				switch {
+				case errors.Is(err, fs.ErrNotExist):
+					// Removed again since nearestDir(); there will be another
+					// event.
+				case err != nil:
+					sendErr(&WatchError{Path: path, Op: "add", Err: err})
+					return
+				default:
+					if added && with.ops.Has(Create) {
+						send(Event{Name: path, Op: Create, Time: time.Now()})
+					}
+					return
+				}
+			case dir != watched:
+				r.unhold(watched, wake)
+				watched = ""
+				if err := r.hold(dir, wake); err != nil {
+					if errors.Is(err, fs.ErrNotExist) && retry() {
+						continue
+					}
+					if !errors.Is(err, fs.ErrNotExist) && !errors.Is(err, ErrClosed) {
+						sendErr(&WatchError{Path: dir, Op: "add", Err: err})
+					}
+					return
+				}
+				watched, delay = dir, rewatchDelay
+				continue // It may have been created before it was watched.
+			}
+
+			// Look again after anything happened in the directory.
+			select {
+			case <-stop:
+				return
+			case <-wake:
+			}
+		}
+	}()
+	return true, nil
+}
+
+// nearestDir gets path if it exists, or the nearest parent directory of it that
+// exists.
+func nearestDir(path string) (string, error) {
+	for p := path; ; {
+		_, err := os.Lstat(p)
+		if err == nil {
+			return p, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return "", err
+		}
+		parent := filepath.Dir(p)
+		if parent == p {
+			return "", err
+		}
+		p = parent
+	}
+}
+
+// hold watches dir for a wait in it, and wakes wake after every event in the
+// directory until unhold() is called.
+//
+// The directory is added with the backend's AddWith() as an internal watch,
+// which isn't reported by WatchList() and its events aren't sent. All waits in
+// the same directory share this watch. If the user already watches the
+// directory (or a recursive watch includes it) that watch is used instead.
+func (r *rewatcher) hold(dir string, wake chan struct{}) error {
+	r.parentMu.Lock()
+	defer r.parentMu.Unlock()
+
+	r.mu.Lock()
+	if p, ok := r.parents[dir]; ok {
+		p.refs++
+		p.wake[wake] = struct{}{}
+		r.mu.Unlock()
+		return nil
+	}
+	if r.parents == nil {
+		r.parents = make(map[string]*parentWatch)
+	}
+	p := &parentWatch{refs: 1, wake: map[chan struct{}]struct{}{wake: {}}}
+	r.parents[dir] = p
+	r.mu.Unlock()
+
+	if err := r.watchParent(dir, p); err != nil {
+		r.mu.Lock()
+		delete(r.parents, dir)
+		r.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// unhold stops waking wake for events in dir, and removes the watch if it was
+// the last wait in it.
+func (r *rewatcher) unhold(dir string, wake chan struct{}) {
+	if dir == "" {
+		return
+	}
+	r.parentMu.Lock()
+	defer r.parentMu.Unlock()
+
+	r.mu.Lock()
+	p, ok := r.parents[dir]
+	if !ok {
+		r.mu.Unlock()
+		return
+	}
+	delete(p.wake, wake)
+	if p.refs--; p.refs > 0 || !p.owned {
+		if p.refs == 0 {
+			delete(r.parents, dir)
+		}
+		r.mu.Unlock()
+		return
+	}
+	r.mu.Unlock()
+
+	// The events are still dropped until it's removed. Fails if the directory
+	// was already removed, which is fine.
+	_ = r.b.Remove(dir)
+	r.mu.Lock()
+	if r.parents[dir] == p {
+		delete(r.parents, dir)
+	}
+	r.mu.Unlock()
+}
+
+// watchParent adds the internal watch for a directory that's waited in, unless
+// the user already watches it.
+//
+// parentMu must be held.
+func (r *rewatcher) watchParent(dir string, p *parentWatch) error {
+	recursive := r.inRecursive(dir)
+	if !recursive && !r.b.IsWatched(dir) {
+		// Set before adding it, so that no events from the new watch are sent.
+		r.mu.Lock()
+		p.owned = true
+		r.mu.Unlock()
+	}
+
+	err := errAlreadyWatched
+	if !recursive {
+		with := parentOpts()
+		err = r.b.AddWith(dir, func(opt *withOpts) { *opt = with })
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch {
+	case err == nil:
+		p.owned = true
+	case errors.Is(err, errAlreadyWatched):
+		p.owned = false
+	default:
+		p.owned = false
+		return err
+	}
+	return nil
+}
+
+// parentOpts gets the options for the internal watch of a directory that's
+// waited in.
+func parentOpts() withOpts {
+	with := defaultOpts
+	with.ops, with.internal = parentOps, true
+	return with
+}
+
+// inRecursive reports if one of the parent directories of dir has a recursive
+// watch, which already sends the events for dir.
+func (r *rewatcher) inRecursive(dir string) bool {
+	if !r.b.SupportsRecursion() {
+		return false
+	}
+	for p := filepath.Dir(dir); ; p = filepath.Dir(p) {
+		if r.b.IsWatched(filepath.Join(p, "...")) {
+			return true
+		}
+		if filepath.Dir(p) == p {
+			return false
+		}
+	}
+}
+
+// route wakes the waits for the directory of name, or for name itself, and
+// reports if the event should be dropped because it's only for a watch that
+// was added by hold().
+//
+// isWatched is the backend's IsWatched(); it's called without any of the
+// rewatcher's locks held.
+func (r *rewatcher) route(name string, isWatched func(string) bool) bool {
+	r.mu.Lock()
+	dir, self := r.parents[filepath.Dir(name)], r.parents[name]
+	if dir == nil && self == nil {
+		r.mu.Unlock()
+		return false
+	}
+	for _, p := range []*parentWatch{dir, self} {
+		if p == nil {
+			continue
+		}
+		for wake := range p.wake {
+			select {
+			case wake <- struct{}{}:
+			default:
+			}
+		}
+	}
+	hide := (dir != nil && dir.owned) || (self != nil && self.owned)
+	r.mu.Unlock()
+
+	// Still send it if the user watches the path, or the directory it's in.
+	return hide && !isWatched(name) && !isWatched(filepath.Dir(name)) && !r.inRecursive(name)
+}
+
+// notify wakes the waits for the directory of name, or for name itself. For
+// backends that drop events for operations that weren't asked for before
+// route() is called.
+func (r *rewatcher) notify(name string) {
+	r.route(name, func(string) bool { return true })
+}
+
+// holds reports if dir is waited in; backends that filter in the kernel also
+// watch it for parentOps if it's a watch the user added.
+func (r *rewatcher) holds(dir string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	p, ok := r.parents[dir]
+	return ok && p.refs > 0
+}
+
+// owns reports if name is only watched for the waits in it. Backends don't
+// report it in IsWatched(), and return ErrNonExistentWatch from Remove().
+func (r *rewatcher) owns(name string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	p, ok := r.parents[name]
+	return ok && p.owned && p.refs > 0
+}
+
+// own takes over the watch for dir once the user no longer watches it, if it's
+// still waited in. Reports false if it's not, in which case the backend should
+// remove the watch.
+func (r *rewatcher) own(dir string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	p, ok := r.parents[dir]
+	if ok && p.refs > 0 {
+		p.owned = true
+	}
+	return ok && p.refs > 0
+}
+
+// claim is called when the user adds name: if it's a directory that's waited
+// in the events are sent from now on, and the watch isn't removed once the
+// waits are done.
+func (r *rewatcher) claim(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if p, ok := r.parents[name]; ok {
+		p.owned = false
+	}
+}
+
+// rehold adds the watch for directories that are waited in again after the
+// user removed name (and everything below it, if recurse is set), as the watch
+// may be gone. The waits are woken, as something may have been created in the
+// meantime.
+func (r *rewatcher) rehold(name string, recurse bool) {
+	r.mu.Lock()
+	var dirs []string
+	for dir, p := range r.parents {
+		if p.refs > 0 && (dir == name || (recurse && strings.HasPrefix(dir, name+string(filepath.Separator)))) {
+			dirs = append(dirs, dir)
+		}
+	}
+	r.mu.Unlock()
+	for _, dir := range dirs {
+		r.readd(dir)
+	}
+}
+
+// reset adds the watches for all directories that are waited in again, after
+// the backend forgot all watches.
+func (r *rewatcher) reset() {
+	r.mu.Lock()
+	var dirs []string
+	for dir, p := range r.parents {
+		if p.refs > 0 {
+			dirs = append(dirs, dir)
+		}
+	}
+	r.mu.Unlock()
+	for _, dir := range dirs {
+		r.readd(dir)
+	}
+}
+
+// readd adds the watch for dir again, for rehold() and reset().
+func (r *rewatcher) readd(dir string) {
+	r.parentMu.Lock()
+	defer r.parentMu.Unlock()
+	r.mu.Lock()
+	p, ok := r.parents[dir]
+	r.mu.Unlock()
+	if !ok || p.refs == 0 {
+		return
+	}
+
+	// If it failed the waits see that the directory is gone.
+	_ = r.watchParent(dir, p)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for wake := range p.wake {
+		select {
+		case wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// hide removes the directories that are only watched for the waits in them
+// from entries, for WatchList().
+func (r *rewatcher) hide(entries []string) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.parents) == 0 {
+		return entries
+	}
+	keep := entries[:0]
+	for _, e := range entries {
+		if p, ok := r.parents[e]; !ok || !p.owned || p.refs == 0 {
+			keep = append(keep, e)
+		}
+	}
+	return keep
+}
+
+// add calls add, unless the wait for name was stopped since. Reports if it
+// was added.
+func (r *rewatcher) add(name string, stop chan struct{}, add func() error) (bool, error) {
+	r.addMu.Lock()
+	defer r.addMu.Unlock()
+	r.mu.Lock()
+	stopped := r.pending[name] != stop
+	r.mu.Unlock()
+	if stopped {
+		return false, nil
+	}
+	err := add()
+	if errors.Is(err, ErrClosed) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// forget stops waiting for name, if stop is still the current wait for it.
+func (r *rewatcher) forget(name string, stop chan struct{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.pending[name] == stop {
+		delete(r.pending, name)
+	}
+}
+
+// stop waiting for name, for Watcher.Remove(). Reports if it was waited on.
+func (r *rewatcher) stop(name string) bool {
+	r.addMu.Lock()
+	defer r.addMu.Unlock()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stop, ok := r.pending[name]
+	if ok {
+		close(stop)
+		delete(r.pending, name)
+	}
+	return ok
+}
+
+// close stops all waits, and waits for them to return. Must be called before
+// the Events and Errors channels are closed.
+func (r *rewatcher) close() {
+	r.mu.Lock()
+	r.closed = true
+	for _, stop := range r.pending {
+		close(stop)
+	}
+	r.pending = nil
+	r.mu.Unlock()
+	r.wg.Wait()
+}
+
+// initialScan sends a Create for everything that already exists in directories
+// that are added with WithInitialScan().
+//
+// Backends call wait() before sending an event, which waits until all scans
+// that were started are sent. begin() is called before adding the watch so
+// there's no gap for events to be sent before the scan.
+type initialScan struct {
+	mu      sync.Mutex // Protects cond, pending, closed.
+	cond    *sync.Cond
+	pending int        // Number of scans that are started but not yet sent.
+	closed  bool       // Set by close(); no new scans are started after this.
+	sendMu  sync.Mutex // Only send one scan at a time.
+	wg      sync.WaitGroup
+}
+
+func (s *initialScan) init() {
+	if s.cond == nil {
+		s.cond = sync.NewCond(&s.mu)
+	}
+}
+
+// begin holds the events until end() is called; run() can be called in between
+// to start a scan.
+func (s *initialScan) begin() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending++
+}
+
+func (s *initialScan) end() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.init()
+	s.pending--
+	s.cond.Broadcast()
+}
+
+// wait until all scans are sent.
+func (s *initialScan) wait() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.init()
+	for s.pending > 0 {
+		s.cond.Wait()
+	}
+}
+
+// run reads root (and everything below it if recurse is set), and sends a
+// Create for everything in it on ev in the background, until abort is closed.
+// Nothing is sent if WithInitialScan() wasn't used, or if root is not a
+// directory.
+func (s *initialScan) run(root string, recurse bool, with withOpts, pipe *pipeline, ev chan<- Event, abort <-chan struct{}, st *stats) {
+	if !with.initialScan || !with.ops.Has(Create) {
+		return
+	}
+
+	now := time.Now()
+	var events []Event
+	if !recurse {
+		ls, _ := os.ReadDir(root)
+		for _, d := range ls {
+			path := filepath.Join(root, d.Name())
+			if !pipe.match(path) {
+				events = append(events, Event{Name: path, Op: Create, Time: now, Seq: pipe.nextSeq(), isDir: d.IsDir(), initial: true})
+			}
+		}
+	} else {
+		filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || path == root {
+				return nil
+			}
+			if pipe.matchBelow(root, path) {
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			events = append(events, Event{Name: path, Op: Create, Time: now, Seq: pipe.nextSeq(), isDir: d.IsDir(), initial: true})
+			if d.IsDir() && with.maxDepth >= 0 && depth(root, path) > with.maxDepth {
+				return filepath.SkipDir
+			}
+			return nil
+		})
+	}
+	s.send(events, pipe, ev, abort, st)
+}
+
+// send sends the events on ev in the background, until abort is closed.
+func (s *initialScan) send(events []Event, pipe *pipeline, ev chan<- Event, abort <-chan struct{}, st *stats) {
+	if len(events) == 0 {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	s.pending++
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer s.end()
+		s.sendMu.Lock()
+		defer s.sendMu.Unlock()
+		for _, e := range events {
+			if pipe.dropExt(e) || pipe.dropPaused() {
+				continue
+			}
+			if !pipe.send(ev, e, abort, st) {
+				return
+			}
+		}
+	}()
+}
+
+// close waits for all scans to be sent. Must be called before the Events
+// channel is closed.
+func (s *initialScan) close() {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+	s.wg.Wait()
+}
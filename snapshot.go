@@ -0,0 +1,255 @@
+package fsnotify
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// snapshot is the last known state of everything in a watch, which is kept up
+// to date by applying the events to it: for DirWatcher, and for watches added
+// with WithSnapshot() (for Watcher.Rescan()).
+type snapshot struct {
+	root    string
+	recurse bool
+	with    withOpts // Options of the watch, for WithSnapshot().
+	dir     bool     // root is a directory; it's not in files itself if it is.
+
+	mu    sync.RWMutex
+	files map[string]fs.FileInfo // Everything in the watch (key: path, as in Event.Name before rewriting).
+}
+
+// contains reports if name is part of the snapshot.
+func (s *snapshot) contains(name string) bool {
+	if !s.dir {
+		return name == s.root
+	}
+	if s.recurse {
+		return strings.HasPrefix(name, s.root+string(filepath.Separator))
+	}
+	return name != s.root && filepath.Dir(name) == s.root
+}
+
+// apply an event to the snapshot. The path is read again rather than relying
+// on the Op, as the event may be outdated by the time it's applied. Returns
+// what was read, or nil if the path is gone or wasn't read.
+func (s *snapshot) apply(e Event) fs.FileInfo {
+	if !s.contains(e.Name) {
+		return nil
+	}
+	var (
+		fi     fs.FileInfo
+		update = e.Has(Create) || e.Has(Write) || e.Has(Chmod)
+	)
+	if update {
+		// Not while holding the lock, as this is done for every event.
+		fi, _ = os.Lstat(e.Name)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e.Has(Remove) || e.Has(Rename) || (update && fi == nil) {
+		s.remove(e.Name)
+	}
+	if fi != nil {
+		s.files[e.Name] = fi
+	}
+	return fi
+}
+
+// add files to the snapshot, for directories that were created with something
+// already in them.
+func (s *snapshot) add(files map[string]fs.FileInfo) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for path, fi := range files {
+		s.files[path] = fi
+	}
+}
+
+// replace everything in the snapshot with files, and get the events to go from
+// the old state to the new one (see diffFiles()).
+func (s *snapshot) replace(files map[string]fs.FileInfo, now time.Time) []Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	events := diffFiles(s.files, files, now)
+	s.files = files
+	return events
+}
+
+// copy gets a copy of everything in the snapshot.
+func (s *snapshot) copy() map[string]fs.FileInfo {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	files := make(map[string]fs.FileInfo, len(s.files))
+	for path, fi := range s.files {
+		files[path] = fi
+	}
+	return files
+}
+
+// remove name and everything below it.
+//
+// mu must be held.
+func (s *snapshot) remove(name string) {
+	prefix := name + string(filepath.Separator)
+	delete(s.files, name)
+	for path := range s.files {
+		if strings.HasPrefix(path, prefix) {
+			delete(s.files, path)
+		}
+	}
+}
+
+// scanSnapshot reads everything in the watch on root, in the same way as
+// WithInitialScan(). A root that doesn't exist has nothing in it.
+func scanSnapshot(root string, recurse bool, with withOpts, pipe *pipeline) *snapshot {
+	s := &snapshot{root: root, recurse: recurse, with: with, files: make(map[string]fs.FileInfo)}
+	stat := os.Stat
+	if with.noFollow {
+		stat = os.Lstat
+	}
+	fi, err := stat(root)
+	if err != nil {
+		return s
+	}
+	if s.dir = fi.IsDir(); !s.dir {
+		s.files[root] = fi
+		return s
+	}
+
+	if !recurse {
+		ls, _ := os.ReadDir(root)
+		for _, d := range ls {
+			path := filepath.Join(root, d.Name())
+			if fi, err := d.Info(); err == nil && !pipe.match(path) {
+				s.files[path] = fi
+			}
+		}
+		return s
+	}
+	filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || path == root {
+			return nil
+		}
+		if pipe.matchBelow(root, path) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if fi, err := d.Info(); err == nil {
+			s.files[path] = fi
+		}
+		if d.IsDir() && with.maxDepth >= 0 && depth(root, path) > with.maxDepth {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return s
+}
+
+// diffFiles gets the events to go from the files in prev to the files in cur:
+// a Create for new paths, a Remove for paths that are gone, a Write for files
+// that have a different size or modification time, and a Chmod for paths that
+// have different permissions. A path that's replaced with something of another
+// type (e.g. a file with a directory) gets a Remove and a Create.
+//
+// The Removes are sent first, with the paths inside a directory before the
+// directory itself, and then everything else with directories before the paths
+// in them.
+func diffFiles(prev, cur map[string]fs.FileInfo, now time.Time) []Event {
+	var removed, changed []Event
+	for path, old := range prev {
+		fi, ok := cur[path]
+		if !ok || fi.Mode().Type() != old.Mode().Type() {
+			removed = append(removed, Event{Name: path, Op: Remove, Time: now, isDir: old.IsDir(), rescanned: true})
+		}
+	}
+	for path, fi := range cur {
+		old, ok := prev[path]
+		var op Op
+		switch {
+		case !ok || fi.Mode().Type() != old.Mode().Type():
+			op = Create
+		default:
+			if fi.Mode().IsRegular() && (fi.Size() != old.Size() || !fi.ModTime().Equal(old.ModTime())) {
+				op |= Write
+			}
+			if fi.Mode().Perm() != old.Mode().Perm() {
+				op |= Chmod
+			}
+		}
+		if op != 0 {
+			changed = append(changed, Event{Name: path, Op: op, Time: now, isDir: fi.IsDir(), rescanned: true})
+		}
+	}
+	sort.Slice(removed, func(i, j int) bool { return removed[i].Name > removed[j].Name })
+	sort.Slice(changed, func(i, j int) bool { return changed[i].Name < changed[j].Name })
+	return append(removed, changed...)
+}
+
+// takeSnapshot reads everything in the watch on name, for WithSnapshot().
+func (l *pipeline) takeSnapshot(name string, recurse bool, with withOpts) {
+	s := scanSnapshot(name, recurse, with, l)
+	l.snapMu.Lock()
+	defer l.snapMu.Unlock()
+	if l.snaps == nil {
+		l.snaps = make(map[string]*snapshot)
+	}
+	l.snaps[name] = s
+}
+
+// applySnapshot applies an event to the snapshot for the watch on path, if
+// there is one.
+func (l *pipeline) applySnapshot(path string, e Event) {
+	l.snapMu.Lock()
+	s, ok := l.snaps[path]
+	l.snapMu.Unlock()
+	if ok {
+		s.apply(e)
+	}
+}
+
+// forgetSnapshot forgets the snapshot for the watch on name.
+func (l *pipeline) forgetSnapshot(name string) {
+	l.snapMu.Lock()
+	defer l.snapMu.Unlock()
+	delete(l.snaps, name)
+}
+
+// rescan reads the watch on name again, and gets the events for everything
+// that's different from the snapshot. The snapshot is replaced with what was
+// read.
+func (l *pipeline) rescan(name string) ([]Event, error) {
+	l.snapMu.Lock()
+	prev, ok := l.snaps[name]
+	l.snapMu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("fsnotify.Rescan: not added with WithSnapshot: %s", name)
+	}
+
+	cur := scanSnapshot(prev.root, prev.recurse, prev.with, l)
+	l.snapMu.Lock()
+	// Removed while scanning.
+	if l.snaps[name] != prev {
+		l.snapMu.Unlock()
+		return nil, nil
+	}
+	l.snaps[name] = cur
+	l.snapMu.Unlock()
+
+	events := diffFiles(prev.copy(), cur.files, time.Now())
+	keep := events[:0]
+	for _, e := range events {
+		if e.Op &= prev.with.ops; e.Op != 0 {
+			keep = append(keep, e)
+		}
+	}
+	return keep, nil
+}
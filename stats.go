@@ -0,0 +1,39 @@
+package fsnotify
+
+import (
+	"errors"
+	"sync"
+)
+
+// stats keeps the counters for Watcher.Stats(); it's embedded in the backends.
+type stats struct {
+	mu sync.Mutex
+	s  WatcherStats
+}
+
+func (s *stats) sentEvent() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.s.EventsDelivered++
+}
+
+func (s *stats) sentError(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.s.ErrorsEmitted++
+	if errors.Is(err, ErrEventOverflow) {
+		s.s.Overflows++
+	}
+}
+
+func (s *stats) rewatch() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.s.Rewatches++
+}
+
+func (s *stats) Stats() WatcherStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.s
+}
@@ -6,3 +6,7 @@ package fsnotify
 import "golang.org/x/sys/unix"
 
 const openMode = unix.O_NONBLOCK | unix.O_RDONLY | unix.O_CLOEXEC
+
+// O_NOFOLLOW makes open() fail on symlinks; there is no O_SYMLINK to open the
+// link itself.
+const openModeNoFollow = openMode | unix.O_NOFOLLOW
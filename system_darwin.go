@@ -7,3 +7,5 @@ import "golang.org/x/sys/unix"
 
 // note: this constant is not defined on BSD
 const openMode = unix.O_EVTONLY | unix.O_CLOEXEC
+
+const openModeNoFollow = openMode | unix.O_SYMLINK
@@ -0,0 +1,98 @@
+package fsnotify
+
+import (
+	"sync"
+	"time"
+)
+
+// watchTTL is the timer to remove a watch for WithTTL().
+type watchTTL struct {
+	mu     sync.Mutex
+	d      time.Duration // 0 for only once.
+	once   bool          // Expire after the first event, for WithOneShot().
+	fired  bool          // The first event was sent, for once.
+	expire func()
+	t      *time.Timer // nil until started, and once stopped.
+}
+
+func (t *watchTTL) start(expire func()) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.expire = expire
+	if t.d > 0 {
+		t.t = time.AfterFunc(t.d, expire)
+	}
+}
+
+func (t *watchTTL) reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.t != nil && !t.fired {
+		t.t.Reset(t.d)
+	}
+}
+
+// fire reports if this is the first event for WithOneShot(), and expires the
+// watch right after it if it is.
+func (t *watchTTL) fire() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.fired {
+		return false
+	}
+	t.fired = true
+	if t.expire != nil {
+		if t.t != nil {
+			t.t.Stop()
+		}
+		// Not from the goroutine that sends the event, as that may be the
+		// backend's reader.
+		t.t = time.AfterFunc(0, t.expire)
+	}
+	return true
+}
+
+func (t *watchTTL) stop() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.t != nil {
+		t.t.Stop()
+		t.t = nil
+	}
+}
+
+// expire removes the watch for WithTTL(), unless it was already removed or
+// added again.
+func (w *Watcher) expire(path, name string, ttl *watchTTL) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.ttls[path] != ttl {
+		return
+	}
+	w.stopTTL(path)
+	w.forgetCanonical(path)
+	delete(w.refs, path)
+	delete(w.opts, path)
+	if err := w.b.Remove(name); err == nil {
+		w.pipe.forgetRewrite(path)
+	}
+}
+
+// stopTTL stops the WithTTL() timer for path, if there is one.
+//
+// Unlocked!
+func (w *Watcher) stopTTL(path string) {
+	if ttl, ok := w.ttls[path]; ok {
+		ttl.stop()
+		delete(w.ttls, path)
+	}
+}
+
+// stopTTLs stops all WithTTL() timers, once the watcher is closed.
+func (w *Watcher) stopTTLs() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for path := range w.ttls {
+		w.stopTTL(path)
+	}
+}